@@ -0,0 +1,138 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/config"
+	"github.com/Azure/azure-storage-fuse/v2/component/file_cache"
+
+	"github.com/spf13/cobra"
+)
+
+type cacheOptions struct {
+	ConfigFile string
+	TmpPath    string
+	Delete     bool
+}
+
+var cacheOpts cacheOptions
+
+// Section defining all the command that we have in cache feature
+var cacheCmd = &cobra.Command{
+	Use:               "cache",
+	Short:             "Manage the local file cache",
+	Long:              "Manage the local file cache",
+	SuggestFor:        []string{"cach", "cahce"},
+	Example:           "blobfuse2 cache verify --config-file=config.yaml",
+	Args:              cobra.ExactArgs(1),
+	FlagErrorHandling: cobra.ExitOnError,
+}
+
+var cacheVerifyCmd = &cobra.Command{
+	Use:               "verify",
+	Short:             "Verify cached files against the checksums recorded when they were downloaded",
+	Long:              "Verify cached files against the checksums recorded when they were downloaded, with file_cache verify-checksum enabled. Corrupt files are listed, and deleted with --delete so they are downloaded again.",
+	SuggestFor:        []string{"ver", "verfy"},
+	Example:           "blobfuse2 cache verify --config-file=config.yaml --delete",
+	FlagErrorHandling: cobra.ExitOnError,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		path, err := cachePath()
+		if err != nil {
+			return fmt.Errorf("failed to find cache path [%s]", err.Error())
+		}
+
+		result, err := file_cache.VerifyCache(path, cacheOpts.Delete)
+		if err != nil {
+			return fmt.Errorf("failed to verify cache %s [%s]", path, err.Error())
+		}
+
+		for _, file := range result.Corrupt {
+			fmt.Println("corrupt :", file)
+		}
+		for _, file := range result.Failed {
+			fmt.Println("unreadable :", file)
+		}
+		fmt.Printf("%d verified, %d without checksum, %d corrupt, %d unreadable\n",
+			result.Verified, result.Unverified, len(result.Corrupt), len(result.Failed))
+
+		if len(result.Corrupt) > 0 && !cacheOpts.Delete {
+			return fmt.Errorf("%d corrupt files in cache, run with --delete to remove them", len(result.Corrupt))
+		}
+		return nil
+	},
+}
+
+//--------------- command section ends
+
+// cachePath : Cache directory given on the command line, else the file_cache path in the config file
+func cachePath() (string, error) {
+	if cacheOpts.TmpPath != "" {
+		return common.ExpandPath(cacheOpts.TmpPath), nil
+	}
+	if cacheOpts.ConfigFile == "" {
+		return "", errors.New("neither tmp-path nor config file provided, check usage")
+	}
+
+	options.ConfigFile = cacheOpts.ConfigFile
+	err := parseConfig()
+	if err != nil {
+		return "", err
+	}
+
+	conf := file_cache.FileCacheOptions{}
+	err = config.UnmarshalKey("file_cache", &conf)
+	if err != nil {
+		return "", fmt.Errorf("invalid file_cache config [%s]", err.Error())
+	}
+	if conf.TmpPath == "" {
+		return "", errors.New("file_cache path not set in config file")
+	}
+	return common.ExpandPath(conf.TmpPath), nil
+}
+
+func init() {
+	rootCmd.AddCommand(cacheCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+
+	cacheVerifyCmd.Flags().StringVar(&cacheOpts.ConfigFile, "config-file", "",
+		"Configuration file of the mount whose cache is verified.")
+	cacheVerifyCmd.Flags().StringVar(&cacheOpts.TmpPath, "tmp-path", "",
+		"Cache directory to verify, instead of the one in the config file.")
+	cacheVerifyCmd.Flags().BoolVar(&cacheOpts.Delete, "delete", false,
+		"Delete corrupt files so they are downloaded again.")
+}
@@ -0,0 +1,104 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type cacheCmdTestSuite struct {
+	suite.Suite
+	assert *assert.Assertions
+}
+
+func (suite *cacheCmdTestSuite) SetupTest() {
+	suite.assert = assert.New(suite.T())
+	err := log.SetDefaultLogger("silent", common.LogConfig{Level: common.ELogLevel.LOG_DEBUG()})
+	if err != nil {
+		panic("Unable to set silent logger as default.")
+	}
+}
+
+func (suite *cacheCmdTestSuite) cleanupTest() {
+	cacheOpts = cacheOptions{}
+	cacheVerifyCmd.Flags().VisitAll(func(f *pflag.Flag) {
+		f.Changed = false
+	})
+}
+
+func TestCacheCommand(t *testing.T) {
+	suite.Run(t, new(cacheCmdTestSuite))
+}
+
+func (suite *cacheCmdTestSuite) TestVerifyNoPath() {
+	defer suite.cleanupTest()
+	_, err := executeCommandSecure(rootCmd, "cache", "verify")
+	suite.assert.NotNil(err)
+}
+
+func (suite *cacheCmdTestSuite) TestVerifyTmpPath() {
+	defer suite.cleanupTest()
+	dir, _ := ioutil.TempDir("", "cache_verify")
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "file"), []byte("cached"), 0777)
+
+	_, err := executeCommandSecure(rootCmd, "cache", "verify", fmt.Sprintf("--tmp-path=%s", dir))
+	suite.assert.Nil(err)
+}
+
+func (suite *cacheCmdTestSuite) TestVerifyConfigFile() {
+	defer suite.cleanupTest()
+	dir, _ := ioutil.TempDir("", "cache_verify")
+	defer os.RemoveAll(dir)
+	confFile := filepath.Join(dir, "config.yaml")
+	ioutil.WriteFile(confFile, []byte(fmt.Sprintf("file_cache:\n  path: %s\n", dir)), 0777)
+
+	_, err := executeCommandSecure(rootCmd, "cache", "verify", fmt.Sprintf("--config-file=%s", confFile))
+	suite.assert.Nil(err)
+
+	ioutil.WriteFile(confFile, []byte("file_cache:\n  timeout-sec: 10\n"), 0777)
+	_, err = executeCommandSecure(rootCmd, "cache", "verify", fmt.Sprintf("--config-file=%s", confFile))
+	suite.assert.NotNil(err)
+}
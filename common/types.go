@@ -176,6 +176,7 @@ func (block *Block) Truncated() bool {
 const (
 	BolFlagUnknown uint16 = iota
 	SmallFile
+	MatchEtag
 )
 
 // list that holds blocks containing ids and corresponding offsets
@@ -185,6 +186,7 @@ type BlockOffsetList struct {
 	BlockIdLength int64
 	Size          int64
 	Mtime         time.Time
+	Etag          string // Version of the blob the list was read from, or last committed
 }
 
 // Dirty : Handle is dirty or not
@@ -192,6 +194,12 @@ func (bol *BlockOffsetList) SmallFile() bool {
 	return bol.Flags.IsSet(SmallFile)
 }
 
+// MatchEtag : Commit only if the blob is still the version the list was read from, as blocks not staged again are
+// taken from that version
+func (bol *BlockOffsetList) MatchEtag() bool {
+	return bol.Flags.IsSet(MatchEtag)
+}
+
 // return true if item found and index of the item
 func (bol BlockOffsetList) BinarySearch(offset int64) (bool, int) {
 	lowerBound := 0
@@ -40,6 +40,7 @@ import (
 	"crypto/rand"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
 	"os/user"
@@ -47,6 +48,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 
 	"gopkg.in/ini.v1"
 )
@@ -265,3 +267,42 @@ func ExpandPath(path string) string {
 
 	return path
 }
+
+// DiskBytes : Space taken by the file on disk, which is less than its size for a sparse file
+func DiskBytes(info os.FileInfo) int64 {
+	if info == nil {
+		return 0
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return stat.Blocks * 512
+	}
+	return info.Size()
+}
+
+// DirUsage : Space on disk taken by each regular file under root and in total. Entries for which skip returns true
+// are left out, along with everything under them if they are directories.
+func DirUsage(root string, skip func(path string, d fs.DirEntry) bool) (map[string]int64, int64) {
+	files := make(map[string]int64)
+	total := int64(0)
+	_ = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if path != root && skip != nil && skip(path, d) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err == nil {
+			files[path] = DiskBytes(info)
+			total += files[path]
+		}
+		return nil
+	})
+	return files, total
+}
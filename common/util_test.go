@@ -35,6 +35,7 @@ package common
 
 import (
 	"fmt"
+	"io/fs"
 	"math/rand"
 	"os"
 	"path/filepath"
@@ -135,3 +136,26 @@ func (suite *utilTestSuite) TestExpandPath() {
 	expandedPath := ExpandPath(path)
 	suite.assert.Contains(expandedPath, path[2:])
 }
+
+func (suite *utilTestSuite) TestDirUsage() {
+	dir := filepath.Join(home_dir, "dir"+randomString(8))
+	os.MkdirAll(filepath.Join(dir, "sub"), 0777)
+	os.MkdirAll(filepath.Join(dir, ".skip"), 0777)
+	defer os.RemoveAll(dir)
+
+	os.WriteFile(filepath.Join(dir, "a"), make([]byte, 8192), 0777)
+	os.WriteFile(filepath.Join(dir, "sub", "b"), make([]byte, 4096), 0777)
+	os.WriteFile(filepath.Join(dir, ".skip", "c"), make([]byte, 4096), 0777)
+	// Sparse space is not counted
+	os.Truncate(filepath.Join(dir, "sub", "b"), 1024*1024)
+
+	files, total := DirUsage(dir, func(path string, d fs.DirEntry) bool {
+		return d.Name() == ".skip"
+	})
+	suite.assert.EqualValues(12288, total)
+	suite.assert.Len(files, 2)
+	suite.assert.EqualValues(4096, files[filepath.Join(dir, "sub", "b")])
+
+	_, total = DirUsage(dir, nil)
+	suite.assert.EqualValues(16384, total)
+}
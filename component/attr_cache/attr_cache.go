@@ -479,6 +479,14 @@ func (ac *AttrCache) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr
 
 	// Get the attributes from next component and cache them
 	pathAttr, err := ac.NextComponent().GetAttr(options)
+	if err == syscall.ENOTCONN && found && value.valid() {
+		// Storage is unreachable so serve whatever we know about the path even if it has expired
+		log.Warn("AttrCache::GetAttr : %s served from expired cache as storage is unreachable", options.Name)
+		if value.isDeleted() {
+			return &internal.ObjAttr{}, syscall.ENOENT
+		}
+		return value.getAttr(), nil
+	}
 
 	ac.cacheLock.Lock()
 	defer ac.cacheLock.Unlock()
@@ -544,12 +552,75 @@ func (ac *AttrCache) Chmod(options internal.ChmodOptions) error {
 	return err
 }
 
-// Chown : Update the file with its new owner and group (when datalake chown is implemented)
+// Chown : Update the file with its new owner and group
 func (ac *AttrCache) Chown(options internal.ChownOptions) error {
 	log.Trace("AttrCache::Chown : Change owner of file/directory %s", options.Name)
 
 	err := ac.NextComponent().Chown(options)
-	// TODO: Implement when datalake chown is supported.
+
+	if err == nil {
+		ac.cacheLock.RLock()
+		defer ac.cacheLock.RUnlock()
+
+		value, found := ac.cacheMap[internal.TruncateDirName(options.Name)]
+		if found && value.valid() && value.exists() {
+			// -1 means this id is not being changed, so we can not build the new owner from the request alone
+			if options.Owner < 0 || options.Group < 0 {
+				value.invalidate()
+			} else {
+				value.setOwner(uint32(options.Owner), uint32(options.Group))
+			}
+		}
+	}
+
+	return err
+}
+
+// SetAttr : Update the file with its new access and modification time
+func (ac *AttrCache) SetAttr(options internal.SetAttrOptions) error {
+	log.Trace("AttrCache::SetAttr : Change times of file/directory %s", options.Name)
+
+	err := ac.NextComponent().SetAttr(options)
+
+	if err == nil && options.Attr != nil {
+		ac.cacheLock.RLock()
+		defer ac.cacheLock.RUnlock()
+
+		value, found := ac.cacheMap[internal.TruncateDirName(options.Name)]
+		if found && value.valid() && value.exists() {
+			value.setTimes(options.Attr.Atime, options.Attr.Mtime)
+		}
+	}
+
+	return err
+}
+
+// SetXattr : Mark the file/directory invalid as an ACL update changes its mode
+func (ac *AttrCache) SetXattr(options internal.SetXattrOptions) error {
+	log.Trace("AttrCache::SetXattr : %s of %s", options.Attr, options.Name)
+
+	err := ac.NextComponent().SetXattr(options)
+
+	if err == nil {
+		ac.cacheLock.RLock()
+		defer ac.cacheLock.RUnlock()
+		ac.invalidatePath(options.Name)
+	}
+
+	return err
+}
+
+// RemoveXattr : Mark the file/directory invalid as an ACL update changes its mode
+func (ac *AttrCache) RemoveXattr(options internal.RemoveXattrOptions) error {
+	log.Trace("AttrCache::RemoveXattr : %s of %s", options.Attr, options.Name)
+
+	err := ac.NextComponent().RemoveXattr(options)
+
+	if err == nil {
+		ac.cacheLock.RLock()
+		defer ac.cacheLock.RUnlock()
+		ac.invalidatePath(options.Name)
+	}
 
 	return err
 }
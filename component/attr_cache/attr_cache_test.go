@@ -1006,6 +1006,29 @@ func (suite *attrCacheTestSuite) TestGetAttrEnonetError() {
 	}
 }
 
+func (suite *attrCacheTestSuite) TestGetAttrExpiredStorageUnreachable() {
+	defer suite.cleanupTest()
+	path := "a"
+	expired := time.Now().Add(-time.Duration(suite.attrCache.cacheTimeout+1) * time.Second)
+	suite.attrCache.cacheMap[path] = newAttrCacheItem(getPathAttr(path, defaultSize, fs.FileMode(defaultMode), true), true, expired)
+
+	// Expired entry is served as storage can not be reached
+	options := internal.GetAttrOptions{Name: path}
+	suite.mock.EXPECT().GetAttr(options).Return(nil, syscall.ENOTCONN)
+
+	result, err := suite.attrCache.GetAttr(options)
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(defaultSize, result.Size)
+
+	// Path not known to the cache still fails
+	options = internal.GetAttrOptions{Name: "b"}
+	suite.mock.EXPECT().GetAttr(options).Return(nil, syscall.ENOTCONN)
+
+	_, err = suite.attrCache.GetAttr(options)
+	suite.assert.Equal(syscall.ENOTCONN, err)
+	suite.assert.NotContains(suite.attrCache.cacheMap, "b")
+}
+
 // Tests Cache Timeout
 func (suite *attrCacheTestSuite) TestCacheTimeout() {
 	defer suite.cleanupTest()
@@ -1122,9 +1145,8 @@ func (suite *attrCacheTestSuite) TestChmod() {
 // Tests Chown
 func (suite *attrCacheTestSuite) TestChown() {
 	defer suite.cleanupTest()
-	// TODO: Implement when datalake chown is supported.
-	owner := 0
-	group := 0
+	owner := 6
+	group := 5
 	var paths = []string{"a", "a/"}
 
 	for _, path := range paths {
@@ -1156,11 +1178,112 @@ func (suite *attrCacheTestSuite) TestChown() {
 
 			err = suite.attrCache.Chown(options)
 			suite.assert.Nil(err)
+			suite.assert.Contains(suite.attrCache.cacheMap, truncatedPath)
+			suite.assert.EqualValues(suite.attrCache.cacheMap[truncatedPath].attr.Size, defaultSize)
+			suite.assert.EqualValues(suite.attrCache.cacheMap[truncatedPath].attr.Uid, owner) // new owner should be set
+			suite.assert.EqualValues(suite.attrCache.cacheMap[truncatedPath].attr.Gid, group)
+			suite.assert.True(suite.attrCache.cacheMap[truncatedPath].attr.IsOwnerSet())
+			suite.assert.True(suite.attrCache.cacheMap[truncatedPath].valid())
+			suite.assert.True(suite.attrCache.cacheMap[truncatedPath].exists())
+
+			// Partial change of ownership
+			options = internal.ChownOptions{Name: path, Owner: -1, Group: group}
+			suite.mock.EXPECT().Chown(options).Return(nil)
+
+			err = suite.attrCache.Chown(options)
+			suite.assert.Nil(err)
+			suite.assert.Contains(suite.attrCache.cacheMap, truncatedPath)
+			suite.assert.False(suite.attrCache.cacheMap[truncatedPath].valid())
+		})
+	}
+}
+
+func (suite *attrCacheTestSuite) TestSetAttr() {
+	defer suite.cleanupTest()
+	mtime := time.Now().Add(-time.Hour)
+	var paths = []string{"a", "a/"}
+
+	for _, path := range paths {
+		// This is a little janky but required since testify suite does not support running setup or clean up for subtests.
+		suite.cleanupTest()
+		suite.SetupTest()
+		suite.Run(path, func() {
+			truncatedPath := internal.TruncateDirName(path)
+			options := internal.SetAttrOptions{Name: path, Attr: &internal.ObjAttr{Mtime: mtime}}
+
+			// Error
+			suite.mock.EXPECT().SetAttr(options).Return(errors.New("Failed to set attributes"))
+
+			err := suite.attrCache.SetAttr(options)
+			suite.assert.NotNil(err)
+			suite.assert.NotContains(suite.attrCache.cacheMap, truncatedPath)
+
+			// Success
+			// Entry Already Exists
+			addPathToCache(suite.assert, suite.attrCache, path, false)
+			atime := suite.attrCache.cacheMap[truncatedPath].attr.Atime
+			suite.mock.EXPECT().SetAttr(options).Return(nil)
+
+			err = suite.attrCache.SetAttr(options)
+			suite.assert.Nil(err)
 			assertUntouched(suite, truncatedPath)
+			suite.assert.True(suite.attrCache.cacheMap[truncatedPath].attr.Mtime.Equal(mtime)) // new mtime should be set
+			suite.assert.True(suite.attrCache.cacheMap[truncatedPath].attr.Atime.Equal(atime)) // zero atime is left as is
 		})
 	}
 }
 
+func (suite *attrCacheTestSuite) TestSetXattr() {
+	defer suite.cleanupTest()
+	var paths = []string{"a", "a/"}
+
+	for _, path := range paths {
+		// This is a little janky but required since testify suite does not support running setup or clean up for subtests.
+		suite.cleanupTest()
+		suite.SetupTest()
+		suite.Run(path, func() {
+			truncatedPath := internal.TruncateDirName(path)
+			options := internal.SetXattrOptions{Name: path, Attr: "system.posix_acl_access", Value: []byte{2, 0, 0, 0}}
+
+			// Error
+			addPathToCache(suite.assert, suite.attrCache, path, false)
+			suite.mock.EXPECT().SetXattr(options).Return(errors.New("Failed to set xattr"))
+
+			err := suite.attrCache.SetXattr(options)
+			suite.assert.NotNil(err)
+			assertUntouched(suite, truncatedPath)
+
+			// Success
+			suite.mock.EXPECT().SetXattr(options).Return(nil)
+
+			err = suite.attrCache.SetXattr(options)
+			suite.assert.Nil(err)
+			assertInvalid(suite, truncatedPath)
+		})
+	}
+}
+
+func (suite *attrCacheTestSuite) TestRemoveXattr() {
+	defer suite.cleanupTest()
+	path := "a"
+	options := internal.RemoveXattrOptions{Name: path, Attr: "system.posix_acl_access"}
+
+	// Error
+	addPathToCache(suite.assert, suite.attrCache, path, false)
+	suite.mock.EXPECT().RemoveXattr(options).Return(errors.New("Failed to remove xattr"))
+
+	err := suite.attrCache.RemoveXattr(options)
+	suite.assert.NotNil(err)
+	assertUntouched(suite, path)
+
+	// Success
+	suite.mock.EXPECT().RemoveXattr(options).Return(nil)
+
+	err = suite.attrCache.RemoveXattr(options)
+	suite.assert.Nil(err)
+	assertInvalid(suite, path)
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestAttrCacheTestSuite(t *testing.T) {
@@ -109,3 +109,22 @@ func (value *attrCacheItem) setMode(mode os.FileMode) {
 	value.attr.Ctime = time.Now()
 	value.cachedAt = time.Now()
 }
+
+func (value *attrCacheItem) setOwner(uid uint32, gid uint32) {
+	value.attr.Uid = uid
+	value.attr.Gid = gid
+	value.attr.Flags.Set(internal.PropFlagOwnerSet)
+	value.attr.Ctime = time.Now()
+	value.cachedAt = time.Now()
+}
+
+func (value *attrCacheItem) setTimes(atime time.Time, mtime time.Time) {
+	if !atime.IsZero() {
+		value.attr.Atime = atime
+	}
+	if !mtime.IsZero() {
+		value.attr.Mtime = mtime
+	}
+	value.attr.Ctime = time.Now()
+	value.cachedAt = time.Now()
+}
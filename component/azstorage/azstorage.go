@@ -36,6 +36,8 @@ package azstorage
 import (
 	"context"
 	"fmt"
+	"os"
+	"sort"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -57,6 +59,7 @@ type AzStorage struct {
 	stConfig    AzStorageConfig
 	startTime   time.Time
 	listBlocked bool
+	tagQueries  tagQueryCache
 }
 
 const compName = "azstorage"
@@ -168,13 +171,47 @@ func (az *AzStorage) Start(ctx context.Context) error {
 
 	// create stats collector for azstorage
 	azStatsCollector = stats_manager.NewStatsCollector(az.Name())
+	if az.stConfig.throttle != nil {
+		az.stConfig.throttle.exportLimits()
+	}
+	if az.stConfig.breaker != nil {
+		az.stConfig.breaker.exportState(circuitClosed)
+	}
 
 	return nil
 }
 
+// OnPipelineStart : Resume large uploads interrupted by a crash in background, from the blocks already staged. Their
+// local files belong to the components above, which may clean them up as they start. Directory renames an earlier mount
+// left behind are finished off in background as well, as rename is not atomic on flat namespace accounts.
+func (az *AzStorage) OnPipelineStart() {
+	if bb, ok := az.storage.(*BlockBlob); ok && !az.stConfig.readOnly {
+		go func() {
+			err := bb.RecoverRenames()
+			if err != nil {
+				log.Err("AzStorage::OnPipelineStart : Failed to recover incomplete directory renames [%s]", err.Error())
+			}
+		}()
+	}
+
+	if az.stConfig.uploadState == nil {
+		return
+	}
+
+	switch s := az.storage.(type) {
+	case *BlockBlob:
+		go s.ResumeUploads()
+	case *Datalake:
+		go s.BlockBlob.ResumeUploads()
+	}
+}
+
 // Stop : Disconnect all running operations here
 func (az *AzStorage) Stop() error {
 	log.Trace("AzStorage::Stop : Stopping component %s", az.Name())
+	if az.stConfig.breaker != nil {
+		az.stConfig.breaker.stop()
+	}
 	azStatsCollector.Destroy()
 	return nil
 }
@@ -190,7 +227,11 @@ func (az *AzStorage) ListContainers() ([]string, error) {
 func (az *AzStorage) CreateDir(options internal.CreateDirOptions) error {
 	log.Trace("AzStorage::CreateDir : %s", options.Name)
 
-	err := az.storage.CreateDirectory(internal.TruncateDirName(options.Name))
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	err := az.circuitErr(az.storage.CreateDirectory(internal.TruncateDirName(options.Name)))
 
 	if err == nil {
 		azStatsCollector.PushEvents(createDir, options.Name, map[string]interface{}{mode: options.Mode.String()})
@@ -203,7 +244,11 @@ func (az *AzStorage) CreateDir(options internal.CreateDirOptions) error {
 func (az *AzStorage) DeleteDir(options internal.DeleteDirOptions) error {
 	log.Trace("AzStorage::DeleteDir : %s", options.Name)
 
-	err := az.storage.DeleteDirectory(internal.TruncateDirName(options.Name))
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	err := az.circuitErr(az.storage.DeleteDirectory(internal.TruncateDirName(options.Name)))
 
 	if err == nil {
 		azStatsCollector.PushEvents(deleteDir, options.Name, nil)
@@ -226,6 +271,11 @@ func formatListDirName(path string) string {
 
 func (az *AzStorage) IsDirEmpty(options internal.IsDirEmptyOptions) bool {
 	log.Trace("AzStorage::IsDirEmpty : %s", options.Name)
+	if az.inTagQueryDir(options.Name) {
+		list, err := az.tagQueryList(options.Name)
+		return err == nil && len(list) == 0
+	}
+
 	list, _, err := az.storage.List(formatListDirName(options.Name), nil, 1)
 	if err != nil {
 		log.Err("AzStorage::IsDirEmpty : error listing [%s]", err)
@@ -239,6 +289,10 @@ func (az *AzStorage) IsDirEmpty(options internal.IsDirEmptyOptions) bool {
 
 func (az *AzStorage) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAttr, error) {
 	log.Trace("AzStorage::ReadDir : %s", options.Name)
+	if az.inTagQueryDir(options.Name) {
+		return az.tagQueryList(options.Name)
+	}
+
 	blobList := make([]*internal.ObjAttr, 0)
 
 	if az.listBlocked {
@@ -259,7 +313,7 @@ func (az *AzStorage) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 		new_list, new_marker, err := az.storage.List(path, marker, common.MaxDirListCount)
 		if err != nil {
 			log.Err("AzStorage::ReadDir : Failed to read dir [%s]", err)
-			return blobList, err
+			return blobList, az.circuitErr(err)
 		}
 		blobList = append(blobList, new_list...)
 		marker = new_marker
@@ -277,6 +331,12 @@ func (az *AzStorage) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 func (az *AzStorage) StreamDir(options internal.StreamDirOptions) ([]*internal.ObjAttr, string, error) {
 	log.Trace("AzStorage::StreamDir : Path %s, offset %d, count %d", options.Name, options.Offset, options.Count)
 
+	if az.inTagQueryDir(options.Name) {
+		// Query results are listed in one go
+		list, err := az.tagQueryList(options.Name)
+		return list, "", err
+	}
+
 	if az.listBlocked {
 		diff := time.Since(az.startTime)
 		if diff.Seconds() > float64(az.stConfig.cancelListForSeconds) {
@@ -293,7 +353,7 @@ func (az *AzStorage) StreamDir(options internal.StreamDirOptions) ([]*internal.O
 	new_list, new_marker, err := az.storage.List(path, &options.Token, options.Count)
 	if err != nil {
 		log.Err("AzStorage::StreamDir : Failed to read dir [%s]", err)
-		return new_list, "", err
+		return new_list, "", az.circuitErr(err)
 	}
 
 	log.Debug("AzStorage::StreamDir : Retrieved %d objects with %s marker for Path %s", len(new_list), options.Token, path)
@@ -327,10 +387,15 @@ func (az *AzStorage) StreamDir(options internal.StreamDirOptions) ([]*internal.O
 
 func (az *AzStorage) RenameDir(options internal.RenameDirOptions) error {
 	log.Trace("AzStorage::RenameDir : %s to %s", options.Src, options.Dst)
+
+	if az.inTagQueryDir(options.Src) || az.inTagQueryDir(options.Dst) {
+		return syscall.EROFS
+	}
+
 	options.Src = internal.TruncateDirName(options.Src)
 	options.Dst = internal.TruncateDirName(options.Dst)
 
-	err := az.storage.RenameDirectory(options.Src, options.Dst)
+	err := az.circuitErr(az.storage.RenameDirectory(options.Src, options.Dst))
 
 	if err == nil {
 		azStatsCollector.PushEvents(renameDir, options.Src, map[string]interface{}{src: options.Src, dest: options.Dst})
@@ -343,6 +408,10 @@ func (az *AzStorage) RenameDir(options internal.RenameDirOptions) error {
 func (az *AzStorage) CreateFile(options internal.CreateFileOptions) (*handlemap.Handle, error) {
 	log.Trace("AzStorage::CreateFile : %s", options.Name)
 
+	if az.inTagQueryDir(options.Name) {
+		return nil, syscall.EROFS
+	}
+
 	// Create a handle object for the file being created
 	// This handle will be added to handlemap by the first component in pipeline
 	handle := handlemap.NewHandle(options.Name)
@@ -353,7 +422,7 @@ func (az *AzStorage) CreateFile(options internal.CreateFileOptions) (*handlemap.
 
 	err := az.storage.CreateFile(options.Name, options.Mode)
 	if err != nil {
-		return nil, err
+		return nil, az.circuitErr(err)
 	}
 	handle.Mtime = time.Now()
 
@@ -368,9 +437,22 @@ func (az *AzStorage) CreateFile(options internal.CreateFileOptions) (*handlemap.
 func (az *AzStorage) OpenFile(options internal.OpenFileOptions) (*handlemap.Handle, error) {
 	log.Trace("AzStorage::OpenFile : %s", options.Name)
 
-	attr, err := az.storage.GetAttr(options.Name)
+	var attr *internal.ObjAttr
+	var err error
+	if az.inTagQueryDir(options.Name) {
+		if options.Flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+			return nil, syscall.EROFS
+		}
+
+		attr, err = az.tagQueryGetAttr(options.Name)
+		if err == nil && attr.IsDir() {
+			err = syscall.EISDIR
+		}
+	} else {
+		attr, err = az.storage.GetAttr(options.Name)
+	}
 	if err != nil {
-		return nil, err
+		return nil, az.circuitErr(err)
 	}
 
 	// Create a handle object for the file being opened
@@ -401,7 +483,11 @@ func (az *AzStorage) CloseFile(options internal.CloseFileOptions) error {
 func (az *AzStorage) DeleteFile(options internal.DeleteFileOptions) error {
 	log.Trace("AzStorage::DeleteFile : %s", options.Name)
 
-	err := az.storage.DeleteFile(options.Name)
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	err := az.circuitErr(az.storage.DeleteFile(options.Name))
 
 	if err == nil {
 		azStatsCollector.PushEvents(deleteFile, options.Name, nil)
@@ -414,7 +500,11 @@ func (az *AzStorage) DeleteFile(options internal.DeleteFileOptions) error {
 func (az *AzStorage) RenameFile(options internal.RenameFileOptions) error {
 	log.Trace("AzStorage::RenameFile : %s to %s", options.Src, options.Dst)
 
-	err := az.storage.RenameFile(options.Src, options.Dst)
+	if az.inTagQueryDir(options.Src) || az.inTagQueryDir(options.Dst) {
+		return syscall.EROFS
+	}
+
+	err := az.circuitErr(az.storage.RenameFile(options.Src, options.Dst))
 
 	if err == nil {
 		azStatsCollector.PushEvents(renameFile, options.Src, map[string]interface{}{src: options.Src, dest: options.Dst})
@@ -425,7 +515,8 @@ func (az *AzStorage) RenameFile(options internal.RenameFileOptions) error {
 
 func (az *AzStorage) ReadFile(options internal.ReadFileOptions) (data []byte, err error) {
 	//log.Trace("AzStorage::ReadFile : Read %s", h.Path)
-	return az.storage.ReadBuffer(options.Handle.Path, 0, 0)
+	data, err = az.storage.ReadBuffer(az.resolveTagQueryPath(options.Handle.Path), 0, 0)
+	return data, az.circuitErr(err)
 }
 
 func (az *AzStorage) ReadInBuffer(options internal.ReadInBufferOptions) (length int, err error) {
@@ -444,9 +535,10 @@ func (az *AzStorage) ReadInBuffer(options internal.ReadInBufferOptions) (length
 		return 0, nil
 	}
 
-	err = az.storage.ReadInBuffer(options.Handle.Path, options.Offset, dataLen, options.Data)
+	err = az.storage.ReadInBuffer(az.resolveTagQueryPath(options.Handle.Path), options.Offset, dataLen, options.Data, options.Etag)
 	if err != nil {
 		log.Err("AzStorage::ReadInBuffer : Failed to read %s [%s]", options.Handle.Path, err.Error())
+		err = az.circuitErr(err)
 	}
 
 	length = int(dataLen)
@@ -454,18 +546,27 @@ func (az *AzStorage) ReadInBuffer(options internal.ReadInBufferOptions) (length
 }
 
 func (az *AzStorage) WriteFile(options internal.WriteFileOptions) (int, error) {
+	if az.inTagQueryDir(options.Handle.Path) {
+		return 0, syscall.EROFS
+	}
+
 	err := az.storage.Write(options)
-	return len(options.Data), err
+	return len(options.Data), az.circuitErr(err)
 }
 
 func (az *AzStorage) GetFileBlockOffsets(options internal.GetFileBlockOffsetsOptions) (*common.BlockOffsetList, error) {
-	return az.storage.GetFileBlockOffsets(options.Name)
+	return az.storage.GetFileBlockOffsets(az.resolveTagQueryPath(options.Name))
 
 }
 
 func (az *AzStorage) TruncateFile(options internal.TruncateFileOptions) error {
 	log.Trace("AzStorage::TruncateFile : %s to %d bytes", options.Name, options.Size)
-	err := az.storage.TruncateFile(options.Name, options.Size)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	err := az.circuitErr(az.storage.TruncateFile(options.Name, options.Size))
 
 	if err == nil {
 		azStatsCollector.PushEvents(truncateFile, options.Name, map[string]interface{}{size: options.Size})
@@ -476,17 +577,27 @@ func (az *AzStorage) TruncateFile(options internal.TruncateFileOptions) error {
 
 func (az *AzStorage) CopyToFile(options internal.CopyToFileOptions) error {
 	log.Trace("AzStorage::CopyToFile : Read file %s", options.Name)
-	return az.storage.ReadToFile(options.Name, options.Offset, options.Count, options.File)
+	return az.circuitErr(az.storage.ReadToFile(az.resolveTagQueryPath(options.Name), options.Offset, options.Count, options.File))
 }
 
 func (az *AzStorage) CopyFromFile(options internal.CopyFromFileOptions) error {
 	log.Trace("AzStorage::CopyFromFile : Upload file %s", options.Name)
-	return az.storage.WriteFromFile(options.Name, options.Metadata, options.File)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	return az.circuitErr(az.storage.WriteFromFile(options.Name, options.Metadata, options.File))
 }
 
 // Symlink operations
 func (az *AzStorage) CreateLink(options internal.CreateLinkOptions) error {
 	log.Trace("AzStorage::CreateLink : Create symlink %s -> %s", options.Name, options.Target)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
 	err := az.storage.CreateLink(options.Name, options.Target)
 
 	if err == nil {
@@ -499,7 +610,7 @@ func (az *AzStorage) CreateLink(options internal.CreateLinkOptions) error {
 
 func (az *AzStorage) ReadLink(options internal.ReadLinkOptions) (string, error) {
 	log.Trace("AzStorage::ReadLink : Read symlink %s", options.Name)
-	data, err := az.storage.ReadBuffer(options.Name, 0, 0)
+	data, err := az.storage.ReadBuffer(az.resolveTagQueryPath(options.Name), 0, 0)
 
 	if err != nil {
 		azStatsCollector.PushEvents(readLink, options.Name, nil)
@@ -512,11 +623,21 @@ func (az *AzStorage) ReadLink(options internal.ReadLinkOptions) (string, error)
 // Attribute operations
 func (az *AzStorage) GetAttr(options internal.GetAttrOptions) (attr *internal.ObjAttr, err error) {
 	//log.Trace("AzStorage::GetAttr : Get attributes of file %s", name)
-	return az.storage.GetAttr(options.Name)
+	if az.inTagQueryDir(options.Name) {
+		return az.tagQueryGetAttr(options.Name)
+	}
+
+	attr, err = az.storage.GetAttr(options.Name)
+	return attr, az.circuitErr(err)
 }
 
 func (az *AzStorage) Chmod(options internal.ChmodOptions) error {
 	log.Trace("AzStorage::Chmod : Change mod of file %s", options.Name)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
 	err := az.storage.ChangeMod(options.Name, options.Mode)
 
 	if err == nil {
@@ -529,16 +650,262 @@ func (az *AzStorage) Chmod(options internal.ChmodOptions) error {
 
 func (az *AzStorage) Chown(options internal.ChownOptions) error {
 	log.Trace("AzStorage::Chown : Change ownership of file %s to %d-%d", options.Name, options.Owner, options.Group)
-	return az.storage.ChangeOwner(options.Name, options.Owner, options.Group)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	err := az.storage.ChangeOwner(options.Name, options.Owner, options.Group)
+
+	if err == nil {
+		azStatsCollector.PushEvents(chown, options.Name, map[string]interface{}{owner: options.Owner, group: options.Group})
+		azStatsCollector.UpdateStats(stats_manager.Increment, chown, (int64)(1))
+	}
+
+	return err
+}
+
+// SetAttr : Only access and modification times are updated here, zero time means leave it unchanged
+func (az *AzStorage) SetAttr(options internal.SetAttrOptions) error {
+	log.Trace("AzStorage::SetAttr : Change times of file %s", options.Name)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	if options.Attr == nil {
+		return nil
+	}
+
+	err := az.storage.ChangeTimes(options.Name, options.Attr.Atime, options.Attr.Mtime)
+
+	if err == nil {
+		azStatsCollector.PushEvents(setAttr, options.Name, map[string]interface{}{atime: options.Attr.Atime, mtime: options.Attr.Mtime})
+		azStatsCollector.UpdateStats(stats_manager.Increment, setAttr, (int64)(1))
+	}
+
+	return err
+}
+
+// GetXattr : POSIX ACLs are read from the access control list of the path and user.tag.* from the blob index tags
+func (az *AzStorage) GetXattr(options internal.GetXattrOptions) ([]byte, error) {
+	log.Trace("AzStorage::GetXattr : Get %s of %s", options.Attr, options.Name)
+
+	options.Name = az.resolveTagQueryPath(options.Name)
+	if options.Name == "" {
+		return nil, syscall.ENODATA
+	}
+
+	if key, ok := blobTagKey(options.Attr); ok {
+		tags, err := az.storage.GetTags(options.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		value, found := tags[key]
+		if !found {
+			return nil, syscall.ENODATA
+		}
+		return []byte(value), nil
+	}
+
+	isDefault, ok := posixACLScope(options.Attr)
+	if !ok {
+		return nil, syscall.ENODATA
+	}
+
+	entries, err := az.getACL(options.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	if !hasACLEntries(entries, isDefault) {
+		return nil, syscall.ENODATA
+	}
+
+	return encodePosixACL(entries, isDefault, az.stConfig.identityMap), nil
+}
+
+// SetXattr : Replace the access or default entries of the access control list of the path, or set a blob index tag
+func (az *AzStorage) SetXattr(options internal.SetXattrOptions) error {
+	log.Trace("AzStorage::SetXattr : Set %s of %s", options.Attr, options.Name)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	if key, ok := blobTagKey(options.Attr); ok {
+		tags, err := az.storage.GetTags(options.Name)
+		if err != nil {
+			return err
+		}
+
+		_, found := tags[key]
+		if found && options.Flags&xattrCreate != 0 {
+			return syscall.EEXIST
+		} else if !found && options.Flags&xattrReplace != 0 {
+			return syscall.ENODATA
+		}
+
+		tags[key] = string(options.Value)
+		return az.setTags(options.Name, tags, options.Attr, setXattr)
+	}
+
+	isDefault, ok := posixACLScope(options.Attr)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	updated, err := decodePosixACL(options.Value, isDefault, az.stConfig.identityMap)
+	if err != nil {
+		log.Err("AzStorage::SetXattr : Invalid %s for %s", options.Attr, options.Name)
+		return err
+	}
+
+	current, err := az.getACL(options.Name)
+	if err != nil {
+		return err
+	}
+
+	err = az.storage.SetACL(options.Name, formatACL(mergeACL(current, updated, isDefault, az.stConfig.identityMap)))
+	if err == nil {
+		azStatsCollector.PushEvents(setXattr, options.Name, map[string]interface{}{xattr: options.Attr})
+		azStatsCollector.UpdateStats(stats_manager.Increment, setXattr, (int64)(1))
+	}
+
+	return err
+}
+
+// ListXattr : List the POSIX ACLs and blob index tags present on the path
+func (az *AzStorage) ListXattr(options internal.ListXattrOptions) ([]string, error) {
+	log.Trace("AzStorage::ListXattr : List xattrs of %s", options.Name)
+
+	names := make([]string, 0, 2)
+	options.Name = az.resolveTagQueryPath(options.Name)
+	if options.Name == "" {
+		return names, nil
+	}
+
+	entries, err := az.getACL(options.Name)
+	if err != nil && err != syscall.ENOTSUP {
+		return nil, err
+	}
+
+	if hasACLEntries(entries, false) {
+		names = append(names, posixACLAccessXattr)
+	}
+	if hasACLEntries(entries, true) {
+		names = append(names, posixACLDefaultXattr)
+	}
+
+	// Directories in ADLS and virtual directories in block blob have no tags
+	tags, err := az.storage.GetTags(options.Name)
+	if err != nil {
+		log.Debug("AzStorage::ListXattr : No tags for %s [%s]", options.Name, err.Error())
+		return names, nil
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, blobTagXattrPrefix+key)
+	}
+	sort.Strings(keys)
+
+	return append(names, keys...), nil
+}
+
+// RemoveXattr : Removing the default ACL drops all default entries, while removing the access ACL leaves only the permission bits.
+// Removing user.tag.* deletes the blob index tag
+func (az *AzStorage) RemoveXattr(options internal.RemoveXattrOptions) error {
+	log.Trace("AzStorage::RemoveXattr : Remove %s of %s", options.Attr, options.Name)
+
+	if az.inTagQueryDir(options.Name) {
+		return syscall.EROFS
+	}
+
+	if key, ok := blobTagKey(options.Attr); ok {
+		tags, err := az.storage.GetTags(options.Name)
+		if err != nil {
+			return err
+		}
+
+		if _, found := tags[key]; !found {
+			return syscall.ENODATA
+		}
+
+		delete(tags, key)
+		return az.setTags(options.Name, tags, options.Attr, removeXattr)
+	}
+
+	isDefault, ok := posixACLScope(options.Attr)
+	if !ok {
+		return syscall.ENOTSUP
+	}
+
+	current, err := az.getACL(options.Name)
+	if err != nil {
+		return err
+	}
+
+	if !hasACLEntries(current, isDefault) {
+		return syscall.ENODATA
+	}
+
+	entries := mergeACL(current, nil, isDefault, az.stConfig.identityMap)
+	if !isDefault {
+		entries = append(entries, baseACL(current)...)
+	}
+
+	err = az.storage.SetACL(options.Name, formatACL(entries))
+	if err == nil {
+		azStatsCollector.PushEvents(removeXattr, options.Name, map[string]interface{}{xattr: options.Attr})
+		azStatsCollector.UpdateStats(stats_manager.Increment, removeXattr, (int64)(1))
+	}
+
+	return err
+}
+
+// setTags : Replace the index tags of a blob and record the change of given xattr
+func (az *AzStorage) setTags(name string, tags map[string]string, attr string, op string) error {
+	err := az.storage.SetTags(name, tags)
+	if err == nil {
+		// Results of earlier queries may no longer be correct
+		az.tagQueries.clear()
+
+		azStatsCollector.PushEvents(op, name, map[string]interface{}{xattr: attr})
+		azStatsCollector.UpdateStats(stats_manager.Increment, op, (int64)(1))
+	}
+
+	return err
+}
+
+// getACL : Get and parse the access control list of the path
+func (az *AzStorage) getACL(name string) ([]aclEntry, error) {
+	acl, err := az.storage.GetACL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := parseACL(acl)
+	if err != nil {
+		log.Err("AzStorage::getACL : Failed to parse acl of %s [%s]", name, err.Error())
+		return nil, syscall.EIO
+	}
+
+	return entries, nil
 }
 
 func (az *AzStorage) FlushFile(options internal.FlushFileOptions) error {
 	log.Trace("AzStorage::FlushFile : Flush file %s", options.Handle.Path)
-	return az.storage.StageAndCommit(options.Handle.Path, options.Handle.CacheObj.BlockOffsetList)
+
+	if az.inTagQueryDir(options.Handle.Path) {
+		return syscall.EROFS
+	}
+
+	return az.circuitErr(az.storage.StageAndCommit(options.Handle.Path, options.Handle.CacheObj.BlockOffsetList))
 }
 
 // TODO : Below methods are pending to be implemented
-// SetAttr(string, internal.ObjAttr) error
 // UnlinkFile(string) error
 // ReleaseFile(*handlemap.Handle) error
 // FlushFile(*handlemap.Handle) error
@@ -550,9 +917,10 @@ func NewazstorageComponent() internal.Component {
 	// Init the component with default config
 	az := &AzStorage{
 		stConfig: AzStorageConfig{
-			blockSize:      0,
-			maxConcurrency: 32,
-			defaultTier:    getAccessTierType("none"),
+			blockSize:         0,
+			maxConcurrency:    32,
+			renameParallelism: defaultRenameParallelism,
+			defaultTier:       getAccessTierType("none"),
 			authConfig: azAuthConfig{
 				AuthMode: EAuthType.KEY(),
 				UseHTTP:  false,
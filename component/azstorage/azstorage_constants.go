@@ -51,6 +51,10 @@ const (
 	createLink   = "CreateLink"
 	readLink     = "ReadLink"
 	chmod        = "Chmod"
+	chown        = "Chown"
+	setAttr      = "SetAttr"
+	setXattr     = "SetXattr"
+	removeXattr  = "RemoveXattr"
 
 	openHandles = "OpenFileHandles"
 	mode        = "Mode"
@@ -59,4 +63,25 @@ const (
 	dest        = "Dest"
 	size        = "Size"
 	target      = "Target"
+	owner       = "Owner"
+	group       = "Group"
+	atime       = "Atime"
+	mtime       = "Mtime"
+	xattr       = "Xattr"
+
+	uploadLimit        = "UploadLimitBytesPerSec"
+	downloadLimit      = "DownloadLimitBytesPerSec"
+	requestLimit       = "RequestLimitPerSec"
+	throttledRequests  = "ThrottledRequests"
+	throttledUploads   = "ThrottledUploads"
+	throttledDownloads = "ThrottledDownloads"
+	throttleWaitMs     = "ThrottleWaitMs"
+	concurrencyLimit   = "ConcurrencyLimit"
+	throttledResponses = "ThrottledResponses"
+	circuitState       = "CircuitBreakerState"
+	circuitTrips       = "CircuitBreakerTrips"
+	hedgedReads        = "HedgedReads"
+	hedgeWins          = "HedgeWins"
+	hedgeThresholdMs   = "HedgeThresholdMs"
+	resumedUploads     = "ResumedUploads"
 )
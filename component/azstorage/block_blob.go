@@ -38,12 +38,15 @@ import (
 	"context"
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"math"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -60,6 +63,16 @@ import (
 const (
 	folderKey  = "hdi_isfolder"
 	symlinkKey = "is_symlink"
+
+	// Reserved keys to persist POSIX attributes as flat namespace has no native support for them
+	posixModeKey  = "posix_mode"
+	posixUidKey   = "posix_uid"
+	posixGidKey   = "posix_gid"
+	posixAtimeKey = "posix_atime"
+	posixMtimeKey = "posix_mtime"
+
+	// Permission, setuid, setgid and sticky bits of a POSIX mode
+	posixModeMask = os.FileMode(07777)
 )
 
 type BlockBlob struct {
@@ -107,6 +120,8 @@ func (bb *BlockBlob) UpdateConfig(cfg AzStorageConfig) error {
 	bb.Config.maxConcurrency = cfg.maxConcurrency
 	bb.Config.defaultTier = cfg.defaultTier
 	bb.Config.ignoreAccessModifiers = cfg.ignoreAccessModifiers
+	bb.Config.renameParallelism = cfg.renameParallelism
+	bb.Config.renameRollback = cfg.renameRollback
 	return nil
 }
 
@@ -366,25 +381,93 @@ func (bb *BlockBlob) RenameFile(source string, target string) error {
 		return err
 	}
 
-	copyStatus := startCopy.CopyStatus()
+	err = bb.waitForCopy(newBlob, startCopy.CopyStatus())
+	if err != nil {
+		log.Err("BlockBlob::RenameFile : Failed to copy %s to %s [%s]", source, target, err.Error())
+		return err
+	}
+	log.Trace("BlockBlob::RenameFile : %s -> %s done", source, target)
+
+	// Copy of the file is done so now delete the older file
+	return bb.DeleteFile(source)
+}
+
+// waitForCopy : Poll the copy status of a blob, backing off between polls, till the copy is no more pending
+func (bb *BlockBlob) waitForCopy(blob azblob.BlockBlobURL, copyStatus azblob.CopyStatusType) error {
+	delay := copyPollMinDelay
 	for copyStatus == azblob.CopyStatusPending {
-		time.Sleep(time.Second * 1)
-		prop, err = newBlob.GetProperties(context.Background(), bb.blobAccCond, bb.blobCPKOpt)
+		time.Sleep(delay)
+		delay = time.Duration(math.Min(float64(delay*2), float64(copyPollMaxDelay)))
+
+		prop, err := blob.GetProperties(context.Background(), bb.blobAccCond, bb.blobCPKOpt)
 		if err != nil {
-			log.Err("BlockBlob::RenameFile : CopyStats : Failed to get blob properties for %s [%s]", source, err.Error())
+			log.Err("BlockBlob::waitForCopy : Failed to get blob properties for %s [%s]", blob.String(), err.Error())
+			return err
 		}
 		copyStatus = prop.CopyStatus()
 	}
-	log.Trace("BlockBlob::RenameFile : %s -> %s done", source, target)
 
-	// Copy of the file is done so now delete the older file
-	return bb.DeleteFile(source)
+	// Copy within the same account mostly completes synchronously and in some cases status is not reported at all
+	if copyStatus != azblob.CopyStatusSuccess && copyStatus != azblob.CopyStatusNone {
+		return fmt.Errorf("copy ended with status %s", copyStatus)
+	}
+
+	return nil
 }
 
 // RenameDirectory : Rename the directory
 func (bb *BlockBlob) RenameDirectory(source string, target string) error {
 	log.Trace("BlockBlob::RenameDirectory : %s -> %s", source, target)
 
+	// Record the rename before touching any blob so that an interrupted rename can be recovered on next mount
+	journal := &renameJournal{
+		Source:    source,
+		Target:    target,
+		StartTime: time.Now(),
+	}
+
+	err := bb.writeRenameJournal(journal)
+	if err != nil {
+		log.Err("BlockBlob::RenameDirectory : Failed to write rename journal for %s [%s]", source, err.Error())
+		return err
+	}
+
+	// Hold a lease for the duration of the rename so that a mount starting meanwhile does not replay it
+	release, err := bb.leaseRenameJournal(journal)
+	if err != nil {
+		log.Err("BlockBlob::RenameDirectory : Failed to lease rename journal for %s [%s]", source, err.Error())
+		return err
+	}
+	defer release()
+
+	err = bb.renameChildren(source, target, journal)
+	if err != nil {
+		// Journal is left behind on purpose so that next mount can complete or undo this rename
+		log.Err("BlockBlob::RenameDirectory : Failed to rename %s to %s [%s]", source, target, err.Error())
+		return err
+	}
+
+	// Virtual directory has no marker blob, its children being renamed is all there is to it
+	err = bb.RenameFile(source, target)
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+
+	return bb.deleteRenameJournal(journal)
+}
+
+// renameChildren : Rename all blobs under the source directory using a pool of workers, checkpointing progress in the journal
+func (bb *BlockBlob) renameChildren(source string, target string, journal *renameJournal) error {
+	type renameJob struct {
+		src string
+		dst string
+	}
+
+	workers := int(bb.Config.renameParallelism)
+	if workers <= 0 {
+		workers = defaultRenameParallelism
+	}
+
 	for marker := (azblob.Marker{}); marker.NotDone(); {
 		listBlob, err := bb.Container.ListBlobsFlatSegment(context.Background(), marker,
 			azblob.ListBlobsSegmentOptions{MaxResults: common.MaxDirListCount,
@@ -392,22 +475,53 @@ func (bb *BlockBlob) RenameDirectory(source string, target string) error {
 			})
 
 		if err != nil {
-			log.Err("BlockBlob::RenameDirectory : Failed to get list of blobs %s", err.Error)
+			log.Err("BlockBlob::renameChildren : Failed to get list of blobs %s", err.Error())
 			return err
 		}
 		marker = listBlob.NextMarker
 
 		// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
+		jobs := make(chan renameJob, len(listBlob.Segment.BlobItems))
 		for _, blobInfo := range listBlob.Segment.BlobItems {
 			srcPath := split(bb.Config.prefixPath, blobInfo.Name)
-			err = bb.RenameFile(srcPath, strings.Replace(srcPath, source, target, 1))
+			jobs <- renameJob{src: srcPath, dst: strings.Replace(srcPath, source, target, 1)}
+		}
+		close(jobs)
+
+		var wg sync.WaitGroup
+		var failed, renamed int64
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for job := range jobs {
+					err := bb.RenameFile(job.src, job.dst)
+					if err != nil {
+						log.Err("BlockBlob::renameChildren : Failed to rename file %s [%s]", job.src, err.Error())
+						atomic.AddInt64(&failed, 1)
+						continue
+					}
+					atomic.AddInt64(&renamed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		journal.Renamed += renamed
+		if failed > 0 {
+			return fmt.Errorf("failed to rename %d blobs under %s", failed, source)
+		}
+
+		// Checkpoint progress once every segment is done
+		if marker.NotDone() {
+			err = bb.writeRenameJournal(journal)
 			if err != nil {
-				log.Err("BlockBlob::RenameDirectory : Failed to rename file %s [%s]", srcPath, err.Error)
+				log.Warn("BlockBlob::renameChildren : Failed to update rename journal for %s [%s]", source, err.Error())
 			}
 		}
 	}
 
-	return bb.RenameFile(source, target)
+	return nil
 }
 
 func (bb *BlockBlob) getAttrUsingRest(name string) (attr *internal.ObjAttr, err error) {
@@ -427,6 +541,7 @@ func (bb *BlockBlob) getAttrUsingRest(name string) (attr *internal.ObjAttr, err
 	}
 
 	// Since block blob does not support acls, we set mode to 0 and FlagModeDefault to true so the fuse layer can return the default permission.
+	// parseMetadata resets the flag if a mode was saved in the metadata through chmod.
 	attr = &internal.ObjAttr{
 		Path:   name, // We don't need to strip the prefixPath here since we pass the input name
 		Name:   filepath.Base(name),
@@ -438,12 +553,13 @@ func (bb *BlockBlob) getAttrUsingRest(name string) (attr *internal.ObjAttr, err
 		Crtime: prop.CreationTime(),
 		Flags:  internal.NewFileBitMap(),
 		MD5:    prop.ContentMD5(),
+		ETag:   string(prop.ETag()),
 	}
 
+	attr.Flags.Set(internal.PropFlagModeDefault)
 	parseMetadata(attr, prop.NewMetadata())
 
 	attr.Flags.Set(internal.PropFlagMetadataRetrieved)
-	attr.Flags.Set(internal.PropFlagModeDefault)
 
 	return attr, nil
 }
@@ -561,11 +677,16 @@ func (bb *BlockBlob) List(prefix string, marker *string, count int32) ([]*intern
 
 	// Process the blobs returned in this result segment (if the segment is empty, the loop body won't execute)
 	// Since block blob does not support acls, we set mode to 0 and FlagModeDefault to true so the fuse layer can return the default permission.
+	// parseMetadata resets the flag if a mode was saved in the metadata through chmod.
 
 	// For some directories 0 byte meta file may not exists so just create a map to figure out such directories
 	var dirList = make(map[string]bool)
 
 	for _, blobInfo := range listBlob.Segment.BlobItems {
+		if isRenameJournalPath(split(bb.Config.prefixPath, blobInfo.Name)) {
+			continue
+		}
+
 		attr := &internal.ObjAttr{
 			Path:   split(bb.Config.prefixPath, blobInfo.Name),
 			Name:   filepath.Base(blobInfo.Name),
@@ -577,11 +698,12 @@ func (bb *BlockBlob) List(prefix string, marker *string, count int32) ([]*intern
 			Crtime: dereferenceTime(blobInfo.Properties.CreationTime, blobInfo.Properties.LastModified),
 			Flags:  internal.NewFileBitMap(),
 			MD5:    blobInfo.Properties.ContentMD5,
+			ETag:   string(blobInfo.Properties.Etag),
 		}
 
+		attr.Flags.Set(internal.PropFlagModeDefault)
 		parseMetadata(attr, blobInfo.Metadata)
 		attr.Flags.Set(internal.PropFlagMetadataRetrieved)
-		attr.Flags.Set(internal.PropFlagModeDefault)
 		blobList = append(blobList, attr)
 
 		if attr.IsDir() {
@@ -595,7 +717,7 @@ func (bb *BlockBlob) List(prefix string, marker *string, count int32) ([]*intern
 	// BlobItems will fail to identify that directory. In such cases BlobPrefixes help to list all directories
 	// dirList contains all dirs for which we got 0 byte meta file, so except those add rest to the list
 	for _, blobInfo := range listBlob.Segment.BlobPrefixes {
-		if !dirList[blobInfo.Name] {
+		if !dirList[blobInfo.Name] && !isRenameJournalPath(split(bb.Config.prefixPath, strings.TrimSuffix(blobInfo.Name, "/"))) {
 			//log.Info("BlockBlob::List : meta file does not exists for dir %s", blobInfo.Name)
 			// For these dirs we get only the name and no other properties so hardcoding time to current time
 			name := strings.TrimSuffix(blobInfo.Name, "/")
@@ -645,14 +767,16 @@ func (bb *BlockBlob) ReadToFile(name string, offset int64, count int64, fi *os.F
 	var downloadPtr *int64 = new(int64)
 	*downloadPtr = 1
 
+	downloadOptions := bb.downloadOptions
+	downloadOptions.Parallelism = bb.parallelism()
 	if common.MonitorBfs() {
-		bb.downloadOptions.Progress = func(bytesTransferred int64) {
+		downloadOptions.Progress = func(bytesTransferred int64) {
 			trackDownload(name, bytesTransferred, count, downloadPtr)
 		}
 	}
 
 	defer log.TimeTrack(time.Now(), "BlockBlob::ReadToFile", name)
-	err = azblob.DownloadBlobToFile(context.Background(), blobURL, offset, count, fi, bb.downloadOptions)
+	err = azblob.DownloadBlobToFile(context.Background(), blobURL, offset, count, fi, downloadOptions)
 
 	if err != nil {
 		e := storeBlobErrToErr(err)
@@ -713,7 +837,7 @@ func (bb *BlockBlob) ReadBuffer(name string, offset int64, len int64) ([]byte, e
 	}
 
 	blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, name))
-	err := azblob.DownloadBlobToBuffer(context.Background(), blobURL, offset, len, buff, bb.downloadOptions)
+	err := bb.downloadRange(name, blobURL, offset, len, buff, bb.downloadOptions)
 
 	if err != nil {
 		e := storeBlobErrToErr(err)
@@ -730,11 +854,16 @@ func (bb *BlockBlob) ReadBuffer(name string, offset int64, len int64) ([]byte, e
 	return buff, nil
 }
 
-// ReadInBuffer : Download specific range from a file to a user provided buffer
-func (bb *BlockBlob) ReadInBuffer(name string, offset int64, len int64, data []byte) error {
+// ReadInBuffer : Download specific range from a file to a user provided buffer, only from the given version of the
+// blob if etag is not empty
+func (bb *BlockBlob) ReadInBuffer(name string, offset int64, len int64, data []byte, etag string) error {
 	// log.Trace("BlockBlob::ReadInBuffer : name %s", name)
 	blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, name))
-	err := azblob.DownloadBlobToBuffer(context.Background(), blobURL, offset, len, data, bb.downloadOptions)
+	options := bb.downloadOptions
+	if etag != "" {
+		options.AccessConditions.ModifiedAccessConditions.IfMatch = azblob.ETag(etag)
+	}
+	err := bb.downloadRange(name, blobURL, offset, len, data, options)
 
 	if err != nil {
 		e := storeBlobErrToErr(err)
@@ -742,6 +871,9 @@ func (bb *BlockBlob) ReadInBuffer(name string, offset int64, len int64, data []b
 			return syscall.ENOENT
 		} else if e == InvalidRange {
 			return syscall.ERANGE
+		} else if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeConditionNotMet {
+			log.Err("BlockBlob::ReadInBuffer : %s is no longer the version %s", name, etag)
+			return syscall.ESTALE
 		}
 
 		log.Err("BlockBlob::ReadInBuffer : Failed to download blob %s [%s]", name, err.Error())
@@ -751,6 +883,18 @@ func (bb *BlockBlob) ReadInBuffer(name string, offset int64, len int64, data []b
 	return nil
 }
 
+// downloadRange : Download a range of the blob in the buffer, hedging the request if it is slow
+func (bb *BlockBlob) downloadRange(name string, blobURL azblob.BlobURL, offset int64, len int64, data []byte,
+	options azblob.DownloadFromBlobOptions) error {
+	if bb.Config.hedge == nil {
+		return azblob.DownloadBlobToBuffer(context.Background(), blobURL, offset, len, data, options)
+	}
+
+	return bb.Config.hedge.hedgedRead(name, data, func(ctx context.Context, buf []byte) error {
+		return azblob.DownloadBlobToBuffer(ctx, blobURL, offset, len, buf, options)
+	})
+}
+
 func (bb *BlockBlob) calculateBlockSize(name string, fileSize int64) (blockSize int64, err error) {
 	// If bufferSize > (BlockBlobMaxStageBlockBytes * BlockBlobMaxBlocks), then error
 	if fileSize > MaxBlocksSize {
@@ -801,8 +945,21 @@ func trackUpload(name string, bytesTransferred int64, count int64, uploadPtr *in
 	}
 }
 
+// parallelism : Number of parallel requests for a transfer, reduced while the service is throttling us
+func (bb *BlockBlob) parallelism() uint16 {
+	if bb.Config.concurrency != nil {
+		return bb.Config.concurrency.parallelism()
+	}
+	return bb.Config.maxConcurrency
+}
+
 // WriteFromFile : Upload local file to blob
 func (bb *BlockBlob) WriteFromFile(name string, metadata map[string]string, fi *os.File) (err error) {
+	return bb.writeFromFile(name, metadata, fi, false)
+}
+
+// writeFromFile : Upload local file to blob, resumed is set for a file left by an earlier mount
+func (bb *BlockBlob) writeFromFile(name string, metadata map[string]string, fi *os.File, resumed bool) (err error) {
 	log.Trace("BlockBlob::WriteFromFile : name %s", name)
 	//defer exectime.StatTimeCurrentBlock("WriteFromFile::WriteFromFile")()
 
@@ -844,8 +1001,8 @@ func (bb *BlockBlob) WriteFromFile(name string, metadata map[string]string, fi *
 
 	uploadOptions := azblob.UploadToBlockBlobOptions{
 		BlockSize:      blockSize,
-		Parallelism:    bb.Config.maxConcurrency,
-		Metadata:       metadata,
+		Parallelism:    bb.parallelism(),
+		Metadata:       removeTimeMetadata(metadata),
 		BlobAccessTier: bb.Config.defaultTier,
 		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
 			ContentType: getContentType(name),
@@ -858,7 +1015,12 @@ func (bb *BlockBlob) WriteFromFile(name string, metadata map[string]string, fi *
 		}
 	}
 
-	_, err = azblob.UploadFileToBlockBlob(context.Background(), fi, blobURL, uploadOptions)
+	// Uploads which need blocks are recorded so they can resume after a crash instead of starting over
+	if bb.Config.uploadState != nil && stat.Size() > azblob.BlockBlobMaxUploadBlobBytes {
+		err = bb.resumableUpload(name, fi, stat, uploadOptions, resumed)
+	} else {
+		_, err = azblob.UploadFileToBlockBlob(context.Background(), fi, blobURL, uploadOptions)
+	}
 
 	if err != nil {
 		serr := storeBlobErrToErr(err)
@@ -889,8 +1051,8 @@ func (bb *BlockBlob) WriteFromBuffer(name string, metadata map[string]string, da
 	defer log.TimeTrack(time.Now(), "BlockBlob::WriteFromBuffer", name)
 	_, err := azblob.UploadBufferToBlockBlob(context.Background(), data, blobURL, azblob.UploadToBlockBlobOptions{
 		BlockSize:      bb.Config.blockSize,
-		Parallelism:    bb.Config.maxConcurrency,
-		Metadata:       metadata,
+		Parallelism:    bb.parallelism(),
+		Metadata:       removeTimeMetadata(metadata),
 		BlobAccessTier: bb.Config.defaultTier,
 		BlobHTTPHeaders: azblob.BlobHTTPHeaders{
 			ContentType: getContentType(name),
@@ -930,7 +1092,7 @@ func (bb *BlockBlob) GetFileBlockOffsets(name string) (*common.BlockOffsetList,
 		blockOffset += block.Size
 		blockList.BlockList = append(blockList.BlockList, blk)
 	}
-	// blockList.Etag = storageBlockList.ETag()
+	blockList.Etag = string(storageBlockList.ETag())
 	blockList.BlockIdLength = common.GetIdLength(blockList.BlockList[0].Id)
 	return &blockList, nil
 }
@@ -980,7 +1142,7 @@ func (bb *BlockBlob) removeBlocks(blockList *common.BlockOffsetList, size int64,
 		blk.Data = make([]byte, blk.EndIndex-blk.StartIndex)
 		blk.Flags.Set(common.DirtyBlock)
 
-		err := bb.ReadInBuffer(name, blk.StartIndex, blk.EndIndex-blk.StartIndex, blk.Data)
+		err := bb.ReadInBuffer(name, blk.StartIndex, blk.EndIndex-blk.StartIndex, blk.Data, "")
 		if err != nil {
 			log.Err("BlockBlob::removeBlocks : Failed to remove blocks %s [%s]", name, err.Error())
 		}
@@ -1123,7 +1285,7 @@ func (bb *BlockBlob) Write(options internal.WriteFileOptions) error {
 		oldDataBuffer := make([]byte, oldDataSize+newBufferSize)
 		if !appendOnly {
 			// fetch the blocks that will be impacted by the new changes so we can overwrite them
-			err = bb.ReadInBuffer(name, fileOffsets.BlockList[index].StartIndex, oldDataSize, oldDataBuffer)
+			err = bb.ReadInBuffer(name, fileOffsets.BlockList[index].StartIndex, oldDataSize, oldDataBuffer, "")
 			if err != nil {
 				log.Err("BlockBlob::Write : Failed to read data in buffer %s [%s]", name, err.Error())
 			}
@@ -1173,6 +1335,15 @@ func (bb *BlockBlob) stageAndCommitModifiedBlocks(name string, data []byte, offs
 	return nil
 }
 
+// committedMetadata : Metadata of the blob, to be carried over when a new block list is committed
+func (bb *BlockBlob) committedMetadata(blobURL azblob.BlockBlobURL) azblob.Metadata {
+	prop, err := blobURL.GetProperties(context.Background(), bb.blobAccCond, bb.blobCPKOpt)
+	if err != nil {
+		return nil
+	}
+	return removeTimeMetadata(prop.NewMetadata())
+}
+
 func (bb *BlockBlob) StageAndCommit(name string, bol *common.BlockOffsetList) error {
 	// lock on the blob name so that no stage and commit race condition occur causing failure
 	blobMtx := bb.blockLocks.GetLock(name)
@@ -1180,75 +1351,276 @@ func (bb *BlockBlob) StageAndCommit(name string, bol *common.BlockOffsetList) er
 	defer blobMtx.Unlock()
 	blobURL := bb.Container.NewBlockBlobURL(filepath.Join(bb.Config.prefixPath, name))
 	var blockIDList []string
-	var data []byte
 	staged := false
+	if bb.Config.uploadState != nil {
+		staged = bb.recordStagedBlocks(name, blobURL, bol)
+	}
+	jobs := make(chan *common.Block, len(bol.BlockList))
 	for _, blk := range bol.BlockList {
 		blockIDList = append(blockIDList, blk.Id)
-		if blk.Truncated() {
-			data = make([]byte, blk.EndIndex-blk.StartIndex)
-			blk.Flags.Clear(common.TruncatedBlock)
-		} else {
-			data = blk.Data
-		}
 		if blk.Dirty() {
-			_, err := blobURL.StageBlock(context.Background(),
-				blk.Id,
-				bytes.NewReader(data),
-				bb.blobAccCond.LeaseAccessConditions,
-				nil,
-				bb.downloadOptions.ClientProvidedKeyOptions)
-			if err != nil {
-				log.Err("BlockBlob::StageAndCommit : Failed to stage to blob %s with ID %s at block %v [%s]", name, blk.Id, blk.StartIndex, err.Error())
-				return err
-			}
-			staged = true
-			blk.Flags.Clear(common.DirtyBlock)
+			jobs <- blk
 		}
 	}
+	close(jobs)
+
+	if len(jobs) > 0 {
+		// Stage dirty blocks in parallel, fewer at a time while the service is throttling us
+		workers := int(bb.parallelism())
+		if workers <= 0 {
+			workers = 1
+		}
+
+		var wg sync.WaitGroup
+		var errMtx sync.Mutex
+		var stageErr error
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for blk := range jobs {
+					err := bb.stageBlock(name, blobURL, blk)
+					if err != nil {
+						errMtx.Lock()
+						if stageErr == nil {
+							stageErr = err
+						}
+						errMtx.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		if stageErr != nil {
+			return stageErr
+		}
+		staged = true
+	}
 	if staged {
-		_, err := blobURL.CommitBlockList(context.Background(),
+		// Blocks of the list which were not staged again may only be valid for the version of the blob they were read
+		// from. Others, like stream, keep the list of an open file across changes to its metadata and commit regardless.
+		accCond := bb.blobAccCond
+		if bol.MatchEtag() && bol.Etag != "" {
+			accCond.ModifiedAccessConditions.IfMatch = azblob.ETag(bol.Etag)
+		}
+		resp, err := blobURL.CommitBlockList(context.Background(),
 			blockIDList,
 			azblob.BlobHTTPHeaders{ContentType: getContentType(name)},
-			nil,
-			bb.blobAccCond,
-			// azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: bol.Etag}},
+			bb.committedMetadata(blobURL),
+			accCond,
 			bb.Config.defaultTier,
 			nil, // datalake doesn't support tags here
 			bb.downloadOptions.ClientProvidedKeyOptions)
 		if err != nil {
+			if stgErr, ok := err.(azblob.StorageError); ok && stgErr.ServiceCode() == azblob.ServiceCodeConditionNotMet {
+				log.Err("BlockBlob::StageAndCommit : %s changed since its block list was read", name)
+				return syscall.ESTALE
+			}
 			log.Err("BlockBlob::StageAndCommit : Failed to commit block list to blob %s [%s]", name, err.Error())
 			return err
 		}
-		// update the etag
-		// bol.Etag = resp.ETag()
+		if bb.Config.uploadState != nil {
+			bb.Config.uploadState.remove(name)
+		}
+		bol.Etag = string(resp.ETag())
 	}
 	return nil
 }
 
-// ChangeMod : Change mode of a blob
-func (bb *BlockBlob) ChangeMod(name string, _ os.FileMode) error {
-	log.Trace("BlockBlob::ChangeMod : name %s", name)
+// stageBlock : Stage a dirty block of the list, a truncated block is staged as zeroes
+func (bb *BlockBlob) stageBlock(name string, blobURL azblob.BlockBlobURL, blk *common.Block) error {
+	data := blk.Data
+	if blk.Truncated() {
+		data = make([]byte, blk.EndIndex-blk.StartIndex)
+	}
+	_, err := blobURL.StageBlock(context.Background(),
+		blk.Id,
+		bytes.NewReader(data),
+		bb.blobAccCond.LeaseAccessConditions,
+		nil,
+		bb.downloadOptions.ClientProvidedKeyOptions)
+	if err != nil {
+		log.Err("BlockBlob::StageAndCommit : Failed to stage to blob %s with ID %s at block %v [%s]", name, blk.Id, blk.StartIndex, err.Error())
+		return err
+	}
+	blk.Flags.Clear(common.TruncatedBlock)
+	blk.Flags.Clear(common.DirtyBlock)
+	return nil
+}
+
+// ChangeMod : Save the new permission bits of a blob in its metadata
+func (bb *BlockBlob) ChangeMod(name string, mode os.FileMode) error {
+	log.Trace("BlockBlob::ChangeMod : name %s, mode %s", name, mode.String())
 
-	if bb.Config.ignoreAccessModifiers {
-		// for operations like git clone where transaction fails if chmod is not successful
-		// return success instead of ENOSYS
+	err := bb.updatePosixMetadata(name, newPosixMetadata(&mode, -1, -1, time.Time{}, time.Time{}))
+	if err == syscall.ENOENT && bb.Config.ignoreAccessModifiers {
+		// Virtual directories and files not yet uploaded have no metadata to keep the mode in.
+		// For operations like git clone where transaction fails if chmod is not successful return success.
 		return nil
 	}
-
-	// This is not currently supported for a flat namespace account
-	return syscall.ENOTSUP
+	return err
 }
 
-// ChangeOwner : Change owner of a blob
-func (bb *BlockBlob) ChangeOwner(name string, _ int, _ int) error {
-	log.Trace("BlockBlob::ChangeOwner : name %s", name)
+// ChangeOwner : Save the new owner and group of a blob in its metadata
+func (bb *BlockBlob) ChangeOwner(name string, owner int, group int) error {
+	log.Trace("BlockBlob::ChangeOwner : name %s, owner %d, group %d", name, owner, group)
 
-	if bb.Config.ignoreAccessModifiers {
+	err := bb.updatePosixMetadata(name, newPosixMetadata(nil, owner, group, time.Time{}, time.Time{}))
+	if err == syscall.ENOENT && bb.Config.ignoreAccessModifiers {
 		// for operations like git clone where transaction fails if chown is not successful
-		// return success instead of ENOSYS
+		// return success instead of ENOENT
 		return nil
 	}
+	return err
+}
+
+// ChangeTimes : Save the new access and modification time of a blob in its metadata, zero time is left unchanged
+func (bb *BlockBlob) ChangeTimes(name string, atime time.Time, mtime time.Time) error {
+	log.Trace("BlockBlob::ChangeTimes : name %s, atime %s, mtime %s", name, atime.String(), mtime.String())
+	return bb.updatePosixMetadata(name, newPosixMetadata(nil, -1, -1, atime, mtime))
+}
 
-	// This is not currently supported for a flat namespace account
+// GetACL : Access control lists are not supported for block blob
+func (bb *BlockBlob) GetACL(_ string) (string, error) {
+	return "", syscall.ENOTSUP
+}
+
+// SetACL : Access control lists are not supported for block blob
+func (bb *BlockBlob) SetACL(_ string, _ string) error {
 	return syscall.ENOTSUP
 }
+
+// GetTags : Get the index tags of a blob
+func (bb *BlockBlob) GetTags(name string) (map[string]string, error) {
+	log.Trace("BlockBlob::GetTags : name %s", name)
+	blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, name))
+
+	resp, err := blobURL.GetTags(context.Background(), nil)
+	if err != nil {
+		e := storeBlobErrToErr(err)
+		if e == ErrFileNotFound {
+			return nil, syscall.ENOENT
+		}
+		log.Err("BlockBlob::GetTags : Failed to get tags of %s [%s]", name, err.Error())
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(resp.BlobTagSet))
+	for _, tag := range resp.BlobTagSet {
+		tags[tag.Key] = tag.Value
+	}
+
+	return tags, nil
+}
+
+// SetTags : Replace all index tags of a blob
+func (bb *BlockBlob) SetTags(name string, tags map[string]string) error {
+	log.Trace("BlockBlob::SetTags : name %s, %d tags", name, len(tags))
+	blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, name))
+
+	_, err := blobURL.SetTags(context.Background(), nil, nil, nil, azblob.BlobTagsMap(tags))
+	if err != nil {
+		e := storeBlobErrToErr(err)
+		if e == ErrFileNotFound {
+			return syscall.ENOENT
+		} else if e == InvalidArgument {
+			return syscall.EINVAL
+		}
+		log.Err("BlockBlob::SetTags : Failed to set tags of %s [%s]", name, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// FindBlobsByTags : Get the paths of all blobs in the container (and under prefix path) matching the tag expression
+func (bb *BlockBlob) FindBlobsByTags(expr string) ([]string, error) {
+	log.Trace("BlockBlob::FindBlobsByTags : expression %s", expr)
+
+	where := fmt.Sprintf("@container='%s' AND %s", bb.Config.container, expr)
+	prefix := ""
+	if bb.Config.prefixPath != "" {
+		prefix = internal.ExtendDirName(bb.Config.prefixPath)
+	}
+
+	var maxResults int32 = common.MaxDirListCount
+	names := make([]string, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		resp, err := bb.Service.FindBlobsByTags(context.Background(), nil, nil, &where, marker, &maxResults)
+		if err != nil {
+			if storeBlobErrToErr(err) == InvalidArgument {
+				log.Err("BlockBlob::FindBlobsByTags : Invalid expression %s [%s]", expr, err.Error())
+				return nil, syscall.EINVAL
+			}
+			log.Err("BlockBlob::FindBlobsByTags : Failed to query %s [%s]", expr, err.Error())
+			return nil, err
+		}
+
+		for _, blob := range resp.Blobs {
+			if blob.ContainerName != bb.Config.container || !strings.HasPrefix(blob.Name, prefix) {
+				continue
+			}
+			names = append(names, strings.TrimPrefix(blob.Name, prefix))
+		}
+		marker = azblob.Marker{Val: resp.NextMarker}
+	}
+
+	return names, nil
+}
+
+// updatePosixMetadata : Merge the given keys in existing metadata of the blob
+func (bb *BlockBlob) updatePosixMetadata(name string, update map[string]string) error {
+	if len(update) == 0 {
+		return nil
+	}
+
+	blobURL := bb.Container.NewBlockBlobURL(filepath.Join(bb.Config.prefixPath, name))
+
+	// Metadata can only be replaced as a whole, so retry if someone else updated the blob in between
+	const maxAttempts = 3
+	var err error
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var prop *azblob.BlobGetPropertiesResponse
+		prop, err = blobURL.GetProperties(context.Background(), bb.blobAccCond, bb.blobCPKOpt)
+		if err != nil {
+			if storeBlobErrToErr(err) == ErrFileNotFound {
+				// Directory without a marker blob or a file which is not yet uploaded
+				log.Err("BlockBlob::updatePosixMetadata : %s does not exist", name)
+				return syscall.ENOENT
+			}
+			log.Err("BlockBlob::updatePosixMetadata : Failed to get blob properties for %s [%s]", name, err.Error())
+			return err
+		}
+
+		metadata := prop.NewMetadata()
+		for k := range metadata {
+			if _, found := update[strings.ToLower(k)]; found {
+				delete(metadata, k)
+			}
+		}
+		for k, v := range update {
+			metadata[k] = v
+		}
+		_, uidSet := update[posixUidKey]
+		_, gidSet := update[posixGidKey]
+		if uidSet || gidSet {
+			fillPosixOwner(metadata)
+		}
+
+		_, err = blobURL.SetMetadata(context.Background(), metadata,
+			azblob.BlobAccessConditions{ModifiedAccessConditions: azblob.ModifiedAccessConditions{IfMatch: prop.ETag()}},
+			bb.blobCPKOpt)
+		if err == nil {
+			return nil
+		}
+
+		if stgErr, ok := err.(azblob.StorageError); !ok || stgErr.ServiceCode() != azblob.ServiceCodeConditionNotMet {
+			break
+		}
+		log.Debug("BlockBlob::updatePosixMetadata : %s modified while updating metadata, retrying", name)
+	}
+
+	log.Err("BlockBlob::updatePosixMetadata : Failed to set metadata of %s [%s]", name, err.Error())
+	return err
+}
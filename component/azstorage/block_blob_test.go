@@ -46,6 +46,7 @@ import (
 	"io"
 	"io/ioutil"
 	"math/rand"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -826,6 +827,146 @@ func (s *blockBlobTestSuite) TestRenameDirHierarchy() {
 	}
 }
 
+func (s *blockBlobTestSuite) TestRenameDirJournalRemoved() {
+	defer s.cleanupTest()
+	// Setup
+	baseSrc := generateDirectoryName()
+	s.setupHierarchy(baseSrc)
+	baseDst := generateDirectoryName()
+
+	err := s.az.RenameDir(internal.RenameDirOptions{Src: baseSrc, Dst: baseDst})
+	s.assert.Nil(err)
+
+	journal := &renameJournal{Source: baseSrc, Target: baseDst}
+	_, err = s.containerUrl.NewBlobURL(journal.journalPath()).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+}
+
+func (s *blockBlobTestSuite) TestRenameDirNoMarker() {
+	defer s.cleanupTest()
+	// Setup
+	baseSrc := generateDirectoryName()
+	name := generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: baseSrc + "/" + name})
+	baseDst := generateDirectoryName()
+
+	// Directory exists only through the blob in it
+	_, err := s.containerUrl.NewBlobURL(baseSrc).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+
+	err = s.az.RenameDir(internal.RenameDirOptions{Src: baseSrc, Dst: baseDst})
+	s.assert.Nil(err)
+
+	_, err = s.containerUrl.NewBlobURL(baseDst+"/"+name).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.Nil(err)
+	_, err = s.containerUrl.NewBlobURL(baseSrc+"/"+name).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+
+	journal := &renameJournal{Source: baseSrc, Target: baseDst}
+	_, err = s.containerUrl.NewBlobURL(journal.journalPath()).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+}
+
+func (s *blockBlobTestSuite) TestRenameDirRecoverResume() {
+	defer s.cleanupTest()
+	// Setup
+	baseSrc := generateDirectoryName()
+	aSrc, _, _ := s.setupHierarchy(baseSrc)
+	baseDst := generateDirectoryName()
+	aDst, _, _ := generateNestedDirectory(baseDst)
+
+	// Simulate a rename which got interrupted after moving one blob
+	bb := s.az.storage.(*BlockBlob)
+	journal := &renameJournal{Source: baseSrc, Target: baseDst, StartTime: time.Now()}
+	err := bb.writeRenameJournal(journal)
+	s.assert.Nil(err)
+	err = bb.RenameFile(baseSrc+"/c2", baseDst+"/c2")
+	s.assert.Nil(err)
+
+	// Journal shall not show up in the listing
+	entries, _, err := bb.List("", nil, 0)
+	s.assert.Nil(err)
+	for _, entry := range entries {
+		s.assert.False(isRenameJournalPath(entry.Path))
+	}
+
+	err = bb.RecoverRenames()
+	s.assert.Nil(err)
+
+	for p := aSrc.Front(); p != nil; p = p.Next() {
+		_, err = s.containerUrl.NewBlobURL(p.Value.(string)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		s.assert.NotNil(err)
+	}
+	for p := aDst.Front(); p != nil; p = p.Next() {
+		_, err = s.containerUrl.NewBlobURL(p.Value.(string)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		s.assert.Nil(err)
+	}
+	_, err = s.containerUrl.NewBlobURL(journal.journalPath()).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+}
+
+func (s *blockBlobTestSuite) TestRenameDirRecoverRollback() {
+	defer s.cleanupTest()
+	// Setup
+	baseSrc := generateDirectoryName()
+	aSrc, _, _ := s.setupHierarchy(baseSrc)
+	baseDst := generateDirectoryName()
+	aDst, _, _ := generateNestedDirectory(baseDst)
+
+	// Simulate a rename which got interrupted after moving one blob
+	bb := s.az.storage.(*BlockBlob)
+	bb.Config.renameRollback = true
+	journal := &renameJournal{Source: baseSrc, Target: baseDst, StartTime: time.Now()}
+	err := bb.writeRenameJournal(journal)
+	s.assert.Nil(err)
+	err = bb.RenameFile(baseSrc+"/c2", baseDst+"/c2")
+	s.assert.Nil(err)
+
+	err = bb.RecoverRenames()
+	s.assert.Nil(err)
+
+	for p := aSrc.Front(); p != nil; p = p.Next() {
+		_, err = s.containerUrl.NewBlobURL(p.Value.(string)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		s.assert.Nil(err)
+	}
+	for p := aDst.Front(); p != nil; p = p.Next() {
+		_, err = s.containerUrl.NewBlobURL(p.Value.(string)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		s.assert.NotNil(err)
+	}
+	_, err = s.containerUrl.NewBlobURL(journal.journalPath()).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.NotNil(err)
+}
+
+func (s *blockBlobTestSuite) TestRenameDirRecoverSkipLeased() {
+	defer s.cleanupTest()
+	// Setup
+	baseSrc := generateDirectoryName()
+	aSrc, _, _ := s.setupHierarchy(baseSrc)
+	baseDst := generateDirectoryName()
+
+	// Simulate a rename which is still in progress on another mount
+	bb := s.az.storage.(*BlockBlob)
+	journal := &renameJournal{Source: baseSrc, Target: baseDst, StartTime: time.Now()}
+	err := bb.writeRenameJournal(journal)
+	s.assert.Nil(err)
+	release, err := bb.leaseRenameJournal(journal)
+	s.assert.Nil(err)
+
+	err = bb.RecoverRenames()
+	s.assert.Nil(err)
+
+	for p := aSrc.Front(); p != nil; p = p.Next() {
+		_, err = s.containerUrl.NewBlobURL(p.Value.(string)).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+		s.assert.Nil(err)
+	}
+	_, err = s.containerUrl.NewBlobURL(journal.journalPath()).GetProperties(ctx, azblob.BlobAccessConditions{}, azblob.ClientProvidedKeyOptions{})
+	s.assert.Nil(err)
+
+	err = bb.deleteRenameJournal(journal)
+	s.assert.Nil(err)
+	release()
+}
+
 func (s *blockBlobTestSuite) TestRenameDirSubDirPrefixPath() {
 	defer s.cleanupTest()
 	// Setup
@@ -1966,16 +2107,37 @@ func (s *blockBlobTestSuite) TestGetAttrError() {
 	}
 }
 
-// If support for chown or chmod are ever added to blob, add tests for error cases and modify the following tests.
 func (s *blockBlobTestSuite) TestChmod() {
 	defer s.cleanupTest()
 	// Setup
 	name := generateFileName()
 	s.az.CreateFile(internal.CreateFileOptions{Name: name})
 
+	err := s.az.Chmod(internal.ChmodOptions{Name: name, Mode: 0666})
+	s.assert.Nil(err)
+
+	attr, err := s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.False(attr.IsModeDefault())
+	s.assert.EqualValues(0666, attr.Mode.Perm())
+
+	// Setuid, setgid and sticky bits are kept
+	err = s.az.Chmod(internal.ChmodOptions{Name: name, Mode: 07755})
+	s.assert.Nil(err)
+
+	attr, err = s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.EqualValues(07755, attr.Mode&posixModeMask)
+}
+
+func (s *blockBlobTestSuite) TestChmodNotExists() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+
 	err := s.az.Chmod(internal.ChmodOptions{Name: name, Mode: 0666})
 	s.assert.NotNil(err)
-	s.assert.EqualValues(syscall.ENOTSUP, err)
+	s.assert.EqualValues(syscall.ENOENT, err)
 }
 
 func (s *blockBlobTestSuite) TestChmodIgnore() {
@@ -1991,6 +2153,10 @@ func (s *blockBlobTestSuite) TestChmodIgnore() {
 
 	err := s.az.Chmod(internal.ChmodOptions{Name: name, Mode: 0666})
 	s.assert.Nil(err)
+
+	// Blob which does not exist, like a virtual directory, has no metadata to keep the mode in
+	err = s.az.Chmod(internal.ChmodOptions{Name: generateFileName(), Mode: 0666})
+	s.assert.Nil(err)
 }
 
 func (s *blockBlobTestSuite) TestChown() {
@@ -2000,8 +2166,183 @@ func (s *blockBlobTestSuite) TestChown() {
 	s.az.CreateFile(internal.CreateFileOptions{Name: name})
 
 	err := s.az.Chown(internal.ChownOptions{Name: name, Owner: 6, Group: 5})
-	s.assert.NotNil(err)
+	s.assert.Nil(err)
+
+	attr, err := s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.True(attr.IsOwnerSet())
+	s.assert.EqualValues(6, attr.Uid)
+	s.assert.EqualValues(5, attr.Gid)
+
+	// Mode shall be retained when owner is changed
+	err = s.az.Chmod(internal.ChmodOptions{Name: name, Mode: 0700})
+	s.assert.Nil(err)
+	err = s.az.Chown(internal.ChownOptions{Name: name, Owner: 7, Group: -1})
+	s.assert.Nil(err)
+
+	attr, err = s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.EqualValues(0700, attr.Mode.Perm())
+	s.assert.EqualValues(7, attr.Uid)
+	s.assert.EqualValues(5, attr.Gid)
+
+	// Blob which has no owner saved keeps showing the mounting user's group when only the owner is changed
+	name = generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+	_, gid, err := common.GetCurrentUser()
+	s.assert.Nil(err)
+
+	err = s.az.Chown(internal.ChownOptions{Name: name, Owner: 8, Group: -1})
+	s.assert.Nil(err)
+
+	attr, err = s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.True(attr.IsOwnerSet())
+	s.assert.EqualValues(8, attr.Uid)
+	s.assert.EqualValues(gid, attr.Gid)
+}
+
+func (s *blockBlobTestSuite) TestPosixACLNotSupported() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+
+	_, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLAccessXattr})
 	s.assert.EqualValues(syscall.ENOTSUP, err)
+
+	names, err := s.az.ListXattr(internal.ListXattrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.Empty(names)
+}
+
+func (s *blockBlobTestSuite) TestBlobTagXattr() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+
+	_, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: "user.tag.dataset"})
+	s.assert.EqualValues(syscall.ENODATA, err)
+
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: "user.tag.dataset", Value: []byte("train")})
+	s.assert.Nil(err)
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: "user.tag.dataset", Value: []byte("test"), Flags: xattrCreate})
+	s.assert.EqualValues(syscall.EEXIST, err)
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: "user.tag.split", Value: []byte("a"), Flags: xattrReplace})
+	s.assert.EqualValues(syscall.ENODATA, err)
+
+	value, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: "user.tag.dataset"})
+	s.assert.Nil(err)
+	s.assert.EqualValues("train", value)
+
+	names, err := s.az.ListXattr(internal.ListXattrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.Equal([]string{"user.tag.dataset"}, names)
+
+	err = s.az.RemoveXattr(internal.RemoveXattrOptions{Name: name, Attr: "user.tag.dataset"})
+	s.assert.Nil(err)
+	err = s.az.RemoveXattr(internal.RemoveXattrOptions{Name: name, Attr: "user.tag.dataset"})
+	s.assert.EqualValues(syscall.ENODATA, err)
+}
+
+func (s *blockBlobTestSuite) TestBlobTagXattrNotExists() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+
+	_, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: "user.tag.dataset"})
+	s.assert.EqualValues(syscall.ENOENT, err)
+
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: "user.tag.dataset", Value: []byte("train")})
+	s.assert.EqualValues(syscall.ENOENT, err)
+}
+
+func (s *blockBlobTestSuite) TestTagQueryDir() {
+	defer s.cleanupTest()
+	// Setup
+	s.az.stConfig.tagQueryDir = ".query"
+	dir := generateDirectoryName()
+	tagged := dir + "/" + generateFileName()
+	untagged := dir + "/" + generateFileName()
+	data := []byte("test data")
+	s.az.storage.WriteFromBuffer(tagged, nil, data)
+	s.az.storage.WriteFromBuffer(untagged, nil, data)
+	err := s.az.SetXattr(internal.SetXattrOptions{Name: tagged, Attr: "user.tag.dataset", Value: []byte(s.container)})
+	s.assert.Nil(err)
+
+	query := ".query/" + url.PathEscape(fmt.Sprintf("\"dataset\"='%s'", s.container))
+
+	// Index tags are indexed asynchronously, so wait for the blob to show up in the query
+	var list []*internal.ObjAttr
+	for i := 0; i < 30; i++ {
+		s.az.tagQueries.clear()
+		list, _, err = s.az.StreamDir(internal.StreamDirOptions{Name: query})
+		s.assert.Nil(err)
+		if len(list) != 0 {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
+	s.assert.Len(list, 1)
+	s.assert.Equal(dir, list[0].Name)
+	s.assert.True(list[0].IsDir())
+
+	list, _, err = s.az.StreamDir(internal.StreamDirOptions{Name: query + "/" + dir})
+	s.assert.Nil(err)
+	s.assert.Len(list, 1)
+	s.assert.Equal(query+"/"+tagged, list[0].Path)
+	s.assert.EqualValues(len(data), list[0].Size)
+
+	_, err = s.az.GetAttr(internal.GetAttrOptions{Name: query + "/" + untagged})
+	s.assert.EqualValues(syscall.ENOENT, err)
+
+	h, err := s.az.OpenFile(internal.OpenFileOptions{Name: query + "/" + tagged})
+	s.assert.Nil(err)
+	output, err := s.az.ReadFile(internal.ReadFileOptions{Handle: h})
+	s.assert.Nil(err)
+	s.assert.EqualValues(data, output)
+
+	_, err = s.az.OpenFile(internal.OpenFileOptions{Name: query + "/" + tagged, Flags: os.O_RDWR})
+	s.assert.EqualValues(syscall.EROFS, err)
+	err = s.az.DeleteFile(internal.DeleteFileOptions{Name: query + "/" + tagged})
+	s.assert.EqualValues(syscall.EROFS, err)
+}
+
+func (s *blockBlobTestSuite) TestTagQueryDirInvalid() {
+	defer s.cleanupTest()
+	// Setup
+	s.az.stConfig.tagQueryDir = ".query"
+
+	attr, err := s.az.GetAttr(internal.GetAttrOptions{Name: ".query"})
+	s.assert.Nil(err)
+	s.assert.True(attr.IsDir())
+
+	_, err = s.az.GetAttr(internal.GetAttrOptions{Name: ".query/" + url.PathEscape("dataset = ")})
+	s.assert.EqualValues(syscall.EINVAL, err)
+}
+
+func (s *blockBlobTestSuite) TestSetAttrTimes() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+
+	err := s.az.SetAttr(internal.SetAttrOptions{Name: name, Attr: &internal.ObjAttr{Mtime: mtime}})
+	s.assert.Nil(err)
+
+	attr, err := s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.True(attr.Mtime.Equal(mtime))
+
+	// Uploading new content resets the modification time
+	err = s.az.storage.WriteFromBuffer(name, attr.Metadata, []byte("data"))
+	s.assert.Nil(err)
+
+	attr, err = s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.False(attr.Mtime.Equal(mtime))
 }
 
 func (s *blockBlobTestSuite) TestChownIgnore() {
@@ -2017,6 +2358,9 @@ func (s *blockBlobTestSuite) TestChownIgnore() {
 
 	err := s.az.Chown(internal.ChownOptions{Name: name, Owner: 6, Group: 5})
 	s.assert.Nil(err)
+
+	err = s.az.Chown(internal.ChownOptions{Name: generateFileName(), Owner: 6, Group: 5})
+	s.assert.Nil(err)
 }
 
 func (s *blockBlobTestSuite) TestBlockSize() {
@@ -2224,7 +2568,7 @@ func (s *blockBlobTestSuite) TestFlushFileUpdateChunkedFile() {
 	updatedBlock := make([]byte, 2*MB)
 	rand.Read(updatedBlock)
 	h.CacheObj.BlockOffsetList.BlockList[1].Data = make([]byte, blockSize)
-	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize), h.CacheObj.BlockOffsetList.BlockList[1].Data)
+	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize), h.CacheObj.BlockOffsetList.BlockList[1].Data, "")
 	copy(h.CacheObj.BlockOffsetList.BlockList[1].Data[MB:2*MB+MB], updatedBlock)
 	h.CacheObj.BlockOffsetList.BlockList[1].Flags.Set(common.DirtyBlock)
 
@@ -2239,6 +2583,51 @@ func (s *blockBlobTestSuite) TestFlushFileUpdateChunkedFile() {
 	s.assert.EqualValues(data[7*MB:], output[7*MB:])
 }
 
+func (s *blockBlobTestSuite) TestFlushFileResumesFailedFlush() {
+	defer s.cleanupTest()
+
+	// Setup
+	name := generateFileName()
+	blockSize := 4 * MB
+	h, _ := s.az.CreateFile(internal.CreateFileOptions{Name: name})
+	data := make([]byte, 16*MB)
+	rand.Read(data)
+
+	_, err := uploadReaderAtToBlockBlob(ctx, bytes.NewReader(data), int64(len(data)), 4, s.containerUrl.NewBlockBlobURL(name), azblob.UploadToBlockBlobOptions{
+		BlockSize: int64(blockSize),
+	})
+	s.assert.Nil(err)
+	bol, _ := s.az.GetFileBlockOffsets(internal.GetFileBlockOffsetsOptions{Name: name})
+	handlemap.CreateCacheObject(int64(16*MB), h)
+	h.CacheObj.BlockOffsetList = bol
+
+	bb := s.az.storage.(*BlockBlob)
+	root := filepath.Join(os.TempDir(), "upload_state_"+name)
+	store, err := newUploadStateStore(root, bb.Config.authConfig.AccountName, bb.Config.container, bb.Config.prefixPath)
+	s.assert.Nil(err)
+	defer os.RemoveAll(root)
+	bb.Config.uploadState = store
+	defer func() { bb.Config.uploadState = nil }()
+
+	// An earlier flush recorded the block but failed before it reached the service, and the block is no longer dirty
+	updatedBlock := make([]byte, blockSize)
+	rand.Read(updatedBlock)
+	blk := h.CacheObj.BlockOffsetList.BlockList[1]
+	blk.Data = updatedBlock
+	err = store.save(&uploadState{Name: name, Blocks: []stagedBlock{{Id: blk.Id, Offset: blk.StartIndex, Size: blk.EndIndex - blk.StartIndex}}})
+	s.assert.Nil(err)
+
+	err = s.az.FlushFile(internal.FlushFileOptions{Handle: h})
+	s.assert.Nil(err)
+	s.assert.Nil(store.load(name))
+
+	output, err := s.az.ReadFile(internal.ReadFileOptions{Handle: h})
+	s.assert.Nil(err)
+	s.assert.EqualValues(data[:4*MB], output[:4*MB])
+	s.assert.EqualValues(updatedBlock, output[4*MB:8*MB])
+	s.assert.EqualValues(data[8*MB:], output[8*MB:])
+}
+
 func (s *blockBlobTestSuite) TestFlushFileTruncateUpdateChunkedFile() {
 	defer s.cleanupTest()
 
@@ -2261,7 +2650,7 @@ func (s *blockBlobTestSuite) TestFlushFileTruncateUpdateChunkedFile() {
 	// truncate block
 	h.CacheObj.BlockOffsetList.BlockList[1].Data = make([]byte, blockSize/2)
 	h.CacheObj.BlockOffsetList.BlockList[1].EndIndex = int64(blockSize + blockSize/2)
-	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize)/2, h.CacheObj.BlockOffsetList.BlockList[1].Data)
+	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize)/2, h.CacheObj.BlockOffsetList.BlockList[1].Data, "")
 	h.CacheObj.BlockOffsetList.BlockList[1].Flags.Set(common.DirtyBlock)
 
 	// remove 2 blocks
@@ -0,0 +1,205 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	defaultCircuitBreakerThreshold = 10
+	defaultCircuitBreakerProbeSec  = 10
+
+	circuitClosed = "closed"
+	circuitOpen   = "open"
+)
+
+// errCircuitOpen : Returned without sending the request while storage is unreachable. This is not a net.Error so the
+// retry policy gives up on it right away, and it wraps ENOTCONN so callers can tell storage was not reached.
+var errCircuitOpen = fmt.Errorf("storage unreachable, circuit breaker is open [%w]", syscall.ENOTCONN)
+
+// circuitBreaker : Stops sending requests to storage after repeated transport failures so that calls fail fast instead
+// of waiting through the whole retry budget. While open, storage is probed in background and the breaker closes on the
+// first successful probe.
+type circuitBreaker struct {
+	sync.Mutex
+	threshold int
+	interval  time.Duration
+	probe     func(ctx context.Context) error
+
+	failures int
+	open     bool
+	done     chan struct{}
+}
+
+// newCircuitBreaker : Create a closed breaker which opens after given consecutive transport failures
+func newCircuitBreaker(threshold int, interval time.Duration, probe func(ctx context.Context) error) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		interval:  interval,
+		probe:     probe,
+		done:      make(chan struct{}),
+	}
+}
+
+// newEndpointProbe : Probe which succeeds when the storage endpoint returns any http response
+func newEndpointProbe(client *http.Client, endpoint string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, endpoint, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		return resp.Body.Close()
+	}
+}
+
+// allow : Check whether a request can be sent to storage
+func (cb *circuitBreaker) allow() bool {
+	cb.Lock()
+	defer cb.Unlock()
+	return !cb.open
+}
+
+// isOpen : Check whether calls are being failed fast
+func (cb *circuitBreaker) isOpen() bool {
+	return cb != nil && !cb.allow()
+}
+
+// record : Count the outcome of a request, err is set only when no response was received
+func (cb *circuitBreaker) record(err error) {
+	cb.Lock()
+	defer cb.Unlock()
+
+	if err == nil {
+		cb.failures = 0
+		return
+	}
+
+	// Requests abandoned by the caller say nothing about health of storage
+	if errors.Is(err, context.Canceled) {
+		return
+	}
+
+	cb.failures++
+	if cb.open || cb.failures < cb.threshold {
+		return
+	}
+
+	log.Err("circuitBreaker::record : Opening circuit after %d consecutive failures [%s]", cb.failures, err.Error())
+	cb.open = true
+	cb.exportState(circuitOpen)
+	if azStatsCollector != nil {
+		azStatsCollector.UpdateStats(stats_manager.Increment, circuitTrips, (int64)(1))
+	}
+
+	go cb.probeLoop()
+}
+
+// probeLoop : Probe storage till it responds and then close the circuit
+func (cb *circuitBreaker) probeLoop() {
+	ticker := time.NewTicker(cb.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-cb.done:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), cb.interval)
+		err := cb.probe(ctx)
+		cancel()
+
+		if err != nil {
+			log.Debug("circuitBreaker::probeLoop : Storage still unreachable [%s]", err.Error())
+			continue
+		}
+
+		cb.Lock()
+		cb.open = false
+		cb.failures = 0
+		cb.exportState(circuitClosed)
+		cb.Unlock()
+
+		log.Info("circuitBreaker::probeLoop : Storage reachable again, circuit closed")
+		return
+	}
+}
+
+// stop : End background probing
+func (cb *circuitBreaker) stop() {
+	cb.Lock()
+	defer cb.Unlock()
+
+	select {
+	case <-cb.done:
+	default:
+		close(cb.done)
+	}
+}
+
+// exportState : Publish state of the breaker, caller must hold the lock unless the breaker is not in use yet
+func (cb *circuitBreaker) exportState(state string) {
+	if azStatsCollector != nil {
+		azStatsCollector.UpdateStats(stats_manager.Replace, circuitState, state)
+	}
+}
+
+// circuitErr : Errors from requests failed fast by the breaker are reported as ENOTCONN so that callers above can
+// tell an outage apart from a failed operation
+func (az *AzStorage) circuitErr(err error) error {
+	if err == nil || !az.stConfig.breaker.isOpen() {
+		return err
+	}
+
+	if _, ok := err.(syscall.Errno); ok {
+		return err
+	}
+	return syscall.ENOTCONN
+}
@@ -0,0 +1,208 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	// Parallelism used by the SDK for a transfer when max-concurrency is not configured
+	sdkDefaultParallelism = 5
+
+	// Throttling responses within this window of a decrease are treated as the same congestion event
+	concurrencyDecreaseWindow = time.Second
+
+	// Upper bound on the time all transfers are paused for a Retry-After from the service
+	maxRetryAfter = time.Minute
+)
+
+// concurrencyController : AIMD controller for the parallelism of transfers. Parallelism is halved when the service
+// throttles us and grows by one after a round of successful requests. Retry-After sent by the service pauses all
+// requests going through the pipeline till it has passed.
+type concurrencyController struct {
+	sync.Mutex
+	ceiling      int
+	limit        int
+	successes    int
+	lastDecrease time.Time
+	pauseUntil   time.Time
+}
+
+// newConcurrencyController : Create a controller which starts at the configured parallelism
+func newConcurrencyController(maxConcurrency uint16) *concurrencyController {
+	cc := &concurrencyController{}
+	cc.setCeiling(maxConcurrency)
+	return cc
+}
+
+// setCeiling : Change the configured parallelism, current limit is brought within it
+func (cc *concurrencyController) setCeiling(maxConcurrency uint16) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	cc.ceiling = int(maxConcurrency)
+	if cc.ceiling == 0 {
+		cc.ceiling = sdkDefaultParallelism
+	}
+	if cc.limit == 0 || cc.limit > cc.ceiling {
+		cc.limit = cc.ceiling
+	}
+}
+
+// parallelism : Number of parallel requests a transfer shall use now
+func (cc *concurrencyController) parallelism() uint16 {
+	cc.Lock()
+	defer cc.Unlock()
+	return uint16(cc.limit)
+}
+
+// wait : Block while the service has asked us to back off
+func (cc *concurrencyController) wait(ctx context.Context) error {
+	cc.Lock()
+	delay := time.Until(cc.pauseUntil)
+	cc.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// onResponse : Adjust the limit based on the outcome of a request
+func (cc *concurrencyController) onResponse(resp *http.Response) {
+	if resp == nil {
+		return
+	}
+
+	if isThrottled(resp.StatusCode) {
+		if azStatsCollector != nil {
+			azStatsCollector.UpdateStats(stats_manager.Increment, throttledResponses, (int64)(1))
+		}
+		cc.onThrottled(parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()))
+	} else if resp.StatusCode < 300 {
+		cc.onSuccess()
+	}
+}
+
+// onThrottled : Multiplicative decrease and pause for the time asked by the service
+func (cc *concurrencyController) onThrottled(retryAfter time.Duration) {
+	cc.Lock()
+	defer cc.Unlock()
+
+	now := time.Now()
+	if retryAfter > 0 && now.Add(retryAfter).After(cc.pauseUntil) {
+		cc.pauseUntil = now.Add(retryAfter)
+	}
+
+	if now.Sub(cc.lastDecrease) < concurrencyDecreaseWindow {
+		return
+	}
+
+	cc.lastDecrease = now
+	cc.successes = 0
+	if cc.limit > 1 {
+		cc.limit /= 2
+	}
+
+	log.Warn("concurrencyController::onThrottled : Throttled by service, parallelism reduced to %d, retry after %s", cc.limit, retryAfter.String())
+	cc.exportLimit()
+}
+
+// onSuccess : Additive increase once a full round of requests at current limit succeeded
+func (cc *concurrencyController) onSuccess() {
+	cc.Lock()
+	defer cc.Unlock()
+
+	if cc.limit >= cc.ceiling {
+		return
+	}
+
+	cc.successes++
+	if cc.successes >= cc.limit {
+		cc.successes = 0
+		cc.limit++
+		log.Debug("concurrencyController::onSuccess : Parallelism increased to %d", cc.limit)
+		cc.exportLimit()
+	}
+}
+
+// exportLimit : Publish current limit, caller must hold the lock
+func (cc *concurrencyController) exportLimit() {
+	if azStatsCollector != nil {
+		azStatsCollector.UpdateStats(stats_manager.Replace, concurrencyLimit, (int64)(cc.limit))
+	}
+}
+
+// isThrottled : Status codes used by storage service when the account or partition is over its limits
+func isThrottled(status int) bool {
+	return status == http.StatusServiceUnavailable || status == http.StatusTooManyRequests
+}
+
+// parseRetryAfter : Retry-After is either delay in seconds or an http date
+func parseRetryAfter(value string, now time.Time) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	var delay time.Duration
+	if secs, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		delay = at.Sub(now)
+	}
+
+	if delay < 0 {
+		return 0
+	} else if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
@@ -36,9 +36,12 @@ package azstorage
 import (
 	"errors"
 	"fmt"
+	"path/filepath"
 	"reflect"
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-storage-fuse/v2/common"
 	"github.com/Azure/azure-storage-fuse/v2/common/config"
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
 
@@ -168,6 +171,23 @@ type AzStorageOptions struct {
 	UpdateMD5               bool   `config:"update-md5" yaml:"update-md5"`
 	ValidateMD5             bool   `config:"validate-md5" yaml:"validate-md5"`
 	VirtualDirectory        bool   `config:"virtual-directory" yaml:"virtual-directory"`
+	RenameParallelism       uint16 `config:"rename-parallelism" yaml:"rename-parallelism,omitempty"`
+	RenameRecovery          string `config:"rename-recovery" yaml:"rename-recovery,omitempty"`
+	IdentityMapFile         string `config:"identity-map-file" yaml:"identity-map-file,omitempty"`
+	IdentityMapCommand      string `config:"identity-map-command" yaml:"identity-map-command,omitempty"`
+	IdentityCacheTimeout    uint32 `config:"identity-cache-timeout-sec" yaml:"identity-cache-timeout-sec,omitempty"`
+	TagQueryDir             string `config:"tag-query-dir" yaml:"tag-query-dir,omitempty"`
+	MaxUploadBytes          int64  `config:"max-upload-bytes-sec" yaml:"max-upload-bytes-sec,omitempty"`
+	MaxDownloadBytes        int64  `config:"max-download-bytes-sec" yaml:"max-download-bytes-sec,omitempty"`
+	MaxRequests             int64  `config:"max-requests-sec" yaml:"max-requests-sec,omitempty"`
+	AdaptiveConcurrency     bool   `config:"adaptive-concurrency" yaml:"adaptive-concurrency,omitempty"`
+	CircuitBreaker          bool   `config:"circuit-breaker" yaml:"circuit-breaker,omitempty"`
+	CircuitBreakerThreshold uint32 `config:"circuit-breaker-threshold" yaml:"circuit-breaker-threshold,omitempty"`
+	CircuitBreakerProbeSec  uint32 `config:"circuit-breaker-probe-sec" yaml:"circuit-breaker-probe-sec,omitempty"`
+	HedgedReads             bool   `config:"hedged-reads" yaml:"hedged-reads,omitempty"`
+	HedgePercentile         uint32 `config:"hedge-percentile" yaml:"hedge-percentile,omitempty"`
+	ResumableUploads        bool   `config:"resumable-uploads" yaml:"resumable-uploads,omitempty"`
+	UploadStatePath         string `config:"upload-state-path" yaml:"upload-state-path,omitempty"`
 
 	// v1 support
 	UseAdls        bool   `config:"use-adls" yaml:"-"`
@@ -320,6 +340,12 @@ func ParseAndValidateConfig(az *AzStorage, opt AzStorageOptions) error {
 		return errors.New("container name not provided")
 	}
 
+	// Nothing is written on a read-only mount, not even to recover an earlier mount's incomplete renames
+	err = config.UnmarshalKey("read-only", &az.stConfig.readOnly)
+	if err != nil {
+		log.Err("ParseAndValidateConfig : Failed to detect read-only")
+	}
+
 	az.stConfig.container = opt.Container
 
 	if config.IsSet(compName + ".use-https") {
@@ -380,6 +406,49 @@ func ParseAndValidateConfig(az *AzStorage, opt AzStorageOptions) error {
 		return err
 	}
 
+	// Adapt parallelism of transfers to throttling by the service
+	if opt.AdaptiveConcurrency {
+		az.stConfig.concurrency = newConcurrencyController(az.stConfig.maxConcurrency)
+	}
+
+	// Fail calls fast during a storage outage
+	if opt.CircuitBreaker {
+		if opt.CircuitBreakerThreshold == 0 {
+			opt.CircuitBreakerThreshold = defaultCircuitBreakerThreshold
+		}
+		if opt.CircuitBreakerProbeSec == 0 {
+			opt.CircuitBreakerProbeSec = defaultCircuitBreakerProbeSec
+		}
+		az.stConfig.breaker = newCircuitBreaker(int(opt.CircuitBreakerThreshold), time.Duration(opt.CircuitBreakerProbeSec)*time.Second,
+			newEndpointProbe(newBlobfuse2HttpClient(az.stConfig), az.stConfig.authConfig.Endpoint))
+	}
+
+	// Duplicate slow ranged reads to cut tail latency, costs extra requests so it is off by default
+	if opt.HedgedReads {
+		if opt.HedgePercentile == 0 {
+			opt.HedgePercentile = defaultHedgePercentile
+		}
+		if opt.HedgePercentile >= 100 {
+			return errors.New("invalid hedge-percentile, must be less than 100")
+		}
+		az.stConfig.hedge = newHedger(int(opt.HedgePercentile))
+		log.Info("ParseAndValidateConfig : hedged reads at p%d latency", opt.HedgePercentile)
+	}
+
+	// Persist staged blocks of large uploads so they resume after a crash
+	if opt.ResumableUploads {
+		if opt.UploadStatePath == "" {
+			opt.UploadStatePath = filepath.Join(common.DefaultWorkDir, defaultUploadStateDir)
+		}
+		az.stConfig.uploadState, err = newUploadStateStore(common.ExpandPath(opt.UploadStatePath),
+			opt.AccountName, opt.Container, opt.PrefixPath)
+		if err != nil {
+			log.Err("ParseAndValidateConfig : Failed to create upload state directory %s [%s]", opt.UploadStatePath, err.Error())
+			return fmt.Errorf("failed to create upload-state-path %s [%s]", opt.UploadStatePath, err.Error())
+		}
+		log.Info("ParseAndValidateConfig : resumable uploads with state in %s", az.stConfig.uploadState.dir)
+	}
+
 	log.Debug("ParseAndValidateConfig : Getting auth type")
 	if opt.AuthMode == "" {
 		// Based on other config decide the auth mode
@@ -452,6 +521,25 @@ func ParseAndValidateConfig(az *AzStorage, opt AzStorageOptions) error {
 		az.stConfig.maxRetryDelay = opt.MaxRetryDelay
 	}
 
+	// Identity map to show real owners of paths in ADLS
+	if opt.IdentityCacheTimeout == 0 {
+		opt.IdentityCacheTimeout = defaultIdentityCacheTimeout
+	}
+	az.stConfig.identityMap, err = newIdentityMap(opt.IdentityMapFile, opt.IdentityMapCommand, opt.IdentityCacheTimeout)
+	if err != nil {
+		log.Err("ParseAndValidateConfig : Failed to load identity map [%s]", err.Error())
+		return err
+	}
+	if az.stConfig.identityMap != nil && az.stConfig.authConfig.AccountType != EAccountType.ADLS() {
+		log.Warn("ParseAndValidateConfig : Identity map is used only with adls accounts")
+	}
+
+	// Virtual directory to list blobs matching a blob index tag query
+	az.stConfig.tagQueryDir = strings.Trim(opt.TagQueryDir, "/")
+	if opt.TagQueryDir != "" && az.stConfig.tagQueryDir == "" {
+		return errors.New("invalid tag-query-dir, root of the mount can not be used")
+	}
+
 	if config.IsSet(compName + ".set-content-type") {
 		log.Warn("unsupported v1 CLI parameter: set-content-type is always true in blobfuse2.")
 	}
@@ -485,6 +573,9 @@ func ParseAndReadDynamicConfig(az *AzStorage, opt AzStorageOptions, reload bool)
 	if opt.MaxConcurrency != 0 {
 		az.stConfig.maxConcurrency = opt.MaxConcurrency
 	}
+	if az.stConfig.concurrency != nil {
+		az.stConfig.concurrency.setCeiling(az.stConfig.maxConcurrency)
+	}
 
 	// Populate default tier
 	if opt.DefaultTier != "" {
@@ -497,6 +588,33 @@ func ParseAndReadDynamicConfig(az *AzStorage, opt AzStorageOptions, reload bool)
 
 	az.stConfig.virtualDirectory = opt.VirtualDirectory
 
+	if opt.RenameParallelism != 0 {
+		az.stConfig.renameParallelism = opt.RenameParallelism
+	}
+
+	// Decide what to do with directory renames left incomplete by an earlier mount
+	switch strings.ToLower(opt.RenameRecovery) {
+	case "", renameRecoveryResume:
+		az.stConfig.renameRollback = false
+	case renameRecoveryRollback:
+		az.stConfig.renameRollback = true
+	default:
+		log.Err("ParseAndReadDynamicConfig : Invalid rename recovery mode %s", opt.RenameRecovery)
+		return errors.New("invalid rename recovery mode")
+	}
+
+	// Limits on traffic to the storage account, zero means no limit
+	if opt.MaxUploadBytes < 0 || opt.MaxDownloadBytes < 0 || opt.MaxRequests < 0 {
+		log.Err("ParseAndReadDynamicConfig : Invalid limits upload %d, download %d, requests %d", opt.MaxUploadBytes, opt.MaxDownloadBytes, opt.MaxRequests)
+		return errors.New("invalid throttling limits")
+	}
+	// The throttler is part of the HTTP pipeline which is built only once at mount, so it is always installed and
+	// lets requests through till a limit is set, which a reload can do
+	if az.stConfig.throttle == nil {
+		az.stConfig.throttle = &throttler{}
+	}
+	az.stConfig.throttle.update(opt.MaxUploadBytes, opt.MaxDownloadBytes, opt.MaxRequests)
+
 	// Auth related reconfig
 	switch opt.AuthMode {
 	case "sas":
@@ -34,7 +34,11 @@
 package azstorage
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Azure/azure-storage-fuse/v2/common"
@@ -368,6 +372,262 @@ func (s *configTestSuite) TestInvalidSASRefresh() {
 	assert.Equal(err.Error(), "SAS key update failure")
 }
 
+func (s *configTestSuite) TestRenameConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+
+	err := ParseAndReadDynamicConfig(az, opt, false)
+	assert.Nil(err)
+	assert.EqualValues(0, az.stConfig.renameParallelism)
+	assert.False(az.stConfig.renameRollback)
+
+	opt.RenameParallelism = 4
+	opt.RenameRecovery = "Rollback"
+	err = ParseAndReadDynamicConfig(az, opt, false)
+	assert.Nil(err)
+	assert.EqualValues(4, az.stConfig.renameParallelism)
+	assert.True(az.stConfig.renameRollback)
+
+	opt.RenameRecovery = "resume"
+	err = ParseAndReadDynamicConfig(az, opt, false)
+	assert.Nil(err)
+	assert.False(az.stConfig.renameRollback)
+
+	opt.RenameRecovery = "abcd"
+	err = ParseAndReadDynamicConfig(az, opt, false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid rename recovery mode")
+}
+
+func (s *configTestSuite) TestIdentityMapConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.AccountType = "adls"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Nil(az.stConfig.identityMap)
+
+	mapFile := filepath.Join(s.T().TempDir(), "identity.map")
+	err = os.WriteFile(mapFile, []byte("user a2b4c3d5-0000-1111-2222-333344445555 1001\n"), 0644)
+	assert.Nil(err)
+
+	opt.IdentityMapFile = mapFile
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.identityMap)
+	assert.Equal(defaultIdentityCacheTimeout*time.Second, az.stConfig.identityMap.cacheTimeout)
+
+	opt.IdentityMapFile = mapFile + ".missing"
+	err = ParseAndValidateConfig(az, opt)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "failed to open identity map file")
+
+	opt.IdentityMapFile = ""
+	opt.IdentityMapCommand = "/nonexistent/lookup"
+	err = ParseAndValidateConfig(az, opt)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "identity map command")
+}
+
+func (s *configTestSuite) TestTagQueryDirConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Empty(az.stConfig.tagQueryDir)
+
+	opt.TagQueryDir = "/.query/"
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Equal(".query", az.stConfig.tagQueryDir)
+
+	opt.TagQueryDir = "/"
+	err = ParseAndValidateConfig(az, opt)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid tag-query-dir")
+}
+
+func (s *configTestSuite) TestThrottleConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+
+	// Throttler is installed without limits so that a reload can set them
+	err := ParseAndReadDynamicConfig(az, opt, false)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.throttle)
+	assert.Equal([3]int64{0, 0, 0}, az.stConfig.throttle.limits)
+	assert.False(az.stConfig.throttle.upload.limited())
+
+	// Reload updates the same throttler so pipelines already built pick up the new limits
+	t := az.stConfig.throttle
+	opt.MaxUploadBytes = 1024
+	err = ParseAndReadDynamicConfig(az, opt, true)
+	assert.Nil(err)
+	assert.Same(t, az.stConfig.throttle)
+	assert.Equal([3]int64{1024, 0, 0}, t.limits)
+	assert.True(t.upload.limited())
+
+	opt.MaxDownloadBytes = 2048
+	opt.MaxRequests = 10
+	err = ParseAndReadDynamicConfig(az, opt, true)
+	assert.Nil(err)
+	assert.Same(t, az.stConfig.throttle)
+	assert.Equal([3]int64{1024, 2048, 10}, t.limits)
+	assert.EqualValues(2048, t.download.rate)
+
+	// Removing the limits keeps the throttler in the pipeline without limiting
+	err = ParseAndReadDynamicConfig(az, AzStorageOptions{}, true)
+	assert.Nil(err)
+	assert.Same(t, az.stConfig.throttle)
+	assert.Equal([3]int64{0, 0, 0}, t.limits)
+
+	opt.MaxRequests = -1
+	err = ParseAndReadDynamicConfig(az, opt, false)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "invalid throttling limits")
+}
+
+func (s *configTestSuite) TestAdaptiveConcurrencyConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+	opt.MaxConcurrency = 8
+
+	// Off unless asked for
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Nil(az.stConfig.concurrency)
+
+	opt.AdaptiveConcurrency = true
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.concurrency)
+	assert.EqualValues(8, az.stConfig.concurrency.parallelism())
+
+	opt.MaxConcurrency = 4
+	err = ParseAndReadDynamicConfig(az, opt, false)
+	assert.Nil(err)
+	assert.EqualValues(4, az.stConfig.concurrency.parallelism())
+}
+
+func (s *configTestSuite) TestCircuitBreakerConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+
+	// Off unless asked for
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Nil(az.stConfig.breaker)
+
+	opt.CircuitBreaker = true
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.breaker)
+	assert.Equal(defaultCircuitBreakerThreshold, az.stConfig.breaker.threshold)
+	assert.Equal(defaultCircuitBreakerProbeSec*time.Second, az.stConfig.breaker.interval)
+
+	opt.CircuitBreakerThreshold = 3
+	opt.CircuitBreakerProbeSec = 30
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Equal(3, az.stConfig.breaker.threshold)
+	assert.Equal(30*time.Second, az.stConfig.breaker.interval)
+}
+
+func (s *configTestSuite) TestHedgedReadsConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Nil(az.stConfig.hedge)
+
+	opt.HedgedReads = true
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.hedge)
+	assert.Equal(defaultHedgePercentile, az.stConfig.hedge.percentile)
+
+	opt.HedgePercentile = 99
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Equal(99, az.stConfig.hedge.percentile)
+
+	opt.HedgePercentile = 100
+	err = ParseAndValidateConfig(az, opt)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "hedge-percentile")
+}
+
+func (s *configTestSuite) TestResumableUploadsConfig() {
+	defer config.ResetConfig()
+	assert := assert.New(s.T())
+	az := &AzStorage{}
+	opt := AzStorageOptions{}
+	opt.AccountName = "abcd"
+	opt.Container = "abcd"
+	opt.AuthMode = "key"
+	opt.AccountKey = "abc"
+
+	err := ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.Nil(az.stConfig.uploadState)
+
+	dir := filepath.Join(os.TempDir(), "upload_state_config")
+	defer os.RemoveAll(dir)
+	opt.ResumableUploads = true
+	opt.UploadStatePath = dir
+	err = ParseAndValidateConfig(az, opt)
+	assert.Nil(err)
+	assert.NotNil(az.stConfig.uploadState)
+	// State of each container is kept apart so mounts sharing the path do not resume each other's uploads
+	assert.Equal(filepath.Join(dir, "abcd", "abcd"), az.stConfig.uploadState.dir)
+	assert.Equal("abcd/abcd/", az.stConfig.uploadState.scope)
+	assert.DirExists(az.stConfig.uploadState.dir)
+
+	// State path under a regular file can not be created
+	opt.UploadStatePath = filepath.Join(dir, "file", "state")
+	assert.Nil(ioutil.WriteFile(filepath.Join(dir, "file"), []byte{}, 0600))
+	err = ParseAndValidateConfig(az, opt)
+	assert.NotNil(err)
+	assert.Contains(err.Error(), "upload-state-path")
+}
+
 func TestConfigTestSuite(t *testing.T) {
 	suite.Run(t, new(configTestSuite))
 }
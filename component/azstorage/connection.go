@@ -36,6 +36,7 @@ package azstorage
 import (
 	"net/url"
 	"os"
+	"time"
 
 	"github.com/Azure/azure-storage-fuse/v2/common"
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
@@ -74,6 +75,33 @@ type AzStorageConfig struct {
 	updateMD5        bool
 	validateMD5      bool
 	virtualDirectory bool
+	readOnly         bool
+
+	// Number of blobs renamed in parallel while renaming a directory
+	renameParallelism uint16
+	// Roll back instead of resuming an interrupted directory rename
+	renameRollback bool
+
+	// Map between AAD identities and local uid/gid, nil if not configured
+	identityMap *identityMap
+
+	// Path of the virtual directory listing blobs by tag query, empty if disabled
+	tagQueryDir string
+
+	// Limits on upload, download and request rate, shared across reloads of config
+	throttle *throttler
+
+	// Parallelism of transfers adapted to throttling by the service, nil if disabled
+	concurrency *concurrencyController
+
+	// Fails requests fast while storage is unreachable, nil if disabled
+	breaker *circuitBreaker
+
+	// Sends a duplicate ranged read when the first one is slow, nil if disabled
+	hedge *hedger
+
+	// Staged blocks of in-progress uploads, persisted so they resume after a crash, nil if disabled
+	uploadState *uploadStateStore
 }
 
 type AzStorageConnection struct {
@@ -113,7 +141,7 @@ type AzConnection interface {
 
 	ReadToFile(name string, offset int64, count int64, fi *os.File) error
 	ReadBuffer(name string, offset int64, len int64) ([]byte, error)
-	ReadInBuffer(name string, offset int64, len int64, data []byte) error
+	ReadInBuffer(name string, offset int64, len int64, data []byte, etag string) error
 
 	WriteFromFile(name string, metadata map[string]string, fi *os.File) error
 	WriteFromBuffer(name string, metadata map[string]string, data []byte) error
@@ -122,6 +150,15 @@ type AzConnection interface {
 
 	ChangeMod(string, os.FileMode) error
 	ChangeOwner(string, int, int) error
+	ChangeTimes(string, time.Time, time.Time) error
+
+	GetACL(string) (string, error)
+	SetACL(string, string) error
+
+	GetTags(name string) (map[string]string, error)
+	SetTags(name string, tags map[string]string) error
+	FindBlobsByTags(expr string) ([]string, error)
+
 	TruncateFile(string, int64) error
 	StageAndCommit(name string, bol *common.BlockOffsetList) error
 
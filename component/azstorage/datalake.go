@@ -411,12 +411,14 @@ func (dl *Datalake) GetAttr(name string) (attr *internal.ObjAttr, err error) {
 		Ctime:  lastModified,
 		Crtime: lastModified,
 		Flags:  internal.NewFileBitMap(),
+		ETag:   prop.ETag(),
 	}
 	parseProperties(attr, prop.XMsProperties())
 	if azbfs.PathResourceDirectory == azbfs.PathResourceType(prop.XMsResourceType()) {
 		attr.Flags = internal.NewDirBitMap()
 		attr.Mode = attr.Mode | os.ModeDir
 	}
+	dl.Config.identityMap.setOwner(attr, prop.XMsOwner(), prop.XMsGroup())
 	attr.Flags.Set(internal.PropFlagMetadataRetrieved)
 
 	return attr, nil
@@ -494,10 +496,16 @@ func (dl *Datalake) List(prefix string, marker *string, count int32) ([]*interna
 			Crtime: pathInfo.LastModifiedTime(),
 			Flags:  internal.NewFileBitMap(),
 		}
+		if pathInfo.ETag != nil {
+			attr.ETag = *pathInfo.ETag
+		}
 		if pathInfo.IsDirectory != nil && *pathInfo.IsDirectory {
 			attr.Flags = internal.NewDirBitMap()
 			attr.Mode = attr.Mode | os.ModeDir
 		}
+		if pathInfo.Owner != nil && pathInfo.Group != nil {
+			dl.Config.identityMap.setOwner(attr, *pathInfo.Owner, *pathInfo.Group)
+		}
 
 		// Note: Datalake list paths does not return metadata/properties.
 		// To account for this and accurately return attributes when needed,
@@ -523,8 +531,8 @@ func (dl *Datalake) ReadBuffer(name string, offset int64, len int64) ([]byte, er
 }
 
 // ReadInBuffer : Download specific range from a file to a user provided buffer
-func (dl *Datalake) ReadInBuffer(name string, offset int64, len int64, data []byte) error {
-	return dl.BlockBlob.ReadInBuffer(name, offset, len, data)
+func (dl *Datalake) ReadInBuffer(name string, offset int64, len int64, data []byte, etag string) error {
+	return dl.BlockBlob.ReadInBuffer(name, offset, len, data, etag)
 }
 
 // WriteFromFile : Upload local file to file
@@ -587,27 +595,103 @@ func (dl *Datalake) ChangeMod(name string, mode os.FileMode) error {
 	return nil
 }
 
-// ChangeOwner : Change owner of a path
-func (dl *Datalake) ChangeOwner(name string, _ int, _ int) error {
-	log.Trace("Datalake::ChangeOwner : name %s", name)
+// ChangeOwner : Change owner of a path, uid and gid are translated to AAD identities through the identity map
+func (dl *Datalake) ChangeOwner(name string, uid int, gid int) error {
+	log.Trace("Datalake::ChangeOwner : name %s, owner %d, group %d", name, uid, gid)
+
+	if dl.Config.identityMap == nil {
+		if dl.Config.ignoreAccessModifiers {
+			// for operations like git clone where transaction fails if chown is not successful
+			// return success instead of ENOSYS
+			return nil
+		}
+		return syscall.ENOTSUP
+	}
+
+	// Negative id means that id is not to be changed
+	acl := azbfs.BlobFSAccessControl{}
+	var found bool
+	if uid >= 0 {
+		if acl.Owner, found = dl.Config.identityMap.aadID(uint32(uid), false); !found {
+			log.Err("Datalake::ChangeOwner : No AAD identity found for uid %d", uid)
+			return syscall.EINVAL
+		}
+	}
+	if gid >= 0 {
+		if acl.Group, found = dl.Config.identityMap.aadID(uint32(gid), true); !found {
+			log.Err("Datalake::ChangeOwner : No AAD identity found for gid %d", gid)
+			return syscall.EINVAL
+		}
+	}
 
-	if dl.Config.ignoreAccessModifiers {
-		// for operations like git clone where transaction fails if chown is not successful
-		// return success instead of ENOSYS
+	if acl.Owner == "" && acl.Group == "" {
 		return nil
 	}
 
-	// TODO: This is not supported for now.
-	// fileURL := dl.Filesystem.NewRootDirectoryURL().NewFileURL(filepath.Join(dl.Config.prefixPath, name))
-	// group := strconv.Itoa(gid)
-	// owner := strconv.Itoa(uid)
-	// _, err := fileURL.SetAccessControl(context.Background(), azbfs.BlobFSAccessControl{Group: group, Owner: owner})
-	// e := storeDatalakeErrToErr(err)
-	// if e == ErrFileNotFound {
-	// 	return syscall.ENOENT
-	// } else if err != nil {
-	// 	log.Err("Datalake::ChangeOwner : Failed to change ownership of file %s to %s [%s]", name, mode, err.Error())
-	// 	return err
-	// }
-	return syscall.ENOTSUP
+	fileURL := dl.Filesystem.NewRootDirectoryURL().NewFileURL(filepath.Join(dl.Config.prefixPath, name))
+	_, err := fileURL.SetAccessControl(context.Background(), acl)
+	e := storeDatalakeErrToErr(err)
+	if e == ErrFileNotFound {
+		return syscall.ENOENT
+	} else if err != nil {
+		log.Err("Datalake::ChangeOwner : Failed to change ownership of %s to %s:%s [%s]", name, acl.Owner, acl.Group, err.Error())
+		return err
+	}
+
+	return nil
+}
+
+// ChangeTimes : Change access and modification time of a path
+func (dl *Datalake) ChangeTimes(name string, atime time.Time, mtime time.Time) error {
+	// ADLS has no native support for setting times, so these are saved in metadata through blob endpoint
+	return dl.BlockBlob.ChangeTimes(name, atime, mtime)
+}
+
+// GetTags : Index tags are only available through the blob endpoint
+func (dl *Datalake) GetTags(name string) (map[string]string, error) {
+	return dl.BlockBlob.GetTags(name)
+}
+
+// SetTags : Index tags are only available through the blob endpoint
+func (dl *Datalake) SetTags(name string, tags map[string]string) error {
+	return dl.BlockBlob.SetTags(name, tags)
+}
+
+// FindBlobsByTags : Index tags are only available through the blob endpoint
+func (dl *Datalake) FindBlobsByTags(expr string) ([]string, error) {
+	return dl.BlockBlob.FindBlobsByTags(expr)
+}
+
+// GetACL : Get the access control list of a path
+func (dl *Datalake) GetACL(name string) (string, error) {
+	log.Trace("Datalake::GetACL : Get acl of %s", name)
+	fileURL := dl.Filesystem.NewRootDirectoryURL().NewFileURL(filepath.Join(dl.Config.prefixPath, name))
+
+	acl, err := fileURL.GetAccessControl(context.Background())
+	e := storeDatalakeErrToErr(err)
+	if e == ErrFileNotFound {
+		return "", syscall.ENOENT
+	} else if err != nil {
+		log.Err("Datalake::GetACL : Failed to get acl of %s [%s]", name, err.Error())
+		return "", err
+	}
+
+	return acl.ACL, nil
+}
+
+// SetACL : Replace the access control list of a path
+func (dl *Datalake) SetACL(name string, acl string) error {
+	log.Trace("Datalake::SetACL : Set acl of %s to %s", name, acl)
+	fileURL := dl.Filesystem.NewRootDirectoryURL().NewFileURL(filepath.Join(dl.Config.prefixPath, name))
+
+	_, err := fileURL.SetAccessControl(context.Background(), azbfs.BlobFSAccessControl{ACL: acl})
+	e := storeDatalakeErrToErr(err)
+	if e == ErrFileNotFound {
+		return syscall.ENOENT
+	} else if err != nil {
+		log.Err("Datalake::SetACL : Failed to set acl of %s to %s [%s]", name, acl, err.Error())
+		return err
+	}
+
+	return nil
 }
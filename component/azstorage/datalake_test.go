@@ -1715,6 +1715,88 @@ func (s *datalakeTestSuite) TestChmodError() {
 	s.assert.EqualValues(syscall.ENOENT, err)
 }
 
+func (s *datalakeTestSuite) TestPosixACLAccess() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+
+	entries, _ := parseACL("user::rw-,group::r--,other::---")
+	value := encodePosixACL(entries, false, nil)
+	err := s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: posixACLAccessXattr, Value: value})
+	s.assert.Nil(err)
+
+	// File's ACL and mode should have changed
+	file := s.containerUrl.NewRootDirectoryURL().NewFileURL(name)
+	acl, err := file.GetAccessControl(ctx)
+	s.assert.Nil(err)
+	s.assert.EqualValues("user::rw-,group::r--,other::---", acl.ACL)
+
+	attr, err := s.az.GetAttr(internal.GetAttrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.EqualValues(0640, attr.Mode.Perm())
+
+	data, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLAccessXattr})
+	s.assert.Nil(err)
+	s.assert.EqualValues(value, data)
+
+	// Files do not have default ACL
+	_, err = s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLDefaultXattr})
+	s.assert.EqualValues(syscall.ENODATA, err)
+
+	names, err := s.az.ListXattr(internal.ListXattrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.EqualValues([]string{posixACLAccessXattr}, names)
+}
+
+func (s *datalakeTestSuite) TestPosixACLDefault() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateDirectoryName()
+	s.az.CreateDir(internal.CreateDirOptions{Name: name})
+
+	entries, _ := parseACL("default:user::rwx,default:group::r-x,default:other::---")
+	value := encodePosixACL(entries, true, nil)
+	err := s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: posixACLDefaultXattr, Value: value})
+	s.assert.Nil(err)
+
+	data, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLDefaultXattr})
+	s.assert.Nil(err)
+	s.assert.EqualValues(value, data)
+
+	names, err := s.az.ListXattr(internal.ListXattrOptions{Name: name})
+	s.assert.Nil(err)
+	s.assert.EqualValues([]string{posixACLAccessXattr, posixACLDefaultXattr}, names)
+
+	// Access ACL shall not be touched by update of the default ACL
+	dir := s.containerUrl.NewDirectoryURL(name)
+	acl, err := dir.GetAccessControl(ctx)
+	s.assert.Nil(err)
+	s.assert.Contains(acl.ACL, "user::rwx")
+
+	err = s.az.RemoveXattr(internal.RemoveXattrOptions{Name: name, Attr: posixACLDefaultXattr})
+	s.assert.Nil(err)
+
+	_, err = s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLDefaultXattr})
+	s.assert.EqualValues(syscall.ENODATA, err)
+}
+
+func (s *datalakeTestSuite) TestPosixACLError() {
+	defer s.cleanupTest()
+	// Setup
+	name := generateFileName()
+
+	_, err := s.az.GetXattr(internal.GetXattrOptions{Name: name, Attr: posixACLAccessXattr})
+	s.assert.EqualValues(syscall.ENOENT, err)
+
+	s.az.CreateFile(internal.CreateFileOptions{Name: name})
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: posixACLAccessXattr, Value: []byte{1, 2, 3}})
+	s.assert.EqualValues(syscall.EINVAL, err)
+
+	err = s.az.SetXattr(internal.SetXattrOptions{Name: name, Attr: "user.key", Value: []byte("value")})
+	s.assert.EqualValues(syscall.ENOTSUP, err)
+}
+
 // If support for chown or chmod are ever added to blob, add tests for error cases and modify the following tests.
 func (s *datalakeTestSuite) TestChown() {
 	defer s.cleanupTest()
@@ -1874,7 +1956,7 @@ func (s *datalakeTestSuite) TestFlushFileUpdateChunkedFile() {
 	updatedBlock := make([]byte, 2*MB)
 	rand.Read(updatedBlock)
 	h.CacheObj.BlockOffsetList.BlockList[1].Data = make([]byte, blockSize)
-	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize), h.CacheObj.BlockOffsetList.BlockList[1].Data)
+	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize), h.CacheObj.BlockOffsetList.BlockList[1].Data, "")
 	copy(h.CacheObj.BlockOffsetList.BlockList[1].Data[MB:2*MB+MB], updatedBlock)
 	h.CacheObj.BlockOffsetList.BlockList[1].Flags.Set(common.DirtyBlock)
 
@@ -1912,7 +1994,7 @@ func (s *datalakeTestSuite) TestFlushFileTruncateUpdateChunkedFile() {
 	// truncate block
 	h.CacheObj.BlockOffsetList.BlockList[1].Data = make([]byte, blockSize/2)
 	h.CacheObj.BlockOffsetList.BlockList[1].EndIndex = int64(blockSize + blockSize/2)
-	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize)/2, h.CacheObj.BlockOffsetList.BlockList[1].Data)
+	s.az.storage.ReadInBuffer(name, int64(blockSize), int64(blockSize)/2, h.CacheObj.BlockOffsetList.BlockList[1].Data, "")
 	h.CacheObj.BlockOffsetList.BlockList[1].Flags.Set(common.DirtyBlock)
 
 	// remove 2 blocks
@@ -0,0 +1,208 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	defaultHedgePercentile = 95
+
+	// Latencies of these many recent reads are used to compute the threshold
+	hedgeWindow = 256
+	// Threshold is recomputed after these many new samples
+	hedgeRecompute = 32
+	// No hedging till enough reads have been seen to know the latency distribution
+	hedgeMinSamples = 20
+	// Reads faster than this are never hedged
+	hedgeMinThreshold = 5 * time.Millisecond
+)
+
+// hedger : Tracks latency of recent reads and decides when a duplicate request shall be sent for a slow read
+type hedger struct {
+	sync.Mutex
+	percentile int
+	samples    []time.Duration
+	next       int
+	added      int
+	threshold  time.Duration
+}
+
+// newHedger : Create a hedger which fires a duplicate read once the given percentile of latency has passed
+func newHedger(percentile int) *hedger {
+	return &hedger{
+		percentile: percentile,
+		samples:    make([]time.Duration, 0, hedgeWindow),
+	}
+}
+
+// record : Add the latency of a successful read
+func (h *hedger) record(latency time.Duration) {
+	h.Lock()
+	defer h.Unlock()
+
+	if len(h.samples) < hedgeWindow {
+		h.samples = append(h.samples, latency)
+	} else {
+		h.samples[h.next] = latency
+		h.next = (h.next + 1) % hedgeWindow
+	}
+
+	h.added++
+	if len(h.samples) >= hedgeMinSamples && (h.threshold == 0 || h.added >= hedgeRecompute) {
+		h.added = 0
+		h.threshold = h.computeThreshold()
+	}
+}
+
+// computeThreshold : Latency at the configured percentile of recent reads, caller must hold the lock
+func (h *hedger) computeThreshold() time.Duration {
+	sorted := make([]time.Duration, len(h.samples))
+	copy(sorted, h.samples)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	idx := (len(sorted)*h.percentile + 99) / 100
+	if idx > 0 {
+		idx--
+	}
+
+	threshold := sorted[idx]
+	if threshold < hedgeMinThreshold {
+		threshold = hedgeMinThreshold
+	}
+	return threshold
+}
+
+// delay : Time to wait for a read before sending a duplicate, zero if reads shall not be hedged yet
+func (h *hedger) delay() time.Duration {
+	h.Lock()
+	defer h.Unlock()
+	return h.threshold
+}
+
+// hedgedRead : Run the read and if it has not completed within the threshold run a duplicate of it. Result of the
+// first one to succeed is used and the other is cancelled. Primary read fills data directly while the duplicate reads
+// in its own buffer which is copied over if it wins.
+func (h *hedger) hedgedRead(name string, data []byte, read func(ctx context.Context, buf []byte) error) error {
+	type result struct {
+		hedge bool
+		err   error
+	}
+
+	threshold := h.delay()
+	results := make(chan result, 2)
+
+	primaryCtx, cancelPrimary := context.WithCancel(context.Background())
+	defer cancelPrimary()
+
+	start := time.Now()
+	go func() {
+		results <- result{false, read(primaryCtx, data)}
+	}()
+
+	if threshold == 0 {
+		res := <-results
+		if res.err == nil {
+			h.record(time.Since(start))
+		}
+		return res.err
+	}
+
+	timer := time.NewTimer(threshold)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		if res.err == nil {
+			h.record(time.Since(start))
+		}
+		return res.err
+	case <-timer.C:
+	}
+
+	// Primary is slow so fire a duplicate
+	log.Debug("hedger::hedgedRead : Hedging read of %s after %s", name, threshold.String())
+	if azStatsCollector != nil {
+		azStatsCollector.UpdateStats(stats_manager.Increment, hedgedReads, (int64)(1))
+		azStatsCollector.UpdateStats(stats_manager.Replace, hedgeThresholdMs, threshold.Milliseconds())
+	}
+
+	hedgeCtx, cancelHedge := context.WithCancel(context.Background())
+	defer cancelHedge()
+
+	hedgeBuf := make([]byte, len(data))
+	hedgeStart := time.Now()
+	go func() {
+		results <- result{true, read(hedgeCtx, hedgeBuf)}
+	}()
+
+	var firstErr error
+	for pending := 2; pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			if firstErr == nil || !res.hedge {
+				firstErr = res.err
+			}
+			continue
+		}
+
+		if !res.hedge {
+			cancelHedge()
+			h.record(time.Since(start))
+			return nil
+		}
+
+		// Duplicate won, wait for the primary to stop writing to data before copying over it
+		cancelPrimary()
+		if pending == 2 {
+			<-results
+		}
+		copy(data, hedgeBuf)
+		h.record(time.Since(hedgeStart))
+
+		if azStatsCollector != nil {
+			azStatsCollector.UpdateStats(stats_manager.Increment, hedgeWins, (int64)(1))
+		}
+		return nil
+	}
+
+	return firstErr
+}
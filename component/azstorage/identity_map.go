@@ -0,0 +1,330 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+)
+
+const (
+	defaultIdentityCacheTimeout = 300
+	identityCommandTimeout      = 10 * time.Second
+	undefinedID                 = ^uint32(0)
+)
+
+// Kinds of lookup passed as first argument to the identity map command
+const (
+	identityLookupUser  = "user"  // AAD object id or UPN of a user to uid
+	identityLookupGroup = "group" // AAD object id or UPN of a group to gid
+	identityLookupUID   = "uid"   // uid to AAD object id or UPN of the user
+	identityLookupGID   = "gid"   // gid to AAD object id or UPN of the group
+)
+
+// identityMap : Map between AAD identities that own paths in ADLS and local uid/gid
+//
+//	Entries come from a static file and, for identities missing in it, from an external command
+type identityMap struct {
+	sync.RWMutex
+
+	users  map[string]uint32 // AAD identity of a user to uid
+	groups map[string]uint32 // AAD identity of a group to gid
+	uids   map[uint32]string // uid to AAD identity
+	gids   map[uint32]string // gid to AAD identity
+
+	command      string
+	cacheTimeout time.Duration
+	lookups      map[string]identityLookup // results of the command
+
+	// Owner of the mount, which libfuse shows for paths without one, given to the unmapped half of an owner
+	defaultUid uint32
+	defaultGid uint32
+}
+
+type identityLookup struct {
+	value   string
+	found   bool
+	expires time.Time
+}
+
+// newIdentityMap : Load the map file and validate the command, returns nil if neither is configured
+func newIdentityMap(file string, command string, cacheTimeout uint32) (*identityMap, error) {
+	if file == "" && command == "" {
+		return nil, nil
+	}
+
+	m := &identityMap{
+		users:        make(map[string]uint32),
+		groups:       make(map[string]uint32),
+		uids:         make(map[uint32]string),
+		gids:         make(map[uint32]string),
+		command:      command,
+		cacheTimeout: time.Duration(cacheTimeout) * time.Second,
+		lookups:      make(map[string]identityLookup),
+	}
+
+	var err error
+	m.defaultUid, m.defaultGid, err = common.GetCurrentUser()
+	if err != nil {
+		log.Warn("newIdentityMap : Unable to obtain current user info, unmapped owners are shown as process ids [%s]", err.Error())
+		m.defaultUid, m.defaultGid = uint32(os.Getuid()), uint32(os.Getgid())
+	}
+
+	if file != "" {
+		err := m.load(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if command != "" {
+		_, err := exec.LookPath(command)
+		if err != nil {
+			return nil, fmt.Errorf("identity map command %s not found [%s]", command, err.Error())
+		}
+	}
+
+	return m, nil
+}
+
+// load : Read the map file, each line is "user|group <aad object id or upn> <local id or name>"
+func (m *identityMap) load(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return fmt.Errorf("failed to open identity map file %s [%s]", file, err.Error())
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid entry at line %d of identity map file %s", line, file)
+		}
+
+		isGroup := false
+		switch fields[0] {
+		case identityLookupUser:
+		case identityLookupGroup:
+			isGroup = true
+		default:
+			return fmt.Errorf("invalid type %s at line %d of identity map file %s", fields[0], line, file)
+		}
+
+		id, err := resolveLocalID(fields[2], isGroup)
+		if err != nil {
+			return fmt.Errorf("invalid id %s at line %d of identity map file %s [%s]", fields[2], line, file, err.Error())
+		}
+
+		aadID := strings.ToLower(fields[1])
+		if isGroup {
+			m.groups[aadID] = id
+			if _, found := m.gids[id]; !found {
+				m.gids[id] = fields[1]
+			}
+		} else {
+			m.users[aadID] = id
+			if _, found := m.uids[id]; !found {
+				m.uids[id] = fields[1]
+			}
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read identity map file %s [%s]", file, err.Error())
+	}
+
+	log.Info("identityMap::load : Loaded %d users and %d groups from %s", len(m.users), len(m.groups), file)
+	return nil
+}
+
+// resolveLocalID : Local id may be given as a number or as a user/group name
+func resolveLocalID(value string, isGroup bool) (uint32, error) {
+	id, err := strconv.ParseUint(value, 10, 32)
+	if err == nil {
+		return uint32(id), nil
+	}
+
+	if isGroup {
+		g, err := user.LookupGroup(value)
+		if err != nil {
+			return 0, err
+		}
+		value = g.Gid
+	} else {
+		u, err := user.Lookup(value)
+		if err != nil {
+			return 0, err
+		}
+		value = u.Uid
+	}
+
+	id, err = strconv.ParseUint(value, 10, 32)
+	return uint32(id), err
+}
+
+// localID : Get uid or gid of an AAD identity, numeric identities are returned as is
+func (m *identityMap) localID(aadID string, isGroup bool) (uint32, bool) {
+	if id, err := strconv.ParseUint(aadID, 10, 32); err == nil && uint32(id) != undefinedID {
+		return uint32(id), true
+	}
+
+	if m == nil || aadID == "" {
+		return 0, false
+	}
+
+	m.RLock()
+	id, found := m.users[strings.ToLower(aadID)]
+	if isGroup {
+		id, found = m.groups[strings.ToLower(aadID)]
+	}
+	m.RUnlock()
+	if found {
+		return id, true
+	}
+
+	kind := identityLookupUser
+	if isGroup {
+		kind = identityLookupGroup
+	}
+	value, found := m.lookup(kind, aadID)
+	if !found {
+		return 0, false
+	}
+
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil {
+		log.Err("identityMap::localID : Invalid %s id %s returned for %s", kind, value, aadID)
+		return 0, false
+	}
+	return uint32(parsed), true
+}
+
+// aadID : Get the AAD identity of a uid or gid
+func (m *identityMap) aadID(id uint32, isGroup bool) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+
+	m.RLock()
+	aadID, found := m.uids[id]
+	if isGroup {
+		aadID, found = m.gids[id]
+	}
+	m.RUnlock()
+	if found {
+		return aadID, true
+	}
+
+	kind := identityLookupUID
+	if isGroup {
+		kind = identityLookupGID
+	}
+	return m.lookup(kind, strconv.FormatUint(uint64(id), 10))
+}
+
+// lookup : Run the command to resolve an identity, results including misses are cached
+func (m *identityMap) lookup(kind string, value string) (string, bool) {
+	if m.command == "" {
+		return "", false
+	}
+
+	key := kind + ":" + strings.ToLower(value)
+	m.RLock()
+	result, found := m.lookups[key]
+	m.RUnlock()
+	if found && time.Now().Before(result.expires) {
+		return result.value, result.found
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), identityCommandTimeout)
+	defer cancel()
+
+	result = identityLookup{expires: time.Now().Add(m.cacheTimeout)}
+	out, err := exec.CommandContext(ctx, m.command, kind, value).Output()
+	if err != nil {
+		// Command exits with non-zero status when the identity is not known
+		log.Debug("identityMap::lookup : No mapping found for %s %s [%s]", kind, value, err.Error())
+	} else if output := strings.TrimSpace(string(out)); output != "" {
+		result.value = output
+		result.found = true
+	}
+
+	m.Lock()
+	m.lookups[key] = result
+	m.Unlock()
+
+	return result.value, result.found
+}
+
+// setOwner : Set uid and gid of the path from its AAD owner and group, unmapped ids are left to the owner of the mount
+func (m *identityMap) setOwner(attr *internal.ObjAttr, owner string, group string) {
+	if m == nil {
+		return
+	}
+
+	uid, uidFound := m.localID(owner, false)
+	gid, gidFound := m.localID(group, true)
+	if !uidFound && !gidFound {
+		return
+	}
+
+	if !uidFound {
+		uid = m.defaultUid
+	}
+	if !gidFound {
+		gid = m.defaultGid
+	}
+
+	attr.Uid = uid
+	attr.Gid = gid
+	attr.Flags.Set(internal.PropFlagOwnerSet)
+}
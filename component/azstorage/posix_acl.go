@@ -0,0 +1,312 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+const (
+	posixACLAccessXattr  = "system.posix_acl_access"
+	posixACLDefaultXattr = "system.posix_acl_default"
+
+	// Layout of the POSIX ACL xattr value as defined in linux/posix_acl_xattr.h
+	posixACLXattrVersion = 2
+	posixACLHeaderSize   = 4
+	posixACLEntrySize    = 8
+	posixACLUndefinedID  = math.MaxUint32
+
+	aclDefaultScope = "default:"
+)
+
+// ACL entry tags as used by the kernel
+const (
+	aclTagUserObj  uint16 = 0x01
+	aclTagUser     uint16 = 0x02
+	aclTagGroupObj uint16 = 0x04
+	aclTagGroup    uint16 = 0x08
+	aclTagMask     uint16 = 0x10
+	aclTagOther    uint16 = 0x20
+)
+
+var aclTagNames = map[uint16]string{
+	aclTagUserObj:  "user",
+	aclTagUser:     "user",
+	aclTagGroupObj: "group",
+	aclTagGroup:    "group",
+	aclTagMask:     "mask",
+	aclTagOther:    "other",
+}
+
+// posixACLScope : Whether the xattr holds the default or the access ACL, false if it is not an ACL xattr
+func posixACLScope(name string) (isDefault bool, ok bool) {
+	switch name {
+	case posixACLAccessXattr:
+		return false, true
+	case posixACLDefaultXattr:
+		return true, true
+	}
+	return false, false
+}
+
+// aclEntry : One entry of the access control list of a path
+type aclEntry struct {
+	isDefault bool
+	tag       uint16
+	qualifier string // user or group of a named entry, empty for others
+	perm      uint16
+}
+
+func (e aclEntry) isNamed() bool {
+	return e.tag == aclTagUser || e.tag == aclTagGroup
+}
+
+// parseACL : Parse the ACL string returned by the service e.g. "user::rwx,group::r-x,other::---,default:user::rwx"
+func parseACL(acl string) ([]aclEntry, error) {
+	entries := make([]aclEntry, 0)
+
+	for _, item := range strings.Split(acl, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		entry := aclEntry{}
+		if strings.HasPrefix(item, aclDefaultScope) {
+			entry.isDefault = true
+			item = item[len(aclDefaultScope):]
+		}
+
+		parts := strings.Split(item, ":")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid acl entry %s", item)
+		}
+
+		entry.qualifier = parts[1]
+		switch parts[0] {
+		case "user":
+			entry.tag = aclTagUserObj
+			if entry.qualifier != "" {
+				entry.tag = aclTagUser
+			}
+		case "group":
+			entry.tag = aclTagGroupObj
+			if entry.qualifier != "" {
+				entry.tag = aclTagGroup
+			}
+		case "mask":
+			entry.tag = aclTagMask
+		case "other":
+			entry.tag = aclTagOther
+		default:
+			return nil, fmt.Errorf("invalid acl entry type %s", item)
+		}
+
+		if len(parts[2]) != 3 {
+			return nil, fmt.Errorf("invalid acl entry permissions %s", item)
+		}
+		if parts[2][0] == 'r' {
+			entry.perm |= 4
+		}
+		if parts[2][1] == 'w' {
+			entry.perm |= 2
+		}
+		// Sticky bit is reported as 't' in place of 'x' for other
+		if parts[2][2] == 'x' || parts[2][2] == 't' {
+			entry.perm |= 1
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// formatACL : Convert the list of entries to the ACL string expected by the service
+func formatACL(entries []aclEntry) string {
+	items := make([]string, 0, len(entries))
+
+	for _, entry := range entries {
+		perm := []byte("---")
+		if entry.perm&4 != 0 {
+			perm[0] = 'r'
+		}
+		if entry.perm&2 != 0 {
+			perm[1] = 'w'
+		}
+		if entry.perm&1 != 0 {
+			perm[2] = 'x'
+		}
+
+		scope := ""
+		if entry.isDefault {
+			scope = aclDefaultScope
+		}
+		items = append(items, fmt.Sprintf("%s%s:%s:%s", scope, aclTagNames[entry.tag], entry.qualifier, string(perm)))
+	}
+
+	return strings.Join(items, ",")
+}
+
+// encodePosixACL : Convert the access or default entries to the xattr value read by getfacl
+//
+//	Named entries whose user or group can not be mapped to a local id are left out
+func encodePosixACL(entries []aclEntry, isDefault bool, ids *identityMap) []byte {
+	type xattrEntry struct {
+		tag  uint16
+		perm uint16
+		id   uint32
+	}
+
+	xattrEntries := make([]xattrEntry, 0, len(entries))
+	for _, entry := range entries {
+		if entry.isDefault != isDefault {
+			continue
+		}
+
+		id := uint32(posixACLUndefinedID)
+		if entry.isNamed() {
+			var ok bool
+			if id, ok = ids.localID(entry.qualifier, entry.tag == aclTagGroup); !ok {
+				continue
+			}
+		}
+		xattrEntries = append(xattrEntries, xattrEntry{tag: entry.tag, perm: entry.perm, id: id})
+	}
+
+	// Kernel expects the entries ordered by tag and then by id
+	sort.SliceStable(xattrEntries, func(i, j int) bool {
+		if xattrEntries[i].tag != xattrEntries[j].tag {
+			return xattrEntries[i].tag < xattrEntries[j].tag
+		}
+		return xattrEntries[i].id < xattrEntries[j].id
+	})
+
+	value := make([]byte, posixACLHeaderSize+len(xattrEntries)*posixACLEntrySize)
+	binary.LittleEndian.PutUint32(value, posixACLXattrVersion)
+	for i, entry := range xattrEntries {
+		offset := posixACLHeaderSize + i*posixACLEntrySize
+		binary.LittleEndian.PutUint16(value[offset:], entry.tag)
+		binary.LittleEndian.PutUint16(value[offset+2:], entry.perm)
+		binary.LittleEndian.PutUint32(value[offset+4:], entry.id)
+	}
+
+	return value
+}
+
+// decodePosixACL : Convert the xattr value written by setfacl to list of entries, EINVAL if a named entry has no AAD identity
+func decodePosixACL(value []byte, isDefault bool, ids *identityMap) ([]aclEntry, error) {
+	if len(value) < posixACLHeaderSize || (len(value)-posixACLHeaderSize)%posixACLEntrySize != 0 ||
+		binary.LittleEndian.Uint32(value) != posixACLXattrVersion {
+		return nil, syscall.EINVAL
+	}
+
+	entries := make([]aclEntry, 0, (len(value)-posixACLHeaderSize)/posixACLEntrySize)
+	for offset := posixACLHeaderSize; offset < len(value); offset += posixACLEntrySize {
+		entry := aclEntry{
+			isDefault: isDefault,
+			tag:       binary.LittleEndian.Uint16(value[offset:]),
+			perm:      binary.LittleEndian.Uint16(value[offset+2:]) & 7,
+		}
+
+		if _, ok := aclTagNames[entry.tag]; !ok {
+			return nil, syscall.EINVAL
+		}
+		if entry.isNamed() {
+			// Storage takes AAD identities only, a local id it can not be mapped to is not stored as is
+			id := binary.LittleEndian.Uint32(value[offset+4:])
+			var ok bool
+			if entry.qualifier, ok = ids.aadID(id, entry.tag == aclTagGroup); !ok {
+				return nil, syscall.EINVAL
+			}
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// mergeACL : Replace the access or default entries of the current ACL with the updated ones
+//
+//	Named entries which could not be shown through the xattr are retained unless the ACL is being removed
+func mergeACL(current []aclEntry, updated []aclEntry, isDefault bool, ids *identityMap) []aclEntry {
+	merged := make([]aclEntry, 0, len(current)+len(updated))
+
+	for _, entry := range current {
+		if entry.isDefault != isDefault {
+			merged = append(merged, entry)
+		}
+	}
+
+	merged = append(merged, updated...)
+	if len(updated) == 0 {
+		return merged
+	}
+
+	for _, entry := range current {
+		if entry.isDefault == isDefault && entry.isNamed() {
+			if _, ok := ids.localID(entry.qualifier, entry.tag == aclTagGroup); !ok {
+				merged = append(merged, entry)
+			}
+		}
+	}
+
+	return merged
+}
+
+// hasACLEntries : Check whether there are any access or default entries in the list
+func hasACLEntries(entries []aclEntry, isDefault bool) bool {
+	for _, entry := range entries {
+		if entry.isDefault == isDefault {
+			return true
+		}
+	}
+	return false
+}
+
+// baseACL : Access entries that carry only the permission bits of a path
+func baseACL(entries []aclEntry) []aclEntry {
+	base := make([]aclEntry, 0, 3)
+	for _, entry := range entries {
+		if !entry.isDefault && (entry.tag == aclTagUserObj || entry.tag == aclTagGroupObj || entry.tag == aclTagOther) {
+			base = append(base, entry)
+		}
+	}
+	return base
+}
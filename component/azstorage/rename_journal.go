@@ -0,0 +1,253 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	// Blobs under this directory record directory renames which are in progress
+	renameJournalDir = ".blobfuse2-rename"
+
+	defaultRenameParallelism = 16
+
+	renameRecoveryResume   = "resume"
+	renameRecoveryRollback = "rollback"
+
+	copyPollMinDelay = 50 * time.Millisecond
+	copyPollMaxDelay = 2 * time.Second
+
+	// Lease on a journal while its rename is in progress, renewed till the rename is done
+	renameJournalLeaseSec = 60
+)
+
+// renameJournal : Progress of a directory rename, persisted as a blob till the rename completes
+type renameJournal struct {
+	Source    string    `json:"source"`
+	Target    string    `json:"target"`
+	Renamed   int64     `json:"renamed"`
+	StartTime time.Time `json:"start-time"`
+
+	leaseID string // Lease held on the journal blob by this mount
+}
+
+// journalPath : Path of the blob holding this journal, relative to the prefix path
+func (j *renameJournal) journalPath() string {
+	hash := md5.Sum([]byte(j.Source))
+	return filepath.Join(renameJournalDir, hex.EncodeToString(hash[:]))
+}
+
+// isRenameJournalPath : Check whether the given path belongs to rename journal directory
+func isRenameJournalPath(path string) bool {
+	return path == renameJournalDir || strings.HasPrefix(path, renameJournalDir+"/")
+}
+
+// writeRenameJournal : Create or overwrite the journal blob
+func (bb *BlockBlob) writeRenameJournal(journal *renameJournal) error {
+	data, err := json.Marshal(journal)
+	if err != nil {
+		return err
+	}
+
+	if journal.leaseID == "" {
+		return bb.WriteFromBuffer(journal.journalPath(), nil, data)
+	}
+
+	blobURL := bb.Container.NewBlockBlobURL(filepath.Join(bb.Config.prefixPath, journal.journalPath()))
+	accCond := bb.blobAccCond
+	accCond.LeaseAccessConditions.LeaseID = journal.leaseID
+	_, err = blobURL.Upload(context.Background(), bytes.NewReader(data), azblob.BlobHTTPHeaders{}, nil, accCond,
+		azblob.AccessTierNone, nil, bb.downloadOptions.ClientProvidedKeyOptions)
+	if err != nil {
+		log.Err("BlockBlob::writeRenameJournal : Failed to update rename journal of %s [%s]", journal.Source, err.Error())
+	}
+	return err
+}
+
+// deleteRenameJournal : Delete the journal blob once rename is complete
+func (bb *BlockBlob) deleteRenameJournal(journal *renameJournal) error {
+	var err error
+	if journal.leaseID == "" {
+		err = bb.DeleteFile(journal.journalPath())
+	} else {
+		blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, journal.journalPath()))
+		accCond := bb.blobAccCond
+		accCond.LeaseAccessConditions.LeaseID = journal.leaseID
+		_, err = blobURL.Delete(context.Background(), azblob.DeleteSnapshotsOptionInclude, accCond)
+	}
+	if err != nil {
+		log.Err("BlockBlob::deleteRenameJournal : Failed to delete rename journal of %s [%s]", journal.Source, err.Error())
+	}
+	return err
+}
+
+// leaseRenameJournal : Lease the journal so that other mounts do not replay the rename while this one works on it. The
+// lease is renewed till the returned function is called, which releases it.
+func (bb *BlockBlob) leaseRenameJournal(journal *renameJournal) (func(), error) {
+	blobURL := bb.Container.NewBlobURL(filepath.Join(bb.Config.prefixPath, journal.journalPath()))
+	resp, err := blobURL.AcquireLease(context.Background(), "", renameJournalLeaseSec, azblob.ModifiedAccessConditions{})
+	if err != nil {
+		return nil, err
+	}
+	journal.leaseID = resp.LeaseID()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(renameJournalLeaseSec * time.Second / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := blobURL.RenewLease(context.Background(), journal.leaseID, azblob.ModifiedAccessConditions{})
+				if err != nil {
+					log.Warn("BlockBlob::leaseRenameJournal : Failed to renew lease on rename journal of %s [%s]", journal.Source, err.Error())
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		// Journal is gone once the rename completes, which ends the lease as well
+		_, _ = blobURL.ReleaseLease(context.Background(), journal.leaseID, azblob.ModifiedAccessConditions{})
+		journal.leaseID = ""
+	}, nil
+}
+
+// RecoverRenames : Resume or roll back directory renames which were interrupted before completion
+func (bb *BlockBlob) RecoverRenames() error {
+	log.Trace("BlockBlob::RecoverRenames : rollback %t", bb.Config.renameRollback)
+
+	journals := make([]*renameJournal, 0)
+	for marker := (azblob.Marker{}); marker.NotDone(); {
+		listBlob, err := bb.Container.ListBlobsFlatSegment(context.Background(), marker,
+			azblob.ListBlobsSegmentOptions{MaxResults: common.MaxDirListCount,
+				Prefix: filepath.Join(bb.Config.prefixPath, renameJournalDir) + "/",
+			})
+
+		if err != nil {
+			log.Err("BlockBlob::RecoverRenames : Failed to list rename journals [%s]", err.Error())
+			return err
+		}
+		marker = listBlob.NextMarker
+
+		for _, blobInfo := range listBlob.Segment.BlobItems {
+			name := split(bb.Config.prefixPath, blobInfo.Name)
+			data, err := bb.ReadBuffer(name, 0, 0)
+			if err != nil {
+				log.Err("BlockBlob::RecoverRenames : Failed to read rename journal %s [%s]", name, err.Error())
+				continue
+			}
+
+			journal := &renameJournal{}
+			err = json.Unmarshal(data, journal)
+			if err != nil || journal.Source == "" || journal.Target == "" {
+				log.Err("BlockBlob::RecoverRenames : Discarding corrupt rename journal %s", name)
+				_ = bb.DeleteFile(name)
+				continue
+			}
+			journals = append(journals, journal)
+		}
+	}
+
+	var recoveryErr error
+	for _, journal := range journals {
+		release, err := bb.leaseRenameJournal(journal)
+		if err != nil {
+			if storeBlobErrToErr(err) == BlobIsUnderLease || storeBlobErrToErr(err) == ErrFileNotFound {
+				log.Info("BlockBlob::RecoverRenames : Rename of %s to %s is being recovered by another mount", journal.Source, journal.Target)
+				continue
+			}
+			log.Err("BlockBlob::RecoverRenames : Failed to lease rename journal of %s [%s]", journal.Source, err.Error())
+			recoveryErr = err
+			continue
+		}
+
+		err = bb.recoverRename(journal)
+		release()
+		if err != nil {
+			log.Err("BlockBlob::RecoverRenames : Failed to recover rename of %s to %s [%s]", journal.Source, journal.Target, err.Error())
+			recoveryErr = err
+		}
+	}
+
+	return recoveryErr
+}
+
+// recoverRename : Finish an interrupted rename, or move the already renamed blobs back to their source
+func (bb *BlockBlob) recoverRename(journal *renameJournal) error {
+	log.Info("BlockBlob::recoverRename : Recovering rename of %s to %s started at %s, %d blobs renamed so far",
+		journal.Source, journal.Target, journal.StartTime.String(), journal.Renamed)
+
+	// Rollback is nothing but a rename in the reverse direction, tracked by the original journal
+	src, dst := journal.Source, journal.Target
+	if bb.Config.renameRollback {
+		src, dst = dst, src
+	}
+
+	err := bb.renameChildren(src, dst, journal)
+	if err != nil {
+		return err
+	}
+
+	// Directory marker is renamed last so it may still be sitting at the source
+	err = bb.RenameFile(src, dst)
+	if err != nil && err != syscall.ENOENT {
+		return err
+	}
+
+	log.Info("BlockBlob::recoverRename : Recovered rename of %s to %s by moving blobs from %s",
+		journal.Source, journal.Target, src)
+	return bb.deleteRenameJournal(journal)
+}
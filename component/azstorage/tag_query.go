@@ -0,0 +1,317 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+)
+
+const (
+	// Index tags of a blob are exposed as xattrs with this prefix followed by the tag name
+	blobTagXattrPrefix = "user.tag."
+
+	// Time for which the result of a tag query is reused before running it again
+	tagQueryCacheTimeout = 60 * time.Second
+
+	// Flags of setxattr as defined in linux/xattr.h
+	xattrCreate  = 0x1
+	xattrReplace = 0x2
+)
+
+// blobTagKey : Get the name of the index tag addressed by a user.tag.* xattr
+func blobTagKey(attr string) (string, bool) {
+	if !strings.HasPrefix(attr, blobTagXattrPrefix) || len(attr) == len(blobTagXattrPrefix) {
+		return "", false
+	}
+	return attr[len(blobTagXattrPrefix):], true
+}
+
+// tagQueryResult : Blobs matching a tag query and the time till which this result is valid
+type tagQueryResult struct {
+	blobs   map[string]bool
+	expires time.Time
+}
+
+// tagQueryCache : Recent tag query results keyed by the query expression
+type tagQueryCache struct {
+	sync.Mutex
+	results map[string]tagQueryResult
+}
+
+// get : Get the result of a query if it has not expired yet
+func (c *tagQueryCache) get(expr string) (map[string]bool, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	result, found := c.results[expr]
+	if !found || time.Now().After(result.expires) {
+		return nil, false
+	}
+	return result.blobs, true
+}
+
+// put : Save the result of a query, dropping any other result which has expired
+func (c *tagQueryCache) put(expr string, blobs map[string]bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if c.results == nil {
+		c.results = make(map[string]tagQueryResult)
+	}
+	for k, v := range c.results {
+		if now.After(v.expires) {
+			delete(c.results, k)
+		}
+	}
+	c.results[expr] = tagQueryResult{blobs: blobs, expires: now.Add(tagQueryCacheTimeout)}
+}
+
+// clear : Drop all saved results
+func (c *tagQueryCache) clear() {
+	c.Lock()
+	defer c.Unlock()
+	c.results = nil
+}
+
+// isTagQueryPath : Check whether the path is the tag query directory or lies under it
+func isTagQueryPath(dir string, name string) bool {
+	if dir == "" {
+		return false
+	}
+	name = strings.Trim(name, "/")
+	return name == dir || strings.HasPrefix(name, dir+"/")
+}
+
+// splitTagQueryPath : Split a path under the tag query directory into the url-encoded query expression
+// and the path of the blob relative to the mount, either of which is empty for the directories above it
+func splitTagQueryPath(dir string, name string) (expr string, blobPath string, err error) {
+	rest := strings.TrimPrefix(strings.Trim(name, "/"), dir)
+	rest = strings.TrimPrefix(rest, "/")
+	if rest == "" {
+		return "", "", nil
+	}
+
+	parts := strings.SplitN(rest, "/", 2)
+	expr, err = url.PathUnescape(parts[0])
+	if err != nil || strings.TrimSpace(expr) == "" {
+		return "", "", syscall.EINVAL
+	}
+
+	if len(parts) == 2 {
+		blobPath = parts[1]
+	}
+	return expr, blobPath, nil
+}
+
+// tagQueryChildren : Get the sorted names of directories and files directly under a path among the matched blobs
+func tagQueryChildren(blobs map[string]bool, blobPath string) (dirs []string, files []string) {
+	prefix := ""
+	if blobPath != "" {
+		prefix = internal.ExtendDirName(blobPath)
+	}
+
+	seen := make(map[string]bool)
+	for blob := range blobs {
+		if !strings.HasPrefix(blob, prefix) {
+			continue
+		}
+
+		child := blob[len(prefix):]
+		if i := strings.Index(child, "/"); i >= 0 {
+			if !seen[child[:i]] {
+				seen[child[:i]] = true
+				dirs = append(dirs, child[:i])
+			}
+		} else if child != "" {
+			files = append(files, child)
+		}
+	}
+
+	sort.Strings(dirs)
+	sort.Strings(files)
+	return dirs, files
+}
+
+// inTagQueryDir : Check whether the path is served from the tag query directory
+func (az *AzStorage) inTagQueryDir(name string) bool {
+	return isTagQueryPath(az.stConfig.tagQueryDir, name)
+}
+
+// resolveTagQueryPath : Get the path of the blob shown at a path under the tag query directory
+func (az *AzStorage) resolveTagQueryPath(name string) string {
+	if !az.inTagQueryDir(name) {
+		return name
+	}
+
+	_, blobPath, _ := splitTagQueryPath(az.stConfig.tagQueryDir, name)
+	return blobPath
+}
+
+// queryTags : Get the blobs matching the expression, reusing a recent result of the same query
+func (az *AzStorage) queryTags(expr string) (map[string]bool, error) {
+	if blobs, found := az.tagQueries.get(expr); found {
+		return blobs, nil
+	}
+
+	names, err := az.storage.FindBlobsByTags(expr)
+	if err != nil {
+		log.Err("AzStorage::queryTags : Failed to run query %s [%s]", expr, err.Error())
+		return nil, err
+	}
+
+	blobs := make(map[string]bool, len(names))
+	for _, name := range names {
+		blobs[name] = true
+	}
+	az.tagQueries.put(expr, blobs)
+
+	log.Debug("AzStorage::queryTags : Query %s matched %d blobs", expr, len(blobs))
+	return blobs, nil
+}
+
+// tagQueryDirAttr : Attributes of a directory under the tag query directory
+func (az *AzStorage) tagQueryDirAttr(name string) *internal.ObjAttr {
+	return &internal.ObjAttr{
+		Path:   internal.TruncateDirName(name),
+		Name:   filepath.Base(name),
+		Mode:   os.ModeDir | 0555,
+		Mtime:  az.startTime,
+		Atime:  az.startTime,
+		Ctime:  az.startTime,
+		Crtime: az.startTime,
+		Flags:  internal.NewDirBitMap(),
+	}
+}
+
+// tagQueryFileAttr : Attributes of a matched blob shown as a read-only file at the given path
+func (az *AzStorage) tagQueryFileAttr(name string, blobPath string) (*internal.ObjAttr, error) {
+	attr, err := az.storage.GetAttr(blobPath)
+	if err != nil {
+		return nil, err
+	}
+
+	attr.Path = name
+	attr.Name = filepath.Base(name)
+	if attr.IsModeDefault() {
+		attr.Flags.Clear(internal.PropFlagModeDefault)
+		attr.Mode = 0444
+	} else {
+		attr.Mode &^= 0222
+	}
+
+	return attr, nil
+}
+
+// tagQueryGetAttr : Attributes of a path under the tag query directory
+func (az *AzStorage) tagQueryGetAttr(name string) (*internal.ObjAttr, error) {
+	expr, blobPath, err := splitTagQueryPath(az.stConfig.tagQueryDir, name)
+	if err != nil {
+		return nil, syscall.ENOENT
+	} else if expr == "" {
+		return az.tagQueryDirAttr(name), nil
+	}
+
+	// Run the query for the expression directory itself so that an invalid expression fails on lookup
+	blobs, err := az.queryTags(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	if blobPath == "" {
+		return az.tagQueryDirAttr(name), nil
+	} else if blobs[blobPath] {
+		return az.tagQueryFileAttr(name, blobPath)
+	}
+
+	prefix := internal.ExtendDirName(blobPath)
+	for blob := range blobs {
+		if strings.HasPrefix(blob, prefix) {
+			return az.tagQueryDirAttr(name), nil
+		}
+	}
+
+	return nil, syscall.ENOENT
+}
+
+// tagQueryList : List a directory under the tag query directory
+func (az *AzStorage) tagQueryList(name string) ([]*internal.ObjAttr, error) {
+	list := make([]*internal.ObjAttr, 0)
+
+	expr, blobPath, err := splitTagQueryPath(az.stConfig.tagQueryDir, name)
+	if err != nil {
+		return list, syscall.ENOENT
+	} else if expr == "" {
+		// Queries can not be enumerated, these are looked up by name
+		return list, nil
+	}
+
+	blobs, err := az.queryTags(expr)
+	if err != nil {
+		return list, err
+	}
+
+	dirs, files := tagQueryChildren(blobs, blobPath)
+	if blobPath != "" && len(dirs) == 0 && len(files) == 0 {
+		return list, syscall.ENOENT
+	}
+
+	dirPath := internal.TruncateDirName(name)
+	for _, dir := range dirs {
+		list = append(list, az.tagQueryDirAttr(filepath.Join(dirPath, dir)))
+	}
+
+	for _, file := range files {
+		attr, err := az.tagQueryFileAttr(filepath.Join(dirPath, file), filepath.Join(blobPath, file))
+		if err == syscall.ENOENT {
+			// Blob was deleted after the query was run
+			continue
+		} else if err != nil {
+			return list, err
+		}
+		list = append(list, attr)
+	}
+
+	return list, nil
+}
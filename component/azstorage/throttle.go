@@ -0,0 +1,222 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+// tokenBucket : Rate limiter which lets a caller take more tokens than available and makes it wait till the debt is
+// refilled, so large transfers are paced at the configured rate instead of being rejected. Zero rate means no limit.
+type tokenBucket struct {
+	sync.Mutex
+	rate   float64 // tokens added per second
+	tokens float64 // tokens available, negative when callers are waiting
+	last   time.Time
+}
+
+// setRate : Change the rate of the bucket, capacity of the bucket is tokens of one second
+func (tb *tokenBucket) setRate(rate int64) {
+	tb.Lock()
+	defer tb.Unlock()
+
+	// Bucket starts full when a limit is put on unlimited traffic
+	first := tb.rate <= 0
+	tb.refill(time.Now())
+	tb.rate = float64(rate)
+	if first || tb.tokens > tb.rate {
+		tb.tokens = tb.rate
+	}
+}
+
+// limited : Whether a limit is set on the bucket
+func (tb *tokenBucket) limited() bool {
+	tb.Lock()
+	defer tb.Unlock()
+	return tb.rate > 0
+}
+
+// refill : Add tokens for the time elapsed since last refill, caller must hold the lock
+func (tb *tokenBucket) refill(now time.Time) {
+	if !tb.last.IsZero() {
+		tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+		if tb.tokens > tb.rate {
+			tb.tokens = tb.rate
+		}
+	}
+	tb.last = now
+}
+
+// reserve : Take n tokens and get the time to wait before they can be used
+func (tb *tokenBucket) reserve(n int64) time.Duration {
+	tb.Lock()
+	defer tb.Unlock()
+
+	if tb.rate <= 0 {
+		return 0
+	}
+
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+
+	return time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+}
+
+// wait : Take n tokens and block till they are available or the context is done
+func (tb *tokenBucket) wait(ctx context.Context, n int64) (time.Duration, error) {
+	delay := tb.reserve(n)
+	if delay == 0 {
+		return 0, nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, ctx.Err()
+	}
+}
+
+// throttler : Limits on traffic to the storage account, shared by all pipelines of a mount so that a config reload
+// applies to requests already in flight
+type throttler struct {
+	upload   tokenBucket
+	download tokenBucket
+	requests tokenBucket
+
+	mu     sync.Mutex
+	limits [3]int64 // upload, download and request limits as configured
+}
+
+// update : Set the limits, zero removes the limit
+func (t *throttler) update(uploadBytes int64, downloadBytes int64, requests int64) {
+	t.upload.setRate(uploadBytes)
+	t.download.setRate(downloadBytes)
+	t.requests.setRate(requests)
+
+	t.mu.Lock()
+	t.limits = [3]int64{uploadBytes, downloadBytes, requests}
+	t.mu.Unlock()
+
+	log.Info("throttler::update : upload %d bytes/sec, download %d bytes/sec, %d requests/sec", uploadBytes, downloadBytes, requests)
+	t.exportLimits()
+}
+
+// exportLimits : Publish the configured limits, stats collector is created only on start so this is called again from there
+func (t *throttler) exportLimits() {
+	if azStatsCollector == nil {
+		return
+	}
+
+	t.mu.Lock()
+	limits := t.limits
+	t.mu.Unlock()
+
+	azStatsCollector.UpdateStats(stats_manager.Replace, uploadLimit, limits[0])
+	azStatsCollector.UpdateStats(stats_manager.Replace, downloadLimit, limits[1])
+	azStatsCollector.UpdateStats(stats_manager.Replace, requestLimit, limits[2])
+}
+
+// throttleRequest : Wait till the request is within limits and pace sending of its body as per the upload limit.
+// Body is wrapped in a copy of the request as retries rewind the body of the original one.
+func (t *throttler) throttleRequest(ctx context.Context, req *http.Request) (*http.Request, error) {
+	if t.requests.limited() {
+		delay, err := t.requests.wait(ctx, 1)
+		t.recordWait(throttledRequests, delay)
+		if err != nil {
+			return req, err
+		}
+	}
+
+	if t.upload.limited() && req.Body != nil && req.Body != http.NoBody {
+		throttled := *req
+		throttled.Body = &throttledReader{ReadCloser: req.Body, ctx: ctx, t: t, bucket: &t.upload, key: throttledUploads}
+		return &throttled, nil
+	}
+	return req, nil
+}
+
+// throttleResponse : Pace reading of the response body as per the download limit
+func (t *throttler) throttleResponse(ctx context.Context, resp *http.Response) {
+	if t.download.limited() && resp != nil && resp.Body != nil && resp.Body != http.NoBody {
+		resp.Body = &throttledReader{ReadCloser: resp.Body, ctx: ctx, t: t, bucket: &t.download, key: throttledDownloads}
+	}
+}
+
+// recordWait : Export the time a request was held back
+func (t *throttler) recordWait(key string, delay time.Duration) {
+	if delay == 0 {
+		return
+	}
+
+	log.Debug("throttler::recordWait : %s delayed by %s", key, delay.String())
+	if azStatsCollector != nil {
+		azStatsCollector.UpdateStats(stats_manager.Increment, key, (int64)(1))
+		azStatsCollector.UpdateStats(stats_manager.Increment, throttleWaitMs, delay.Milliseconds())
+	}
+}
+
+// throttledReader : Request or response body which waits for tokens of its bucket for the bytes read
+type throttledReader struct {
+	io.ReadCloser
+	ctx    context.Context
+	t      *throttler
+	bucket *tokenBucket
+	key    string
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		delay, werr := r.bucket.wait(r.ctx, int64(n))
+		r.t.recordWait(r.key, delay)
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+	return n, err
+}
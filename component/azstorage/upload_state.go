@@ -0,0 +1,485 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package azstorage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+)
+
+const (
+	defaultUploadStateDir = "uploads"
+	uploadStateExt        = ".json"
+
+	// All blocks of a blob need ids of same length, so uploads driven from here use a fixed length
+	uploadBlockIdLength = 16
+)
+
+// stagedBlock : A block of an in-progress upload
+type stagedBlock struct {
+	Id     string `json:"id"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// uploadState : Blocks of an in-progress upload, persisted till the block list is committed
+type uploadState struct {
+	Name  string `json:"name"`
+	Scope string `json:"scope"` // Account, container and subdirectory the blob is in
+
+	// Local file being uploaded, empty when blocks are staged from memory
+	LocalPath string            `json:"local-path,omitempty"`
+	Size      int64             `json:"size"`
+	ModTime   time.Time         `json:"mod-time"`
+	BlockSize int64             `json:"block-size"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Blocks    []stagedBlock     `json:"blocks"`
+}
+
+// matches : Check whether this state was created for the same version of the local file
+func (st *uploadState) matches(size int64, modTime time.Time, blockSize int64) bool {
+	return st.Size == size && st.ModTime.Equal(modTime) && st.BlockSize == blockSize
+}
+
+// sourceUnchanged : Check the local file of this state is still at its path and is the version the state was made for
+func (st *uploadState) sourceUnchanged(fi *os.File) bool {
+	opened, err := fi.Stat()
+	if err != nil {
+		return false
+	}
+	current, err := os.Stat(st.LocalPath)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(opened, current) && st.matches(current.Size(), current.ModTime(), st.BlockSize)
+}
+
+// newUploadPlan : Split a file of given size in blocks with fresh ids
+func newUploadPlan(size int64, blockSize int64) []stagedBlock {
+	blocks := make([]stagedBlock, 0, (size+blockSize-1)/blockSize)
+	for offset := int64(0); offset < size; offset += blockSize {
+		length := blockSize
+		if offset+length > size {
+			length = size - offset
+		}
+		blocks = append(blocks, stagedBlock{
+			Id:     base64.StdEncoding.EncodeToString(common.NewUUIDWithLength(uploadBlockIdLength)),
+			Offset: offset,
+			Size:   length,
+		})
+	}
+	return blocks
+}
+
+// missingBlocks : Blocks which are not in the uncommitted block list of the blob and need to be staged again
+func missingBlocks(blocks []stagedBlock, uncommitted []azblob.Block) []stagedBlock {
+	staged := make(map[string]int64, len(uncommitted))
+	for _, blk := range uncommitted {
+		staged[blk.Name] = blk.Size
+	}
+
+	missing := make([]stagedBlock, 0)
+	for _, blk := range blocks {
+		if size, ok := staged[blk.Id]; !ok || size != blk.Size {
+			missing = append(missing, blk)
+		}
+	}
+	return missing
+}
+
+// uploadStateStore : Directory holding state of in-progress uploads, one file per blob. Mounts on a host share the
+// root directory, each keeps its uploads in a directory of its own account, container and subdirectory.
+type uploadStateStore struct {
+	dir   string
+	scope string
+}
+
+// newUploadStateStore : Create the store of the given container under root, making the directory if required
+func newUploadStateStore(root string, account string, container string, prefixPath string) (*uploadStateStore, error) {
+	dir := filepath.Join(root, account, container, prefixPath)
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return &uploadStateStore{
+		dir:   dir,
+		scope: strings.Join([]string{account, container, prefixPath}, "/"),
+	}, nil
+}
+
+// path : Local file holding state of upload of the given blob
+func (s *uploadStateStore) path(name string) string {
+	hash := md5.Sum([]byte(s.scope + "\n" + name))
+	return filepath.Join(s.dir, hex.EncodeToString(hash[:])+uploadStateExt)
+}
+
+// load : Read state of the upload of given blob, nil if there is no upload in progress
+func (s *uploadStateStore) load(name string) *uploadState {
+	data, err := ioutil.ReadFile(s.path(name))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warn("uploadStateStore::load : Failed to read upload state of %s [%s]", name, err.Error())
+		}
+		return nil
+	}
+
+	st := &uploadState{}
+	err = json.Unmarshal(data, st)
+	if err != nil || st.Name != name {
+		log.Warn("uploadStateStore::load : Discarding corrupt upload state of %s", name)
+		s.remove(name)
+		return nil
+	}
+	if st.Scope != s.scope {
+		log.Warn("uploadStateStore::load : Upload state of %s belongs to %s, ignoring it", name, st.Scope)
+		return nil
+	}
+	return st
+}
+
+// save : Persist the state, replacing the earlier one atomically so a crash never leaves a partial file
+func (s *uploadStateStore) save(st *uploadState) error {
+	st.Scope = s.scope
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+
+	path := s.path(st.Name)
+	err = ioutil.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// remove : Delete state once the upload is committed
+func (s *uploadStateStore) remove(name string) {
+	err := os.Remove(s.path(name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("uploadStateStore::remove : Failed to remove upload state of %s [%s]", name, err.Error())
+	}
+}
+
+// pending : All uploads which were in progress when blobfuse2 last stopped
+func (s *uploadStateStore) pending() []*uploadState {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		log.Err("uploadStateStore::pending : Failed to read %s [%s]", s.dir, err.Error())
+		return nil
+	}
+
+	states := make([]*uploadState, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), uploadStateExt) {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(s.dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+
+		st := &uploadState{}
+		if json.Unmarshal(data, st) != nil || st.Name == "" {
+			log.Warn("uploadStateStore::pending : Discarding corrupt upload state %s", entry.Name())
+			_ = os.Remove(filepath.Join(s.dir, entry.Name()))
+			continue
+		}
+		if st.Scope != s.scope {
+			// Left by another mount, which resumes it
+			continue
+		}
+		states = append(states, st)
+	}
+	return states
+}
+
+// uncommittedBlocks : Blocks staged on the blob which are not yet committed
+func (bb *BlockBlob) uncommittedBlocks(blobURL azblob.BlockBlobURL) ([]azblob.Block, error) {
+	resp, err := blobURL.GetBlockList(context.Background(), azblob.BlockListUncommitted, bb.blobAccCond.LeaseAccessConditions)
+	if err != nil {
+		if storeBlobErrToErr(err) == ErrFileNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return resp.UncommittedBlocks, nil
+}
+
+// resumableUpload : Upload the file block by block, recording the blocks so an interrupted upload stages only the
+// blocks missing from the uncommitted block list when retried
+func (bb *BlockBlob) resumableUpload(name string, fi *os.File, stat os.FileInfo, options azblob.UploadToBlockBlobOptions,
+	resumed bool) error {
+	blobMtx := bb.blockLocks.GetLock(name)
+	blobMtx.Lock()
+	defer blobMtx.Unlock()
+
+	store := bb.Config.uploadState
+	blobURL := bb.Container.NewBlockBlobURL(filepath.Join(bb.Config.prefixPath, name))
+
+	if (stat.Size()+options.BlockSize-1)/options.BlockSize > azblob.BlockBlobMaxBlocks {
+		return errors.New("buffer is too large to upload to a block blob")
+	}
+
+	st := store.load(name)
+	toStage := []stagedBlock{}
+	if st != nil && st.matches(stat.Size(), stat.ModTime(), options.BlockSize) {
+		uncommitted, err := bb.uncommittedBlocks(blobURL)
+		if err != nil {
+			log.Err("BlockBlob::resumableUpload : Failed to get uncommitted blocks of %s [%s]", name, err.Error())
+			return err
+		}
+
+		toStage = missingBlocks(st.Blocks, uncommitted)
+		log.Info("BlockBlob::resumableUpload : Resuming upload of %s, %d of %d blocks already staged",
+			name, len(st.Blocks)-len(toStage), len(st.Blocks))
+		if azStatsCollector != nil {
+			azStatsCollector.UpdateStats(stats_manager.Increment, resumedUploads, (int64)(1))
+		}
+	} else {
+		st = &uploadState{
+			Name:      name,
+			LocalPath: fi.Name(),
+			Size:      stat.Size(),
+			ModTime:   stat.ModTime(),
+			BlockSize: options.BlockSize,
+			Metadata:  options.Metadata,
+			Blocks:    newUploadPlan(stat.Size(), options.BlockSize),
+		}
+		toStage = st.Blocks
+
+		err := store.save(st)
+		if err != nil {
+			// Upload still goes ahead, it just can not be resumed
+			log.Warn("BlockBlob::resumableUpload : Failed to save upload state of %s [%s]", name, err.Error())
+		}
+	}
+
+	err := bb.stageFileBlocks(name, fi, blobURL, toStage, stat.Size(), options)
+	if err != nil {
+		return err
+	}
+
+	// File left by an earlier mount may have been changed or removed locally while it was being uploaded
+	if resumed && !st.sourceUnchanged(fi) {
+		log.Warn("BlockBlob::resumableUpload : %s changed while its upload was resumed, discarding", st.LocalPath)
+		store.remove(name)
+		return syscall.ESTALE
+	}
+
+	blockIDList := make([]string, 0, len(st.Blocks))
+	for _, blk := range st.Blocks {
+		blockIDList = append(blockIDList, blk.Id)
+	}
+
+	_, err = blobURL.CommitBlockList(context.Background(),
+		blockIDList,
+		options.BlobHTTPHeaders,
+		options.Metadata,
+		bb.blobAccCond,
+		options.BlobAccessTier,
+		nil,
+		bb.downloadOptions.ClientProvidedKeyOptions)
+	if err != nil {
+		log.Err("BlockBlob::resumableUpload : Failed to commit block list to blob %s [%s]", name, err.Error())
+		return err
+	}
+
+	store.remove(name)
+	return nil
+}
+
+// stageFileBlocks : Stage the given blocks of the local file in parallel
+func (bb *BlockBlob) stageFileBlocks(name string, fi *os.File, blobURL azblob.BlockBlobURL, blocks []stagedBlock,
+	size int64, options azblob.UploadToBlockBlobOptions) error {
+	// Blocks staged earlier count as transferred for progress
+	transferred := size
+	jobs := make(chan stagedBlock, len(blocks))
+	for _, blk := range blocks {
+		transferred -= blk.Size
+		jobs <- blk
+	}
+	close(jobs)
+
+	var wg sync.WaitGroup
+	var progressMtx sync.Mutex
+	var failed int64
+	for i := 0; i < int(options.Parallelism); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, options.BlockSize)
+			for blk := range jobs {
+				if atomic.LoadInt64(&failed) > 0 {
+					continue
+				}
+
+				_, err := fi.ReadAt(buf[:blk.Size], blk.Offset)
+				if err == nil {
+					_, err = blobURL.StageBlock(context.Background(),
+						blk.Id,
+						bytes.NewReader(buf[:blk.Size]),
+						bb.blobAccCond.LeaseAccessConditions,
+						nil,
+						bb.downloadOptions.ClientProvidedKeyOptions)
+				}
+				if err != nil {
+					log.Err("BlockBlob::stageFileBlocks : Failed to stage block of %s at offset %d [%s]", name, blk.Offset, err.Error())
+					atomic.AddInt64(&failed, 1)
+					continue
+				}
+
+				done := atomic.AddInt64(&transferred, blk.Size)
+				if options.Progress != nil {
+					progressMtx.Lock()
+					options.Progress(done)
+					progressMtx.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("failed to stage %d blocks of %s", failed, name)
+	}
+	return nil
+}
+
+// recordStagedBlocks : Persist dirty blocks of the list before staging them. If an earlier flush of the blob failed
+// midway, blocks it recorded which are missing from the uncommitted block list are marked dirty again. Returns true
+// if such a flush is pending, in which case the block list has to be committed even if nothing is dirty now.
+func (bb *BlockBlob) recordStagedBlocks(name string, blobURL azblob.BlockBlobURL, bol *common.BlockOffsetList) bool {
+	store := bb.Config.uploadState
+	pendingFlush := false
+
+	if st := store.load(name); st != nil {
+		pendingFlush = true
+		uncommitted, err := bb.uncommittedBlocks(blobURL)
+		if err != nil {
+			log.Warn("BlockBlob::recordStagedBlocks : Failed to get uncommitted blocks of %s, staging all [%s]", name, err.Error())
+		}
+
+		missing := make(map[string]bool)
+		for _, blk := range missingBlocks(st.Blocks, uncommitted) {
+			missing[blk.Id] = true
+		}
+
+		for _, blk := range bol.BlockList {
+			if !missing[blk.Id] || blk.Dirty() {
+				continue
+			}
+			blk.Flags.Set(common.DirtyBlock)
+			if int64(len(blk.Data)) != blk.EndIndex-blk.StartIndex {
+				blk.Flags.Set(common.TruncatedBlock)
+			}
+		}
+	}
+
+	st := &uploadState{Name: name, Blocks: make([]stagedBlock, 0)}
+	for _, blk := range bol.BlockList {
+		if blk.Dirty() {
+			st.Blocks = append(st.Blocks, stagedBlock{Id: blk.Id, Offset: blk.StartIndex, Size: blk.EndIndex - blk.StartIndex})
+		}
+	}
+
+	if len(st.Blocks) > 0 {
+		err := store.save(st)
+		if err != nil {
+			log.Warn("BlockBlob::recordStagedBlocks : Failed to save upload state of %s [%s]", name, err.Error())
+		}
+	}
+
+	return pendingFlush
+}
+
+// ResumeUploads : Finish uploads of local files which were in progress when blobfuse2 last stopped
+func (bb *BlockBlob) ResumeUploads() {
+	for _, st := range bb.Config.uploadState.pending() {
+		if st.LocalPath == "" {
+			// Blocks were staged from memory, so there is nothing left to resume from
+			log.Warn("BlockBlob::ResumeUploads : Discarding interrupted flush of %s", st.Name)
+			bb.Config.uploadState.remove(st.Name)
+			continue
+		}
+
+		err := bb.resumeUpload(st)
+		if err != nil {
+			log.Err("BlockBlob::ResumeUploads : Failed to resume upload of %s [%s]", st.Name, err.Error())
+		}
+	}
+}
+
+// resumeUpload : Upload the local file of the given state again, provided it has not changed since
+func (bb *BlockBlob) resumeUpload(st *uploadState) error {
+	fi, err := os.Open(st.LocalPath)
+	if err != nil {
+		bb.Config.uploadState.remove(st.Name)
+		if os.IsNotExist(err) {
+			return syscall.ENOENT
+		}
+		return err
+	}
+	defer fi.Close()
+
+	if !st.sourceUnchanged(fi) {
+		log.Warn("BlockBlob::resumeUpload : %s changed since its upload was interrupted, discarding", st.LocalPath)
+		bb.Config.uploadState.remove(st.Name)
+		return nil
+	}
+
+	log.Info("BlockBlob::resumeUpload : Resuming upload of %s from %s", st.Name, st.LocalPath)
+	return bb.writeFromFile(st.Name, st.Metadata, fi, true)
+}
@@ -46,6 +46,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
@@ -99,8 +100,8 @@ func getAzBlobPipelineOptions(conf AzStorageConfig) (azblob.PipelineOptions, ste
 		SyslogDisabled: sysLogDisabled,
 	}
 	logOptions := getLogOptions(conf.sdkTrace)
-	if conf.proxyAddress == "" {
-		// If we did not set a proxy address in our config then use default settings
+	if conf.proxyAddress == "" && conf.throttle == nil && conf.concurrency == nil && conf.breaker == nil {
+		// If we did not set a proxy address, limits, adaptive concurrency or circuit breaker in our config then use default settings
 		return azblob.PipelineOptions{
 				Log:        logOptions,
 				RequestLog: requestLogOptions,
@@ -109,14 +110,14 @@ func getAzBlobPipelineOptions(conf AzStorageConfig) (azblob.PipelineOptions, ste
 			// Set RetryOptions to control how HTTP request are retried when retryable failures occur
 			retryOptions
 	} else {
-		// Else create custom HTTPClient to pass to the factory in order to set our proxy
+		// Else create custom HTTPClient to pass to the factory in order to set our proxy, limits, concurrency control and breaker
 		var pipelineHTTPClient = newBlobfuse2HttpClient(conf)
 		// While creating new pipeline we need to provide the retry policy
 		return azblob.PipelineOptions{
 				Log:        logOptions,
 				RequestLog: requestLogOptions,
 				Telemetry:  telemetryOptions,
-				HTTPSender: newBlobfuse2HTTPClientFactory(pipelineHTTPClient),
+				HTTPSender: newBlobfuse2HTTPClientFactory(pipelineHTTPClient, conf),
 			},
 			// Set RetryOptions to control how HTTP request are retried when retryable failures occur
 			retryOptions
@@ -141,8 +142,8 @@ func getAzBfsPipelineOptions(conf AzStorageConfig) (azbfs.PipelineOptions, ste.X
 		SyslogDisabled: sysLogDisabled,
 	}
 	logOptions := getLogOptions(conf.sdkTrace)
-	if conf.proxyAddress == "" {
-		// If we did not set a proxy address in our config then use default settings
+	if conf.proxyAddress == "" && conf.throttle == nil && conf.concurrency == nil && conf.breaker == nil {
+		// If we did not set a proxy address, limits, adaptive concurrency or circuit breaker in our config then use default settings
 		return azbfs.PipelineOptions{
 				Log:        logOptions,
 				RequestLog: requestLogOptions,
@@ -151,29 +152,32 @@ func getAzBfsPipelineOptions(conf AzStorageConfig) (azbfs.PipelineOptions, ste.X
 			// Set RetryOptions to control how HTTP request are retried when retryable failures occur
 			retryOptions
 	} else {
-		// Else create custom HTTPClient to pass to the factory in order to set our proxy
+		// Else create custom HTTPClient to pass to the factory in order to set our proxy, limits, concurrency control and breaker
 		var pipelineHTTPClient = newBlobfuse2HttpClient(conf)
 		// While creating new pipeline we need to provide the retry policy
 		return azbfs.PipelineOptions{
 				Log:        logOptions,
 				RequestLog: requestLogOptions,
 				Telemetry:  telemetryOptions,
-				HTTPSender: newBlobfuse2HTTPClientFactory(pipelineHTTPClient),
+				HTTPSender: newBlobfuse2HTTPClientFactory(pipelineHTTPClient, conf),
 			},
 			// Set RetryOptions to control how HTTP request are retried when retryable failures occur
 			retryOptions
 	}
 }
 
-// Create an HTTP Client with configured proxy
+// Create an HTTP Client with configured proxy, or proxy from environment if none is configured
 // TODO: More configurations for other http client parameters?
 func newBlobfuse2HttpClient(conf AzStorageConfig) *http.Client {
-	var ProxyURL func(req *http.Request) (*url.URL, error) = func(req *http.Request) (*url.URL, error) {
-		// If a proxy address is passed return
-		var proxyURL url.URL = url.URL{
-			Host: conf.proxyAddress,
+	var ProxyURL func(req *http.Request) (*url.URL, error) = http.ProxyFromEnvironment
+	if conf.proxyAddress != "" {
+		ProxyURL = func(req *http.Request) (*url.URL, error) {
+			// If a proxy address is passed return
+			var proxyURL url.URL = url.URL{
+				Host: conf.proxyAddress,
+			}
+			return &proxyURL, nil
 		}
-		return &proxyURL, nil
 	}
 	return &http.Client{
 		Transport: &http.Transport{
@@ -199,13 +203,45 @@ func newBlobfuse2HttpClient(conf AzStorageConfig) *http.Client {
 }
 
 // newBlobfuse2HTTPClientFactory creates a custom HTTPClientPolicyFactory object that sends HTTP requests to the http client.
-func newBlobfuse2HTTPClientFactory(pipelineHTTPClient *http.Client) pipeline.Factory {
+// If a throttler is given every try of a request waits for its limits before being sent.
+// If a concurrency controller is given every try waits out Retry-After of the service and reports its response.
+// If a circuit breaker is given requests are failed right away while it is open.
+func newBlobfuse2HTTPClientFactory(pipelineHTTPClient *http.Client, conf AzStorageConfig) pipeline.Factory {
+	t, cc, cb := conf.throttle, conf.concurrency, conf.breaker
 	return pipeline.FactoryFunc(func(next pipeline.Policy, po *pipeline.PolicyOptions) pipeline.PolicyFunc {
 		return func(ctx context.Context, request pipeline.Request) (pipeline.Response, error) {
+			if cb != nil && !cb.allow() {
+				return nil, errCircuitOpen
+			}
+
+			if cc != nil {
+				if err := cc.wait(ctx); err != nil {
+					return nil, pipeline.NewError(err, "HTTP request paused")
+				}
+			}
+
+			if t != nil {
+				throttled, err := t.throttleRequest(ctx, request.Request)
+				if err != nil {
+					return nil, pipeline.NewError(err, "HTTP request throttled")
+				}
+				request.Request = throttled
+			}
+
 			r, err := pipelineHTTPClient.Do(request.WithContext(ctx))
+			if cb != nil {
+				cb.record(err)
+			}
 			if err != nil {
 				err = pipeline.NewError(err, "HTTP request failed")
 				log.Err("BlockBlob::newBlobfuse2HTTPClientFactory : HTTP request failed")
+			} else {
+				if cc != nil {
+					cc.onResponse(r)
+				}
+				if t != nil {
+					t.throttleResponse(ctx, r)
+				}
 			}
 			return pipeline.NewHTTPResponse(r), err
 		}
@@ -282,6 +318,7 @@ const (
 	InvalidRange
 	BlobIsUnderLease
 	InvalidPermission
+	InvalidArgument
 )
 
 // ErrStr : Store error to string mapping
@@ -304,10 +341,12 @@ func storeBlobErrToErr(err error) uint16 {
 			return ErrFileNotFound
 		case azblob.ServiceCodeInvalidRange:
 			return InvalidRange
-		case azblob.ServiceCodeLeaseIDMissing:
+		case azblob.ServiceCodeLeaseIDMissing, azblob.ServiceCodeLeaseAlreadyPresent:
 			return BlobIsUnderLease
 		case azblob.ServiceCodeInsufficientAccountPermissions:
 			return InvalidPermission
+		case azblob.ServiceCodeInvalidQueryParameterValue, "InvalidTag":
+			return InvalidArgument
 		default:
 			return ErrUnknown
 		}
@@ -366,14 +405,131 @@ func parseMetadata(attr *internal.ObjAttr, metadata map[string]string) {
 	// Save the metadata in attributes so that later if someone wants to add anything it can work
 	attr.Metadata = metadata
 	for k, v := range metadata {
-		if strings.ToLower(k) == folderKey && v == "true" {
-			attr.Flags = internal.NewDirBitMap()
-			attr.Mode = attr.Mode | os.ModeDir
-		} else if strings.ToLower(k) == symlinkKey && v == "true" {
-			attr.Flags = internal.NewSymlinkBitMap()
-			attr.Mode = attr.Mode | os.ModeSymlink
+		switch strings.ToLower(k) {
+		case folderKey:
+			if v == "true" {
+				attr.Flags.Set(internal.PropFlagIsDir)
+				attr.Mode = attr.Mode | os.ModeDir
+			}
+		case symlinkKey:
+			if v == "true" {
+				attr.Flags.Set(internal.PropFlagSymlink)
+				attr.Mode = attr.Mode | os.ModeSymlink
+			}
+		case posixAtimeKey:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				attr.Atime = t
+			}
+		case posixMtimeKey:
+			if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+				attr.Mtime = t
+			}
+		}
+	}
+
+	// Mode and owner saved in metadata are honoured only when the storage has no native permission model
+	if !attr.IsModeDefault() {
+		return
+	}
+
+	if mode, err := strconv.ParseUint(getMetadataValue(metadata, posixModeKey), 8, 32); err == nil {
+		attr.Mode = (attr.Mode & os.ModeType) | (os.FileMode(mode) & posixModeMask)
+		attr.Flags.Clear(internal.PropFlagModeDefault)
+	}
+
+	uid, uidErr := strconv.ParseUint(getMetadataValue(metadata, posixUidKey), 10, 32)
+	gid, gidErr := strconv.ParseUint(getMetadataValue(metadata, posixGidKey), 10, 32)
+	if uidErr == nil && gidErr == nil {
+		attr.Uid = uint32(uid)
+		attr.Gid = uint32(gid)
+		attr.Flags.Set(internal.PropFlagOwnerSet)
+	}
+}
+
+// getMetadataValue : Look up a metadata key ignoring the case, as service may return keys in a different case
+func getMetadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.ToLower(k) == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// posixModeBits : Permission, setuid, setgid and sticky bits of a mode in their POSIX octal layout, which is how
+// libfuse passes them down
+func posixModeBits(mode os.FileMode) uint64 {
+	bits := uint64(mode & posixModeMask)
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	return bits
+}
+
+// newPosixMetadata : Convert POSIX attributes to the reserved metadata keys, unset attributes are skipped
+func newPosixMetadata(mode *os.FileMode, uid int, gid int, atime time.Time, mtime time.Time) map[string]string {
+	metadata := make(map[string]string)
+	if mode != nil {
+		metadata[posixModeKey] = strconv.FormatUint(posixModeBits(*mode), 8)
+	}
+	if uid >= 0 {
+		metadata[posixUidKey] = strconv.Itoa(uid)
+	}
+	if gid >= 0 {
+		metadata[posixGidKey] = strconv.Itoa(gid)
+	}
+	if !atime.IsZero() {
+		metadata[posixAtimeKey] = atime.UTC().Format(time.RFC3339Nano)
+	}
+	if !mtime.IsZero() {
+		metadata[posixMtimeKey] = mtime.UTC().Format(time.RFC3339Nano)
+	}
+	return metadata
+}
+
+// fillPosixOwner : Owner and group are honoured only together, so when one of them is saved on a blob which has
+// none the other is saved as it is shown till now, which is the mounting user
+func fillPosixOwner(metadata map[string]string) {
+	uid := getMetadataValue(metadata, posixUidKey)
+	gid := getMetadataValue(metadata, posixGidKey)
+	if (uid == "") == (gid == "") {
+		return
+	}
+
+	currentUID, currentGID, err := common.GetCurrentUser()
+	if err != nil {
+		log.Err("fillPosixOwner : Failed to get current user [%s]", err.Error())
+		return
+	}
+
+	if uid == "" {
+		metadata[posixUidKey] = strconv.FormatUint(uint64(currentUID), 10)
+	} else {
+		metadata[posixGidKey] = strconv.FormatUint(uint64(currentGID), 10)
+	}
+}
+
+// removeTimeMetadata : Content upload changes the last modified time, so saved times are stale once data is written
+func removeTimeMetadata(metadata map[string]string) map[string]string {
+	if getMetadataValue(metadata, posixAtimeKey) == "" && getMetadataValue(metadata, posixMtimeKey) == "" {
+		return metadata
+	}
+
+	// Caller may be holding on to this map so work on a copy
+	newMetadata := make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		key := strings.ToLower(k)
+		if key != posixAtimeKey && key != posixMtimeKey {
+			newMetadata[k] = v
 		}
 	}
+	return newMetadata
 }
 
 //    ----------- Content-type handling  ---------------
@@ -34,13 +34,28 @@
 package azstorage
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/Azure/azure-pipeline-go/pipeline"
 	"github.com/Azure/azure-storage-blob-go/azblob"
 	"github.com/Azure/azure-storage-fuse/v2/common"
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
@@ -408,6 +423,706 @@ func (s *utilsTestSuite) TestAutoDetectAuthMode() {
 	assert.Equal(authType, "sas")
 }
 
+func (s *utilsTestSuite) TestParsePosixMetadata() {
+	assert := assert.New(s.T())
+	mode := os.FileMode(0740)
+	atime := time.Date(2021, 1, 2, 3, 4, 5, 6, time.Local)
+	mtime := time.Date(2022, 1, 2, 3, 4, 5, 6, time.Local)
+
+	metadata := newPosixMetadata(&mode, 10, 20, atime, mtime)
+	metadata[folderKey] = "true"
+
+	attr := &internal.ObjAttr{Flags: internal.NewFileBitMap()}
+	attr.Flags.Set(internal.PropFlagModeDefault)
+	parseMetadata(attr, metadata)
+	assert.True(attr.IsDir())
+	assert.False(attr.IsModeDefault())
+	assert.EqualValues(os.ModeDir|0740, attr.Mode)
+	assert.True(attr.IsOwnerSet())
+	assert.EqualValues(10, attr.Uid)
+	assert.EqualValues(20, attr.Gid)
+	assert.True(attr.Atime.Equal(atime))
+	assert.True(attr.Mtime.Equal(mtime))
+
+	// Storage with native permissions does not take mode and owner from metadata
+	attr = &internal.ObjAttr{Mode: 0777, Flags: internal.NewFileBitMap()}
+	parseMetadata(attr, metadata)
+	assert.EqualValues(os.ModeDir|0777, attr.Mode)
+	assert.False(attr.IsOwnerSet())
+	assert.True(attr.Mtime.Equal(mtime))
+
+	// Unset values are not written
+	metadata = newPosixMetadata(nil, -1, 5, time.Time{}, mtime)
+	assert.Len(metadata, 2)
+	attr = &internal.ObjAttr{Flags: internal.NewFileBitMap()}
+	attr.Flags.Set(internal.PropFlagModeDefault)
+	parseMetadata(attr, metadata)
+	assert.True(attr.IsModeDefault())
+	assert.False(attr.IsOwnerSet())
+
+	// Setuid, setgid and sticky bits are kept, whether they come in POSIX or Go layout
+	mode = os.FileMode(04755)
+	metadata = newPosixMetadata(&mode, -1, -1, time.Time{}, time.Time{})
+	assert.Equal("4755", metadata[posixModeKey])
+	mode = os.ModeSetgid | os.ModeSticky | 0770
+	metadata = newPosixMetadata(&mode, -1, -1, time.Time{}, time.Time{})
+	assert.Equal("3770", metadata[posixModeKey])
+	attr = &internal.ObjAttr{Flags: internal.NewFileBitMap()}
+	attr.Flags.Set(internal.PropFlagModeDefault)
+	parseMetadata(attr, metadata)
+	assert.EqualValues(03770, attr.Mode)
+}
+
+func (s *utilsTestSuite) TestFillPosixOwner() {
+	assert := assert.New(s.T())
+	uid, gid, err := common.GetCurrentUser()
+	assert.Nil(err)
+
+	// Group not given is the one shown so far
+	metadata := newPosixMetadata(nil, 7, -1, time.Time{}, time.Time{})
+	fillPosixOwner(metadata)
+	assert.Equal("7", metadata[posixUidKey])
+	assert.Equal(strconv.FormatUint(uint64(gid), 10), metadata[posixGidKey])
+
+	metadata = newPosixMetadata(nil, -1, 5, time.Time{}, time.Time{})
+	fillPosixOwner(metadata)
+	assert.Equal(strconv.FormatUint(uint64(uid), 10), metadata[posixUidKey])
+	assert.Equal("5", metadata[posixGidKey])
+
+	attr := &internal.ObjAttr{Flags: internal.NewFileBitMap()}
+	attr.Flags.Set(internal.PropFlagModeDefault)
+	parseMetadata(attr, metadata)
+	assert.True(attr.IsOwnerSet())
+	assert.EqualValues(uid, attr.Uid)
+	assert.EqualValues(5, attr.Gid)
+
+	// Owner already saved in full is left alone
+	metadata = map[string]string{"Posix_uid": "1", posixGidKey: "2"}
+	fillPosixOwner(metadata)
+	assert.Len(metadata, 2)
+}
+
+func (s *utilsTestSuite) TestRemoveTimeMetadata() {
+	assert := assert.New(s.T())
+	metadata := map[string]string{"Posix_mtime": "x", posixAtimeKey: "y", posixModeKey: "755", "key": "value"}
+
+	newMetadata := removeTimeMetadata(metadata)
+	assert.Len(newMetadata, 2)
+	assert.Contains(newMetadata, posixModeKey)
+	assert.Contains(newMetadata, "key")
+	assert.Len(metadata, 4) // input is not modified
+
+	assert.Nil(removeTimeMetadata(nil))
+}
+
+func (s *utilsTestSuite) TestParseACL() {
+	assert := assert.New(s.T())
+	acl := "user::rwx,user:1001:r-x,user:a2b4c3d5-0000-1111-2222-333344445555:rw-,group::r--,mask::r-x,other::--t,default:user::rwx,default:group::---,default:other::---"
+
+	entries, err := parseACL(acl)
+	assert.Nil(err)
+	assert.Len(entries, 9)
+	assert.Equal(aclEntry{tag: aclTagUserObj, perm: 7}, entries[0])
+	assert.Equal(aclEntry{tag: aclTagUser, qualifier: "1001", perm: 5}, entries[1])
+	assert.Equal(aclEntry{tag: aclTagOther, perm: 1}, entries[5])
+	assert.Equal(aclEntry{isDefault: true, tag: aclTagUserObj, perm: 7}, entries[6])
+
+	// Sticky bit is not part of the entry permissions
+	assert.Equal(strings.Replace(acl, "--t", "--x", 1), formatACL(entries))
+
+	for _, invalid := range []string{"user:rwx", "owner::rwx", "user::rw"} {
+		_, err = parseACL(invalid)
+		assert.NotNil(err, invalid)
+	}
+}
+
+func (s *utilsTestSuite) TestPosixACLXattr() {
+	assert := assert.New(s.T())
+	entries, err := parseACL("user::rwx,group:20:rw-,user:a2b4c3d5-0000-1111-2222-333344445555:rw-,user:10:r--,group::r-x,mask::rwx,other::---,default:user::rwx,default:group::r-x,default:other::---")
+	assert.Nil(err)
+
+	value := encodePosixACL(entries, false, nil)
+	expected := []byte{
+		2, 0, 0, 0,
+		0x01, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+		0x02, 0, 4, 0, 10, 0, 0, 0,
+		0x04, 0, 5, 0, 0xff, 0xff, 0xff, 0xff,
+		0x08, 0, 6, 0, 20, 0, 0, 0,
+		0x10, 0, 7, 0, 0xff, 0xff, 0xff, 0xff,
+		0x20, 0, 0, 0, 0xff, 0xff, 0xff, 0xff,
+	}
+	assert.Equal(expected, value) // sorted by tag and entry of object id is left out
+
+	// Local ids not mapped to an AAD identity can not be set
+	_, err = decodePosixACL(value, false, nil)
+	assert.Equal(syscall.EINVAL, err)
+
+	entries, err = parseACL("user::rwx,group::r-x,mask::rwx,other::---,default:user::rwx,default:group::r-x,default:other::---")
+	assert.Nil(err)
+	decoded, err := decodePosixACL(encodePosixACL(entries, false, nil), false, nil)
+	assert.Nil(err)
+	assert.Equal("user::rwx,group::r-x,mask::rwx,other::---", formatACL(decoded))
+
+	decoded, err = decodePosixACL(encodePosixACL(entries, true, nil), true, nil)
+	assert.Nil(err)
+	assert.Equal("default:user::rwx,default:group::r-x,default:other::---", formatACL(decoded))
+
+	_, err = decodePosixACL([]byte{1, 0, 0, 0}, false, nil)
+	assert.Equal(syscall.EINVAL, err)
+	_, err = decodePosixACL(value[:10], false, nil)
+	assert.Equal(syscall.EINVAL, err)
+	_, err = decodePosixACL([]byte{2, 0, 0, 0, 0x40, 0, 7, 0, 0, 0, 0, 0}, false, nil)
+	assert.Equal(syscall.EINVAL, err)
+}
+
+func (s *utilsTestSuite) TestMergeACL() {
+	assert := assert.New(s.T())
+	current, _ := parseACL("user::rwx,user:a2b4c3d5-0000-1111-2222-333344445555:rw-,user:10:r--,group::r-x,mask::rwx,other::---,default:user::rwx,default:group::r-x,default:other::---")
+	updated, _ := parseACL("user::rw-,user:11:r--,group::r--,mask::r--,other::r--")
+
+	// Entries of the object id are retained as those can not be set through the xattr
+	merged := mergeACL(current, updated, false, nil)
+	assert.Equal("default:user::rwx,default:group::r-x,default:other::---,user::rw-,user:11:r--,group::r--,mask::r--,other::r--,user:a2b4c3d5-0000-1111-2222-333344445555:rw-", formatACL(merged))
+
+	// Removing the default ACL
+	merged = mergeACL(current, nil, true, nil)
+	assert.False(hasACLEntries(merged, true))
+	assert.Equal("user::rwx,user:a2b4c3d5-0000-1111-2222-333344445555:rw-,user:10:r--,group::r-x,mask::rwx,other::---", formatACL(merged))
+
+	// Removing the access ACL leaves the permission bits
+	merged = append(mergeACL(current, nil, false, nil), baseACL(current)...)
+	assert.Equal("default:user::rwx,default:group::r-x,default:other::---,user::rwx,group::r-x,other::---", formatACL(merged))
+}
+
+func (s *utilsTestSuite) TestIdentityMapFile() {
+	assert := assert.New(s.T())
+	mapFile := filepath.Join(s.T().TempDir(), "identity.map")
+	content := `# type  identity  local-id
+user  A2B4C3D5-0000-1111-2222-333344445555  1001
+user  alice@contoso.com  1001
+group 0d8a0c1e-0000-1111-2222-333344445555  2001
+group root 0
+`
+	err := os.WriteFile(mapFile, []byte(content), 0644)
+	assert.Nil(err)
+
+	ids, err := newIdentityMap(mapFile, "", defaultIdentityCacheTimeout)
+	assert.Nil(err)
+
+	// Lookup is case insensitive and first entry for an id is used for reverse lookup
+	uid, found := ids.localID("a2b4c3d5-0000-1111-2222-333344445555", false)
+	assert.True(found)
+	assert.EqualValues(1001, uid)
+	uid, found = ids.localID("Alice@Contoso.com", false)
+	assert.True(found)
+	assert.EqualValues(1001, uid)
+	aadID, found := ids.aadID(1001, false)
+	assert.True(found)
+	assert.Equal("A2B4C3D5-0000-1111-2222-333344445555", aadID)
+
+	// Users and groups are looked up separately
+	_, found = ids.localID("0d8a0c1e-0000-1111-2222-333344445555", false)
+	assert.False(found)
+	gid, found := ids.localID("0d8a0c1e-0000-1111-2222-333344445555", true)
+	assert.True(found)
+	assert.EqualValues(2001, gid)
+	aadID, found = ids.aadID(0, true)
+	assert.True(found)
+	assert.Equal("root", aadID)
+	_, found = ids.aadID(2002, true)
+	assert.False(found)
+
+	// Unmapped half of the owner is the owner of the mount
+	_, gid, _ = common.GetCurrentUser()
+	assert.Equal(gid, ids.defaultGid)
+	ids.defaultGid = 4242
+	attr := &internal.ObjAttr{Flags: internal.NewFileBitMap()}
+	ids.setOwner(attr, "$superuser", "$superuser")
+	assert.False(attr.IsOwnerSet())
+	ids.setOwner(attr, "alice@contoso.com", "$superuser")
+	assert.True(attr.IsOwnerSet())
+	assert.EqualValues(1001, attr.Uid)
+	assert.EqualValues(4242, attr.Gid)
+
+	// Named entries of the ACL are shown with the mapped ids
+	entries, _ := parseACL("user::rwx,user:a2b4c3d5-0000-1111-2222-333344445555:r--,group::r-x,mask::r-x,other::---")
+	decoded, err := decodePosixACL(encodePosixACL(entries, false, ids), false, ids)
+	assert.Nil(err)
+	assert.Equal("user::rwx,user:A2B4C3D5-0000-1111-2222-333344445555:r--,group::r-x,mask::r-x,other::---", formatACL(decoded))
+	entries, _ = parseACL("user::rwx,user:4242:r--,group::r-x,mask::r-x,other::---")
+	_, err = decodePosixACL(encodePosixACL(entries, false, ids), false, ids)
+	assert.Equal(syscall.EINVAL, err)
+
+	for _, invalid := range []string{"user abcd", "owner abcd 10", "user abcd nosuchlocaluser"} {
+		err = os.WriteFile(mapFile, []byte(invalid), 0644)
+		assert.Nil(err)
+		_, err = newIdentityMap(mapFile, "", defaultIdentityCacheTimeout)
+		assert.NotNil(err, invalid)
+	}
+
+	ids, err = newIdentityMap("", "", defaultIdentityCacheTimeout)
+	assert.Nil(err)
+	assert.Nil(ids)
+}
+
+func (s *utilsTestSuite) TestIdentityMapCommand() {
+	assert := assert.New(s.T())
+	dir := s.T().TempDir()
+	command := filepath.Join(dir, "lookup.sh")
+	script := `#!/bin/sh
+echo "$1 $2" >> ` + filepath.Join(dir, "calls") + `
+case "$1:$2" in
+  user:bob@contoso.com) echo 1002 ;;
+  uid:1002) echo bob@contoso.com ;;
+  *) exit 1 ;;
+esac
+`
+	err := os.WriteFile(command, []byte(script), 0755)
+	assert.Nil(err)
+
+	ids, err := newIdentityMap("", command, defaultIdentityCacheTimeout)
+	assert.Nil(err)
+
+	uid, found := ids.localID("bob@contoso.com", false)
+	assert.True(found)
+	assert.EqualValues(1002, uid)
+	aadID, found := ids.aadID(1002, false)
+	assert.True(found)
+	assert.Equal("bob@contoso.com", aadID)
+	_, found = ids.localID("carol@contoso.com", false)
+	assert.False(found)
+
+	// Results and misses are served from the cache
+	ids.localID("bob@contoso.com", false)
+	ids.localID("carol@contoso.com", false)
+	calls, err := os.ReadFile(filepath.Join(dir, "calls"))
+	assert.Nil(err)
+	assert.Equal(3, strings.Count(string(calls), "\n"))
+}
+
+func (s *utilsTestSuite) TestBlobTagKey() {
+	assert := assert.New(s.T())
+
+	key, ok := blobTagKey("user.tag.dataset")
+	assert.True(ok)
+	assert.Equal("dataset", key)
+
+	_, ok = blobTagKey("user.tag.")
+	assert.False(ok)
+	_, ok = blobTagKey("user.dataset")
+	assert.False(ok)
+	_, ok = blobTagKey(posixACLAccessXattr)
+	assert.False(ok)
+}
+
+func (s *utilsTestSuite) TestSplitTagQueryPath() {
+	assert := assert.New(s.T())
+
+	assert.False(isTagQueryPath("", ".query"))
+	assert.True(isTagQueryPath(".query", ".query"))
+	assert.True(isTagQueryPath(".query", "/.query/"))
+	assert.True(isTagQueryPath(".query", ".query/a/b"))
+	assert.False(isTagQueryPath(".query", ".queryx"))
+	assert.False(isTagQueryPath(".query", "dir/.query"))
+
+	expr, blobPath, err := splitTagQueryPath(".query", ".query")
+	assert.Nil(err)
+	assert.Empty(expr)
+	assert.Empty(blobPath)
+
+	expr, blobPath, err = splitTagQueryPath(".query", ".query/%22dataset%22%3D%27train%27/")
+	assert.Nil(err)
+	assert.Equal("\"dataset\"='train'", expr)
+	assert.Empty(blobPath)
+
+	expr, blobPath, err = splitTagQueryPath(".query", ".query/\"dataset\"='train' AND \"split\"='a%2Fb'/dir/file.txt")
+	assert.Nil(err)
+	assert.Equal("\"dataset\"='train' AND \"split\"='a/b'", expr)
+	assert.Equal("dir/file.txt", blobPath)
+
+	_, _, err = splitTagQueryPath(".query", ".query/%zz")
+	assert.Equal(syscall.EINVAL, err)
+	_, _, err = splitTagQueryPath(".query", ".query/%20/file")
+	assert.Equal(syscall.EINVAL, err)
+}
+
+func (s *utilsTestSuite) TestTagQueryChildren() {
+	assert := assert.New(s.T())
+	blobs := map[string]bool{
+		"b.txt":         true,
+		"a.txt":         true,
+		"dir/c.txt":     true,
+		"dir/sub/d.txt": true,
+		"dir2/e.txt":    true,
+	}
+
+	dirs, files := tagQueryChildren(blobs, "")
+	assert.Equal([]string{"dir", "dir2"}, dirs)
+	assert.Equal([]string{"a.txt", "b.txt"}, files)
+
+	dirs, files = tagQueryChildren(blobs, "dir")
+	assert.Equal([]string{"sub"}, dirs)
+	assert.Equal([]string{"c.txt"}, files)
+
+	dirs, files = tagQueryChildren(blobs, "di")
+	assert.Empty(dirs)
+	assert.Empty(files)
+}
+
+func (s *utilsTestSuite) TestTagQueryCache() {
+	assert := assert.New(s.T())
+	cache := tagQueryCache{}
+
+	_, found := cache.get("a='b'")
+	assert.False(found)
+
+	cache.put("a='b'", map[string]bool{"file": true})
+	blobs, found := cache.get("a='b'")
+	assert.True(found)
+	assert.True(blobs["file"])
+
+	cache.results["a='b'"] = tagQueryResult{blobs: blobs, expires: time.Now().Add(-time.Second)}
+	_, found = cache.get("a='b'")
+	assert.False(found)
+
+	cache.put("c='d'", map[string]bool{})
+	assert.NotContains(cache.results, "a='b'")
+
+	cache.clear()
+	_, found = cache.get("c='d'")
+	assert.False(found)
+}
+
+func (s *utilsTestSuite) TestTokenBucket() {
+	assert := assert.New(s.T())
+
+	tb := tokenBucket{}
+	assert.Zero(tb.reserve(1 << 30))
+
+	tb.setRate(100)
+	assert.Zero(tb.reserve(100))
+	delay := tb.reserve(50)
+	assert.InDelta(500*time.Millisecond, delay, float64(50*time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := tb.wait(ctx, 100)
+	assert.Equal(context.Canceled, err)
+
+	tb.setRate(0)
+	assert.Zero(tb.reserve(1 << 30))
+}
+
+func (s *utilsTestSuite) TestThrottledHTTPClient() {
+	assert := assert.New(s.T())
+	data := make([]byte, 3000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(ioutil.Discard, r.Body)
+		_, _ = w.Write(data)
+	}))
+	defer server.Close()
+
+	t := &throttler{}
+	t.update(0, 2000, 0)
+	sender := newBlobfuse2HTTPClientFactory(newBlobfuse2HttpClient(AzStorageConfig{}), AzStorageConfig{throttle: t}).New(nil, nil)
+
+	req, err := pipeline.NewRequest(http.MethodGet, *mustParseURL(server.URL), nil)
+	assert.Nil(err)
+
+	start := time.Now()
+	resp, err := sender.Do(context.Background(), req)
+	assert.Nil(err)
+	body, err := ioutil.ReadAll(resp.Response().Body)
+	assert.Nil(err)
+	assert.Len(body, len(data))
+	assert.GreaterOrEqual(time.Since(start), 400*time.Millisecond)
+
+	// Requests beyond the rate are held back
+	t.update(0, 0, 1)
+	start = time.Now()
+	for i := 0; i < 2; i++ {
+		resp, err = sender.Do(context.Background(), req)
+		assert.Nil(err)
+		_ = resp.Response().Body.Close()
+	}
+	assert.GreaterOrEqual(time.Since(start), 900*time.Millisecond)
+
+	// Request body is paced as it is sent
+	t.update(2000, 0, 0)
+	req, err = pipeline.NewRequest(http.MethodPut, *mustParseURL(server.URL), bytes.NewReader(data))
+	assert.Nil(err)
+	start = time.Now()
+	resp, err = sender.Do(context.Background(), req)
+	assert.Nil(err)
+	_ = resp.Response().Body.Close()
+	assert.GreaterOrEqual(time.Since(start), 400*time.Millisecond)
+
+	// Without limits requests and responses go through untouched
+	t.update(0, 0, 0)
+	assert.Nil(req.RewindBody())
+	resp, err = sender.Do(context.Background(), req)
+	assert.Nil(err)
+	_, ok := resp.Response().Body.(*throttledReader)
+	assert.False(ok)
+	_ = resp.Response().Body.Close()
+}
+
+func (s *utilsTestSuite) TestConcurrencyController() {
+	assert := assert.New(s.T())
+
+	cc := newConcurrencyController(0)
+	assert.EqualValues(sdkDefaultParallelism, cc.parallelism())
+
+	cc.setCeiling(16)
+	assert.EqualValues(5, cc.parallelism())
+	for i := 0; i < 5; i++ {
+		cc.onResponse(&http.Response{StatusCode: http.StatusOK})
+	}
+	assert.EqualValues(6, cc.parallelism())
+
+	// Multiple throttled responses in a burst halve the limit only once
+	cc.onResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}})
+	cc.onResponse(&http.Response{StatusCode: http.StatusServiceUnavailable, Header: http.Header{}})
+	assert.EqualValues(3, cc.parallelism())
+
+	cc.lastDecrease = time.Time{}
+	cc.onResponse(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"1"}}})
+	assert.EqualValues(1, cc.parallelism())
+
+	start := time.Now()
+	assert.Nil(cc.wait(context.Background()))
+	assert.GreaterOrEqual(time.Since(start), 900*time.Millisecond)
+
+	cc.lastDecrease = time.Time{}
+	cc.onThrottled(0)
+	assert.EqualValues(1, cc.parallelism())
+
+	cc.setCeiling(4)
+	for i := 0; i < 20; i++ {
+		cc.onResponse(&http.Response{StatusCode: http.StatusCreated})
+	}
+	assert.EqualValues(4, cc.parallelism())
+}
+
+func (s *utilsTestSuite) TestParseRetryAfter() {
+	assert := assert.New(s.T())
+	now := time.Now()
+
+	assert.Zero(parseRetryAfter("", now))
+	assert.Zero(parseRetryAfter("abc", now))
+	assert.Zero(parseRetryAfter("-5", now))
+	assert.Equal(3*time.Second, parseRetryAfter("3", now))
+	assert.Equal(maxRetryAfter, parseRetryAfter("3600", now))
+	assert.Equal(10*time.Second, parseRetryAfter(now.Add(10*time.Second).UTC().Format(http.TimeFormat), now.Truncate(time.Second)))
+}
+
+func (s *utilsTestSuite) TestCircuitBreaker() {
+	assert := assert.New(s.T())
+
+	var healthy int32
+	cb := newCircuitBreaker(2, 20*time.Millisecond, func(ctx context.Context) error {
+		if atomic.LoadInt32(&healthy) == 0 {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	defer cb.stop()
+
+	// Cancelled requests and failures separated by a success do not trip the breaker
+	cb.record(errors.New("dial tcp: i/o timeout"))
+	cb.record(context.Canceled)
+	cb.record(nil)
+	cb.record(errors.New("dial tcp: i/o timeout"))
+	assert.True(cb.allow())
+
+	cb.record(errors.New("dial tcp: i/o timeout"))
+	assert.False(cb.allow())
+	assert.True(cb.isOpen())
+
+	az := &AzStorage{stConfig: AzStorageConfig{breaker: cb}}
+	assert.Equal(syscall.ENOTCONN, az.circuitErr(errCircuitOpen))
+	assert.Equal(syscall.ENOENT, az.circuitErr(syscall.ENOENT))
+	assert.Nil(az.circuitErr(nil))
+
+	// Stays open while probe fails and closes once storage responds
+	time.Sleep(100 * time.Millisecond)
+	assert.True(cb.isOpen())
+	atomic.StoreInt32(&healthy, 1)
+	assert.Eventually(func() bool { return cb.allow() }, time.Second, 10*time.Millisecond)
+	assert.Equal(errCircuitOpen, (&AzStorage{}).circuitErr(errCircuitOpen))
+}
+
+func (s *utilsTestSuite) TestCircuitBreakerPipeline() {
+	assert := assert.New(s.T())
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	client := newBlobfuse2HttpClient(AzStorageConfig{})
+	cb := newCircuitBreaker(1, time.Hour, newEndpointProbe(client, server.URL))
+	defer cb.stop()
+	sender := newBlobfuse2HTTPClientFactory(client, AzStorageConfig{breaker: cb}).New(nil, nil)
+
+	req, err := pipeline.NewRequest(http.MethodGet, *mustParseURL(server.URL), nil)
+	assert.Nil(err)
+	_, err = sender.Do(context.Background(), req)
+	assert.Nil(err)
+	assert.EqualValues(1, atomic.LoadInt32(&hits))
+
+	// Request to an address nobody listens on trips the breaker, later requests are not sent
+	closed, err := pipeline.NewRequest(http.MethodGet, *mustParseURL("http://127.0.0.1:1"), nil)
+	assert.Nil(err)
+	_, err = sender.Do(context.Background(), closed)
+	assert.NotNil(err)
+	assert.True(cb.isOpen())
+
+	_, err = sender.Do(context.Background(), req)
+	assert.Equal(errCircuitOpen, err)
+	assert.EqualValues(1, atomic.LoadInt32(&hits))
+
+	assert.Nil(newEndpointProbe(client, server.URL)(context.Background()))
+}
+
+func (s *utilsTestSuite) TestHedgerThreshold() {
+	assert := assert.New(s.T())
+	h := newHedger(90)
+
+	for i := 1; i < hedgeMinSamples; i++ {
+		h.record(time.Duration(i) * 10 * time.Millisecond)
+	}
+	assert.Zero(h.delay())
+
+	h.record(hedgeMinSamples * 10 * time.Millisecond)
+	assert.Equal(180*time.Millisecond, h.delay())
+
+	// Very fast reads are not hedged below the minimum threshold
+	h = newHedger(50)
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.record(time.Microsecond)
+	}
+	assert.Equal(hedgeMinThreshold, h.delay())
+}
+
+func (s *utilsTestSuite) TestHedgedRead() {
+	assert := assert.New(s.T())
+	h := newHedger(50)
+	for i := 0; i < hedgeMinSamples; i++ {
+		h.record(hedgeMinThreshold)
+	}
+
+	// First read hangs till cancelled, duplicate answers and its data is used
+	var calls int32
+	data := make([]byte, 4)
+	err := h.hedgedRead("a", data, func(ctx context.Context, buf []byte) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		copy(buf, "abcd")
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal("abcd", string(data))
+	assert.EqualValues(2, atomic.LoadInt32(&calls))
+
+	// Fast read is not duplicated
+	atomic.StoreInt32(&calls, 0)
+	err = h.hedgedRead("a", data, func(ctx context.Context, buf []byte) error {
+		atomic.AddInt32(&calls, 1)
+		copy(buf, "efgh")
+		return nil
+	})
+	assert.Nil(err)
+	assert.Equal("efgh", string(data))
+	assert.EqualValues(1, atomic.LoadInt32(&calls))
+
+	// Error is returned only when both reads fail
+	err = h.hedgedRead("a", data, func(ctx context.Context, buf []byte) error {
+		time.Sleep(2 * hedgeMinThreshold)
+		return syscall.ENOENT
+	})
+	assert.Equal(syscall.ENOENT, err)
+}
+
+func (s *utilsTestSuite) TestUploadPlan() {
+	assert := assert.New(s.T())
+
+	blocks := newUploadPlan(10, 4)
+	assert.Len(blocks, 3)
+	assert.EqualValues(0, blocks[0].Offset)
+	assert.EqualValues(8, blocks[2].Offset)
+	assert.EqualValues(2, blocks[2].Size)
+	assert.Equal(len(blocks[0].Id), len(blocks[2].Id))
+	assert.NotEqual(blocks[0].Id, blocks[1].Id)
+
+	// Blocks missing from the service or staged with another size need to be staged again
+	uncommitted := []azblob.Block{{Name: blocks[0].Id, Size: 4}, {Name: blocks[2].Id, Size: 1}}
+	missing := missingBlocks(blocks, uncommitted)
+	assert.Len(missing, 2)
+	assert.Equal(blocks[1].Id, missing[0].Id)
+	assert.Equal(blocks[2].Id, missing[1].Id)
+
+	assert.Empty(missingBlocks(blocks[:1], uncommitted))
+	assert.Len(missingBlocks(blocks, nil), 3)
+}
+
+func (s *utilsTestSuite) TestUploadStateStore() {
+	assert := assert.New(s.T())
+	dir := filepath.Join(os.TempDir(), "upload_state_test")
+	defer os.RemoveAll(dir)
+
+	store, err := newUploadStateStore(dir, "account", "container", "")
+	assert.Nil(err)
+	assert.Nil(store.load("a/b"))
+
+	modTime := time.Now()
+	st := &uploadState{Name: "a/b", LocalPath: "/tmp/b", Size: 10, ModTime: modTime, BlockSize: 4, Blocks: newUploadPlan(10, 4)}
+	assert.Nil(store.save(st))
+
+	loaded := store.load("a/b")
+	assert.NotNil(loaded)
+	assert.Equal(st.Blocks, loaded.Blocks)
+	assert.True(loaded.matches(10, modTime, 4))
+	assert.False(loaded.matches(10, modTime.Add(time.Second), 4))
+	assert.False(loaded.matches(11, modTime, 4))
+
+	// Corrupt state is discarded
+	assert.Nil(ioutil.WriteFile(store.path("c"), []byte("{"), 0600))
+	pending := store.pending()
+	assert.Len(pending, 1)
+	assert.Equal("a/b", pending[0].Name)
+	_, err = os.Stat(store.path("c"))
+	assert.True(os.IsNotExist(err))
+
+	// Uploads of another container or subdirectory in the same root are not picked up
+	other, err := newUploadStateStore(dir, "account", "other", "")
+	assert.Nil(err)
+	assert.Nil(other.load("a/b"))
+	assert.Empty(other.pending())
+	sub, err := newUploadStateStore(dir, "account", "container", "sub")
+	assert.Nil(err)
+	assert.Nil(sub.save(&uploadState{Name: "a/b", Blocks: newUploadPlan(10, 4)}))
+	assert.NotEqual(store.path("a/b"), sub.path("a/b"))
+	assert.Len(store.pending(), 1)
+	assert.Len(sub.pending(), 1)
+
+	// State copied in from another store is ignored
+	data, _ := ioutil.ReadFile(sub.path("a/b"))
+	assert.Nil(ioutil.WriteFile(store.path("x"), data, 0600))
+	assert.Len(store.pending(), 1)
+
+	store.remove("a/b")
+	assert.Nil(store.load("a/b"))
+	assert.Empty(store.pending())
+}
+
+func mustParseURL(raw string) *url.URL {
+	u, _ := url.Parse(raw)
+	return u
+}
+
 func TestUtilsTestSuite(t *testing.T) {
 	suite.Run(t, new(utilsTestSuite))
 }
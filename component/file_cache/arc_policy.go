@@ -0,0 +1,333 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+)
+
+// Evicted files remembered at least, so that a small cache still learns from what it evicts
+const arcMinGhosts = 1000
+
+const (
+	arcT1 = iota // Cached and used once since
+	arcT2        // Cached and used again since
+	arcB1        // Evicted from T1, only the name is kept
+	arcB2        // Evicted from T2, only the name is kept
+)
+
+type arcEntry struct {
+	name     string
+	list     int
+	lastUsed time.Time
+}
+
+// arcPolicy : Adaptive replacement cache. Files used once and files used again are kept in separate lists, and the
+// share of the cache each list gets adapts to the names of evicted files that come back. A large scan goes through
+// the first list only so it does not push out the files used repeatedly.
+type arcPolicy struct {
+	sync.Mutex
+	cachePolicyConfig
+
+	lists   [4]*list.List
+	entries map[string]*list.Element
+	target  int // Number of cached files T1 aims for
+
+	evictor *evictor
+}
+
+var _ cachePolicy = &arcPolicy{}
+
+func NewARCPolicy(cfg cachePolicyConfig) cachePolicy {
+	pol := &arcPolicy{
+		cachePolicyConfig: cfg,
+		entries:           make(map[string]*list.Element),
+	}
+	for i := range pol.lists {
+		pol.lists[i] = list.New()
+	}
+	pol.evictor = newEvictor("arcPolicy", &pol.cachePolicyConfig, pol)
+	return pol
+}
+
+func (p *arcPolicy) StartPolicy() error {
+	log.Trace("arcPolicy::StartPolicy")
+
+	p.evictor.start()
+	return nil
+}
+
+func (p *arcPolicy) ShutdownPolicy() error {
+	log.Trace("arcPolicy::ShutdownPolicy")
+
+	p.evictor.shutdown()
+	return nil
+}
+
+func (p *arcPolicy) UpdateConfig(c cachePolicyConfig) error {
+	log.Trace("arcPolicy::UpdateConfig")
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.maxSizeMB = c.maxSizeMB
+	p.highThreshold = c.highThreshold
+	p.lowThreshold = c.lowThreshold
+	p.maxEviction = c.maxEviction
+	p.policyTrace = c.policyTrace
+	return nil
+}
+
+func (p *arcPolicy) CacheValid(name string) {
+	log.Trace("arcPolicy::CacheValid : %s", name)
+
+	p.Lock()
+	added := p.access(name)
+	p.Unlock()
+
+	if added {
+		p.evictor.checkUsage()
+	}
+}
+
+func (p *arcPolicy) CacheInvalidate(name string) {
+	log.Trace("arcPolicy::CacheInvalidate : %s", name)
+
+	if p.cacheTimeout == 0 {
+		p.CachePurge(name)
+	}
+}
+
+func (p *arcPolicy) CachePurge(name string) {
+	log.Trace("arcPolicy::CachePurge : %s", name)
+
+	p.Lock()
+	if e, found := p.entries[name]; found {
+		p.lists[e.Value.(*arcEntry).list].Remove(e)
+		delete(p.entries, name)
+	}
+	p.Unlock()
+
+	p.evictor.purge(name)
+}
+
+func (p *arcPolicy) IsCached(name string) bool {
+	log.Trace("arcPolicy::IsCached : %s", name)
+
+	p.Lock()
+	defer p.Unlock()
+
+	e, found := p.entries[name]
+	return found && p.resident(e)
+}
+
+func (p *arcPolicy) Name() string {
+	return "arc"
+}
+
+func (p *arcPolicy) resident(e *list.Element) bool {
+	l := e.Value.(*arcEntry).list
+	return l == arcT1 || l == arcT2
+}
+
+// move : Make the entry the most recent of the given list, requires Lock()
+func (p *arcPolicy) move(e *list.Element, to int) {
+	entry := e.Value.(*arcEntry)
+	p.lists[entry.list].Remove(e)
+	entry.list = to
+	p.entries[entry.name] = p.lists[to].PushFront(entry)
+}
+
+// access : File was used, returns whether it was not cached till now. Requires Lock()
+func (p *arcPolicy) access(name string) bool {
+	e, found := p.entries[name]
+	if !found {
+		p.entries[name] = p.lists[arcT1].PushFront(&arcEntry{name: name, list: arcT1, lastUsed: time.Now()})
+		return true
+	}
+
+	entry := e.Value.(*arcEntry)
+	entry.lastUsed = time.Now()
+	added := !p.resident(e)
+
+	// Name of an evicted file came back, so the list it was evicted from deserved more room
+	b1, b2 := p.lists[arcB1].Len(), p.lists[arcB2].Len()
+	cached := p.lists[arcT1].Len() + p.lists[arcT2].Len() + 1
+	switch entry.list {
+	case arcB1:
+		step := 1
+		if b2 > b1 {
+			step = b2 / b1
+		}
+		p.target += step
+		if p.target > cached {
+			p.target = cached
+		}
+	case arcB2:
+		step := 1
+		if b1 > b2 {
+			step = b1 / b2
+		}
+		p.target -= step
+		if p.target < 0 {
+			p.target = 0
+		}
+	}
+
+	p.move(e, arcT2)
+	return added
+}
+
+// trimGhosts : Forget the oldest evicted files, requires Lock()
+func (p *arcPolicy) trimGhosts() {
+	limit := p.lists[arcT1].Len() + p.lists[arcT2].Len()
+	if limit < arcMinGhosts {
+		limit = arcMinGhosts
+	}
+	for _, l := range []int{arcB1, arcB2} {
+		for p.lists[l].Len() > limit {
+			e := p.lists[l].Back()
+			p.lists[l].Remove(e)
+			delete(p.entries, e.Value.(*arcEntry).name)
+		}
+	}
+}
+
+// oldest : Least recently used file of the list which is not pinned, requires Lock()
+func (p *arcPolicy) oldest(l int) *list.Element {
+	for e := p.lists[l].Back(); e != nil; e = e.Prev() {
+		if !p.pinned(e.Value.(*arcEntry).name) {
+			return e
+		}
+	}
+	return nil
+}
+
+// victim : Least recent file of T1 while T1 is over its target, else of T2
+func (p *arcPolicy) victim() (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Pinned files are passed over
+	t1, t2 := p.oldest(arcT1), p.oldest(arcT2)
+	e := t1
+	ghost := arcB1
+	if t1 == nil || (p.lists[arcT1].Len() <= p.target && t2 != nil) {
+		e = t2
+		ghost = arcB2
+	}
+	if e == nil {
+		return "", false
+	}
+
+	p.move(e, ghost)
+	p.trimGhosts()
+	return e.Value.(*arcEntry).name, true
+}
+
+func (p *arcPolicy) expired(timeout time.Duration, maxCount uint32) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	names := make([]string, 0)
+	for _, l := range []int{arcT1, arcT2} {
+		ghost := arcB1
+		if l == arcT2 {
+			ghost = arcB2
+		}
+		// Lists are in order of use so the expired files are at the back
+		for e := p.lists[l].Back(); e != nil && uint32(len(names)) < maxCount; {
+			entry := e.Value.(*arcEntry)
+			if time.Since(entry.lastUsed) < timeout {
+				break
+			}
+			prev := e.Prev()
+			if !p.pinned(entry.name) {
+				names = append(names, entry.name)
+				p.move(e, ghost)
+			}
+			e = prev
+		}
+	}
+	p.trimGhosts()
+	return names
+}
+
+func (p *arcPolicy) keep(name string) {
+	p.Lock()
+	defer p.Unlock()
+
+	e, found := p.entries[name]
+	if !found {
+		p.entries[name] = p.lists[arcT1].PushFront(&arcEntry{name: name, list: arcT1, lastUsed: time.Now()})
+		return
+	}
+
+	e.Value.(*arcEntry).lastUsed = time.Now()
+	switch e.Value.(*arcEntry).list {
+	case arcB1:
+		p.move(e, arcT1)
+	case arcB2:
+		p.move(e, arcT2)
+	}
+}
+
+// evicted : Name stays in its ghost list
+func (p *arcPolicy) evicted(string) {}
+
+func (p *arcPolicy) printNodes() {
+	if !p.policyTrace {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	log.Debug("arcPolicy::printNodes : Starts, target %d, T1 %d, T2 %d, B1 %d, B2 %d", p.target,
+		p.lists[arcT1].Len(), p.lists[arcT2].Len(), p.lists[arcB1].Len(), p.lists[arcB2].Len())
+
+	for _, l := range []int{arcT1, arcT2} {
+		count := 0
+		for e := p.lists[l].Front(); e != nil; e = e.Next() {
+			log.Debug(" ==> T%d (%d) %s", l+1, count, e.Value.(*arcEntry).name)
+			count++
+		}
+	}
+
+	log.Debug("arcPolicy::printNodes : Ends")
+}
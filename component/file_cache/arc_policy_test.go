@@ -0,0 +1,294 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type arcPolicyTestSuite struct {
+	suite.Suite
+	assert *assert.Assertions
+	policy *arcPolicy
+}
+
+func (suite *arcPolicyTestSuite) SetupTest() {
+	err := log.SetDefaultLogger("silent", common.LogConfig{Level: common.ELogLevel.LOG_DEBUG()})
+	if err != nil {
+		panic("Unable to set silent logger as default.")
+	}
+	suite.assert = assert.New(suite.T())
+
+	os.Mkdir(cache_path, fs.FileMode(0777))
+
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  0,
+		maxEviction:   defaultMaxEviction,
+		maxSizeMB:     0,
+		highThreshold: defaultMaxThreshold,
+		lowThreshold:  defaultMinThreshold,
+		fileLocks:     &common.LockMap{},
+	}
+
+	suite.setupTestHelper(config)
+}
+
+func (suite *arcPolicyTestSuite) setupTestHelper(config cachePolicyConfig) {
+	suite.policy = NewARCPolicy(config).(*arcPolicy)
+	suite.policy.StartPolicy()
+}
+
+func (suite *arcPolicyTestSuite) cleanupTest() {
+	suite.policy.ShutdownPolicy()
+
+	os.RemoveAll(cache_path)
+}
+
+func (suite *arcPolicyTestSuite) TestDefault() {
+	defer suite.cleanupTest()
+	suite.assert.EqualValues("arc", suite.policy.Name())
+	suite.assert.EqualValues(0, suite.policy.cacheTimeout)
+	suite.assert.EqualValues(defaultMaxEviction, suite.policy.maxEviction)
+	suite.assert.EqualValues(0, suite.policy.maxSizeMB)
+	suite.assert.EqualValues(defaultMaxThreshold, suite.policy.highThreshold)
+	suite.assert.EqualValues(defaultMinThreshold, suite.policy.lowThreshold)
+}
+
+func (suite *arcPolicyTestSuite) TestUpdateConfig() {
+	defer suite.cleanupTest()
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  120,
+		maxEviction:   100,
+		maxSizeMB:     10,
+		highThreshold: 70,
+		lowThreshold:  20,
+		fileLocks:     &common.LockMap{},
+	}
+	suite.policy.UpdateConfig(config)
+
+	suite.assert.EqualValues(0, suite.policy.cacheTimeout) // cacheTimeout does not change
+	suite.assert.EqualValues(100, suite.policy.maxEviction)
+	suite.assert.EqualValues(10, suite.policy.maxSizeMB)
+	suite.assert.EqualValues(70, suite.policy.highThreshold)
+	suite.assert.EqualValues(20, suite.policy.lowThreshold)
+}
+
+func (suite *arcPolicyTestSuite) TestCacheValid() {
+	defer suite.cleanupTest()
+	suite.policy.CacheValid("temp")
+	suite.assert.True(suite.policy.IsCached("temp"))
+	suite.assert.EqualValues(arcT1, suite.policy.entries["temp"].Value.(*arcEntry).list)
+
+	// Used again, so it is frequent now
+	suite.policy.CacheValid("temp")
+	suite.assert.True(suite.policy.IsCached("temp"))
+	suite.assert.EqualValues(arcT2, suite.policy.entries["temp"].Value.(*arcEntry).list)
+}
+
+func (suite *arcPolicyTestSuite) TestCacheInvalidate() {
+	defer suite.cleanupTest()
+	suite.policy.CacheValid("temp")
+	suite.policy.CacheInvalidate("temp") // this is equivalent to purge since timeout=0
+
+	suite.assert.False(suite.policy.IsCached("temp"))
+}
+
+func (suite *arcPolicyTestSuite) TestCachePurge() {
+	defer suite.cleanupTest()
+	f, _ := os.Create(cache_path + "/test")
+	f.Close()
+	suite.policy.CacheValid(f.Name())
+	suite.policy.CachePurge(f.Name())
+
+	suite.assert.False(suite.policy.IsCached(f.Name()))
+	suite.assert.Eventually(func() bool {
+		_, err := os.Stat(f.Name())
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func (suite *arcPolicyTestSuite) TestIsCachedFalse() {
+	defer suite.cleanupTest()
+	suite.assert.False(suite.policy.IsCached("temp"))
+}
+
+func (suite *arcPolicyTestSuite) TestGhostHit() {
+	defer suite.cleanupTest()
+	suite.policy.CacheValid("once")
+	suite.policy.CacheValid("twice")
+	suite.policy.CacheValid("twice")
+
+	// Recently used once goes first
+	name, found := suite.policy.victim()
+	suite.assert.True(found)
+	suite.assert.EqualValues("once", name)
+	suite.assert.False(suite.policy.IsCached("once"))
+	suite.assert.EqualValues(arcB1, suite.policy.entries["once"].Value.(*arcEntry).list)
+
+	// Coming back after eviction gives recently used files more room
+	suite.policy.CacheValid("once")
+	suite.assert.True(suite.policy.IsCached("once"))
+	suite.assert.EqualValues(arcT2, suite.policy.entries["once"].Value.(*arcEntry).list)
+	suite.assert.EqualValues(1, suite.policy.target)
+
+	name, _ = suite.policy.victim()
+	suite.assert.EqualValues("twice", name)
+	suite.policy.CacheValid("twice")
+	suite.assert.EqualValues(0, suite.policy.target)
+}
+
+func (suite *arcPolicyTestSuite) TestTimeout() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  1,
+		maxEviction:   defaultMaxEviction,
+		maxSizeMB:     0,
+		highThreshold: defaultMaxThreshold,
+		lowThreshold:  defaultMinThreshold,
+		fileLocks:     &common.LockMap{},
+	}
+
+	suite.setupTestHelper(config)
+
+	for i := 1; i < 100; i++ {
+		suite.policy.CacheValid("temp" + fmt.Sprint(i))
+	}
+	suite.policy.CacheValid("temp1")
+
+	time.Sleep(3 * time.Second) // Wait for time > cacheTimeout, the files should no longer be cached
+
+	for i := 1; i < 100; i++ {
+		suite.assert.False(suite.policy.IsCached("temp" + fmt.Sprint(i)))
+	}
+}
+
+func (suite *arcPolicyTestSuite) TestScanResistance() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	os.Mkdir(cache_path, fs.FileMode(0777))
+
+	usage := newUsageTracker(cache_path)
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  120,
+		maxEviction:   defaultMaxEviction,
+		maxSizeMB:     2,
+		highThreshold: 80,
+		lowThreshold:  50,
+		fileLocks:     &common.LockMap{},
+		usage:         usage,
+	}
+
+	suite.setupTestHelper(config)
+
+	add := func(name string, uses int) {
+		path := cache_path + "/" + name
+		os.WriteFile(path, make([]byte, 256*1024), 0777)
+		usage.changed(path)
+		for i := 0; i < uses; i++ {
+			suite.policy.CacheValid(path)
+		}
+	}
+
+	add("hot1", 2)
+	add("hot2", 2)
+	for i := 0; i < 12; i++ {
+		add("scan"+fmt.Sprint(i), 1)
+	}
+
+	suite.assert.Eventually(func() bool {
+		return getUsagePercentage(usage, 2) <= 80
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Files read once by the scan are evicted before the ones used repeatedly
+	suite.assert.True(suite.policy.IsCached(cache_path + "/hot1"))
+	suite.assert.FileExists(cache_path + "/hot1")
+	suite.assert.True(suite.policy.IsCached(cache_path + "/hot2"))
+	suite.assert.FileExists(cache_path + "/hot2")
+	suite.assert.False(suite.policy.IsCached(cache_path + "/scan0"))
+	suite.assert.NoFileExists(cache_path + "/scan0")
+}
+
+func (suite *arcPolicyTestSuite) TestPinned() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	os.Mkdir(cache_path, fs.FileMode(0777))
+
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  1,
+		maxEviction:   defaultMaxEviction,
+		maxSizeMB:     0,
+		highThreshold: defaultMaxThreshold,
+		lowThreshold:  defaultMinThreshold,
+		fileLocks:     &common.LockMap{},
+		pins:          newPinSet([]string{"models/**"}),
+	}
+
+	suite.setupTestHelper(config)
+
+	names := []string{"models/weights", "scratch"}
+	os.Mkdir(cache_path+"/models", fs.FileMode(0777))
+	for _, name := range names {
+		f, _ := os.Create(cache_path + "/" + name)
+		f.Close()
+		suite.policy.CacheValid(cache_path + "/" + name)
+	}
+
+	time.Sleep(3 * time.Second) // Wait for time > cacheTimeout, only the file not pinned is evicted
+
+	suite.assert.True(suite.policy.IsCached(cache_path + "/models/weights"))
+	suite.assert.FileExists(cache_path + "/models/weights")
+	suite.assert.False(suite.policy.IsCached(cache_path + "/scratch"))
+	suite.assert.NoFileExists(cache_path + "/scratch")
+}
+
+func TestARCPolicyTestSuite(t *testing.T) {
+	suite.Run(t, new(arcPolicyTestSuite))
+}
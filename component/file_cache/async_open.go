@@ -0,0 +1,165 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"sync"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const defaultAsyncOpenParallelism = 8
+
+// claimChunk : Pick the next chunk the background download should fetch and mark it in flight, -1 once there is none.
+// Chunks already being fetched by a read or write are skipped. Also returns the bytes of the blob in the chunk.
+func (s *sparseFile) claimChunk() (int64, int64) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.stop {
+		return -1, 0
+	}
+
+	chunks := (s.size + s.chunkSize - 1) / s.chunkSize
+	for ; s.next < chunks; s.next++ {
+		if s.present(s.next) {
+			continue
+		}
+		if _, ok := s.inflight[s.next]; ok {
+			continue
+		}
+		s.inflight[s.next] = make(chan struct{})
+		s.next++
+
+		bytes := s.chunkSize
+		if s.next*s.chunkSize > s.size {
+			bytes = s.size - (s.next-1)*s.chunkSize
+		}
+		return s.next - 1, bytes
+	}
+	return -1, 0
+}
+
+// startAsyncDownload : Download the missing chunks of a partially cached file in background, unless already running.
+// Reads and writes meanwhile only wait for the chunks they touch. The download holds a reference on the file like an
+// open handle, so it carries on once the file is closed and the file is not evicted under it. Caller holds the file lock.
+func (fc *FileCache) startAsyncDownload(name string, localPath string, s *sparseFile) {
+	s.Lock()
+	if s.downloading || s.missing == 0 {
+		s.Unlock()
+		return
+	}
+	s.downloading = true
+	s.next = 0
+	s.stop = false
+	s.done = make(chan struct{})
+	s.Unlock()
+
+	flock := fc.fileLocks.Get(name)
+	flock.Inc()
+
+	log.Debug("FileCache::startAsyncDownload : downloading %s in background", name)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, asyncDownloads, (int64)(1))
+
+	go func() {
+		var wg sync.WaitGroup
+		for i := 0; i < fc.asyncOpenParallelism; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				fc.asyncDownloadWorker(name, localPath, s)
+			}()
+		}
+		wg.Wait()
+
+		s.Lock()
+		fileCacheStatsCollector.UpdateStats(stats_manager.Decrement, asyncDownloads, (int64)(1))
+		if s.missing == 0 {
+			log.Debug("FileCache::startAsyncDownload : download of %s is complete", name)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, asyncCompleted, (int64)(1))
+		}
+
+		s.downloading = false
+		close(s.done)
+		s.Unlock()
+
+		// Done is closed first as delete and rename wait for it with the file lock held
+		flock.Lock()
+		flock.Dec()
+		if flock.Count() == 0 {
+			fc.releaseSparseFile(name)
+		}
+		flock.Unlock()
+	}()
+}
+
+func (fc *FileCache) asyncDownloadWorker(name string, localPath string, s *sparseFile) {
+	for {
+		chunk, bytes := s.claimChunk()
+		if chunk < 0 {
+			return
+		}
+
+		err := fc.downloadChunks(name, localPath, s, []int64{chunk})
+		if err != nil {
+			log.Err("FileCache::asyncDownloadWorker : failed to download chunk %d of %s [%s]", chunk, name, err.Error())
+			return
+		}
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, asyncBytes, bytes)
+	}
+}
+
+// stopAsyncDownload : Stop the background download of the file and wait for the chunks in flight, so nothing is written
+// to the cached file once it is deleted or renamed
+func (fc *FileCache) stopAsyncDownload(s *sparseFile) {
+	s.Lock()
+	if !s.downloading {
+		s.Unlock()
+		return
+	}
+	s.stop = true
+	done := s.done
+	s.Unlock()
+
+	<-done
+}
+
+// stopAsyncDownloads : Stop the background downloads of all files on unmount, the rest is fetched on next open
+func (fc *FileCache) stopAsyncDownloads() {
+	fc.sparseFiles.Range(func(key, value interface{}) bool {
+		fc.stopAsyncDownload(value.(*sparseFile))
+		return true
+	})
+}
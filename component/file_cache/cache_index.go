@@ -0,0 +1,560 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	cacheIndexFile     = "index.json"
+	quarantineDir      = "quarantine"
+	cacheIndexInterval = 30 * time.Second
+
+	// Set on a cached file from the time it is modified till it is uploaded. Kept with the file instead of the
+	// index so that a crash between two saves of the index does not lose it.
+	dirtyXattr = "user.blobfuse2.dirty"
+)
+
+var errRestoreStopped = errors.New("cache restore stopped")
+
+// cacheIndexEntry : What is known about a cached file, used to trust it again after a remount
+type cacheIndexEntry struct {
+	Path       string    `json:"path"`
+	Size       int64     `json:"size"`
+	ETag       string    `json:"etag,omitempty"`
+	LMT        time.Time `json:"lmt"`
+	LastAccess time.Time `json:"last_access"`
+	Dirty      bool      `json:"dirty,omitempty"`
+
+	revalidate bool // Restored from an earlier mount, to be checked against storage on first open
+}
+
+// matches : Whether the blob is the one the file was cached from
+func (e *cacheIndexEntry) matches(attr *internal.ObjAttr) bool {
+	if attr.Size != e.Size {
+		return false
+	}
+	if e.ETag != "" {
+		return attr.ETag == e.ETag
+	}
+	return attr.Mtime.Equal(e.LMT)
+}
+
+// cacheIndex : Index of cached files saved periodically and on unmount
+type cacheIndex struct {
+	sync.Mutex
+	dir     string
+	entries map[string]*cacheIndexEntry
+	changed bool
+
+	// Files of an earlier mount are checked in background, till then each is checked on its first use instead
+	restoring   bool
+	checked     map[string]bool // Files checked so far, or left to the write-back journal
+	restoreDone chan struct{}
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// newCacheIndex : Index saved in the given directory, or held only in memory if it is empty
+func newCacheIndex(dir string) (*cacheIndex, error) {
+	if dir != "" {
+		err := os.MkdirAll(filepath.Join(dir, quarantineDir), 0700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &cacheIndex{
+		dir:     dir,
+		entries: make(map[string]*cacheIndexEntry),
+	}, nil
+}
+
+// load : Read the index saved by an earlier mount
+func (ci *cacheIndex) load() error {
+	data, err := os.ReadFile(filepath.Join(ci.dir, cacheIndexFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	entries := make([]*cacheIndexEntry, 0)
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return err
+	}
+
+	ci.Lock()
+	defer ci.Unlock()
+	for _, e := range entries {
+		ci.entries[e.Path] = e
+	}
+	return nil
+}
+
+// save : Write the index, replacing the earlier one atomically
+func (ci *cacheIndex) save() error {
+	ci.Lock()
+	entries := make([]*cacheIndexEntry, 0, len(ci.entries))
+	for _, e := range ci.entries {
+		entries = append(entries, e)
+	}
+	data, err := json.Marshal(entries)
+	ci.changed = false
+	ci.Unlock()
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(ci.dir, cacheIndexFile)
+	err = os.WriteFile(path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// beginRestore : Files of an earlier mount are not trusted till checked, except those the write-back journal uploads
+func (ci *cacheIndex) beginRestore(pending map[string]bool) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	ci.restoring = true
+	ci.checked = make(map[string]bool, len(pending))
+	for name := range pending {
+		ci.checked[name] = true
+	}
+	ci.restoreDone = make(chan struct{})
+}
+
+// claim : Whether the file is still to be checked, in which case the caller checks it holding the lock of the file
+func (ci *cacheIndex) claim(name string) bool {
+	ci.Lock()
+	defer ci.Unlock()
+
+	if !ci.restoring || ci.checked[name] {
+		return false
+	}
+	ci.checked[name] = true
+	return true
+}
+
+// endRestore : All files of the earlier mount are checked
+func (ci *cacheIndex) endRestore() {
+	ci.Lock()
+	defer ci.Unlock()
+
+	ci.restoring = false
+	ci.checked = nil
+	close(ci.restoreDone)
+}
+
+// waitRestore : Wait till the files of an earlier mount are checked
+func (ci *cacheIndex) waitRestore() {
+	ci.Lock()
+	done := ci.restoreDone
+	ci.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// start : Save the index periodically while it changes
+func (ci *cacheIndex) start() {
+	ci.stop = make(chan struct{})
+	ci.wg.Add(1)
+	go func() {
+		defer ci.wg.Done()
+		ticker := time.NewTicker(cacheIndexInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ci.stop:
+				return
+			case <-ticker.C:
+				ci.Lock()
+				changed := ci.changed
+				ci.Unlock()
+				if changed {
+					err := ci.save()
+					if err != nil {
+						log.Err("cacheIndex::start : Failed to save cache index [%s]", err.Error())
+					}
+				}
+			}
+		}
+	}()
+}
+
+// halt : Stop saving the index and checking files of an earlier mount
+func (ci *cacheIndex) halt() {
+	if ci.stop != nil {
+		close(ci.stop)
+		ci.wg.Wait()
+		ci.stop = nil
+	}
+}
+
+func (ci *cacheIndex) shutdown() {
+	ci.halt()
+
+	err := ci.save()
+	if err != nil {
+		log.Err("cacheIndex::shutdown : Failed to save cache index [%s]", err.Error())
+	}
+}
+
+func (ci *cacheIndex) get(name string) *cacheIndexEntry {
+	ci.Lock()
+	defer ci.Unlock()
+
+	e, found := ci.entries[name]
+	if !found {
+		return nil
+	}
+	c := *e
+	return &c
+}
+
+// restored : Whether the file was cached by an earlier mount and is not checked against storage yet
+func (ci *cacheIndex) restored(name string) bool {
+	ci.Lock()
+	defer ci.Unlock()
+
+	e, found := ci.entries[name]
+	return found && e.revalidate
+}
+
+// set : Record the file as matching the blob with the given attributes
+func (ci *cacheIndex) set(name string, attr *internal.ObjAttr) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	ci.entries[name] = &cacheIndexEntry{
+		Path:       name,
+		Size:       attr.Size,
+		ETag:       attr.ETag,
+		LMT:        attr.Mtime,
+		LastAccess: time.Now(),
+	}
+	ci.changed = true
+}
+
+// touch : Record an access to the file, which is now trusted for this mount
+func (ci *cacheIndex) touch(name string) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	if e, found := ci.entries[name]; found {
+		e.LastAccess = time.Now()
+		e.revalidate = false
+		ci.changed = true
+	}
+}
+
+// markDirty : Record the file as modified locally, returns true if it was not dirty already
+func (ci *cacheIndex) markDirty(name string) bool {
+	ci.Lock()
+	defer ci.Unlock()
+
+	e, found := ci.entries[name]
+	if !found {
+		e = &cacheIndexEntry{Path: name}
+		ci.entries[name] = e
+	}
+	if e.Dirty {
+		return false
+	}
+
+	e.Dirty = true
+	e.revalidate = false
+	e.LastAccess = time.Now()
+	ci.changed = true
+	return true
+}
+
+func (ci *cacheIndex) remove(name string) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	if _, found := ci.entries[name]; found {
+		delete(ci.entries, name)
+		ci.changed = true
+	}
+}
+
+func (ci *cacheIndex) rename(src string, dst string) {
+	ci.Lock()
+	defer ci.Unlock()
+
+	delete(ci.entries, dst)
+	if e, found := ci.entries[src]; found {
+		delete(ci.entries, src)
+		e.Path = dst
+		ci.entries[dst] = e
+	}
+	ci.changed = true
+}
+
+// indexDirty : File is being modified, keep it from being trusted as a copy of the blob after a remount
+func (fc *FileCache) indexDirty(name string) {
+	if fc.index == nil || !fc.index.markDirty(name) || !fc.persistent() {
+		return
+	}
+
+	err := syscall.Setxattr(filepath.Join(fc.tmpPath, name), dirtyXattr, []byte{1}, 0)
+	if err != nil {
+		log.Warn("FileCache::indexDirty : Failed to mark %s dirty [%s]", name, err.Error())
+	}
+}
+
+// indexUploaded : File was uploaded or changed in storage, record it with the new attributes of the blob
+func (fc *FileCache) indexUploaded(name string) {
+	if fc.index == nil {
+		return
+	}
+
+	localPath := filepath.Join(fc.tmpPath, name)
+	attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+	if err != nil {
+		// Without the new ETag the file can not be trusted after a remount
+		log.Warn("FileCache::indexUploaded : Failed to get attributes of %s [%s]", name, err.Error())
+		fc.index.remove(name)
+	} else {
+		fc.index.set(name, attr)
+	}
+
+	if !fc.persistent() {
+		return
+	}
+	err = syscall.Removexattr(localPath, dirtyXattr)
+	if err != nil && err != syscall.ENODATA && !os.IsNotExist(err) {
+		log.Warn("FileCache::indexUploaded : Failed to clear dirty mark of %s [%s]", name, err.Error())
+	}
+}
+
+// revalidateCached : Reuse a cached file which expired or was restored from an earlier mount if the blob has not
+// changed since it was downloaded, going by its ETag or by its last modified time if storage gives no ETag
+func (fc *FileCache) revalidateCached(name string, localPath string) bool {
+	e := fc.index.get(name)
+	if e == nil || e.Dirty || (e.ETag == "" && e.LMT.IsZero()) {
+		return false
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil || fc.plainInfo(info).Size() != e.Size {
+		return false
+	}
+
+	attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+	if fc.checkOffline(err) {
+		// Nothing to check against, keep using the cached copy
+		log.Info("FileCache::revalidateCached : storage is offline, serving %s from cache", name)
+		return true
+	}
+	if err != nil || !e.matches(attr) {
+		log.Debug("FileCache::revalidateCached : %s changed in storage since it was cached", name)
+		return false
+	}
+
+	// Reset the change time of the file so it is valid for the cache timeout again
+	err = os.Chtimes(localPath, attr.Atime, attr.Mtime)
+	if err != nil {
+		return false
+	}
+
+	fc.index.touch(name)
+	fc.recordETag(name, attr)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, cacheRevalidations, (int64)(1))
+	return true
+}
+
+// quarantine : Move a file aside which has local changes that can not be uploaded safely
+func (fc *FileCache) quarantine(name string, localPath string) {
+	dst := filepath.Join(fc.index.dir, quarantineDir, name)
+	err := os.MkdirAll(filepath.Dir(dst), 0700)
+	if err == nil {
+		err = os.Rename(localPath, dst)
+	}
+	if err != nil {
+		log.Err("FileCache::quarantine : Failed to move %s to %s [%s]", localPath, dst, err.Error())
+		return
+	}
+	fc.usage.removed(localPath)
+
+	log.Warn("FileCache::quarantine : Local changes of %s could not be uploaded, kept in %s", name, dst)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, indexQuarantined, (int64)(1))
+}
+
+// recoverDirty : Upload a file left with local changes by an earlier mount if the blob did not change since it was
+// cached, else quarantine it so neither copy is lost
+func (fc *FileCache) recoverDirty(name string, localPath string, e *cacheIndexEntry) bool {
+	attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+	unchanged := false
+	if err == nil {
+		unchanged = e != nil && e.ETag != "" && attr.ETag == e.ETag
+	} else if err == syscall.ENOENT || os.IsNotExist(err) {
+		// Created locally and never uploaded
+		unchanged = e == nil || e.ETag == ""
+	}
+
+	if unchanged {
+		f, err := os.Open(localPath)
+		if err == nil {
+			err = fc.NextComponent().CopyFromFile(internal.CopyFromFileOptions{Name: name, File: f})
+			f.Close()
+		}
+		if err == nil {
+			log.Info("FileCache::recoverDirty : Uploaded local changes of %s left by earlier mount", name)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, indexRecovered, (int64)(1))
+			fc.indexUploaded(name)
+			return true
+		}
+		log.Err("FileCache::recoverDirty : Failed to upload %s [%s]", name, err.Error())
+	}
+
+	fc.index.remove(name)
+	fc.quarantine(name, localPath)
+	return false
+}
+
+// restoreCache : Register files cached by an earlier mount with the eviction policy. Files the index does not know
+// of are removed, ones with local changes are uploaded or quarantined, the rest are checked against storage on
+// first open. Uploads may take long so files are gone through in background, and a file opened before its turn
+// is checked right then.
+func (fc *FileCache) restoreCache(pending map[string]bool) {
+	err := fc.index.load()
+	if err != nil {
+		log.Err("FileCache::restoreCache : Failed to load cache index, not reusing cached files [%s]", err.Error())
+	}
+
+	fc.index.beginRestore(pending)
+	fc.index.wg.Add(1)
+	go func() {
+		defer fc.index.wg.Done()
+		defer fc.index.endRestore()
+
+		err := filepath.WalkDir(fc.tmpPath, func(path string, d fs.DirEntry, err error) error {
+			select {
+			case <-fc.index.stop:
+				return errRestoreStopped
+			default:
+			}
+
+			if err != nil || d.IsDir() {
+				return nil
+			}
+
+			name, err := filepath.Rel(fc.tmpPath, path)
+			if err != nil {
+				return nil
+			}
+
+			flock := fc.fileLocks.Get(name)
+			flock.Lock()
+			fc.checkRestored(name, path)
+			flock.Unlock()
+			return nil
+		})
+		if err != nil {
+			log.Info("FileCache::restoreCache : Stopped before all cached files were checked")
+		}
+
+		// Forget files which are not in the cache anymore
+		fc.index.Lock()
+		names := make([]string, 0, len(fc.index.entries))
+		for name := range fc.index.entries {
+			names = append(names, name)
+		}
+		fc.index.Unlock()
+		for _, name := range names {
+			if _, err := os.Lstat(filepath.Join(fc.tmpPath, name)); os.IsNotExist(err) {
+				fc.index.remove(name)
+			}
+		}
+		log.Info("FileCache::restoreCache : Done checking files cached by earlier mount")
+	}()
+}
+
+// checkRestored : Check the file if it was cached by an earlier mount and is not checked yet, caller holds the lock
+// of the file
+func (fc *FileCache) checkRestored(name string, localPath string) {
+	if fc.index == nil || !fc.index.claim(name) {
+		return
+	}
+
+	info, err := os.Lstat(localPath)
+	if err != nil || info.IsDir() {
+		return
+	}
+
+	e := fc.index.get(name)
+	_, xerr := syscall.Getxattr(localPath, dirtyXattr, nil)
+	if (e != nil && e.Dirty) || xerr == nil {
+		fc.recoverDirty(name, localPath, e)
+		return
+	}
+
+	if e == nil || info.Size() != e.Size {
+		log.Debug("FileCache::checkRestored : Removing untracked file %s", name)
+		fc.index.remove(name)
+		_ = deleteFile(localPath)
+		return
+	}
+
+	fc.index.Lock()
+	if e, found := fc.index.entries[name]; found {
+		e.revalidate = true
+	}
+	fc.index.Unlock()
+	fc.policy.CacheValid(localPath)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, indexRestored, (int64)(1))
+}
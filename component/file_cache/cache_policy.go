@@ -34,12 +34,11 @@
 package file_cache
 
 import (
-	"bytes"
 	"fmt"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Azure/azure-storage-fuse/v2/common"
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
@@ -58,6 +57,11 @@ type cachePolicyConfig struct {
 	lowThreshold  float64
 
 	fileLocks *common.LockMap
+	pins      *pinSet       // Files never to be evicted
+	usage     *usageTracker // Bytes and files in the cache
+
+	demote func(name string) bool // Moves an evicted file to a slower tier, false if it is to be deleted
+	shared *sharedCache           // Set when other mounts use the same cache directory
 
 	policyTrace bool
 }
@@ -78,66 +82,213 @@ type cachePolicy interface {
 }
 
 // getUsage: The current cache usage in MB
-func getUsage(path string) float64 {
-	log.Trace("cachePolicy::getCacheUsage : %s", path)
-
-	var currSize float64
-	var out bytes.Buffer
+func getUsage(usage *usageTracker) float64 {
+	bytes, files := usage.get()
+	log.Debug("cachePolicy::getCacheUsage : current cache usage : %d bytes in %d files", bytes, files)
 
-	// du - estimates file space usage
-	// https://man7.org/linux/man-pages/man1/du.1.html
-	// Note: We cannot just pass -BM as a parameter here since it will result in less accurate estimates of the size of the path
-	// (i.e. du will round up to 1M if the path is smaller than 1M).
-	cmd := exec.Command("du", "-sh", path)
-	cmd.Stdout = &out
+	updateUsageStats(bytes, files)
+	return float64(bytes) / MB
+}
 
-	err := cmd.Run()
-	if err != nil {
-		log.Err("cachePolicy::getCacheUsage : error running du [%s]", err.Error())
+// getUsagePercentage:  The current cache usage as a percentage of the maxSize
+func getUsagePercentage(usage *usageTracker, maxSize float64) float64 {
+	if maxSize == 0 {
 		return 0
 	}
 
-	size := strings.Split(out.String(), "\t")[0]
-	if size == "0" {
-		return 0
+	currSize := getUsage(usage)
+	usagePercent := (currSize / float64(maxSize)) * 100
+	log.Debug("cachePolicy::getUsagePercentage : current cache usage : %f%%", usagePercent)
+
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, cacheUsage, fmt.Sprintf("%f MB", currSize))
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, usgPer, fmt.Sprintf("%f%%", usagePercent))
+
+	return usagePercent
+}
+
+// victimPicker : Policy which leaves eviction to an evictor and only picks the files to evict
+type victimPicker interface {
+	cachePolicy
+
+	victim() (string, bool)                             // Next file to evict, taken out of the cached files
+	expired(timeout time.Duration, max uint32) []string // Files unused for the timeout, taken out of the cached files
+	keep(name string)                                   // Put back a file which could not be evicted
+	evicted(name string)                                // File picked earlier is gone from the cache
+	printNodes()
+}
+
+// evictor : Deletes the files its policy picks, when they expire and when usage crosses the high threshold
+type evictor struct {
+	policy string
+	cfg    *cachePolicyConfig
+	picker victimPicker
+
+	deleteEvent chan string
+	usageCheck  chan struct{}
+	closeSignal chan struct{}
+	wg          sync.WaitGroup
+}
+
+func newEvictor(policy string, cfg *cachePolicyConfig, picker victimPicker) *evictor {
+	return &evictor{
+		policy:      policy,
+		cfg:         cfg,
+		picker:      picker,
+		deleteEvent: make(chan string, 1000),
+		usageCheck:  make(chan struct{}, 1),
 	}
-	// some OS's use "," instead of "." that will not work for float parsing - replace it
-	size = strings.Replace(size, ",", ".", 1)
-	parsed, err := strconv.ParseFloat(size[:len(size)-1], 64)
-	if err != nil {
-		log.Err("cachePolicy::getCacheUsage : error parsing folder size [%s]", err.Error())
-		return 0
+}
+
+func (e *evictor) start() {
+	e.closeSignal = make(chan struct{})
+	e.wg.Add(1)
+	go e.run()
+}
+
+func (e *evictor) shutdown() {
+	close(e.closeSignal)
+	e.wg.Wait()
+}
+
+// purge : Delete the file, which the policy has already dropped
+func (e *evictor) purge(name string) {
+	e.deleteEvent <- name
+}
+
+// checkUsage : A file was added to the cache, so evict if usage is over the high threshold
+func (e *evictor) checkUsage() {
+	select {
+	case e.usageCheck <- struct{}{}:
+	default:
 	}
+}
+
+func (e *evictor) run() {
+	defer e.wg.Done()
 
-	switch size[len(size)-1] {
-	case 'K':
-		currSize = parsed / float64(1024)
-	case 'M':
-		currSize = parsed
-	case 'G':
-		currSize = parsed * 1024
-	case 'T':
-		currSize = parsed * 1024 * 1024
+	var timeout <-chan time.Time
+	if e.cfg.cacheTimeout != 0 {
+		ticker := time.NewTicker(time.Duration(e.cfg.cacheTimeout) * time.Second)
+		defer ticker.Stop()
+		timeout = ticker.C
 	}
 
-	log.Debug("cachePolicy::getCacheUsage : current cache usage : %fMB", currSize)
-	return currSize
+	diskUsage := time.NewTicker(DiskUsageCheckInterval * time.Minute)
+	defer diskUsage.Stop()
+
+	for {
+		select {
+		case name := <-e.deleteEvent:
+			if !evictFile(e.cfg, e.policy, name) {
+				e.picker.CacheValid(name)
+			}
+
+		case <-timeout:
+			for _, name := range e.picker.expired(time.Duration(e.cfg.cacheTimeout)*time.Second, e.cfg.maxEviction) {
+				e.evict(name)
+			}
+			e.picker.printNodes()
+
+		case <-e.usageCheck:
+			e.evictToThreshold()
+
+		case <-diskUsage.C:
+			e.evictToThreshold()
+
+		case <-e.closeSignal:
+			return
+		}
+	}
 }
 
-// getUsagePercentage:  The current cache usage as a percentage of the maxSize
-func getUsagePercentage(path string, maxSize float64) float64 {
-	if maxSize == 0 {
-		return 0
+func (e *evictor) evict(name string) bool {
+	if evictFile(e.cfg, e.policy, name) {
+		e.picker.evicted(name)
+		return true
 	}
+	e.picker.keep(name)
+	return false
+}
 
-	currSize := getUsage(path)
-	usagePercent := (currSize / float64(maxSize)) * 100
-	log.Debug("cachePolicy::getUsagePercentage : current cache usage : %f%%", usagePercent)
+func (e *evictor) evictToThreshold() {
+	usage := getUsagePercentage(e.cfg.usage, e.cfg.maxSizeMB)
+	if usage <= e.cfg.highThreshold {
+		return
+	}
+	log.Info("%s::evictToThreshold : High threshold reached %f > %f", e.policy, usage, e.cfg.highThreshold)
 
-	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, cacheUsage, fmt.Sprintf("%f MB", currSize))
-	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, usgPer, fmt.Sprintf("%f%%", usagePercent))
+	for count := uint32(0); usage > e.cfg.lowThreshold && count < e.cfg.maxEviction; count++ {
+		name, found := e.picker.victim()
+		if !found {
+			break
+		}
+		if e.evict(name) {
+			usage = getUsagePercentage(e.cfg.usage, e.cfg.maxSizeMB)
+		}
+	}
 
-	return usagePercent
+	log.Info("%s::evictToThreshold : Usage at %f after eviction", e.policy, usage)
+	e.picker.printNodes()
+}
+
+// pinned : Whether the cached file at the local path is pinned
+func (cfg *cachePolicyConfig) pinned(name string) bool {
+	return cfg.pins.pinned(strings.TrimPrefix(strings.TrimPrefix(name, cfg.tmpPath), "/"))
+}
+
+// removeFile : Move the evicted file to a slower tier if there is one, else delete it. A file of a shared cache open in
+// another mount is left in place, that mount evicts it once done with it.
+func (cfg *cachePolicyConfig) removeFile(name string) error {
+	if cfg.shared != nil {
+		unlock := cfg.shared.evictable(name)
+		if unlock == nil {
+			return nil
+		}
+		defer unlock()
+	}
+	if cfg.demote != nil && cfg.demote(name) {
+		return nil
+	}
+	return deleteFile(name)
+}
+
+// evictFile : Delete a file picked for eviction by the policy, unless it is pinned, being downloaded or open, in which
+// case false is returned and the policy has to keep it
+func evictFile(cfg *cachePolicyConfig, policy string, name string) bool {
+	azPath := strings.TrimPrefix(strings.TrimPrefix(name, cfg.tmpPath), "/")
+
+	if cfg.pins.pinned(azPath) {
+		// Gone from the cache already if purged by a delete, nothing to keep then
+		if _, err := os.Stat(name); err != nil {
+			return true
+		}
+		log.Debug("%s::evictFile : %s is pinned, not evicting", policy, name)
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, pinnedSkips, (int64)(1))
+		return false
+	}
+
+	flock := cfg.fileLocks.Get(azPath)
+	if cfg.fileLocks.Locked(azPath) {
+		log.Warn("%s::evictFile : File in under download %s", policy, azPath)
+		return false
+	}
+
+	flock.Lock()
+	defer flock.Unlock()
+
+	// Check if there are any open handles to this file or not
+	if flock.Count() > 0 {
+		log.Warn("%s::evictFile : File in use %s", policy, name)
+		return false
+	}
+
+	err := cfg.removeFile(name)
+	if err != nil {
+		log.Err("%s::evictFile : failed to delete local file %s [%s]", policy, name, err.Error())
+		return true
+	}
+	cfg.usage.removed(name)
+	return true
 }
 
 // Delete a given file
@@ -69,7 +69,9 @@ func (suite *cachePolicyTestSuite) TestGetUsage() {
 	f, _ := os.Create(cache_path + "/test")
 	data := make([]byte, 1024*1024)
 	f.Write(data)
-	result := getUsage(cache_path)
+	usage := newUsageTracker(cache_path)
+	usage.changed(f.Name())
+	result := getUsage(usage)
 	suite.assert.Equal(float64(1), math.Floor(result))
 }
 
@@ -78,12 +80,77 @@ func (suite *cachePolicyTestSuite) TestGetUsagePercentage() {
 	f, _ := os.Create(cache_path + "/test")
 	data := make([]byte, 1024*1024)
 	f.Write(data)
-	result := getUsagePercentage(cache_path, 4)
+	usage := newUsageTracker(cache_path)
+	usage.changed(f.Name())
+	result := getUsagePercentage(usage, 4)
 	// since the value might defer a little distro to distro
 	suite.assert.GreaterOrEqual(result, float64(25))
 	suite.assert.LessOrEqual(result, float64(30))
 }
 
+func (suite *cachePolicyTestSuite) TestUsageTracker() {
+	defer suite.cleanupTest()
+	usage := newUsageTracker(cache_path)
+	bytes, files := usage.get()
+	suite.assert.EqualValues(0, bytes)
+	suite.assert.EqualValues(0, files)
+
+	os.WriteFile(cache_path+"/a", make([]byte, 1024*1024), 0777)
+	os.WriteFile(cache_path+"/b", make([]byte, 512*1024), 0777)
+	usage.changed(cache_path + "/a")
+	usage.changed(cache_path + "/b")
+	bytes, files = usage.get()
+	suite.assert.EqualValues(1536*1024, bytes)
+	suite.assert.EqualValues(2, files)
+
+	// Sparse space is not counted
+	os.Truncate(cache_path+"/b", 4*1024*1024)
+	usage.changed(cache_path + "/b")
+	bytes, _ = usage.get()
+	suite.assert.EqualValues(1536*1024, bytes)
+
+	os.Truncate(cache_path+"/b", 0)
+	usage.changed(cache_path + "/b")
+	bytes, _ = usage.get()
+	suite.assert.EqualValues(1024*1024, bytes)
+
+	// Rename over an existing file drops the destination
+	os.Rename(cache_path+"/a", cache_path+"/b")
+	usage.renamed(cache_path+"/a", cache_path+"/b")
+	bytes, files = usage.get()
+	suite.assert.EqualValues(1024*1024, bytes)
+	suite.assert.EqualValues(1, files)
+
+	os.Remove(cache_path + "/b")
+	usage.removed(cache_path + "/b")
+	bytes, files = usage.get()
+	suite.assert.EqualValues(0, bytes)
+	suite.assert.EqualValues(0, files)
+
+	// Files changed behind its back are picked up by a walk
+	os.MkdirAll(cache_path+"/dir", 0777)
+	os.WriteFile(cache_path+"/dir/c", make([]byte, 1024*1024), 0777)
+	usage.reconcile()
+	bytes, files = usage.get()
+	suite.assert.EqualValues(1024*1024, bytes)
+	suite.assert.EqualValues(1, files)
+
+	// Open file is looked at on every use, writes to it need not be reported
+	usage.opened(cache_path + "/dir/c")
+	os.WriteFile(cache_path+"/dir/c", make([]byte, 2*1024*1024), 0777)
+	bytes, _ = usage.get()
+	suite.assert.EqualValues(2*1024*1024, bytes)
+	os.Truncate(cache_path+"/dir/c", 0)
+	bytes, _ = usage.get()
+	suite.assert.EqualValues(0, bytes)
+
+	os.WriteFile(cache_path+"/dir/c", make([]byte, 1024*1024), 0777)
+	usage.closed(cache_path + "/dir/c")
+	bytes, _ = usage.get()
+	suite.assert.EqualValues(1024*1024, bytes)
+	suite.assert.Empty(usage.open)
+}
+
 func (suite *cachePolicyTestSuite) TestDeleteFile() {
 	defer suite.cleanupTest()
 	f, _ := os.Create(cache_path + "/test")
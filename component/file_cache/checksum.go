@@ -0,0 +1,273 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+// CRC64 of the content of a downloaded file is kept in this xattr of the cached file, so it can be verified later and
+// offline. Changing the file drops it, a cached file without it is not verified.
+const checksumXattr = "user.blobfuse2.crc64"
+
+var (
+	crc64Table          = crc64.MakeTable(crc64.ECMA)
+	errChecksumMismatch = errors.New("checksum mismatch")
+	errScanStopped      = errors.New("checksum scan stopped")
+)
+
+// fileChecksum : CRC64 and MD5 of the content of the file
+func fileChecksum(path string) (uint64, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer f.Close()
+
+	crc := crc64.New(crc64Table)
+	sum := md5.New()
+	_, err = io.Copy(io.MultiWriter(crc, sum), f)
+	if err != nil {
+		return 0, nil, err
+	}
+	return crc.Sum64(), sum.Sum(nil), nil
+}
+
+func recordChecksum(path string, crc uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, crc)
+	return syscall.Setxattr(path, checksumXattr, value, 0)
+}
+
+// dropChecksum : File is being changed, its content is not what was downloaded anymore
+func dropChecksum(path string) {
+	err := syscall.Removexattr(path, checksumXattr)
+	if err != nil && err != syscall.ENODATA && !os.IsNotExist(err) {
+		log.Warn("FileCache::dropChecksum : Failed to drop checksum of %s [%s]", path, err.Error())
+	}
+}
+
+// verifyChecksum : Check the file against the checksum recorded when it was downloaded, false if it has none
+func verifyChecksum(path string) (bool, error) {
+	value := make([]byte, 8)
+	n, err := syscall.Getxattr(path, checksumXattr, value)
+	if err == syscall.ENODATA {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	} else if n != len(value) {
+		return true, errChecksumMismatch
+	}
+
+	crc, _, err := fileChecksum(path)
+	if err != nil {
+		return false, err
+	}
+	if crc != binary.BigEndian.Uint64(value) {
+		return true, errChecksumMismatch
+	}
+	return true, nil
+}
+
+// VerifyResult : Outcome of verifying the files of a cache directory
+type VerifyResult struct {
+	Verified   int      // Files matching their checksum
+	Unverified int      // Files without a checksum, changed locally or not downloaded whole
+	Corrupt    []string // Files not matching their checksum
+	Failed     []string // Files which could not be read
+}
+
+// VerifyCache : Verify the files cached in path against their checksums, without a mount. Corrupt files are deleted
+// if remove is set, so they are downloaded again on their next use.
+func VerifyCache(path string, remove bool) (VerifyResult, error) {
+	result := VerifyResult{}
+	err := filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		verified, err := verifyChecksum(file)
+		switch {
+		case err == errChecksumMismatch:
+			result.Corrupt = append(result.Corrupt, file)
+			if remove {
+				err = os.Remove(file)
+				if err != nil {
+					return fmt.Errorf("failed to delete %s [%s]", file, err.Error())
+				}
+			}
+		case err != nil:
+			result.Failed = append(result.Failed, file)
+		case verified:
+			result.Verified++
+		default:
+			result.Unverified++
+		}
+		return nil
+	})
+	return result, err
+}
+
+// checkDownload : Record the checksum of a file just downloaded, after checking it against the MD5 of the blob if
+// storage has one
+func (fc *FileCache) checkDownload(name string, localPath string, attr *internal.ObjAttr) error {
+	crc, sum, err := fileChecksum(localPath)
+	if err != nil {
+		return err
+	}
+	if len(attr.MD5) > 0 && !bytes.Equal(attr.MD5, sum) {
+		fc.checksumMismatch(name, "download")
+		return errChecksumMismatch
+	}
+
+	err = recordChecksum(localPath, crc)
+	if err != nil {
+		log.Warn("FileCache::checkDownload : Failed to record checksum of %s [%s]", name, err.Error())
+	}
+	return nil
+}
+
+// checksumValid : Whether the cached file still matches its checksum, a file without one is taken as valid
+func (fc *FileCache) checksumValid(name string, localPath string) bool {
+	_, err := verifyChecksum(localPath)
+	if err == errChecksumMismatch {
+		fc.checksumMismatch(name, "open")
+		return false
+	} else if err != nil {
+		log.Warn("FileCache::checksumValid : Failed to verify %s [%s]", name, err.Error())
+	}
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, checksumVerified, (int64)(1))
+	return true
+}
+
+// checksumMismatch : Raise the alert for a cached file which is not the content of its blob
+func (fc *FileCache) checksumMismatch(name string, when string) {
+	log.Err("FileCache::checksumMismatch : %s failed checksum verification on %s, it will be downloaded again", name, when)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, checksumMismatches, (int64)(1))
+	fileCacheStatsCollector.PushEvents(checksumMismatchEvent, name, map[string]interface{}{"verified on": when})
+}
+
+// checksumScanner : Verifies the files in the cache in background, deleting the ones which fail
+type checksumScanner struct {
+	interval time.Duration
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func (s *checksumScanner) start(scan func()) {
+	if s == nil {
+		return
+	}
+
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				scan()
+			}
+		}
+	}()
+}
+
+func (s *checksumScanner) shutdown() {
+	if s != nil && s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+	}
+}
+
+// scanChecksums : Verify the cached files which are not open, and evict the ones which fail so they are downloaded again
+func (fc *FileCache) scanChecksums() {
+	_ = filepath.WalkDir(fc.tmpPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		select {
+		case <-fc.scanner.stop:
+			return errScanStopped
+		default:
+		}
+
+		name := strings.TrimPrefix(strings.TrimPrefix(path, fc.tmpPath), "/")
+		flock := fc.fileLocks.Get(name)
+		flock.Lock()
+		defer flock.Unlock()
+		if flock.Count() > 0 {
+			return nil
+		}
+
+		verified, err := verifyChecksum(path)
+		if err == errChecksumMismatch {
+			fc.checksumMismatch(name, "scan")
+			err = deleteFile(path)
+			if err != nil {
+				log.Err("FileCache::scanChecksums : Failed to delete %s [%s]", path, err.Error())
+				return nil
+			}
+			fc.policy.CachePurge(path)
+			fc.usage.removed(path)
+		} else if verified {
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, checksumVerified, (int64)(1))
+		}
+		return nil
+	})
+}
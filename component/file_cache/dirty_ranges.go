@@ -0,0 +1,273 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/handlemap"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	// Key under which the dirty ranges are kept in the handle
+	dirtyRangesKey = "dirtyRanges"
+
+	// Beyond these many separate ranges tracking is dropped and whole file is uploaded
+	maxDirtyRanges = 4096
+
+	// Changed blocks are held in memory while staging, so larger changes are uploaded from the file as a whole
+	maxDirtyUploadBytes = 256 * common.MbToBytes
+
+	// Maximum blocks a block blob can have
+	maxBlobBlocks = 50000
+
+	// New block ids are uuids of same length as existing ones, which need at least this many bytes
+	minBlockIdLength = 9
+)
+
+type byteRange struct {
+	start int64
+	end   int64
+}
+
+// dirtyRanges : Byte ranges of the cached file written through a handle and not yet uploaded
+type dirtyRanges struct {
+	sync.Mutex
+	ranges []byteRange // sorted and non overlapping
+	full   bool        // whole file needs to be uploaded
+}
+
+// add : Mark the given range dirty, merging it with overlapping or adjacent ranges
+func (d *dirtyRanges) add(start int64, end int64) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.full || start >= end {
+		return
+	}
+
+	i := sort.Search(len(d.ranges), func(i int) bool { return d.ranges[i].end >= start })
+	j := i
+	for j < len(d.ranges) && d.ranges[j].start <= end {
+		if d.ranges[j].start < start {
+			start = d.ranges[j].start
+		}
+		if d.ranges[j].end > end {
+			end = d.ranges[j].end
+		}
+		j++
+	}
+
+	merged := append([]byteRange{}, d.ranges[:i]...)
+	merged = append(merged, byteRange{start, end})
+	d.ranges = append(merged, d.ranges[j:]...)
+
+	if len(d.ranges) > maxDirtyRanges {
+		d.full = true
+		d.ranges = nil
+	}
+}
+
+// setFull : Whole file needs to be uploaded on next flush
+func (d *dirtyRanges) setFull() {
+	d.Lock()
+	defer d.Unlock()
+	d.full = true
+	d.ranges = nil
+}
+
+// take : Get the dirty ranges and reset them, writes from here on are tracked for the next flush
+func (d *dirtyRanges) take() ([]byteRange, bool) {
+	d.Lock()
+	defer d.Unlock()
+	ranges, full := d.ranges, d.full
+	d.ranges, d.full = nil, false
+	return ranges, full
+}
+
+// restore : Put back ranges taken for a flush which failed
+func (d *dirtyRanges) restore(ranges []byteRange, full bool) {
+	if full {
+		d.setFull()
+		return
+	}
+	for _, r := range ranges {
+		d.add(r.start, r.end)
+	}
+}
+
+// newDirtyRanges : Start tracking writes on the handle
+func newDirtyRanges(handle *handlemap.Handle) *dirtyRanges {
+	d := &dirtyRanges{}
+	handle.SetValue(dirtyRangesKey, d)
+	return d
+}
+
+// getDirtyRanges : Ranges tracked on the handle, nil if handle was not opened by file cache
+func getDirtyRanges(handle *handlemap.Handle) *dirtyRanges {
+	val, found := handle.GetValue(dirtyRangesKey)
+	if !found {
+		return nil
+	}
+	return val.(*dirtyRanges)
+}
+
+// uploadDirtyBlocks : Stage only the blocks of the blob which overlap the dirty ranges, plus the part of the file
+// beyond the current blob size, and commit the block list. Returns false without uploading anything if the block
+// layout of the blob does not allow it, in which case the whole file needs to be uploaded.
+func (fc *FileCache) uploadDirtyBlocks(name string, f *os.File, ranges []byteRange) (bool, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return false, nil
+	}
+	size := info.Size()
+
+	bol, err := fc.NextComponent().GetFileBlockOffsets(internal.GetFileBlockOffsetsOptions{Name: name})
+	if err != nil || bol.SmallFile() || len(bol.BlockList) == 0 {
+		return false, nil
+	}
+
+	// Blocks not written to are taken from the blob, which is only right if it is the version the file was cached from
+	etag, found := fc.cachedETags.Load(name)
+	if !found || bol.Etag == "" || bol.Etag != etag.(string) {
+		log.Info("FileCache::uploadDirtyBlocks : %s may have changed in storage since it was cached, uploading it whole", name)
+		return false, nil
+	}
+
+	blobSize := bol.BlockList[len(bol.BlockList)-1].EndIndex
+	blockSize := bol.BlockList[0].EndIndex - bol.BlockList[0].StartIndex
+	if size < blobSize || blockSize <= 0 || bol.BlockIdLength < minBlockIdLength {
+		return false, nil
+	}
+
+	// Everything past the end of the blob is new, including holes left by writing beyond the end
+	for offset := blobSize; offset < size; offset += blockSize {
+		end := offset + blockSize
+		if end > size {
+			end = size
+		}
+		blk := &common.Block{
+			Id:         base64.StdEncoding.EncodeToString(common.NewUUIDWithLength(bol.BlockIdLength)),
+			StartIndex: offset,
+			EndIndex:   end,
+		}
+		blk.Flags.Set(common.DirtyBlock)
+		bol.BlockList = append(bol.BlockList, blk)
+	}
+
+	if len(bol.BlockList) > maxBlobBlocks {
+		return false, nil
+	}
+
+	for _, r := range ranges {
+		if r.start >= blobSize {
+			break
+		}
+		blocks, _ := bol.FindBlocks(r.start, r.end-r.start-1)
+		for _, blk := range blocks {
+			blk.Flags.Set(common.DirtyBlock)
+		}
+	}
+
+	dirtyBytes := int64(0)
+	for _, blk := range bol.BlockList {
+		if blk.Dirty() {
+			dirtyBytes += blk.EndIndex - blk.StartIndex
+		}
+	}
+	if dirtyBytes > maxDirtyUploadBytes || dirtyBytes >= size {
+		return false, nil
+	}
+
+	localPath := filepath.Join(fc.tmpPath, name)
+	for _, blk := range bol.BlockList {
+		if !blk.Dirty() {
+			continue
+		}
+
+		// Parts of the block not written to may not have been downloaded yet
+		err = fc.fillRange(name, localPath, blk.StartIndex, blk.EndIndex-blk.StartIndex, false)
+		if err != nil {
+			return true, err
+		}
+
+		blk.Data = make([]byte, blk.EndIndex-blk.StartIndex)
+		_, err = f.ReadAt(blk.Data, blk.StartIndex)
+		if err != nil {
+			log.Err("FileCache::uploadDirtyBlocks : failed to read %s at %d [%s]", name, blk.StartIndex, err.Error())
+			return false, nil
+		}
+	}
+
+	log.Debug("FileCache::uploadDirtyBlocks : uploading %d of %d bytes of %s", dirtyBytes, size, name)
+
+	// Clean blocks are those of the version the file was cached from
+	bol.Flags.Set(common.MatchEtag)
+
+	uploadHandle := handlemap.NewHandle(name)
+	uploadHandle.SetFileObject(f)
+	uploadHandle.CacheObj = &handlemap.Cache{BlockOffsetList: bol}
+	err = fc.NextComponent().FlushFile(internal.FlushFileOptions{Handle: uploadHandle})
+	if err == syscall.ESTALE {
+		// Blob changed after its block list was read
+		log.Info("FileCache::uploadDirtyBlocks : %s changed in storage while uploading, uploading it whole", name)
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	fc.cachedETags.Store(name, bol.Etag)
+	fc.updateSparseETag(name, localPath, bol.Etag)
+
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, partialUploads, (int64)(1))
+	return true, nil
+}
+
+// recordETag : Remember the version of the blob the cached file matches, so partial uploads can be checked against it
+func (fc *FileCache) recordETag(name string, attr *internal.ObjAttr) {
+	if attr == nil || attr.ETag == "" {
+		fc.cachedETags.Delete(name)
+		return
+	}
+	fc.cachedETags.Store(name, attr.ETag)
+}
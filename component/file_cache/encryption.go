@@ -0,0 +1,499 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+)
+
+const (
+	// Plain bytes sealed together, random reads and writes decrypt and encrypt whole chunks
+	encryptChunkSize = 64 * 1024
+	encryptKeySize   = 32
+
+	// Decrypted copy of a file being uploaded is kept here, in memory, as upload needs a file
+	defaultEncryptStagingPath = "/dev/shm"
+
+	// Filesystems keeping their files in memory only, the only ones plain copies may be staged on
+	tmpfsMagic = 0x01021994
+	ramfsMagic = 0x858458f6
+
+	// Ranges of the blob downloaded at once, each is as many chunks
+	encryptDownloadParallelism = 8
+	encryptDownloadChunks      = 64
+
+	// Files are locked for read-modify-write of their chunks, by inode, over this many locks
+	encryptLockStripes = 64
+)
+
+// cacheCipher : Encrypts cached files with AES-GCM. A file is a sequence of chunks, each stored as a random nonce,
+// the sealed chunk and its tag. The chunk index is authenticated along with it so chunks can not be reordered.
+type cacheCipher struct {
+	aead    cipher.AEAD
+	chunk   int64 // Plain bytes in a full chunk
+	sealed  int64 // Bytes on disk of a full chunk
+	staging string
+	locks   [encryptLockStripes]sync.Mutex
+}
+
+// newCacheCipher : Cipher with the key in keyFile, or a random key for this mount only if keyFile is empty
+func newCacheCipher(keyFile string, staging string) (*cacheCipher, error) {
+	key := make([]byte, encryptKeySize)
+	if keyFile == "" {
+		_, err := rand.Read(key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		// Key is either the raw bytes or their base64 encoding
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != encryptKeySize {
+			key = data
+		}
+		if len(key) != encryptKeySize {
+			return nil, fmt.Errorf("key in %s is not %d bytes", keyFile, encryptKeySize)
+		}
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cacheCipher{
+		aead:    aead,
+		chunk:   encryptChunkSize,
+		sealed:  encryptChunkSize + int64(aead.NonceSize()+aead.Overhead()),
+		staging: staging,
+	}, nil
+}
+
+// plainSize : Size of the file content for a file of this size on disk
+func (c *cacheCipher) plainSize(size int64) int64 {
+	full, rest := size/c.sealed, size%c.sealed
+	plain := full * c.chunk
+	if rest > c.sealed-c.chunk {
+		plain += rest - (c.sealed - c.chunk)
+	}
+	return plain
+}
+
+// diskSize : Size on disk of a file with content of this size
+func (c *cacheCipher) diskSize(plain int64) int64 {
+	full, rest := plain/c.chunk, plain%c.chunk
+	size := full * c.sealed
+	if rest > 0 {
+		size += rest + c.sealed - c.chunk
+	}
+	return size
+}
+
+// lock : Lock the file for changes to its chunks
+func (c *cacheCipher) lock(f *os.File) (*sync.Mutex, int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	mu := &c.locks[info.Sys().(*syscall.Stat_t).Ino%encryptLockStripes]
+	mu.Lock()
+
+	// Size is read again under the lock as another handle may have changed it
+	info, err = f.Stat()
+	if err != nil {
+		mu.Unlock()
+		return nil, 0, err
+	}
+	return mu, c.plainSize(info.Size()), nil
+}
+
+// readChunk : Plain content of the chunk at index i of a file of the given plain size
+func (c *cacheCipher) readChunk(f *os.File, i int64, size int64) ([]byte, error) {
+	length := size - i*c.chunk
+	if length <= 0 {
+		return []byte{}, nil
+	}
+	if length > c.chunk {
+		length = c.chunk
+	}
+
+	sealed := make([]byte, length+c.sealed-c.chunk)
+	_, err := f.ReadAt(sealed, i*c.sealed)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := sealed[:c.aead.NonceSize()]
+	plain, err := c.aead.Open(nil, nonce, sealed[c.aead.NonceSize():], c.index(i))
+	if err != nil {
+		log.Err("cacheCipher::readChunk : chunk %d of %s failed authentication", i, f.Name())
+		return nil, syscall.EIO
+	}
+	return plain, nil
+}
+
+// writeChunk : Seal and write the plain content of the chunk at index i
+func (c *cacheCipher) writeChunk(f *os.File, i int64, plain []byte) error {
+	nonce := make([]byte, c.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(c.aead.Seal(nonce, nonce, plain, c.index(i)), i*c.sealed)
+	return err
+}
+
+func (c *cacheCipher) index(i int64) []byte {
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, uint64(i))
+	return data
+}
+
+// readAt : Read plain content at offset, short at the end of the file like pread
+func (c *cacheCipher) readAt(f *os.File, data []byte, offset int64) (int, error) {
+	mu, size, err := c.lock(f)
+	if err != nil {
+		return 0, err
+	}
+	defer mu.Unlock()
+
+	n := 0
+	for offset+int64(n) < size && n < len(data) {
+		pos := offset + int64(n)
+		plain, err := c.readChunk(f, pos/c.chunk, size)
+		if err != nil {
+			return n, err
+		}
+		n += copy(data[n:], plain[pos%c.chunk:])
+	}
+	return n, nil
+}
+
+// writeAt : Write plain content at offset, the gap to the end of the file is filled with zeros if it is beyond it
+func (c *cacheCipher) writeAt(f *os.File, data []byte, offset int64) (int, error) {
+	mu, size, err := c.lock(f)
+	if err != nil {
+		return 0, err
+	}
+	defer mu.Unlock()
+
+	return len(data), c.write(f, data, offset, size)
+}
+
+// write : Rewrite the chunks from the end of the file or offset, whichever is first, till the end of data
+func (c *cacheCipher) write(f *os.File, data []byte, offset int64, size int64) error {
+	start := offset
+	if size < start {
+		start = size
+	}
+	end := offset + int64(len(data))
+
+	for i := start / c.chunk; i*c.chunk < end; i++ {
+		plain, err := c.readChunk(f, i, size)
+		if err != nil {
+			return err
+		}
+
+		// Chunk grows to cover the data written to it, new bytes before the data are zeros
+		length := end - i*c.chunk
+		if length > c.chunk {
+			length = c.chunk
+		}
+		if int64(len(plain)) < length {
+			plain = append(plain, make([]byte, length-int64(len(plain)))...)
+		}
+		if offset < (i+1)*c.chunk {
+			from := offset - i*c.chunk
+			skip := int64(0)
+			if from < 0 {
+				skip, from = -from, 0
+			}
+			copy(plain[from:], data[skip:])
+		}
+
+		err = c.writeChunk(f, i, plain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// truncate : Change the plain size of the file, growing it with zeros
+func (c *cacheCipher) truncate(f *os.File, size int64) error {
+	mu, current, err := c.lock(f)
+	if err != nil {
+		return err
+	}
+	defer mu.Unlock()
+
+	if size > current {
+		return c.write(f, []byte{}, size, current)
+	}
+
+	// Last chunk left is sealed again with its new length
+	if size%c.chunk != 0 && size < current {
+		plain, err := c.readChunk(f, size/c.chunk, current)
+		if err != nil {
+			return err
+		}
+		err = c.writeChunk(f, size/c.chunk, plain[:size%c.chunk])
+		if err != nil {
+			return err
+		}
+	}
+	return f.Truncate(c.diskSize(size))
+}
+
+// plainCopy : Decrypted copy of the file in the staging directory, unlinked at once so it is gone when closed or on a
+// crash. Upload takes a file so the whole file is decrypted on each upload, which costs its size in memory meanwhile.
+func (c *cacheCipher) plainCopy(f *os.File) (*os.File, error) {
+	mu, size, err := c.lock(f)
+	if err != nil {
+		return nil, err
+	}
+	defer mu.Unlock()
+
+	out, err := os.CreateTemp(c.staging, ".blobfuse2-upload-")
+	if err != nil {
+		return nil, err
+	}
+	_ = os.Remove(out.Name())
+
+	for i := int64(0); i*c.chunk < size; i++ {
+		plain, err := c.readChunk(f, i, size)
+		if err == nil {
+			_, err = out.Write(plain)
+		}
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+	}
+
+	_, err = out.Seek(0, 0)
+	if err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+// encryptedInfo : File info of an encrypted cached file, with the size of its content
+type encryptedInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (e *encryptedInfo) Size() int64 {
+	return e.size
+}
+
+// configureEncryption : Encrypt cached files with the configured key, or one made for this mount
+func (c *FileCache) configureEncryption(conf FileCacheOptions) error {
+	// These read or write cached files directly, or keep them across mounts when a random key is lost
+	unsupported := []struct {
+		option string
+		set    bool
+	}{
+		{"sparse-cache", conf.SparseCache},
+		{"async-open", conf.AsyncOpen},
+		{"write-back", conf.WriteBack},
+		{"offline-mode", conf.OfflineMode},
+		{"persistent-cache", conf.PersistentCache},
+		{"shared-cache", conf.SharedCache},
+		{"tiers", len(conf.Tiers) > 0 || conf.MemoryTierMB > 0},
+		{"verify-checksum", conf.VerifyChecksum},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			log.Err("FileCache: config error [encryption can not be used with %s]", u.option)
+			return fmt.Errorf("config error in %s [encryption can not be used with %s]", c.Name(), u.option)
+		}
+	}
+
+	// Plain copies are never written to disk, that is what encryption is there to prevent
+	staging := defaultEncryptStagingPath
+	if conf.EncryptionStaging != "" {
+		staging = common.ExpandPath(conf.EncryptionStaging)
+	}
+	err := os.MkdirAll(staging, 0700)
+	if err != nil {
+		log.Err("FileCache: config error [failed to create encryption staging directory %s [%s]]", staging, err.Error())
+		return fmt.Errorf("config error in %s [encryption-staging-path %s: %s]", c.Name(), staging, err.Error())
+	}
+	if !memoryBacked(staging) {
+		log.Err("FileCache: config error [encryption staging directory %s is not memory backed]", staging)
+		return fmt.Errorf("config error in %s [encryption-staging-path %s is not on tmpfs or ramfs]", c.Name(), staging)
+	}
+
+	c.cipher, err = newCacheCipher(common.ExpandPath(conf.EncryptionKeyFile), staging)
+	if err != nil {
+		log.Err("FileCache: config error [failed to set up encryption [%s]]", err.Error())
+		return fmt.Errorf("config error in %s [encryption: %s]", c.Name(), err.Error())
+	}
+
+	// Files left by an earlier mount may be plain or under another key, they would fail authentication on every read
+	if !isLocalDirEmpty(c.tmpPath) {
+		log.Warn("FileCache::configureEncryption : files cached earlier in %s may be plain or under another key, cleaning them up", c.tmpPath)
+		c.cleanupOnStart = true
+	}
+	return nil
+}
+
+// memoryBacked : Whether the files in the directory are kept in memory only
+func memoryBacked(path string) bool {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return false
+	}
+	return stat.Type == tmpfsMagic || stat.Type == ramfsMagic
+}
+
+// plainInfo : Info of the cached file as seen by the user, whose size is of its content if it is encrypted
+func (fc *FileCache) plainInfo(info fs.FileInfo) fs.FileInfo {
+	if fc.cipher == nil || info == nil || !info.Mode().IsRegular() {
+		return info
+	}
+	return &encryptedInfo{FileInfo: info, size: fc.cipher.plainSize(info.Size())}
+}
+
+// truncateCached : Change the size of the cached file, re-encrypting its last chunk if it is encrypted
+func (fc *FileCache) truncateCached(localPath string, size int64) error {
+	if fc.cipher == nil {
+		return os.Truncate(localPath, size)
+	}
+
+	f, err := os.OpenFile(localPath, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return fc.cipher.truncate(f, size)
+}
+
+// downloadEncrypted : Download the blob into the cached file, encrypting it as it is written
+func (fc *FileCache) downloadEncrypted(name string, f *os.File, size int64) error {
+	if size == 0 {
+		return nil
+	}
+
+	remote, err := fc.NextComponent().OpenFile(internal.OpenFileOptions{Name: name, Flags: os.O_RDONLY, Mode: fc.defaultPermission})
+	if err != nil {
+		return err
+	}
+	defer fc.NextComponent().CloseFile(internal.CloseFileOptions{Handle: remote}) //nolint
+	if remote.Size == 0 {
+		remote.Size = size
+	}
+
+	// Ranges are downloaded in parallel and encrypted in order, as the file grows by whole chunks
+	type segment struct {
+		data []byte
+		err  error
+	}
+	length := encryptDownloadChunks * fc.cipher.chunk
+	pending := make(chan chan segment, encryptDownloadParallelism)
+	stop := make(chan struct{})
+	// Reads still running on a failure have to be done before the handle is closed
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	defer close(stop)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(pending)
+		for offset := int64(0); offset < size; offset += length {
+			data := make([]byte, length)
+			if size-offset < length {
+				data = data[:size-offset]
+			}
+			result := make(chan segment, 1)
+			select {
+			case pending <- result:
+			case <-stop:
+				return
+			}
+
+			wg.Add(1)
+			go func(offset int64, data []byte) {
+				defer wg.Done()
+				n, err := fc.NextComponent().ReadInBuffer(internal.ReadInBufferOptions{Handle: remote, Offset: offset, Data: data})
+				if err == nil && n != len(data) {
+					err = syscall.EIO
+				}
+				result <- segment{data: data, err: err}
+			}(offset, data)
+		}
+	}()
+
+	offset := int64(0)
+	for result := range pending {
+		seg := <-result
+		err := seg.err
+		if err == nil {
+			_, err = fc.cipher.writeAt(f, seg.data, offset)
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(len(seg.data))
+	}
+	return nil
+}
@@ -70,12 +70,65 @@ type FileCache struct {
 	cleanupOnStart  bool
 	policyTrace     bool
 	missedChmodList sync.Map
+	missedTimesList sync.Map
 	mountPath       string
 	allowOther      bool
 	offloadIO       bool
 	maxCacheSize    float64
 
 	defaultPermission os.FileMode
+
+	// Download only the ranges being read instead of the whole file on open
+	sparse          bool
+	sparseBlockSize int64
+	sparseReadAhead int64
+	sparseFiles     sync.Map // Chunks downloaded so far of partially cached files which are open or downloading
+
+	// Version of the blob each cached file was downloaded from or last uploaded to
+	cachedETags sync.Map
+
+	// Return from open at once and download the file in background
+	asyncOpen            bool
+	asyncOpenParallelism int
+
+	// Upload closed files in background from a durable queue
+	writeBack       *writeBack
+	writeBackOnSync bool
+	writeBackDirty  sync.Map // Ranges written through the handles of each pending file, not known after a remount
+
+	// Index of cached files to reuse them after a remount, or to check them against storage once they expire
+	index      *cacheIndex
+	revalidate bool
+
+	// Keep serving from the cache while storage is unreachable, and reconcile the uploads queued meanwhile
+	conn           *connectivity
+	conflictPolicy string
+
+	// Files kept in the cache whatever the eviction policy says, and files fetched ahead of their use
+	pins         *pinSet
+	prefetch     *prefetcher
+	prefetchList string
+
+	usage *usageTracker
+
+	// Slower caches below tmpPath, in order, which take evicted files till they are used again
+	tiers []cacheTier
+
+	// Cache directory used by other mounts on the host as well
+	shared *sharedCache
+
+	// Encrypts cached files, which are then read and written only through this component
+	cipher *cacheCipher
+
+	// Checksums recorded on download and verified when files are opened or in background
+	verify       bool
+	verifyOnOpen bool
+	scanner      *checksumScanner
+
+	// Limits on the files cached under path prefixes, and files which are not cached at all
+	quotas       *quotaSet
+	admitMaxSize int64
+	admitExclude []string
 }
 
 // Structure defining your config parameters
@@ -98,6 +151,49 @@ type FileCacheOptions struct {
 	EnablePolicyTrace bool `config:"policy-trace" yaml:"policy-trace,omitempty"`
 	OffloadIO         bool `config:"offload-io" yaml:"offload-io,omitempty"`
 
+	SparseCache       bool   `config:"sparse-cache" yaml:"sparse-cache,omitempty"`
+	SparseBlockSizeMB uint32 `config:"sparse-block-size-mb" yaml:"sparse-block-size-mb,omitempty"`
+	SparseReadAhead   uint32 `config:"sparse-read-ahead" yaml:"sparse-read-ahead,omitempty"`
+
+	AsyncOpen            bool   `config:"async-open" yaml:"async-open,omitempty"`
+	AsyncOpenParallelism uint32 `config:"async-open-parallelism" yaml:"async-open-parallelism,omitempty"`
+
+	WriteBack        bool   `config:"write-back" yaml:"write-back,omitempty"`
+	WriteBackWorkers uint32 `config:"write-back-workers" yaml:"write-back-workers,omitempty"`
+	WriteBackPath    string `config:"write-back-path" yaml:"write-back-path,omitempty"`
+	WriteBackOnSync  bool   `config:"write-back-upload-on-fsync" yaml:"write-back-upload-on-fsync,omitempty"`
+
+	PersistentCache     bool   `config:"persistent-cache" yaml:"persistent-cache,omitempty"`
+	PersistentCachePath string `config:"persistent-cache-path" yaml:"persistent-cache-path,omitempty"`
+	Revalidate          bool   `config:"revalidate" yaml:"revalidate,omitempty"`
+
+	OfflineMode          bool   `config:"offline-mode" yaml:"offline-mode,omitempty"`
+	OfflineProbeInterval uint32 `config:"offline-probe-interval-sec" yaml:"offline-probe-interval-sec,omitempty"`
+	ConflictPolicy       string `config:"conflict-policy" yaml:"conflict-policy,omitempty"`
+
+	PinPaths            []string `config:"pin-paths" yaml:"pin-paths,omitempty"`
+	PrefetchPaths       []string `config:"prefetch-paths" yaml:"prefetch-paths,omitempty"`
+	PrefetchList        string   `config:"prefetch-list" yaml:"prefetch-list,omitempty"`
+	PrefetchParallelism uint32   `config:"prefetch-parallelism" yaml:"prefetch-parallelism,omitempty"`
+
+	Tiers            []TierOptions `config:"tiers" yaml:"tiers,omitempty"`
+	MemoryTierMB     uint32        `config:"memory-tier-mb" yaml:"memory-tier-mb,omitempty"`
+	MemoryTierFileKB uint32        `config:"memory-tier-file-kb" yaml:"memory-tier-file-kb,omitempty"`
+
+	SharedCache bool `config:"shared-cache" yaml:"shared-cache,omitempty"`
+
+	Encryption        bool   `config:"encryption" yaml:"encryption,omitempty"`
+	EncryptionKeyFile string `config:"encryption-key-file" yaml:"encryption-key-file,omitempty"`
+	EncryptionStaging string `config:"encryption-staging-path" yaml:"encryption-staging-path,omitempty"`
+
+	VerifyChecksum    bool   `config:"verify-checksum" yaml:"verify-checksum,omitempty"`
+	VerifyOnOpen      bool   `config:"verify-on-open" yaml:"verify-on-open,omitempty"`
+	VerifyIntervalSec uint32 `config:"verify-interval-sec" yaml:"verify-interval-sec,omitempty"`
+
+	Quotas             []QuotaOptions `config:"quotas" yaml:"quotas,omitempty"`
+	AdmissionMaxFileMB float64        `config:"admission-max-file-mb" yaml:"admission-max-file-mb,omitempty"`
+	AdmissionExclude   []string       `config:"admission-exclude" yaml:"admission-exclude,omitempty"`
+
 	// v1 support
 	V1Timeout     uint32 `config:"file-cache-timeout-in-seconds" yaml:"-"`
 	EmptyDirCheck bool   `config:"empty-dir-check" yaml:"-"`
@@ -139,7 +235,21 @@ func (c *FileCache) Priority() internal.ComponentPriority {
 func (c *FileCache) Start(ctx context.Context) error {
 	log.Trace("Starting component : %s", c.Name())
 
-	if c.cleanupOnStart {
+	// Files pending upload live only in the cache, so the cache is kept till they are uploaded
+	pending := make(map[string]bool)
+	if c.writeBack != nil {
+		for _, rec := range c.writeBack.journal() {
+			pending[rec.Name] = true
+		}
+	}
+
+	if c.cleanupOnStart && c.shared != nil {
+		log.Info("FileCache::Start : cache is shared with other mounts, reusing files in it instead of cleaning it up")
+	} else if c.cleanupOnStart && c.persistent() {
+		log.Info("FileCache::Start : persistent cache is enabled, reusing files in temp cache instead of cleaning it up")
+	} else if c.cleanupOnStart && len(pending) > 0 {
+		log.Warn("FileCache::Start : skipping cleanup of temp cache as files are pending upload")
+	} else if c.cleanupOnStart {
 		err := c.TempCacheCleanup()
 		if err != nil {
 			return fmt.Errorf("error in %s error [fail to cleanup temp cache]", c.Name())
@@ -158,6 +268,42 @@ func (c *FileCache) Start(ctx context.Context) error {
 	// create stats collector for file cache
 	fileCacheStatsCollector = stats_manager.NewStatsCollector(c.Name())
 
+	if c.persistent() {
+		c.index.start()
+		c.restoreCache(pending)
+	}
+	if c.shared != nil {
+		c.restoreShared()
+		c.shared.start(c.evictShared)
+	}
+
+	c.usage.start()
+	for _, t := range c.tiers {
+		t.load()
+	}
+	c.scanner.start(c.scanChecksums)
+	c.quotas.start(c.enforceQuotas)
+
+	if c.writeBack != nil {
+		c.replayWriteBack()
+		c.writeBack.start()
+	}
+
+	if c.conn != nil {
+		c.conn.start()
+	}
+
+	c.prefetch.start()
+	for _, rule := range c.prefetch.rules {
+		c.prefetch.add(rule)
+	}
+	if c.prefetchList != "" {
+		err = c.prefetch.addList(c.prefetchList)
+		if err != nil {
+			log.Err("FileCache::Start : Failed to read prefetch-list %s [%s]", c.prefetchList, err.Error())
+		}
+	}
+
 	return nil
 }
 
@@ -165,14 +311,53 @@ func (c *FileCache) Start(ctx context.Context) error {
 func (c *FileCache) Stop() error {
 	log.Trace("Stopping component : %s", c.Name())
 
+	c.prefetch.shutdown()
+	c.scanner.shutdown()
+	c.quotas.shutdown()
+	if c.conn != nil {
+		c.conn.shutdown()
+	}
+	if c.persistent() {
+		// Restore still going on registers files with the policy, which is shut down below
+		c.index.halt()
+	}
+
+	if c.writeBack != nil {
+		c.writeBack.stop()
+	}
+	c.stopAsyncDownloads()
+
 	_ = c.policy.ShutdownPolicy()
-	_ = c.TempCacheCleanup()
+	if c.shared != nil {
+		c.shared.shutdown()
+	}
+	c.usage.shutdown()
+	if c.persistent() {
+		c.index.shutdown()
+		log.Info("FileCache::Stop : keeping temp cache for next mount as persistent cache is enabled")
+	} else if c.shared != nil {
+		log.Info("FileCache::Stop : keeping temp cache as it is shared with other mounts")
+	} else if c.pendingWriteBack() {
+		log.Warn("FileCache::Stop : skipping cleanup of temp cache as files are pending upload, they will be uploaded on next mount")
+	} else {
+		_ = c.TempCacheCleanup()
+	}
 
 	fileCacheStatsCollector.Destroy()
 
 	return nil
 }
 
+// persistent : Whether the cache and its index are kept across remounts
+func (c *FileCache) persistent() bool {
+	return c.index != nil && c.index.dir != ""
+}
+
+// pendingWriteBack : Whether there are closed files not yet uploaded
+func (c *FileCache) pendingWriteBack() bool {
+	return c.writeBack != nil && c.writeBack.count() > 0
+}
+
 func (c *FileCache) TempCacheCleanup() error {
 	// TODO : Cleanup temp cache dir before exit
 	if !isLocalDirEmpty(c.tmpPath) {
@@ -188,6 +373,10 @@ func (c *FileCache) TempCacheCleanup() error {
 		}
 	}
 
+	for _, t := range c.tiers {
+		t.clear()
+	}
+
 	return nil
 }
 
@@ -221,18 +410,100 @@ func (c *FileCache) Configure(_ bool) error {
 	c.offloadIO = conf.OffloadIO
 	c.maxCacheSize = conf.MaxSizeMB
 
+	c.sparse = conf.SparseCache
+	c.sparseBlockSize = defaultSparseBlockSizeMB * MB
+	if conf.SparseBlockSizeMB > 0 {
+		c.sparseBlockSize = int64(conf.SparseBlockSizeMB) * MB
+	}
+	c.sparseReadAhead = defaultSparseReadAhead
+	if config.IsSet(compName + ".sparse-read-ahead") {
+		c.sparseReadAhead = int64(conf.SparseReadAhead)
+	}
+
+	c.asyncOpen = conf.AsyncOpen
+	c.asyncOpenParallelism = defaultAsyncOpenParallelism
+	if conf.AsyncOpenParallelism > 0 {
+		c.asyncOpenParallelism = int(conf.AsyncOpenParallelism)
+	}
+
 	c.tmpPath = common.ExpandPath(conf.TmpPath)
 	if c.tmpPath == "" {
 		log.Err("FileCache: config error [tmp-path not set]")
 		return fmt.Errorf("config error in %s error [tmp-path not set]", c.Name())
 	}
 
+	// path is the root of the shared cache then, and this mount caches under its account and container
+	if conf.SharedCache {
+		err = c.configureShared(conf)
+		if err != nil {
+			return err
+		}
+	}
+
 	err = config.UnmarshalKey("mount-path", &c.mountPath)
 	if err == nil && c.mountPath == c.tmpPath {
 		log.Err("FileCache: config error [tmp-path is same as mount path]")
 		return fmt.Errorf("config error in %s error [tmp-path is same as mount path]", c.Name())
 	}
 
+	// Offline mode queues writes for upload once storage is back, so it needs write-back
+	if (conf.WriteBack || conf.OfflineMode) && c.writeBack == nil {
+		journal := conf.WriteBackPath
+		if journal == "" {
+			journal = filepath.Clean(c.tmpPath) + "_writeback"
+		}
+		workers := defaultWriteBackWorkers
+		if conf.WriteBackWorkers > 0 {
+			workers = int(conf.WriteBackWorkers)
+		}
+
+		c.writeBack, err = newWriteBack(common.ExpandPath(journal), workers, c.writeBackUpload, c.writeBackRelease)
+		if err != nil {
+			log.Err("FileCache: config error [failed to create write-back journal %s [%s]]", journal, err.Error())
+			return fmt.Errorf("config error in %s [write-back-path %s: %s]", c.Name(), journal, err.Error())
+		}
+	}
+	c.writeBackOnSync = !config.IsSet(compName+".write-back-upload-on-fsync") || conf.WriteBackOnSync
+
+	// Index is kept in memory only when it is needed just for revalidation or conflict detection
+	c.revalidate = conf.Revalidate
+	if (conf.PersistentCache || c.revalidate || conf.OfflineMode) && c.index == nil {
+		dir := ""
+		if conf.PersistentCache {
+			dir = conf.PersistentCachePath
+			if dir == "" {
+				dir = filepath.Clean(c.tmpPath) + "_persist"
+			}
+			dir = common.ExpandPath(dir)
+		}
+
+		c.index, err = newCacheIndex(dir)
+		if err != nil {
+			log.Err("FileCache: config error [failed to create persistent cache directory %s [%s]]", dir, err.Error())
+			return fmt.Errorf("config error in %s [persistent-cache-path %s: %s]", c.Name(), dir, err.Error())
+		}
+	}
+
+	if conf.OfflineMode {
+		c.conflictPolicy = strings.ToLower(conf.ConflictPolicy)
+		switch c.conflictPolicy {
+		case "":
+			c.conflictPolicy = conflictKeepBoth
+		case conflictKeepBoth, conflictKeepLocal, conflictKeepRemote:
+		default:
+			log.Err("FileCache: config error [invalid conflict-policy %s]", conf.ConflictPolicy)
+			return fmt.Errorf("config error in %s [invalid conflict-policy %s]", c.Name(), conf.ConflictPolicy)
+		}
+
+		interval := defaultOfflineProbeInterval
+		if conf.OfflineProbeInterval > 0 {
+			interval = int(conf.OfflineProbeInterval)
+		}
+		if c.conn == nil {
+			c.conn = newConnectivity(time.Duration(interval)*time.Second, c.probeStorage, c.connectivityChanged)
+		}
+	}
+
 	// Extract values from 'conf' and store them as you wish here
 	_, err = os.Stat(c.tmpPath)
 	if os.IsNotExist(err) {
@@ -244,7 +515,9 @@ func (c *FileCache) Configure(_ bool) error {
 		}
 	}
 
-	if !isLocalDirEmpty(c.tmpPath) && !c.allowNonEmpty {
+	// Files left pending upload or cached by last mount are expected in the temp directory
+	pending := c.writeBack != nil && len(c.writeBack.journal()) > 0
+	if !isLocalDirEmpty(c.tmpPath) && !c.allowNonEmpty && !pending && !c.persistent() && c.shared == nil {
 		log.Err("FileCache: config error %s directory is not empty", c.tmpPath)
 		return fmt.Errorf("config error in %s [%s]", c.Name(), "temp directory not empty")
 	}
@@ -261,13 +534,73 @@ func (c *FileCache) Configure(_ bool) error {
 		c.defaultPermission = common.DefaultFilePermissionBits
 	}
 
+	if c.usage == nil && c.shared != nil {
+		// Eviction starts on the usage of all the mounts sharing the cache
+		c.usage = newUsageTracker(c.shared.root)
+		c.usage.interval = sharedUsageReconcileInterval
+	} else if c.usage == nil {
+		c.usage = newUsageTracker(c.tmpPath)
+	}
+	if c.pins == nil {
+		c.pins = newPinSet(conf.PinPaths)
+		pinFile := filepath.Clean(c.tmpPath) + pinFileSuffix
+		err = c.pins.load(pinFile)
+		if err != nil {
+			log.Warn("FileCache::Configure : failed to restore pins from %s [%s]", pinFile, err.Error())
+		}
+	}
+	if c.prefetch == nil {
+		workers := defaultPrefetchParallelism
+		if conf.PrefetchParallelism > 0 {
+			workers = int(conf.PrefetchParallelism)
+		}
+		c.prefetch = newPrefetcher(workers, c.walkStorage, c.statStorage, c.prefetchFile)
+	}
+	c.prefetch.rules = conf.PrefetchPaths
+	c.prefetchList = common.ExpandPath(conf.PrefetchList)
+
+	err = c.configureTiers(conf)
+	if err != nil {
+		return err
+	}
+
+	if conf.Encryption {
+		err = c.configureEncryption(conf)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.verify = conf.VerifyChecksum
+	c.verifyOnOpen = conf.VerifyChecksum && conf.VerifyOnOpen
+	if c.verify && conf.VerifyIntervalSec > 0 && c.scanner == nil {
+		c.scanner = &checksumScanner{interval: time.Duration(conf.VerifyIntervalSec) * time.Second}
+	}
+
+	if len(conf.Quotas) > 0 && c.quotas == nil {
+		c.quotas, err = newQuotaSet(conf.Quotas)
+		if err != nil {
+			log.Err("FileCache: config error [%s]", err.Error())
+			return fmt.Errorf("config error in %s [%s]", c.Name(), err.Error())
+		}
+	}
+	c.admitMaxSize = int64(conf.AdmissionMaxFileMB * MB)
+	c.admitExclude = conf.AdmissionExclude
+
 	cacheConfig := c.GetPolicyConfig(conf)
+	if c.quotas != nil {
+		c.quotas.policy = cacheConfig
+	}
 
 	switch strings.ToLower(conf.Policy) {
 	case "lru":
 		c.policy = NewLRUPolicy(cacheConfig)
 	case "lfu":
 		c.policy = NewLFUPolicy(cacheConfig)
+	case "arc":
+		c.policy = NewARCPolicy(cacheConfig)
+	case "gdsf":
+		c.policy = NewGDSFPolicy(cacheConfig)
 	default:
 		log.Info("FileCache::Configure : Using default eviction policy")
 		c.policy = NewLRUPolicy(cacheConfig)
@@ -289,7 +622,41 @@ func (c *FileCache) Configure(_ bool) error {
 	}
 
 	log.Info("FileCache::Configure : create-empty %t, cache-timeout %d, tmp-path %s, max-size-mb %d, high-mark %d, low-mark %d",
-		c.createEmptyFile, int(c.cacheTimeout), c.tmpPath, int(cacheConfig.maxSizeMB), int(cacheConfig.highThreshold), int(cacheConfig.lowThreshold))
+		c.createEmptyFile, int(c.cacheTimeout), c.tmpPath, int(c.maxCacheSize), int(cacheConfig.highThreshold), int(cacheConfig.lowThreshold))
+	log.Info("FileCache::Configure : sparse-cache %t, sparse-block-size %d, sparse-read-ahead %d",
+		c.sparse, c.sparseBlockSize, c.sparseReadAhead)
+	log.Info("FileCache::Configure : async-open %t, async-open-parallelism %d", c.asyncOpen, c.asyncOpenParallelism)
+	if c.persistent() {
+		log.Info("FileCache::Configure : persistent-cache-path %s", c.index.dir)
+	}
+	log.Info("FileCache::Configure : revalidate %t", c.revalidate)
+	log.Info("FileCache::Configure : pin-paths %v, prefetch-paths %v, prefetch-list %s, prefetch-parallelism %d",
+		conf.PinPaths, conf.PrefetchPaths, c.prefetchList, c.prefetch.workers)
+	if len(c.tiers) > 0 {
+		log.Info("FileCache::Configure : tiers %v, memory-tier-mb %d, memory-tier-file-kb %d",
+			conf.Tiers, conf.MemoryTierMB, conf.MemoryTierFileKB)
+	}
+	if c.shared != nil {
+		log.Info("FileCache::Configure : shared-cache %s", c.shared.root)
+	}
+	if c.cipher != nil {
+		log.Info("FileCache::Configure : encryption, encryption-key-file %s, encryption-staging-path %s",
+			conf.EncryptionKeyFile, c.cipher.staging)
+	}
+	if c.verify {
+		log.Info("FileCache::Configure : verify-checksum, verify-on-open %t, verify-interval-sec %d", c.verifyOnOpen, conf.VerifyIntervalSec)
+	}
+	if c.quotas != nil || c.admitMaxSize > 0 || len(c.admitExclude) > 0 {
+		log.Info("FileCache::Configure : quotas %v, admission-max-file-mb %v, admission-exclude %v",
+			conf.Quotas, conf.AdmissionMaxFileMB, c.admitExclude)
+	}
+	if c.conn != nil {
+		log.Info("FileCache::Configure : offline-mode, offline-probe-interval %s, conflict-policy %s", c.conn.interval, c.conflictPolicy)
+	}
+	if c.writeBack != nil {
+		log.Info("FileCache::Configure : write-back journal %s, write-back-workers %d, write-back-upload-on-fsync %t",
+			c.writeBack.dir, c.writeBack.workers, c.writeBackOnSync)
+	}
 
 	return nil
 }
@@ -307,6 +674,7 @@ func (c *FileCache) OnConfigChange() {
 	c.policyTrace = conf.EnablePolicyTrace
 	c.offloadIO = conf.OffloadIO
 	c.maxCacheSize = conf.MaxSizeMB
+	c.pins.setRules(conf.PinPaths)
 	_ = c.policy.UpdateConfig(c.GetPolicyConfig(conf))
 }
 
@@ -319,7 +687,7 @@ func (c *FileCache) StatFs() (*syscall.Statfs_t, bool, error) {
 	if maxCacheSize == 0 {
 		return nil, false, nil
 	}
-	usage := getUsage(c.tmpPath) * MB
+	usage := getUsage(c.usage) * MB
 	available := maxCacheSize - usage
 	statfs := &syscall.Statfs_t{}
 	err := syscall.Statfs("/", statfs)
@@ -355,7 +723,18 @@ func (c *FileCache) GetPolicyConfig(conf FileCacheOptions) cachePolicyConfig {
 		maxSizeMB:     conf.MaxSizeMB,
 		fileLocks:     c.fileLocks,
 		policyTrace:   conf.EnablePolicyTrace,
+		pins:          c.pins,
+		usage:         c.usage,
 	}
+	if len(c.tiers) > 0 {
+		cacheConfig.demote = c.demoteFile
+	}
+	if c.shared != nil {
+		// Usage is that of all the mounts sharing the cache, so the shared index evicts to the thresholds, not the policy
+		c.shared.setThresholds(cacheConfig.maxSizeMB, cacheConfig.highThreshold, cacheConfig.lowThreshold)
+		cacheConfig.maxSizeMB = 0
+	}
+	cacheConfig.shared = c.shared
 
 	return cacheConfig
 }
@@ -454,9 +833,18 @@ func (fc *FileCache) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 	// 3. Path in storage and in local cache (this could result in dirty properties on the service if we recently wrote to the file)
 
 	// To cover case 1, grab all entries from storage
-	attrs, err := fc.NextComponent().ReadDir(options)
+	var attrs []*internal.ObjAttr
+	var err error
+	if fc.offline() {
+		err = errStorageOffline
+	} else {
+		attrs, err = fc.NextComponent().ReadDir(options)
+	}
+	// Only what is in the local cache can be listed while storage is offline
+	offline := false
 	if err != nil {
 		log.Err("FileCache::ReadDir : error fetching storage attributes [%s]", err.Error())
+		offline = fc.checkOffline(err)
 		// TODO : Should we return here if the directory failed to be read from storage?
 	}
 
@@ -480,6 +868,9 @@ func (fc *FileCache) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 			entryCachePath := filepath.Join(fc.tmpPath, entryPath)
 
 			info, err := os.Stat(entryCachePath) // Grab local cache attributes
+			if err == nil {
+				info = fc.plainInfo(info)
+			}
 			// All directory operations are guaranteed to be synced with storage so they cannot be in a case 2 or 3 state.
 			if err == nil && !info.IsDir() {
 				idx, ok := pathToIndex[filepath.Join(options.Name, entry.Name())] // Grab the index of the corresponding storage attributes
@@ -498,6 +889,8 @@ func (fc *FileCache) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 					attrs = append(attrs, attr)
 					pathToIndex[attr.Path] = len(attrs) - 1 // append adds to the end of an array
 				}
+			} else if err == nil && offline {
+				attrs = append(attrs, newObjAttr(entryPath, info))
 			}
 		}
 	} else {
@@ -509,7 +902,25 @@ func (fc *FileCache) ReadDir(options internal.ReadDirOptions) ([]*internal.ObjAt
 
 // StreamDir : Add local files to the list retrieved from storage container
 func (fc *FileCache) StreamDir(options internal.StreamDirOptions) ([]*internal.ObjAttr, string, error) {
-	attrs, token, err := fc.NextComponent().StreamDir(options)
+	var attrs []*internal.ObjAttr
+	var token string
+	var err error
+	if fc.offline() {
+		err = errStorageOffline
+	} else {
+		attrs, token, err = fc.NextComponent().StreamDir(options)
+	}
+
+	// Only what is in the local cache can be listed while storage is offline
+	offline := fc.checkOffline(err)
+	if offline {
+		log.Debug("FileCache::StreamDir : storage is offline, listing %s from local cache", options.Name)
+		if options.Token != "" {
+			// Local entries were given with the first page already
+			return nil, "", nil
+		}
+		attrs, token, err = nil, "", nil
+	}
 
 	if token == "" {
 		// This is the last set of objects retrieved from container so we need to add local files here
@@ -523,6 +934,14 @@ func (fc *FileCache) StreamDir(options internal.StreamDirOptions) ([]*internal.O
 				entryCachePath := filepath.Join(fc.tmpPath, entryPath)
 
 				info, err := os.Stat(entryCachePath) // Grab local cache attributes
+				if err == nil {
+					info = fc.plainInfo(info)
+				}
+				if err == nil && offline {
+					attrs = append(attrs, newObjAttr(entryPath, info))
+					continue
+				}
+
 				// If local file is not locked then only use its attributes otherwise rely on container attributes
 				if err == nil && !info.IsDir() &&
 					!fc.fileLocks.Locked(entryPath) {
@@ -586,12 +1005,24 @@ func (fc *FileCache) IsDirEmpty(options internal.IsDirEmptyOptions) bool {
 func (fc *FileCache) RenameDir(options internal.RenameDirOptions) error {
 	log.Trace("FileCache::RenameDir : src=%s, dst=%s", options.Src, options.Dst)
 
+	// Files pending upload are not in storage yet, so they would be left out of the rename
+	if fc.writeBack != nil {
+		for _, name := range fc.writeBack.under(options.Src) {
+			err := fc.writeBack.flush(name)
+			if err != nil {
+				log.Err("FileCache::RenameDir : failed to upload pending file %s [%s]", name, err.Error())
+				return err
+			}
+		}
+	}
+
 	err := fc.NextComponent().RenameDir(options)
 	if err != nil {
 		log.Err("FileCache::RenameDir : error %s [%s]", options.Src, err.Error())
 		return err
 	}
 
+	fc.pins.rename(options.Src, options.Dst)
 	go fc.invalidateDirectory(options.Src)
 	// TLDR: Dst is guaranteed to be non-existent or empty.
 	// Note: We do not need to invalidate Dst due to the logic in our FUSE connector, see comments there.
@@ -607,21 +1038,44 @@ func (fc *FileCache) CreateFile(options internal.CreateFileOptions) (*handlemap.
 	flock.Lock()
 	defer flock.Unlock()
 
+	localPath := filepath.Join(fc.tmpPath, options.Name)
+	if _, err := os.Stat(localPath); err != nil && fc.excluded(options.Name) {
+		handle, err := fc.NextComponent().CreateFile(options)
+		if err != nil {
+			log.Err("FileCache::CreateFile : Failed to create file %s [%s]", options.Name, err.Error())
+			return nil, err
+		}
+		return bypass(handle, true), nil
+	}
+
 	// createEmptyFile was added to optionally support immutable containers. If customers do not care about immutability they can set this to true.
-	if fc.createEmptyFile {
+	uploadRequired := !fc.createEmptyFile
+	if fc.createEmptyFile && fc.offline() {
+		uploadRequired = true
+	} else if fc.createEmptyFile {
 		// We tried moving CreateFile to a separate thread for better perf.
 		// However, before it is created in storage, if GetAttr is called, the call will fail since the file
 		// does not exist in storage yet, failing the whole CreateFile sequence in FUSE.
 		_, err := fc.NextComponent().CreateFile(options)
-		if err != nil {
+		if err != nil && fc.checkOffline(err) {
+			log.Warn("FileCache::CreateFile : Storage is offline, %s is created locally only", options.Name)
+			uploadRequired = true
+		} else if err != nil {
 			log.Err("FileCache::CreateFile : Failed to create file %s", options.Name)
 			return nil, err
+		} else if fc.conn != nil {
+			// Empty blob is the version local changes are checked against on upload
+			attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: options.Name})
+			if err == nil {
+				fc.index.set(options.Name, attr)
+			}
 		}
 	}
 
 	// Create the file in local cache
-	localPath := filepath.Join(fc.tmpPath, options.Name)
 	fc.policy.CacheValid(localPath)
+	fc.quotas.used(options.Name, localPath)
+	fc.cachedETags.Delete(options.Name)
 
 	err := os.MkdirAll(filepath.Dir(localPath), fc.defaultPermission)
 	if err != nil {
@@ -629,12 +1083,27 @@ func (fc *FileCache) CreateFile(options internal.CreateFileOptions) (*handlemap.
 		return nil, err
 	}
 
+	unlock, err := fc.shared.lock(localPath)
+	if err != nil {
+		log.Err("FileCache::CreateFile : unable to lock %s in shared cache [%s]", options.Name, err.Error())
+		return nil, err
+	}
+	defer unlock()
+
 	// Open the file and grab a shared lock to prevent deletion by the cache policy.
 	f, err := os.OpenFile(localPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, options.Mode)
 	if err != nil {
 		log.Err("FileCache::CreateFile : error opening local file %s [%s]", options.Name, err.Error())
 		return nil, err
 	}
+	err = fc.shared.hold(f)
+	if err != nil {
+		log.Err("FileCache::CreateFile : unable to lock %s in shared cache [%s]", options.Name, err.Error())
+		f.Close()
+		return nil, err
+	}
+	fc.usage.changed(localPath)
+	dropChecksum(localPath)
 	// The user might change permissions WHILE creating the file therefore we need to account for that
 	if options.Mode != common.DefaultFilePermissionBits {
 		fc.missedChmodList.LoadOrStore(options.Name, true)
@@ -646,15 +1115,17 @@ func (fc *FileCache) CreateFile(options internal.CreateFileOptions) (*handlemap.
 	handle := handlemap.NewHandle(options.Name)
 	handle.UnixFD = uint64(f.Fd())
 
-	if !fc.offloadIO {
+	if !fc.offloadIO && fc.cipher == nil {
 		handle.Flags.Set(handlemap.HandleFlagCached)
 	}
 	log.Info("FileCache::CreateFile : file=%s, fd=%d", options.Name, f.Fd())
 
 	handle.SetFileObject(f)
+	newDirtyRanges(handle).setFull()
+	fc.indexDirty(options.Name)
 
 	// If an empty file is created in storage then there is no need to upload if FlushFile is called immediately after CreateFile.
-	if !fc.createEmptyFile {
+	if uploadRequired {
 		handle.Flags.Set(handlemap.HandleFlagDirty)
 	}
 
@@ -701,17 +1172,42 @@ func (fc *FileCache) validateStorageError(path string, err error, method string,
 func (fc *FileCache) DeleteFile(options internal.DeleteFileOptions) error {
 	log.Trace("FileCache::DeleteFile : name=%s", options.Name)
 
+	// Delete can not reach storage, and dropping the pending upload would lose the file
+	if fc.offline() {
+		log.Err("FileCache::DeleteFile : storage is offline, can not delete %s", options.Name)
+		return errStorageOffline
+	}
+
+	// Pending upload would bring the file back in storage
+	cancelled := fc.writeBack != nil && fc.writeBack.cancel(options.Name)
+
 	flock := fc.fileLocks.Get(options.Name)
 	flock.Lock()
 	defer flock.Unlock()
 
+	if cancelled {
+		flock.Dec()
+		fc.writeBackDirty.Delete(options.Name)
+	}
+
 	err := fc.NextComponent().DeleteFile(options)
+	if cancelled && (err == syscall.ENOENT || os.IsNotExist(err)) {
+		// File was never uploaded
+		err = nil
+	}
 	err = fc.validateStorageError(options.Name, err, "DeleteFile", false)
 	if err != nil {
 		log.Err("FileCache::DeleteFile : error  %s [%s]", options.Name, err.Error())
 		return err
 	}
 
+	fc.releaseSparseFile(options.Name)
+	if fc.index != nil {
+		fc.index.remove(options.Name)
+	}
+	fc.dropFromTiers(options.Name)
+	fc.cachedETags.Delete(options.Name)
+
 	localPath := filepath.Join(fc.tmpPath, options.Name)
 	err = deleteFile(localPath)
 	if err != nil && !os.IsNotExist(err) {
@@ -778,7 +1274,24 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 	flock.Lock()
 	defer flock.Unlock()
 
+	// File left by an earlier mount is checked before use if the restore has not come to it yet
+	fc.checkRestored(options.Name, localPath)
+
+	// Files kept out of the cache are read, or written afresh, in storage directly
+	if flock.Count() == 0 && streamable(options.Flags) && !fc.admitted(options.Name, localPath) {
+		return fc.openBypass(options)
+	}
+
+	// Other mounts sharing the cache do not replace or evict the file while it is checked and downloaded
+	unlock, err := fc.shared.lock(localPath)
+	if err != nil {
+		log.Err("FileCache::OpenFile : unable to lock %s in shared cache [%s]", options.Name, err.Error())
+		return nil, err
+	}
+	defer unlock()
+
 	fc.policy.CacheValid(localPath)
+	fc.quotas.used(options.Name, localPath)
 
 	downloadRequired, fileExists := fc.isDownloadRequired(localPath)
 
@@ -789,6 +1302,69 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 		downloadRequired = false
 	}
 
+	// Cached copy is all there is while storage is offline, whatever its age
+	if fc.offline() {
+		if !fileExists {
+			log.Err("FileCache::OpenFile : storage is offline and %s is not cached", options.Name)
+			return nil, errStorageOffline
+		}
+		if downloadRequired {
+			log.Info("FileCache::OpenFile : storage is offline, serving %s from cache", options.Name)
+			downloadRequired = false
+		}
+	}
+
+	// File cached by an earlier mount is checked against storage before its first use, whatever its age.
+	// Otherwise an expired file is downloaded again only if the blob changed, when revalidation is on.
+	revalidated := false
+	if fileExists && flock.Count() == 0 && fc.index != nil && !fc.offline() &&
+		(fc.index.restored(options.Name) || (downloadRequired && fc.revalidate)) {
+		revalidated = fc.revalidateCached(options.Name, localPath)
+		downloadRequired = !revalidated
+	}
+
+	// Copy which fails its checksum is a cache miss
+	if fc.verifyOnOpen && fileExists && !downloadRequired && flock.Count() == 0 && !fc.checksumValid(options.Name, localPath) {
+		downloadRequired = true
+	}
+
+	// Attributes are fetched before the cached copy is dropped, so the copy can still be served if storage is offline
+	var attr *internal.ObjAttr
+	attrReceived := false
+	if downloadRequired {
+		attr, err = fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: options.Name})
+		if err != nil {
+			log.Err("FileCache::OpenFile : Failed to get attr of %s [%s]", options.Name, err.Error())
+			if fc.checkOffline(err) {
+				if !fileExists {
+					return nil, err
+				}
+				log.Info("FileCache::OpenFile : storage is offline, serving %s from cache", options.Name)
+				downloadRequired = false
+			}
+		} else {
+			attrReceived = true
+		}
+	}
+
+	// Slower tier holding the version in storage is cheaper to move up than downloading it
+	if downloadRequired && attrReceived && !fileExists && fc.promoteFile(options.Name, localPath, attr) {
+		downloadRequired = false
+	}
+
+	// Copy downloaded by another mount is reused if it is the version in storage, and kept if another mount has it open
+	if fc.shared != nil && downloadRequired && attrReceived && fileExists {
+		if fc.shared.current(localPath, attr) {
+			log.Debug("FileCache::OpenFile : %s reused from shared cache", options.Name)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, sharedReuses, (int64)(1))
+			fc.recordETag(options.Name, attr)
+			downloadRequired = false
+		} else if fc.shared.inUse(localPath) {
+			log.Warn("FileCache::OpenFile : %s is open in another mount, serving it from shared cache as is", options.Name)
+			downloadRequired = false
+		}
+	}
+
 	if downloadRequired {
 		log.Debug("FileCache::OpenFile : Need to re-download %s", options.Name)
 
@@ -815,18 +1391,37 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 			return nil, err
 		}
 
-		attrReceived := false
 		fileSize := int64(0)
-
-		attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: options.Name})
-		if err != nil {
-			log.Err("FileCache::OpenFile : Failed to get attr of %s [%s]", options.Name, err.Error())
-		} else {
-			attrReceived = true
+		if attrReceived {
 			fileSize = int64(attr.Size)
 		}
 
-		if !attrReceived || fileSize > 0 {
+		sparseCreated := false
+		if (fc.sparse || fc.asyncOpen) && attrReceived && fileSize > 0 {
+			// Only size the file here, ranges are downloaded as they are read or in background
+			err = fc.createSparseFile(localPath, f, fileSize, attr.ETag)
+			if err != nil {
+				log.Warn("FileCache::OpenFile : Failed to create sparse file %s, downloading it whole [%s]", options.Name, err.Error())
+			} else {
+				sparseCreated = true
+			}
+		}
+
+		if fc.cipher != nil && attrReceived {
+			err = fc.downloadEncrypted(options.Name, f, fileSize)
+			if err != nil {
+				log.Err("FileCache::OpenFile : error downloading file from storage %s [%s]", options.Name, err.Error())
+				_ = f.Close()
+				_ = os.Remove(localPath)
+				return nil, err
+			}
+		} else if fc.cipher != nil {
+			// Size of the blob is needed to encrypt it as it is downloaded
+			log.Err("FileCache::OpenFile : unable to download %s without its attributes", options.Name)
+			_ = f.Close()
+			_ = os.Remove(localPath)
+			return nil, syscall.EIO
+		} else if (!attrReceived || fileSize > 0) && !sparseCreated {
 			// Download/Copy the file from storage to the local file.
 			err = fc.NextComponent().CopyToFile(
 				internal.CopyToFileOptions{
@@ -847,6 +1442,15 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 		log.Debug("FileCache::OpenFile : Download of %s is complete", options.Name)
 		f.Close()
 
+		if fc.verify && attrReceived && !sparseCreated {
+			err = fc.checkDownload(options.Name, localPath, attr)
+			if err != nil {
+				log.Err("FileCache::OpenFile : error verifying download of %s [%s]", options.Name, err.Error())
+				_ = os.Remove(localPath)
+				return nil, syscall.EIO
+			}
+		}
+
 		// After downloading the file, update the modified times and mode of the file.
 		fileMode := fc.defaultPermission
 		if attrReceived && !attr.IsModeDefault() {
@@ -867,10 +1471,21 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 		}
 
 		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, dlFiles, (int64)(1))
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, cacheMisses, (int64)(1))
+		if fc.index != nil && attrReceived {
+			fc.index.set(options.Name, attr)
+		}
+		fc.recordETag(options.Name, attr)
 
 	} else {
 		log.Debug("FileCache::OpenFile : %s will be served from cache", options.Name)
 		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, cacheServed, (int64)(1))
+		if !revalidated {
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, cacheHits, (int64)(1))
+		}
+		if fc.index != nil {
+			fc.index.touch(options.Name)
+		}
 	}
 
 	// Open the file and grab a shared lock to prevent deletion by the cache policy.
@@ -879,6 +1494,13 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 		log.Err("FileCache::OpenFile : error opening cached file %s [%s]", options.Name, err.Error())
 		return nil, err
 	}
+	err = fc.shared.hold(f)
+	if err != nil {
+		log.Err("FileCache::OpenFile : unable to lock %s in shared cache [%s]", options.Name, err.Error())
+		f.Close()
+		return nil, err
+	}
+	fc.usage.opened(localPath)
 
 	// Increment the handle count in this lock item as there is one handle open for this now
 	flock.Inc()
@@ -886,17 +1508,42 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 	handle := handlemap.NewHandle(options.Name)
 	inf, err := f.Stat()
 	if err == nil {
-		handle.Size = inf.Size()
+		handle.Size = fc.plainInfo(inf).Size()
 	}
 
 	handle.UnixFD = uint64(f.Fd())
-	if !fc.offloadIO {
+
+	// Reads of a partially downloaded file have to come here to fetch missing ranges, so libfuse can not serve them
+	if options.Flags&os.O_TRUNC != 0 {
+		fc.truncateSparseFile(options.Name, localPath, 0)
+	}
+	s := fc.openSparseFile(options.Name, localPath)
+	if !fc.offloadIO && s == nil && fc.cipher == nil {
 		handle.Flags.Set(handlemap.HandleFlagCached)
 	}
+	// Writes on a cached handle do not come here, so the file is taken as modified already
+	if handle.Cached() && options.Flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		fc.indexDirty(options.Name)
+	}
+	if options.Flags&(os.O_WRONLY|os.O_RDWR|os.O_TRUNC|os.O_APPEND) != 0 {
+		dropChecksum(localPath)
+	}
+	if fc.asyncOpen && s != nil {
+		fc.startAsyncDownload(options.Name, localPath, s)
+	}
 
 	log.Info("FileCache::OpenFile : file=%s, fd=%d", options.Name, f.Fd())
 	handle.SetFileObject(f)
 
+	// Writes on a cached handle go to the local file directly from libfuse and can not be tracked, such handles and
+	// truncating opens which leave the blob as is always upload the whole file
+	if !handle.Cached() {
+		dirty := newDirtyRanges(handle)
+		if options.Flags&os.O_TRUNC != 0 {
+			dirty.setFull()
+		}
+	}
+
 	return handle, nil
 }
 
@@ -904,6 +1551,14 @@ func (fc *FileCache) OpenFile(options internal.OpenFileOptions) (*handlemap.Hand
 func (fc *FileCache) CloseFile(options internal.CloseFileOptions) error {
 	log.Trace("FileCache::CloseFile : name=%s, handle=%d", options.Handle.Path, options.Handle.ID)
 
+	if bypassed(options.Handle) {
+		err := fc.flushBypass(options.Handle)
+		if err != nil {
+			return err
+		}
+		return fc.NextComponent().CloseFile(options)
+	}
+
 	localPath := filepath.Join(fc.tmpPath, options.Handle.Path)
 
 	if options.Handle.Dirty() {
@@ -932,9 +1587,14 @@ func (fc *FileCache) CloseFile(options internal.CloseFileOptions) error {
 		return err
 	}
 	flock.Dec()
+	fc.usage.closed(localPath)
+	if flock.Count() == 0 {
+		// Bitmap stays persisted with the file, it is only held in memory while the file is open
+		fc.releaseSparseFile(options.Handle.Path)
+	}
 
-	// If it is an fsync op then purge the file
-	if options.Handle.Fsynced() {
+	// If it is an fsync op then purge the file, unless the local copy is still to be uploaded
+	if options.Handle.Fsynced() && !(fc.writeBack != nil && fc.writeBack.has(options.Handle.Path)) {
 		log.Trace("FileCache::CloseFile : fsync/sync op, purging %s", options.Handle.Path)
 		localPath := filepath.Join(fc.tmpPath, options.Handle.Path)
 
@@ -948,11 +1608,19 @@ func (fc *FileCache) CloseFile(options internal.CloseFileOptions) error {
 	}
 
 	fc.policy.CacheInvalidate(localPath) // Invalidate the file from the local cache.
+	fc.quotas.nudge()
 	return nil
 }
 
 // ReadFile: Read the local file
 func (fc *FileCache) ReadFile(options internal.ReadFileOptions) ([]byte, error) {
+	if bypassed(options.Handle) {
+		if err := fc.flushBypass(options.Handle); err != nil {
+			return nil, err
+		}
+		return fc.NextComponent().ReadFile(options)
+	}
+
 	// The file should already be in the cache since CreateFile/OpenFile was called before and a shared lock was acquired.
 	localPath := filepath.Join(fc.tmpPath, options.Handle.Path)
 	fc.policy.CacheValid(localPath)
@@ -969,8 +1637,20 @@ func (fc *FileCache) ReadFile(options internal.ReadFileOptions) ([]byte, error)
 		log.Err("FileCache::ReadFile : error stat %s [%s] ", options.Handle.Path, err.Error())
 		return nil, err
 	}
+	info = fc.plainInfo(info)
+	err = fc.fillRange(options.Handle.Path, localPath, 0, info.Size(), false)
+	if err != nil {
+		log.Err("FileCache::ReadFile : error downloading %s [%s]", options.Handle.Path, err.Error())
+		return nil, err
+	}
+
 	data := make([]byte, info.Size())
-	bytesRead, err := f.Read(data)
+	var bytesRead int
+	if fc.cipher != nil {
+		bytesRead, err = fc.cipher.readAt(f, data, 0)
+	} else {
+		bytesRead, err = f.Read(data)
+	}
 
 	if int64(bytesRead) != info.Size() {
 		log.Err("FileCache::ReadFile : error [couldn't read entire file] %s", options.Handle.Path)
@@ -983,6 +1663,13 @@ func (fc *FileCache) ReadFile(options internal.ReadFileOptions) ([]byte, error)
 // ReadInBuffer: Read the local file into a buffer
 func (fc *FileCache) ReadInBuffer(options internal.ReadInBufferOptions) (int, error) {
 	//defer exectime.StatTimeCurrentBlock("FileCache::ReadInBuffer")()
+	if bypassed(options.Handle) {
+		if err := fc.flushBypass(options.Handle); err != nil {
+			return 0, err
+		}
+		return fc.NextComponent().ReadInBuffer(options)
+	}
+
 	// The file should already be in the cache since CreateFile/OpenFile was called before and a shared lock was acquired.
 	f := options.Handle.GetFileObject()
 	if f == nil {
@@ -998,6 +1685,19 @@ func (fc *FileCache) ReadInBuffer(options internal.ReadInBufferOptions) (int, er
 		fc.policy.CacheValid(localPath)
 	}
 
+	if fc.getSparseFile(options.Handle.Path) != nil {
+		err := fc.fillRange(options.Handle.Path, filepath.Join(fc.tmpPath, options.Handle.Path),
+			options.Offset, int64(len(options.Data)), true)
+		if err != nil {
+			log.Err("FileCache::ReadInBuffer : error downloading %s [%s]", options.Handle.Path, err.Error())
+			return 0, err
+		}
+	}
+
+	if fc.cipher != nil {
+		return fc.cipher.readAt(f, options.Data, options.Offset)
+	}
+
 	// Removing f.ReadAt as it involves lot of house keeping and then calls syscall.Pread
 	// Instead we will call syscall directly for better perf
 	return syscall.Pread(options.Handle.FD(), options.Data, options.Offset)
@@ -1006,6 +1706,10 @@ func (fc *FileCache) ReadInBuffer(options internal.ReadInBufferOptions) (int, er
 // WriteFile: Write to the local file
 func (fc *FileCache) WriteFile(options internal.WriteFileOptions) (int, error) {
 	//defer exectime.StatTimeCurrentBlock("FileCache::WriteFile")()
+	if bypassed(options.Handle) {
+		return fc.writeBypass(options)
+	}
+
 	// The file should already be in the cache since CreateFile/OpenFile was called before and a shared lock was acquired.
 	f := options.Handle.GetFileObject()
 	if f == nil {
@@ -1021,14 +1725,36 @@ func (fc *FileCache) WriteFile(options internal.WriteFileOptions) (int, error) {
 		fc.policy.CacheValid(localPath)
 	}
 
-	// Removing f.WriteAt as it involves lot of house keeping and then calls syscall.Pwrite
-	// Instead we will call syscall directly for better perf
-	bytesWritten, err := syscall.Pwrite(options.Handle.FD(), options.Data, options.Offset)
+	// Rest of the chunks being written to have to be in the cache, else downloading them later would overwrite this
+	if fc.getSparseFile(options.Handle.Path) != nil {
+		err := fc.fillRange(options.Handle.Path, filepath.Join(fc.tmpPath, options.Handle.Path),
+			options.Offset, int64(len(options.Data)), false)
+		if err != nil {
+			log.Err("FileCache::WriteFile : error downloading %s [%s]", options.Handle.Path, err.Error())
+			return 0, err
+		}
+	}
+
+	// Marked before the write so the file is never modified while the index takes it as a copy of the blob
+	fc.indexDirty(options.Handle.Path)
+
+	var bytesWritten int
+	var err error
+	if fc.cipher != nil {
+		bytesWritten, err = fc.cipher.writeAt(f, options.Data, options.Offset)
+	} else {
+		// Removing f.WriteAt as it involves lot of house keeping and then calls syscall.Pwrite
+		// Instead we will call syscall directly for better perf
+		bytesWritten, err = syscall.Pwrite(options.Handle.FD(), options.Data, options.Offset)
+	}
 
 	if err == nil {
 		// Mark the handle dirty so the file is written back to storage on FlushFile.
 		options.Handle.Flags.Set(handlemap.HandleFlagDirty)
-
+		fc.usage.changed(filepath.Join(fc.tmpPath, options.Handle.Path))
+		if dirty := getDirtyRanges(options.Handle); dirty != nil {
+			dirty.add(options.Offset, options.Offset+int64(bytesWritten))
+		}
 	} else {
 		log.Err("FileCache::WriteFile : failed to write %s [%s]", options.Handle.Path, err.Error())
 	}
@@ -1037,6 +1763,23 @@ func (fc *FileCache) WriteFile(options internal.WriteFileOptions) (int, error) {
 }
 
 func (fc *FileCache) SyncFile(options internal.SyncFileOptions) error {
+	// With write-back fsync is the point where the user wants data in storage
+	if fc.writeBack != nil && fc.writeBackOnSync {
+		err := fc.FlushFile(internal.FlushFileOptions{Handle: options.Handle})
+		if err == nil {
+			err = fc.writeBack.flush(options.Handle.Path)
+		}
+		// Data is durable in the cache and queued, it goes to storage once it is reachable
+		if err != nil && fc.checkOffline(err) {
+			log.Warn("FileCache::SyncFile : storage is offline, %s will be uploaded once it is back", options.Handle.Path)
+			err = nil
+		}
+		if err != nil {
+			log.Err("FileCache::SyncFile : %s upload failed [%s]", options.Handle.Path, err.Error())
+			return err
+		}
+	}
+
 	err := fc.NextComponent().SyncFile(options)
 	if err != nil {
 		log.Err("FileCache::SyncFile : %s failed", options.Handle.Path)
@@ -1068,6 +1811,11 @@ func (fc *FileCache) FlushFile(options internal.FlushFileOptions) error {
 	//defer exectime.StatTimeCurrentBlock("FileCache::FlushFile")()
 	log.Trace("FileCache::FlushFile : handle=%d, path=%s", options.Handle.ID, options.Handle.Path)
 
+	// File which is not cached only has the block being filled to upload
+	if bypassed(options.Handle) {
+		return fc.flushBypass(options.Handle)
+	}
+
 	// The file should already be in the cache since CreateFile/OpenFile was called before and a shared lock was acquired.
 	localPath := filepath.Join(fc.tmpPath, options.Handle.Path)
 	fc.policy.CacheValid(localPath)
@@ -1095,53 +1843,128 @@ func (fc *FileCache) FlushFile(options internal.FlushFileOptions) error {
 			return syscall.EIO
 		}
 
+		// Close returns once data is on local disk, the upload happens in background
+		if fc.writeBack != nil {
+			err = fc.writeBackQueue(options.Handle.Path, f, getDirtyRanges(options.Handle))
+			if err != nil {
+				log.Err("FileCache::FlushFile : %s failed to queue upload [%s]", options.Handle.Path, err.Error())
+				return syscall.EIO
+			}
+
+			options.Handle.Flags.Clear(handlemap.HandleFlagDirty)
+			return nil
+		}
+
 		// Write to storage
-		// Create a new handle for the SDK to use to upload (read local file)
-		// The local handle can still be used for read and write.
-		uploadHandle, err := os.Open(localPath)
+		err = fc.uploadCached(options.Handle.Path, getDirtyRanges(options.Handle))
 		if err != nil {
-			log.Err("FileCache::FlushFile : error [unable to open upload handle] %s [%s]", options.Handle.Path, err.Error())
-			return nil
+			log.Err("FileCache::FlushFile : %s upload failed [%s]", options.Handle.Path, err.Error())
+			return err
+		}
+
+		options.Handle.Flags.Clear(handlemap.HandleFlagDirty)
+	}
+
+	return nil
+}
+
+// uploadCached : Upload the cached file to storage, only the blocks covering the dirty ranges if the blob layout
+// allows it, else the whole file. Ranges are put back if the upload fails, nil ranges means the whole file.
+func (fc *FileCache) uploadCached(name string, dirty *dirtyRanges) error {
+	localPath := filepath.Join(fc.tmpPath, name)
+
+	// Create a new handle for the SDK to use to upload (read local file)
+	// The local handle can still be used for read and write.
+	uploadHandle, err := os.Open(localPath)
+	if err == nil && fc.cipher != nil {
+		// Storage gets the content, decrypted into a copy which is gone once uploaded
+		plain, err := fc.cipher.plainCopy(uploadHandle)
+		uploadHandle.Close()
+		if err != nil {
+			log.Err("FileCache::uploadCached : error [unable to decrypt] %s [%s]", name, err.Error())
+			return syscall.EIO
 		}
+		uploadHandle = plain
+	}
+	if err != nil {
+		log.Err("FileCache::uploadCached : error [unable to open upload handle] %s [%s]", name, err.Error())
+		return err
+	}
+	defer uploadHandle.Close()
 
+	// Upload only the blocks which were written to if the blob layout allows it, else the whole file
+	uploaded := false
+	ranges, full := []byteRange{}, true
+	if dirty != nil {
+		ranges, full = dirty.take()
+	}
+	if !full {
+		uploaded, err = fc.uploadDirtyBlocks(name, uploadHandle, ranges)
+	}
+	if !uploaded {
+		err = fc.fillFile(name, localPath)
+	}
+	if !uploaded && err == nil {
+		// ETag of the new blob is not known, so the next flush uploads the whole file as well
+		fc.cachedETags.Delete(name)
 		err = fc.NextComponent().CopyFromFile(
 			internal.CopyFromFileOptions{
-				Name: options.Handle.Path,
+				Name: name,
 				File: uploadHandle,
 			})
+	}
 
-		uploadHandle.Close()
-		if err != nil {
-			log.Err("FileCache::FlushFile : %s upload failed [%s]", options.Handle.Path, err.Error())
-			return err
+	if err != nil {
+		if dirty != nil {
+			dirty.restore(ranges, full)
 		}
+		return err
+	}
 
-		options.Handle.Flags.Clear(handlemap.HandleFlagDirty)
+	fc.restoreMissedAttrs(name)
+	fc.indexUploaded(name)
+	return nil
+}
 
-		// If chmod was done on the file before it was uploaded to container then setting up mode would have been missed
-		// Such file names are added to this map and here post upload we try to set the mode correctly
-		_, found := fc.missedChmodList.Load(options.Handle.Path)
-		if found {
-			// If file is found in map it means last chmod was missed on this
-			// Delete the entry from map so that any further flush do not try to update the mode again
-			fc.missedChmodList.Delete(options.Handle.Path)
-
-			// When chmod on container was missed, local file was updated with correct mode
-			// Here take the mode from local cache and update the container accordingly
-			localPath := filepath.Join(fc.tmpPath, options.Handle.Path)
-			info, err := os.Lstat(localPath)
-			if err == nil {
-				err = fc.Chmod(internal.ChmodOptions{Name: options.Handle.Path, Mode: info.Mode()})
-				if err != nil {
-					// chmod was missed earlier for this file and doing it now also
-					// resulted in error so ignore this one and proceed for flush handling
-					log.Err("FileCache::FlushFile : %s chmod failed [%s]", options.Handle.Path, err.Error())
-				}
+// restoreMissedAttrs : Apply mode and times set on the file before it was uploaded, as the upload loses them
+func (fc *FileCache) restoreMissedAttrs(name string) {
+	// If chmod was done on the file before it was uploaded to container then setting up mode would have been missed
+	// Such file names are added to this map and here post upload we try to set the mode correctly
+	_, found := fc.missedChmodList.Load(name)
+	if found {
+		// If file is found in map it means last chmod was missed on this
+		// Delete the entry from map so that any further flush do not try to update the mode again
+		fc.missedChmodList.Delete(name)
+
+		// When chmod on container was missed, local file was updated with correct mode
+		// Here take the mode from local cache and update the container accordingly
+		localPath := filepath.Join(fc.tmpPath, name)
+		info, err := os.Lstat(localPath)
+		if err == nil {
+			err = fc.Chmod(internal.ChmodOptions{Name: name, Mode: info.Mode()})
+			if err != nil {
+				// chmod was missed earlier for this file and doing it now also
+				// resulted in error so ignore this one and proceed for flush handling
+				log.Err("FileCache::restoreMissedAttrs : %s chmod failed [%s]", name, err.Error())
 			}
 		}
 	}
 
-	return nil
+	// Upload sets the modification time in storage to now, so restore the times user had set explicitly
+	_, found = fc.missedTimesList.Load(name)
+	if found {
+		fc.missedTimesList.Delete(name)
+
+		localPath := filepath.Join(fc.tmpPath, name)
+		info, err := os.Lstat(localPath)
+		if err == nil {
+			localAttr := newObjAttr(name, info)
+			err = fc.NextComponent().SetAttr(internal.SetAttrOptions{Name: name, Attr: localAttr})
+			if err != nil {
+				log.Err("FileCache::restoreMissedAttrs : %s setting times failed [%s]", name, err.Error())
+			}
+		}
+	}
 }
 
 // GetAttr: Consolidate attributes from storage and local cache
@@ -1155,11 +1978,23 @@ func (fc *FileCache) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr
 
 	// To cover case 1, get attributes from storage
 	var exists bool
-	attrs, err := fc.NextComponent().GetAttr(options)
+	var attrs *internal.ObjAttr
+	var err error
+	if fc.offline() {
+		err = errStorageOffline
+	} else {
+		attrs, err = fc.NextComponent().GetAttr(options)
+	}
+
+	// Local cache is all there is while storage is offline, so a path not cached there does not exist
+	offline := false
 	if err != nil {
 		if err == syscall.ENOENT || os.IsNotExist(err) {
 			log.Debug("FileCache::GetAttr : %s does not exist in storage", options.Name)
 			exists = false
+		} else if fc.checkOffline(err) {
+			log.Debug("FileCache::GetAttr : storage is offline, looking up %s in local cache", options.Name)
+			offline = true
 		} else {
 			log.Err("FileCache::GetAttr : Failed to get attr of %s [%s]", options.Name, err.Error())
 			return &internal.ObjAttr{}, err
@@ -1171,6 +2006,9 @@ func (fc *FileCache) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr
 	// To cover cases 2 and 3, grab the attributes from the local cache
 	localPath := filepath.Join(fc.tmpPath, options.Name)
 	info, err := os.Lstat(localPath)
+	if err == nil {
+		info = fc.plainInfo(info)
+	}
 	// All directory operations are guaranteed to be synced with storage so they cannot be in a case 2 or 3 state.
 	if (err == nil || os.IsExist(err)) && !info.IsDir() {
 		if exists { // Case 3 (file in storage and in local cache) so update the relevant attributes
@@ -1193,6 +2031,9 @@ func (fc *FileCache) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr
 				attrs = newObjAttr(options.Name, info)
 			}
 		}
+	} else if err == nil && offline && strings.Contains(localPath, fc.tmpPath) {
+		exists = true
+		attrs = newObjAttr(options.Name, info)
 	}
 
 	if !exists {
@@ -1206,10 +2047,22 @@ func (fc *FileCache) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr
 func (fc *FileCache) RenameFile(options internal.RenameFileOptions) error {
 	log.Trace("FileCache::RenameFile : src=%s, dst=%s", options.Src, options.Dst)
 
+	// Pending upload of the source has to be in storage to be renamed there
+	if fc.writeBack != nil {
+		err := fc.writeBack.flush(options.Src)
+		if err != nil {
+			log.Err("FileCache::RenameFile : failed to upload pending file %s [%s]", options.Src, err.Error())
+			return err
+		}
+	}
+
 	sflock := fc.fileLocks.Get(options.Src)
 	sflock.Lock()
 	defer sflock.Unlock()
 
+	// Local changes an earlier mount left on the source are uploaded before it is renamed
+	fc.checkRestored(options.Src, filepath.Join(fc.tmpPath, options.Src))
+
 	dflock := fc.fileLocks.Get(options.Dst)
 	dflock.Lock()
 	defer dflock.Unlock()
@@ -1228,9 +2081,29 @@ func (fc *FileCache) RenameFile(options internal.RenameFileOptions) error {
 	// if we do not perform rename operation locally and those destination files are cached then next time they are read
 	// we will be serving the wrong content (as we did not rename locally, we still be having older destination files with
 	// stale content). We either need to remove dest file as well from cache or just run rename to replace the content.
+	// Background download of the source works on its old path so stop it first, next open of the file resumes it.
+	if val, found := fc.sparseFiles.Load(options.Src); found {
+		fc.stopAsyncDownload(val.(*sparseFile))
+	}
 	err = os.Rename(localSrcPath, localDstPath)
 	if err != nil && !os.IsNotExist(err) {
 		log.Err("FileCache::RenameFile : %s failed to rename local file %s [%s]", localSrcPath, err.Error())
+	} else if err == nil {
+		fc.usage.renamed(localSrcPath, localDstPath)
+	}
+
+	// Bitmap of a partially downloaded file, its index entry and its pin move along with it
+	if fc.index != nil {
+		fc.index.rename(options.Src, options.Dst)
+	}
+	fc.pins.rename(options.Src, options.Dst)
+	fc.dropFromTiers(options.Src)
+	fc.dropFromTiers(options.Dst)
+	fc.cachedETags.Delete(options.Src)
+	fc.cachedETags.Delete(options.Dst)
+	fc.sparseFiles.Delete(options.Dst)
+	if val, found := fc.sparseFiles.LoadAndDelete(options.Src); found && err == nil {
+		fc.sparseFiles.Store(options.Dst, val)
 	}
 
 	if err != nil {
@@ -1269,18 +2142,29 @@ func (fc *FileCache) TruncateFile(options internal.TruncateFileOptions) error {
 		return err
 	}
 
-	// Update the size of the file in the local cache
+	// Update the size of the file in the local cache. Storage was truncated above so handles with pending writes
+	// need no tracking here, their ranges beyond the new size are dropped on flush as per the new block list.
 	localPath := filepath.Join(fc.tmpPath, options.Name)
 	info, err := os.Stat(localPath)
 	if err == nil || os.IsExist(err) {
 		fc.policy.CacheValid(localPath)
 
-		if info.Size() != options.Size {
-			err = os.Truncate(localPath, options.Size)
+		if fc.plainInfo(info).Size() != options.Size {
+			err = fc.truncateCached(localPath, options.Size)
 			if err != nil {
 				log.Err("FileCache::TruncateFile : error truncating cached file %s [%s]", localPath, err.Error())
 				return err
 			}
+			fc.usage.changed(localPath)
+			dropChecksum(localPath)
+		}
+		fc.truncateSparseFile(options.Name, localPath, options.Size)
+
+		// Storage changed, a file without local changes is still the same as the blob
+		if fc.index != nil {
+			if e := fc.index.get(options.Name); e != nil && !e.Dirty {
+				fc.indexUploaded(options.Name)
+			}
 		}
 	}
 
@@ -1309,6 +2193,11 @@ func (fc *FileCache) Chmod(options internal.ChmodOptions) error {
 	if err == nil || os.IsExist(err) {
 		fc.policy.CacheValid(localPath)
 
+		// Storage may ignore the mode of a blob that is not uploaded yet, so apply it again after upload of an open file
+		if fc.fileLocks.Get(options.Name).Count() > 0 {
+			fc.missedChmodList.LoadOrStore(options.Name, true)
+		}
+
 		if info.Mode() != options.Mode {
 			err = os.Chmod(localPath, options.Mode)
 			if err != nil {
@@ -1349,6 +2238,51 @@ func (fc *FileCache) Chown(options internal.ChownOptions) error {
 	return nil
 }
 
+// SetAttr : Update the access and modification time of the file
+func (fc *FileCache) SetAttr(options internal.SetAttrOptions) error {
+	log.Trace("FileCache::SetAttr : Change times of path %s", options.Name)
+	if options.Attr == nil {
+		return nil
+	}
+
+	// Update the file in storage
+	err := fc.NextComponent().SetAttr(options)
+	err = fc.validateStorageError(options.Name, err, "SetAttr", true)
+	if err != nil {
+		log.Err("FileCache::SetAttr : %s failed to change times [%s]", options.Name, err.Error())
+		return err
+	}
+
+	// Update the times of the file in the local cache
+	localPath := filepath.Join(fc.tmpPath, options.Name)
+	info, err := os.Stat(localPath)
+	if err == nil || os.IsExist(err) {
+		fc.policy.CacheValid(localPath)
+
+		// Upload of an open file resets the times in storage, so those need to be applied again after upload
+		if fc.fileLocks.Get(options.Name).Count() > 0 {
+			fc.missedTimesList.LoadOrStore(options.Name, true)
+		}
+
+		localAttr := newObjAttr(options.Name, info)
+		atime, mtime := options.Attr.Atime, options.Attr.Mtime
+		if atime.IsZero() {
+			atime = localAttr.Atime
+		}
+		if mtime.IsZero() {
+			mtime = localAttr.Mtime
+		}
+
+		err = os.Chtimes(localPath, atime, mtime)
+		if err != nil {
+			log.Err("FileCache::SetAttr : error changing times on the cached path %s [%s]", localPath, err.Error())
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (fc *FileCache) FileUsed(name string) error {
 	// Update the owner and group of the file in the local cache
 	localPath := filepath.Join(fc.tmpPath, name)
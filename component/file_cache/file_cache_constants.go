@@ -36,6 +36,49 @@ package file_cache
 const (
 	cacheUsage  = "Cache Usage"
 	usgPer      = "Usage Percent"
+	cacheBytes  = "Cache bytes"
+	cacheFiles  = "Cached files"
 	dlFiles     = "Files Downloaded"
 	cacheServed = "Files served from cache"
+
+	partialUploads = "Files uploaded partially"
+	sparseFetches  = "Ranges downloaded on demand"
+	sparseDiscards = "Partial files changed in storage"
+
+	asyncDownloads = "Background downloads in progress"
+	asyncCompleted = "Background downloads completed"
+	asyncBytes     = "Bytes downloaded in background"
+
+	writeBackPending  = "Files pending upload"
+	writeBackUploads  = "Files uploaded in background"
+	writeBackFailures = "Background upload failures"
+
+	indexRestored    = "Files restored from earlier mount"
+	indexRecovered   = "Dirty files uploaded on mount"
+	indexQuarantined = "Dirty files quarantined"
+
+	cacheHits          = "Cache hits"
+	cacheMisses        = "Cache misses"
+	cacheRevalidations = "Cache revalidations"
+
+	connectionState  = "Storage connection"
+	offlineConflicts = "Conflicts on reconcile"
+
+	prefetchFiles    = "Files prefetched"
+	prefetchFailures = "Prefetch failures"
+	pinnedSkips      = "Evictions skipped for pinned files"
+
+	tierDemotions  = "Files moved to a slower tier"
+	tierPromotions = "Files moved back from a slower tier"
+
+	sharedReuses    = "Files reused from shared cache"
+	sharedSkips     = "Evictions skipped for files open in other mounts"
+	sharedEvictions = "Files evicted from shared cache"
+
+	checksumVerified      = "Files verified"
+	checksumMismatches    = "Checksum mismatches"
+	checksumMismatchEvent = "ChecksumMismatch"
+
+	quotaEvictions = "Evictions for quota"
+	bypassOpens    = "Files streamed past the cache"
 )
@@ -34,12 +34,17 @@
 package file_cache
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"math/rand"
+	"net"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -133,6 +138,7 @@ func (suite *fileCacheTestSuite) cleanupTest() {
 	// Delete the temp directories created
 	os.RemoveAll(suite.cache_path)
 	os.RemoveAll(suite.fake_storage_path)
+	os.Remove(filepath.Clean(suite.cache_path) + pinFileSuffix)
 }
 
 // Tests the default configuration of file cache
@@ -989,6 +995,211 @@ func (suite *fileCacheTestSuite) TestFlushFileErrorBadFd() {
 	suite.assert.EqualValues(syscall.EBADF, err)
 }
 
+// blockListFS : Reports fixed size blocks for files in loopback and records the uploads
+type blockListFS struct {
+	etagFS
+	blockSize int64
+	flushed   *common.BlockOffsetList
+	copied    bool
+	stale     bool // Commit fails as if the blob changed after its block list was read
+}
+
+func (fs *blockListFS) GetFileBlockOffsets(options internal.GetFileBlockOffsetsOptions) (*common.BlockOffsetList, error) {
+	attr, err := fs.GetAttr(internal.GetAttrOptions{Name: options.Name})
+	if err != nil {
+		return nil, err
+	}
+
+	bol := &common.BlockOffsetList{BlockIdLength: 16, Etag: attr.ETag}
+	for offset := int64(0); offset < attr.Size; offset += fs.blockSize {
+		end := offset + fs.blockSize
+		if end > attr.Size {
+			end = attr.Size
+		}
+		bol.BlockList = append(bol.BlockList, &common.Block{Id: base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%016d", offset))), StartIndex: offset, EndIndex: end})
+	}
+	return bol, nil
+}
+
+func (fs *blockListFS) FlushFile(options internal.FlushFileOptions) error {
+	if fs.stale {
+		return syscall.ESTALE
+	}
+	fs.flushed = options.Handle.CacheObj.BlockOffsetList
+	return nil
+}
+
+func (fs *blockListFS) CopyFromFile(options internal.CopyFromFileOptions) error {
+	fs.copied = true
+	return fs.Component.CopyFromFile(options)
+}
+
+// setupBlockListFS : Restart file cache on top of a blockListFS
+func (suite *fileCacheTestSuite) setupBlockListFS(blockSize int64) *blockListFS {
+	fs := &blockListFS{etagFS: etagFS{Component: suite.loopback}, blockSize: blockSize}
+	suite.fileCache.Stop()
+	suite.fileCache = newTestFileCache(fs)
+	suite.fileCache.Start(context.Background())
+	return fs
+}
+
+func (suite *fileCacheTestSuite) TestDirtyRanges() {
+	defer suite.cleanupTest()
+	d := &dirtyRanges{}
+
+	d.add(10, 20)
+	d.add(30, 40)
+	d.add(0, 5)
+	d.add(20, 25) // adjacent ranges are merged
+	ranges, full := d.take()
+	suite.assert.False(full)
+	suite.assert.Equal([]byteRange{{0, 5}, {10, 25}, {30, 40}}, ranges)
+
+	// Taking resets the ranges and a failed flush puts them back
+	ranges, _ = d.take()
+	suite.assert.Empty(ranges)
+	d.add(15, 35)
+	d.restore([]byteRange{{0, 5}, {10, 20}}, false)
+	ranges, _ = d.take()
+	suite.assert.Equal([]byteRange{{0, 5}, {10, 35}}, ranges)
+
+	d.setFull()
+	d.add(1, 2)
+	ranges, full = d.take()
+	suite.assert.True(full)
+	suite.assert.Empty(ranges)
+
+	for i := int64(0); i <= maxDirtyRanges; i++ {
+		d.add(i*10, i*10+1)
+	}
+	_, full = d.take()
+	suite.assert.True(full)
+}
+
+func (suite *fileCacheTestSuite) TestFlushFileDirtyBlocks() {
+	defer suite.cleanupTest()
+	// Setup
+	file := "file"
+	fs := suite.setupBlockListFS(4)
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(suite.fake_storage_path+"/"+file, []byte("abcdefghijkl"), 0777)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 5, Data: []byte("XY")})
+
+	// Only the block which was written to is uploaded
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.False(fs.copied)
+	suite.assert.False(handle.Dirty())
+	suite.assert.NotNil(fs.flushed)
+	suite.assert.True(fs.flushed.MatchEtag())
+	suite.assert.Len(fs.flushed.BlockList, 3)
+	suite.assert.False(fs.flushed.BlockList[0].Dirty())
+	suite.assert.True(fs.flushed.BlockList[1].Dirty())
+	suite.assert.EqualValues("eXYh", fs.flushed.BlockList[1].Data)
+	suite.assert.False(fs.flushed.BlockList[2].Dirty())
+
+	// Writing past the end adds blocks, hole included
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 14, Data: []byte("Z")})
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.False(fs.copied)
+	suite.assert.Len(fs.flushed.BlockList, 4)
+	for _, blk := range fs.flushed.BlockList[:3] {
+		suite.assert.False(blk.Dirty())
+	}
+	suite.assert.True(fs.flushed.BlockList[3].Dirty())
+	suite.assert.EqualValues(12, fs.flushed.BlockList[3].StartIndex)
+	suite.assert.EqualValues([]byte{0, 0, 'Z'}, fs.flushed.BlockList[3].Data)
+	suite.assert.Len(fs.flushed.BlockList[3].Id, len(fs.flushed.BlockList[0].Id))
+
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestFlushFileDirtyBlocksFallback() {
+	defer suite.cleanupTest()
+	// Setup
+	file := "file"
+	fs := suite.setupBlockListFS(4)
+
+	// New file is uploaded as a whole
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: file, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("abcdefghijkl")})
+	err := suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(fs.copied)
+	suite.assert.Nil(fs.flushed)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Changing every block is no cheaper than uploading the file
+	fs.copied = false
+	handle, _ = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 2, Data: []byte("0123456789")})
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(fs.copied)
+	suite.assert.Nil(fs.flushed)
+
+	d, _ := os.ReadFile(suite.fake_storage_path + "/" + file)
+	suite.assert.EqualValues("ab0123456789", d)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Writes on a cached handle bypass file cache so the whole file is uploaded
+	fs.copied = false
+	suite.fileCache.offloadIO = false
+	handle, _ = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.True(handle.Cached())
+	handle.GetFileObject().WriteAt([]byte("Z"), 0)
+	handle.Flags.Set(handlemap.HandleFlagDirty)
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(fs.copied)
+	suite.assert.Nil(fs.flushed)
+
+	d, _ = os.ReadFile(suite.fake_storage_path + "/" + file)
+	suite.assert.EqualValues("Zb0123456789", d)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestFlushFileDirtyBlocksBlobChanged() {
+	defer suite.cleanupTest()
+	// Setup
+	file := "file"
+	fs := suite.setupBlockListFS(4)
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(suite.fake_storage_path+"/"+file, []byte("abcdefghijkl"), 0777)
+
+	// Blob written by someone else after it was cached is not merged with the local copy
+	handle, _ := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 5, Data: []byte("XY")})
+	os.WriteFile(suite.fake_storage_path+"/"+file, []byte("ABCDEFGHIJKLMNOP"), 0777)
+	err := suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(fs.copied)
+	suite.assert.Nil(fs.flushed)
+
+	d, _ := os.ReadFile(suite.fake_storage_path + "/" + file)
+	suite.assert.EqualValues("abcdeXYhijkl", d)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Blob changing between reading its block list and the commit falls back as well
+	fs.copied = false
+	os.Remove(filepath.Join(suite.cache_path, file))
+	suite.fileCache.policy.CachePurge(filepath.Join(suite.cache_path, file))
+	handle, _ = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("Z")})
+	fs.stale = true
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(fs.copied)
+
+	d, _ = os.ReadFile(suite.fake_storage_path + "/" + file)
+	suite.assert.EqualValues("ZbcdeXYhijkl", d)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
 func (suite *fileCacheTestSuite) TestGetAttrCase1() {
 	defer suite.cleanupTest()
 	// Setup
@@ -1340,6 +1551,72 @@ func (suite *fileCacheTestSuite) TestChmodCase2() {
 	suite.assert.EqualValues(attr.Mode, newMode)
 }
 
+func (suite *fileCacheTestSuite) TestSetAttrNotInCache() {
+	defer suite.cleanupTest()
+	// Setup
+	path := "file"
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: path, Mode: 0777})
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	_, err := os.Stat(suite.cache_path + "/" + path)
+	for i := 0; i < 10 && !os.IsNotExist(err); i++ {
+		time.Sleep(time.Second)
+		_, err = os.Stat(suite.cache_path + "/" + path)
+	}
+	suite.assert.True(os.IsNotExist(err))
+
+	// SetAttr
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	err = suite.fileCache.SetAttr(internal.SetAttrOptions{Name: path, Attr: &internal.ObjAttr{Mtime: mtime}})
+	suite.assert.Nil(err)
+
+	// Path in fake storage should be updated
+	info, _ := os.Stat(suite.fake_storage_path + "/" + path)
+	suite.assert.True(info.ModTime().Equal(mtime))
+}
+
+func (suite *fileCacheTestSuite) TestSetAttrInCache() {
+	defer suite.cleanupTest()
+	// Setup
+	path := "file"
+	createHandle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: path, Mode: 0666})
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: createHandle})
+	openHandle, _ := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: path, Mode: 0666})
+
+	// SetAttr
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	err := suite.fileCache.SetAttr(internal.SetAttrOptions{Name: path, Attr: &internal.ObjAttr{Mtime: mtime}})
+	suite.assert.Nil(err)
+
+	// Path in fake storage and file cache should be updated
+	info, _ := os.Stat(suite.cache_path + "/" + path)
+	suite.assert.True(info.ModTime().Equal(mtime))
+	info, _ = os.Stat(suite.fake_storage_path + "/" + path)
+	suite.assert.True(info.ModTime().Equal(mtime))
+
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: openHandle})
+}
+
+func (suite *fileCacheTestSuite) TestSetAttrAfterWrite() {
+	defer suite.cleanupTest()
+	// Setup
+	path := "file"
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: path, Mode: 0666})
+	_, err := suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("data")})
+	suite.assert.Nil(err)
+
+	// Times set on an open file shall survive the upload on flush
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.Local)
+	err = suite.fileCache.SetAttr(internal.SetAttrOptions{Name: path, Attr: &internal.ObjAttr{Mtime: mtime}})
+	suite.assert.Nil(err)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	info, _ := os.Stat(suite.fake_storage_path + "/" + path)
+	suite.assert.True(info.ModTime().Equal(mtime))
+}
+
 func (suite *fileCacheTestSuite) TestChownNotInCache() {
 	defer suite.cleanupTest()
 	// Setup
@@ -1514,6 +1791,1660 @@ func (suite *fileCacheTestSuite) TestStatFS() {
 	suite.assert.NotEqual(stat, &syscall.Statfs_t{})
 }
 
+func (suite *fileCacheTestSuite) TestSparseFileBitmap() {
+	defer suite.cleanupTest()
+
+	suite.assert.EqualValues(1024, sparseChunkSize(1024*maxSparseChunks, 1024))
+	suite.assert.EqualValues(2048, sparseChunkSize(1024*maxSparseChunks+1, 1024))
+
+	s := newSparseFile(10*1024+1, 1024)
+	suite.assert.EqualValues(11, s.missing)
+	suite.assert.Len(s.bitmap, 2)
+	s.set(0)
+	s.set(10)
+	s.set(10)
+	suite.assert.EqualValues(9, s.missing)
+
+	d, err := decodeSparseFile(s.encode())
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(s.chunkSize, d.chunkSize)
+	suite.assert.EqualValues(s.size, d.size)
+	suite.assert.EqualValues(s.missing, d.missing)
+	suite.assert.True(d.present(0))
+	suite.assert.False(d.present(1))
+	suite.assert.True(d.present(10))
+
+	_, err = decodeSparseFile(s.encode()[:sparseHeaderLen+1])
+	suite.assert.Equal(errSparseCorrupt, err)
+
+	s.etag = "0x8D9"
+	d, err = decodeSparseFile(s.encode())
+	suite.assert.Nil(err)
+	suite.assert.Equal("0x8D9", d.etag)
+	suite.assert.True(d.present(10))
+	suite.assert.EqualValues(s.missing, d.missing)
+
+	// Shrinking drops the chunks beyond the new size, growing is ignored
+	s.truncate(1024 + 1)
+	suite.assert.EqualValues(1, s.missing)
+	s.truncate(4096)
+	suite.assert.EqualValues(1024+1, s.size)
+}
+
+func (suite *fileCacheTestSuite) TestSparseCacheReadOnDemand() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  sparse-cache: true\n  sparse-block-size-mb: 1\n  sparse-read-ahead: 0\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+
+	file := "sparse_file"
+	size := 5 * MB
+	data := make([]byte, size)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), data, 0777)
+	localPath := filepath.Join(suite.cache_path, file)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.False(handle.Cached())
+
+	// Cached file is sized like the blob but nothing is downloaded yet
+	info, err := os.Stat(localPath)
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(size, info.Size())
+	s := suite.fileCache.getSparseFile(file)
+	suite.assert.NotNil(s)
+	suite.assert.EqualValues(5, s.missing)
+
+	buf := make([]byte, 1024)
+	n, err := suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 2*MB + 10, Data: buf})
+	suite.assert.Nil(err)
+	suite.assert.Equal(len(buf), n)
+	suite.assert.EqualValues(data[2*MB+10:2*MB+10+1024], buf)
+	suite.assert.True(s.present(2))
+	suite.assert.EqualValues(4, s.missing)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.Nil(suite.fileCache.getSparseFile(file))
+
+	// Bitmap is reloaded from the cached file on next open
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	s = suite.fileCache.getSparseFile(file)
+	suite.assert.NotNil(s)
+	suite.assert.True(s.present(2))
+	suite.assert.EqualValues(4, s.missing)
+
+	// Partial write to a missing chunk downloads the rest of it first
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: MB + 5, Data: []byte("hello")})
+	suite.assert.Nil(err)
+	suite.assert.True(s.present(1))
+	copy(data[MB+5:], []byte("hello"))
+
+	output, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(data, output)
+	suite.assert.EqualValues(0, s.missing)
+
+	// Complete file drops its bitmap
+	_, err = syscall.Getxattr(localPath, sparseXattr, nil)
+	suite.assert.Equal(syscall.ENODATA, err)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+}
+
+// staleFS : Refuses ranged reads of an older version of the blob, like storage does on If-Match
+type staleFS struct {
+	etagFS
+}
+
+func (fs *staleFS) ReadInBuffer(options internal.ReadInBufferOptions) (int, error) {
+	if options.Etag != "" {
+		attr, err := fs.GetAttr(internal.GetAttrOptions{Name: options.Handle.Path})
+		if err == nil && attr.ETag != options.Etag {
+			return 0, syscall.ESTALE
+		}
+	}
+	return fs.etagFS.ReadInBuffer(options)
+}
+
+func (suite *fileCacheTestSuite) TestSparseCacheBlobChanged() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  sparse-cache: true\n  sparse-block-size-mb: 1\n  sparse-read-ahead: 0\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+	suite.remount(&staleFS{etagFS: etagFS{Component: suite.loopback}})
+
+	file := "sparse_changed_file"
+	size := 4 * MB
+	data := make([]byte, size)
+	rand.Read(data)
+	storagePath := filepath.Join(suite.fake_storage_path, file)
+	os.WriteFile(storagePath, data, 0777)
+	localPath := filepath.Join(suite.cache_path, file)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	s := suite.fileCache.getSparseFile(file)
+	suite.assert.NotNil(s)
+	suite.assert.NotEmpty(s.etag)
+
+	buf := make([]byte, 1024)
+	_, err = suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 0, Data: buf})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(data[:1024], buf)
+
+	// Blob is replaced in storage, chunks still missing must not come from the new version
+	changed := make([]byte, size)
+	rand.Read(changed)
+	time.Sleep(10 * time.Millisecond)
+	os.WriteFile(storagePath, changed, 0777)
+
+	_, err = suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 2 * MB, Data: buf})
+	suite.assert.NotNil(err)
+	suite.assert.True(s.stale)
+	_, err = os.Stat(localPath)
+	suite.assert.True(os.IsNotExist(err))
+
+	// Chunks downloaded earlier are not served anymore either
+	_, err = suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 0, Data: buf})
+	suite.assert.NotNil(err)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	// Next open starts over from the new version
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	output, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(changed, output)
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+}
+
+func (suite *fileCacheTestSuite) TestAsyncOpen() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  async-open: true\n  sparse-block-size-mb: 1\n  async-open-parallelism: 2\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+	suite.assert.True(suite.fileCache.asyncOpen)
+	suite.assert.False(suite.fileCache.sparse)
+
+	file := "async_file"
+	size := 5*MB + 10
+	data := make([]byte, size)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), data, 0777)
+	localPath := filepath.Join(suite.cache_path, file)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.False(handle.Cached())
+	s := suite.fileCache.getSparseFile(file)
+	suite.assert.NotNil(s)
+
+	// Reads do not wait for the whole file
+	buf := make([]byte, 100)
+	n, err := suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 5 * MB, Data: buf})
+	suite.assert.Nil(err)
+	suite.assert.Equal(10, n)
+	suite.assert.EqualValues(data[5*MB:], buf[:n])
+
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 3*MB + 1, Data: []byte("hello")})
+	suite.assert.Nil(err)
+	copy(data[3*MB+1:], []byte("hello"))
+
+	suite.assert.Eventually(func() bool {
+		s.Lock()
+		defer s.Unlock()
+		return !s.downloading
+	}, 10*time.Second, 10*time.Millisecond)
+	suite.assert.EqualValues(0, s.missing)
+	_, err = syscall.Getxattr(localPath, sparseXattr, nil)
+	suite.assert.Equal(syscall.ENODATA, err)
+
+	local, _ := os.ReadFile(localPath)
+	suite.assert.EqualValues(data, local)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+}
+
+func (suite *fileCacheTestSuite) TestAsyncOpenAfterClose() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  async-open: true\n  sparse-block-size-mb: 1\n  async-open-parallelism: 1\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+
+	file := "async_close_file"
+	size := 8 * MB
+	data := make([]byte, size)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), data, 0777)
+	localPath := filepath.Join(suite.cache_path, file)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	// Download carries on after the last close and drops the bitmap once done
+	suite.assert.Eventually(func() bool {
+		return suite.fileCache.getSparseFile(file) == nil
+	}, 10*time.Second, 10*time.Millisecond)
+	suite.assert.EqualValues(0, suite.fileCache.fileLocks.Get(file).Count())
+	_, err = syscall.Getxattr(localPath, sparseXattr, nil)
+	suite.assert.Equal(syscall.ENODATA, err)
+	local, _ := os.ReadFile(localPath)
+	suite.assert.EqualValues(data, local)
+}
+
+func (suite *fileCacheTestSuite) TestAsyncOpenStop() {
+	defer suite.cleanupTest()
+	s := newSparseFile(4*MB, MB)
+	s.set(1)
+
+	// Chunks in flight for reads are left to them
+	s.inflight[2] = make(chan struct{})
+	chunk, bytes := s.claimChunk()
+	suite.assert.EqualValues(0, chunk)
+	suite.assert.EqualValues(MB, bytes)
+	chunk, _ = s.claimChunk()
+	suite.assert.EqualValues(3, chunk)
+	chunk, _ = s.claimChunk()
+	suite.assert.EqualValues(-1, chunk)
+
+	s.next = 0
+	s.stop = true
+	chunk, _ = s.claimChunk()
+	suite.assert.EqualValues(-1, chunk)
+
+	// Stopping a file which is not downloading returns at once
+	suite.fileCache.stopAsyncDownload(s)
+}
+
+// writeBackFS : Holds uploads till released and fails the given number of them
+type writeBackFS struct {
+	internal.Component
+	gate  chan struct{}
+	fails int32
+}
+
+func (fs *writeBackFS) CopyFromFile(options internal.CopyFromFileOptions) error {
+	if fs.gate != nil {
+		<-fs.gate
+	}
+	if atomic.AddInt32(&fs.fails, -1) >= 0 {
+		return syscall.EIO
+	}
+	return fs.Component.CopyFromFile(options)
+}
+
+// setupWriteBackFS : Restart file cache with write-back on top of a writeBackFS
+func (suite *fileCacheTestSuite) setupWriteBackFS(extra string) *writeBackFS {
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  write-back: true\n%s\nloopbackfs:\n  path: %s",
+		suite.cache_path, extra, suite.fake_storage_path)
+	suite.cleanupTest()
+	suite.setupTestHelper(config)
+
+	fs := &writeBackFS{Component: suite.loopback}
+	suite.fileCache.Stop()
+	suite.fileCache = newTestFileCache(fs)
+	suite.fileCache.Start(context.Background())
+	return fs
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackClose() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupWriteBackFS("")
+	fs.gate = make(chan struct{})
+
+	file := "wb_file"
+	handle, err := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: file, Mode: 0777})
+	suite.assert.Nil(err)
+	data := []byte("test data")
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: data})
+	suite.assert.Nil(err)
+
+	// Close returns while the upload is held
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(suite.fileCache.writeBack.has(file))
+	suite.assert.FileExists(suite.fileCache.writeBack.journalPath(file))
+	suite.assert.EqualValues(1, suite.fileCache.fileLocks.Get(file).Count())
+	suite.assert.NoFileExists(filepath.Join(suite.fake_storage_path, file))
+
+	// Local copy is served till then
+	attr, err := suite.fileCache.GetAttr(internal.GetAttrOptions{Name: file})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(len(data), attr.Size)
+
+	close(fs.gate)
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.writeBack.has(file)
+	}, 5*time.Second, 10*time.Millisecond)
+	suite.assert.NoFileExists(suite.fileCache.writeBack.journalPath(file))
+	suite.assert.EqualValues(0, suite.fileCache.fileLocks.Get(file).Count())
+
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackDirtyBlocks() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	suite.setupWriteBackFS("")
+	fs := suite.setupBlockListFS(4)
+	file := "wb_blocks"
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), []byte("abcdefghijkl"), 0777)
+
+	// Blocks written through the handles closed before the upload are uploaded, not the whole file
+	for _, w := range []struct {
+		offset int64
+		data   string
+	}{{5, "XY"}, {0, "Z"}} {
+		handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+		suite.assert.Nil(err)
+		suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: w.offset, Data: []byte(w.data)})
+		err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		suite.assert.Nil(err)
+	}
+
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.writeBack.has(file)
+	}, 5*time.Second, 10*time.Millisecond)
+	suite.assert.False(fs.copied)
+	suite.assert.NotNil(fs.flushed)
+	suite.assert.True(fs.flushed.BlockList[0].Dirty())
+	suite.assert.True(fs.flushed.BlockList[1].Dirty())
+	suite.assert.False(fs.flushed.BlockList[2].Dirty())
+	suite.assert.EqualValues("Zbcd", fs.flushed.BlockList[0].Data)
+	suite.assert.EqualValues("eXYh", fs.flushed.BlockList[1].Data)
+	_, found := suite.fileCache.writeBackDirty.Load(file)
+	suite.assert.False(found)
+
+	// Workers and the retry ticker are gone once stopped
+	wb := suite.fileCache.writeBack
+	suite.fileCache.Stop()
+	_, open := <-wb.quit
+	suite.assert.False(open)
+	suite.fileCache = newTestFileCache(fs)
+	suite.fileCache.Start(context.Background())
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackRetry() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupWriteBackFS("  write-back-workers: 1\n")
+	fs.fails = 1
+
+	file := "wb_retry"
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: file, Mode: 0777})
+	data := []byte("test data")
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: data})
+	err := suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.writeBack.has(file)
+	}, 5*time.Second, 10*time.Millisecond)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackSyncFile() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupWriteBackFS("")
+	fs.gate = make(chan struct{})
+	close(fs.gate)
+
+	file := "wb_sync"
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: file, Mode: 0777})
+	data := []byte("test data")
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: data})
+
+	// fsync uploads before returning
+	err := suite.fileCache.SyncFile(internal.SyncFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.False(suite.fileCache.writeBack.has(file))
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackDelete() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupWriteBackFS("")
+	fs.gate = make(chan struct{})
+
+	file := "wb_delete"
+	handle, _ := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: file, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("test data")})
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.True(suite.fileCache.writeBack.has(file))
+
+	// Upload in progress is waited for, then the file goes away from storage and the queue
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		close(fs.gate)
+	}()
+	err := suite.fileCache.DeleteFile(internal.DeleteFileOptions{Name: file})
+	suite.assert.Nil(err)
+	suite.assert.False(suite.fileCache.writeBack.has(file))
+	suite.assert.NoFileExists(suite.fileCache.writeBack.journalPath(file))
+	suite.assert.EqualValues(0, suite.fileCache.fileLocks.Get(file).Count())
+	suite.assert.NoFileExists(filepath.Join(suite.fake_storage_path, file))
+}
+
+func (suite *fileCacheTestSuite) TestWriteBackReplay() {
+	defer suite.cleanupTest()
+	journal := suite.cache_path + "_writeback"
+	defer os.RemoveAll(journal)
+
+	// Cached file and journal left behind by an earlier mount
+	file := "wb_replay"
+	data := []byte("test data")
+	suite.cleanupTest()
+	os.MkdirAll(suite.cache_path, 0777)
+	os.WriteFile(filepath.Join(suite.cache_path, file), data, 0777)
+	wb, _ := newWriteBack(journal, 1, nil, nil)
+	suite.assert.Nil(wb.persist(file))
+
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  write-back: true\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.writeBack.has(file)
+	}, 5*time.Second, 10*time.Millisecond)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, file))
+	suite.assert.EqualValues(data, storage)
+	suite.assert.Empty(suite.fileCache.writeBack.journal())
+}
+
+// etagFS : Gives loopback files an ETag which changes with the file and counts the downloads
+type etagFS struct {
+	internal.Component
+	downloads int
+}
+
+func (fs *etagFS) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr, error) {
+	attr, err := fs.Component.GetAttr(options)
+	if err == nil {
+		attr.ETag = fmt.Sprintf("%d-%d", attr.Size, attr.Mtime.UnixNano())
+	}
+	return attr, err
+}
+
+func (fs *etagFS) CopyToFile(options internal.CopyToFileOptions) error {
+	fs.downloads++
+	return fs.Component.CopyToFile(options)
+}
+
+// setupPersistentCache : Restart file cache with persistent cache on top of an etagFS
+func (suite *fileCacheTestSuite) setupPersistentCache() *etagFS {
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  persistent-cache: true\n  timeout-sec: 120\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.cleanupTest()
+	suite.setupTestHelper(config)
+
+	fs := &etagFS{Component: suite.loopback}
+	suite.remount(fs)
+	return fs
+}
+
+// remount : Stop file cache and start a new one on the same cache directory
+func (suite *fileCacheTestSuite) remount(next internal.Component) {
+	suite.fileCache.Stop()
+	suite.fileCache = newTestFileCache(next)
+	suite.fileCache.Start(context.Background())
+}
+
+func (suite *fileCacheTestSuite) TestPersistentCacheRestore() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_persist")
+	fs := suite.setupPersistentCache()
+
+	file := "persist_file"
+	data := []byte("test data")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), data, 0777)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(1, fs.downloads)
+
+	// Stray file the index does not know of is not trusted
+	stray := filepath.Join(suite.cache_path, "stray")
+	os.WriteFile(stray, data, 0777)
+
+	suite.remount(fs)
+	suite.fileCache.index.waitRestore()
+	suite.assert.FileExists(filepath.Join(suite.cache_path, file))
+	suite.assert.NoFileExists(stray)
+	e := suite.fileCache.index.get(file)
+	suite.assert.NotNil(e)
+	suite.assert.True(e.revalidate)
+
+	// Unchanged blob is served from the restored file
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	output, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(data, output)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(1, fs.downloads)
+
+	// Blob changed while unmounted so it is downloaded again
+	suite.remount(fs)
+	time.Sleep(10 * time.Millisecond)
+	newData := []byte("new data!")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), newData, 0777)
+
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	output, _ = suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.EqualValues(newData, output)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(2, fs.downloads)
+}
+
+func (suite *fileCacheTestSuite) TestPersistentCacheDirty() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_persist")
+	fs := suite.setupPersistentCache()
+
+	// New file written but never closed is uploaded on next mount
+	created := "persist_created"
+	handle, err := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: created, Mode: 0777})
+	suite.assert.Nil(err)
+	data := []byte("test data")
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: data})
+
+	// Modified file whose blob also changed meanwhile is quarantined
+	modified := "persist_modified"
+	os.WriteFile(filepath.Join(suite.fake_storage_path, modified), data, 0777)
+	handle2, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: modified, Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle2, Offset: 0, Data: []byte("local")})
+
+	suite.fileCache.Stop()
+	time.Sleep(10 * time.Millisecond)
+	remote := []byte("remote data")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, modified), remote, 0777)
+
+	suite.fileCache = newTestFileCache(fs)
+	suite.fileCache.Start(context.Background())
+	suite.fileCache.index.waitRestore()
+
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, created))
+	suite.assert.EqualValues(data, storage)
+	e := suite.fileCache.index.get(created)
+	suite.assert.NotNil(e)
+	suite.assert.False(e.Dirty)
+
+	storage, _ = os.ReadFile(filepath.Join(suite.fake_storage_path, modified))
+	suite.assert.EqualValues(remote, storage)
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, modified))
+	quarantined, _ := os.ReadFile(filepath.Join(suite.cache_path+"_persist", quarantineDir, modified))
+	suite.assert.EqualValues("localdata", string(quarantined))
+	suite.assert.Nil(suite.fileCache.index.get(modified))
+}
+
+// slowUploadFS : Holds back the upload of one file till released
+type slowUploadFS struct {
+	etagFS
+	name    string
+	release chan struct{}
+}
+
+func (fs *slowUploadFS) CopyFromFile(options internal.CopyFromFileOptions) error {
+	if options.Name == fs.name {
+		<-fs.release
+	}
+	return fs.etagFS.CopyFromFile(options)
+}
+
+func (suite *fileCacheTestSuite) TestPersistentCacheRestoreInBackground() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_persist")
+	fs := suite.setupPersistentCache()
+
+	// Two files an earlier mount left with local changes, to be uploaded on next mount
+	suite.fileCache.Stop()
+	data := []byte("test data")
+	for _, name := range []string{"a_slow", "b_opened"} {
+		localPath := filepath.Join(suite.cache_path, name)
+		suite.assert.Nil(os.WriteFile(localPath, data, 0777))
+		suite.assert.Nil(syscall.Setxattr(localPath, dirtyXattr, []byte{1}, 0))
+	}
+
+	// Start does not wait for the uploads
+	slow := &slowUploadFS{etagFS: etagFS{Component: fs.Component}, name: "a_slow", release: make(chan struct{})}
+	suite.fileCache = newTestFileCache(slow)
+	suite.fileCache.Start(context.Background())
+
+	// File opened before the restore comes to it is uploaded first, not taken as it is
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "b_opened", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, "b_opened"))
+	suite.assert.EqualValues(data, storage)
+	e := suite.fileCache.index.get("b_opened")
+	suite.assert.NotNil(e)
+	suite.assert.False(e.Dirty)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	suite.assert.NoFileExists(filepath.Join(suite.fake_storage_path, "a_slow"))
+	close(slow.release)
+	suite.fileCache.index.waitRestore()
+	suite.assert.False(suite.fileCache.index.claim("a_slow"))
+	storage, _ = os.ReadFile(filepath.Join(suite.fake_storage_path, "a_slow"))
+	suite.assert.EqualValues(data, storage)
+}
+
+func (suite *fileCacheTestSuite) TestRevalidateExpired() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offload-io: true\n  revalidate: true\n  timeout-sec: 120\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.cleanupTest()
+	suite.setupTestHelper(config)
+	fs := &etagFS{Component: suite.loopback}
+	suite.remount(fs)
+	suite.assert.True(suite.fileCache.revalidate)
+	suite.assert.False(suite.fileCache.persistent())
+
+	file := "revalidate_file"
+	data := []byte("test data")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), data, 0777)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(1, fs.downloads)
+
+	// Expired file is reused as the blob did not change
+	suite.fileCache.cacheTimeout = 0
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	output, _ := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.EqualValues(data, output)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(1, fs.downloads)
+
+	time.Sleep(10 * time.Millisecond)
+	newData := []byte("new data!")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), newData, 0777)
+
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	output, _ = suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.EqualValues(newData, output)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Equal(2, fs.downloads)
+}
+
+func (suite *fileCacheTestSuite) TestCacheIndexEntryMatches() {
+	defer suite.cleanupTest()
+	lmt := time.Now()
+
+	e := &cacheIndexEntry{Size: 10, ETag: "a", LMT: lmt}
+	suite.assert.True(e.matches(&internal.ObjAttr{Size: 10, ETag: "a"}))
+	suite.assert.False(e.matches(&internal.ObjAttr{Size: 10, ETag: "b", Mtime: lmt}))
+	suite.assert.False(e.matches(&internal.ObjAttr{Size: 11, ETag: "a"}))
+
+	// Without an ETag the last modified time decides
+	e = &cacheIndexEntry{Size: 10, LMT: lmt}
+	suite.assert.True(e.matches(&internal.ObjAttr{Size: 10, Mtime: lmt}))
+	suite.assert.False(e.matches(&internal.ObjAttr{Size: 10, Mtime: lmt.Add(time.Second)}))
+}
+
+
+// offlineFS : Fails calls reaching storage with a network error while down, or as an open circuit breaker does
+type offlineFS struct {
+	etagFS
+	down    int32
+	tripped int32
+}
+
+func (fs *offlineFS) unreachable() error {
+	if atomic.LoadInt32(&fs.down) == 1 {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	}
+	if atomic.LoadInt32(&fs.tripped) == 1 {
+		return syscall.ENOTCONN
+	}
+	return nil
+}
+
+func (fs *offlineFS) GetAttr(options internal.GetAttrOptions) (*internal.ObjAttr, error) {
+	if err := fs.unreachable(); err != nil {
+		return nil, err
+	}
+	return fs.etagFS.GetAttr(options)
+}
+
+func (fs *offlineFS) StreamDir(options internal.StreamDirOptions) ([]*internal.ObjAttr, string, error) {
+	if err := fs.unreachable(); err != nil {
+		return nil, "", err
+	}
+	return fs.etagFS.StreamDir(options)
+}
+
+func (fs *offlineFS) CopyToFile(options internal.CopyToFileOptions) error {
+	if err := fs.unreachable(); err != nil {
+		return err
+	}
+	return fs.etagFS.CopyToFile(options)
+}
+
+func (fs *offlineFS) CopyFromFile(options internal.CopyFromFileOptions) error {
+	if err := fs.unreachable(); err != nil {
+		return err
+	}
+	return fs.etagFS.CopyFromFile(options)
+}
+
+// setupOfflineFS : Restart file cache in offline mode on top of an offlineFS
+func (suite *fileCacheTestSuite) setupOfflineFS(extra string) *offlineFS {
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  offline-mode: true\n  offline-probe-interval-sec: 1\n  timeout-sec: 120\n%s\nloopbackfs:\n  path: %s",
+		suite.cache_path, extra, suite.fake_storage_path)
+	suite.cleanupTest()
+	suite.setupTestHelper(config)
+
+	fs := &offlineFS{etagFS: etagFS{Component: suite.loopback}}
+	suite.remount(fs)
+	return fs
+}
+
+func (suite *fileCacheTestSuite) TestOfflineMode() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupOfflineFS("")
+
+	file := "offline_cached"
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), []byte("test data"), 0777)
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Expired file is served from cache once storage turns out to be unreachable
+	atomic.StoreInt32(&fs.down, 1)
+	suite.fileCache.cacheTimeout = 0
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.True(suite.fileCache.offline())
+	data, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues("test data", data)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Lookups and listings come from the local cache
+	attr, err := suite.fileCache.GetAttr(internal.GetAttrOptions{Name: file})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(len("test data"), attr.Size)
+	_, err = suite.fileCache.GetAttr(internal.GetAttrOptions{Name: "offline_missing"})
+	suite.assert.Equal(syscall.ENOENT, err)
+	attrs, token, err := suite.fileCache.StreamDir(internal.StreamDirOptions{Name: ""})
+	suite.assert.Nil(err)
+	suite.assert.Empty(token)
+	suite.assert.Len(attrs, 1)
+	suite.assert.EqualValues(file, attrs[0].Path)
+
+	// Files created offline are queued and uploaded once storage is back
+	newFile := "offline_new"
+	handle, err = suite.fileCache.CreateFile(internal.CreateFileOptions{Name: newFile, Mode: 0777})
+	suite.assert.Nil(err)
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("new data")})
+	suite.assert.Nil(err)
+	err = suite.fileCache.SyncFile(internal.SyncFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(suite.fileCache.writeBack.has(newFile))
+	suite.assert.NoFileExists(filepath.Join(suite.fake_storage_path, newFile))
+
+	// Deletes are refused rather than dropping the pending upload
+	err = suite.fileCache.DeleteFile(internal.DeleteFileOptions{Name: newFile})
+	suite.assert.NotNil(err)
+
+	atomic.StoreInt32(&fs.down, 0)
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.offline() && !suite.fileCache.writeBack.has(newFile)
+	}, 5*time.Second, 10*time.Millisecond)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, newFile))
+	suite.assert.EqualValues("new data", storage)
+}
+
+func (suite *fileCacheTestSuite) TestOfflineModeCircuitBreaker() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+	fs := suite.setupOfflineFS("")
+
+	file := "offline_cached"
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, file), []byte("test data"), 0777)
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Calls failed by an open circuit breaker switch to offline mode
+	atomic.StoreInt32(&fs.tripped, 1)
+	suite.fileCache.cacheTimeout = 0
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.True(suite.fileCache.offline())
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	newFile := "offline_new"
+	handle, err = suite.fileCache.CreateFile(internal.CreateFileOptions{Name: newFile, Mode: 0777})
+	suite.assert.Nil(err)
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("new data")})
+	suite.assert.Nil(err)
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	// Probes failed by the breaker do not bring storage back online
+	time.Sleep(2500 * time.Millisecond)
+	suite.assert.True(suite.fileCache.offline())
+	suite.assert.True(suite.fileCache.writeBack.has(newFile))
+
+	atomic.StoreInt32(&fs.tripped, 0)
+	suite.assert.Eventually(func() bool {
+		return !suite.fileCache.offline() && !suite.fileCache.writeBack.has(newFile)
+	}, 5*time.Second, 10*time.Millisecond)
+	storage, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, newFile))
+	suite.assert.EqualValues("new data", storage)
+}
+
+func (suite *fileCacheTestSuite) TestOfflineConflict() {
+	defer suite.cleanupTest()
+	defer os.RemoveAll(suite.cache_path + "_writeback")
+
+	for _, policy := range []string{conflictKeepBoth, conflictKeepLocal, conflictKeepRemote} {
+		fs := suite.setupOfflineFS(fmt.Sprintf("  conflict-policy: %s\n", policy))
+
+		file := "conflict_file"
+		path := filepath.Join(suite.fake_storage_path, file)
+		os.MkdirAll(suite.fake_storage_path, 0777)
+		os.WriteFile(path, []byte("test data"), 0777)
+		handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: file, Flags: os.O_RDWR, Mode: 0777})
+		suite.assert.Nil(err)
+
+		// Changed on both sides while storage is unreachable
+		atomic.StoreInt32(&fs.down, 1)
+		_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("local data")})
+		suite.assert.Nil(err)
+		err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		suite.assert.Nil(err)
+		suite.assert.Eventually(suite.fileCache.offline, 5*time.Second, 10*time.Millisecond)
+		os.WriteFile(path, []byte("remote data!"), 0777)
+
+		atomic.StoreInt32(&fs.down, 0)
+		suite.assert.Eventually(func() bool {
+			return !suite.fileCache.writeBack.has(file)
+		}, 5*time.Second, 10*time.Millisecond)
+
+		storage, _ := os.ReadFile(path)
+		conflicts, _ := filepath.Glob(path + ".conflict-*")
+		aside, _ := os.ReadFile(filepath.Join(suite.cache_path+"_writeback", conflictDir, file))
+		switch policy {
+		case conflictKeepBoth:
+			suite.assert.EqualValues("remote data!", storage)
+			suite.assert.Len(conflicts, 1)
+			copied, _ := os.ReadFile(conflicts[0])
+			suite.assert.EqualValues("local data", copied)
+		case conflictKeepLocal:
+			suite.assert.EqualValues("local data", storage)
+			suite.assert.Empty(conflicts)
+		case conflictKeepRemote:
+			suite.assert.EqualValues("remote data!", storage)
+			suite.assert.Empty(conflicts)
+			suite.assert.EqualValues("local data", aside)
+		}
+		os.RemoveAll(suite.cache_path + "_writeback")
+	}
+}
+
+func (suite *fileCacheTestSuite) TestIsOfflineError() {
+	defer suite.cleanupTest()
+
+	suite.assert.True(isOfflineError(errStorageOffline))
+	suite.assert.True(isOfflineError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}))
+	suite.assert.True(isOfflineError(fmt.Errorf("get attr failed [%w]", &net.DNSError{Err: "no such host", IsNotFound: true})))
+	suite.assert.True(isOfflineError(context.DeadlineExceeded))
+	suite.assert.True(isOfflineError(syscall.ENOTCONN))
+	suite.assert.False(isOfflineError(nil))
+	suite.assert.False(isOfflineError(syscall.ENOENT))
+	suite.assert.False(isOfflineError(syscall.EIO))
+}
+
+func (suite *fileCacheTestSuite) TestMatchPath() {
+	defer suite.cleanupTest()
+
+	suite.assert.True(matchPath("models", "models/v1/weights"))
+	suite.assert.True(matchPath("models/*/weights", "models/v1/weights"))
+	suite.assert.True(matchPath("**/*.bin", "a/b/c.bin"))
+	suite.assert.True(matchPath("**/*.bin", "c.bin"))
+	suite.assert.True(matchPath("data/**/ref", "data/x/y/ref/file"))
+	suite.assert.False(matchPath("models/*/weights", "models/v1/v2/weights"))
+	suite.assert.False(matchPath("*.bin", "a/c.bin"))
+	suite.assert.False(matchPath("model", "models/weights"))
+}
+
+func (suite *fileCacheTestSuite) TestPinXattr() {
+	defer suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  pin-paths:\n    - keep/**\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.cleanupTest()
+	suite.setupTestHelper(config)
+
+	value, err := suite.fileCache.GetXattr(internal.GetXattrOptions{Name: "keep/file", Attr: pinXattr})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues("1", value)
+	// Pins from config rules can not be removed at runtime
+	err = suite.fileCache.RemoveXattr(internal.RemoveXattrOptions{Name: "keep/file", Attr: pinXattr})
+	suite.assert.Equal(syscall.ENODATA, err)
+
+	_, err = suite.fileCache.GetXattr(internal.GetXattrOptions{Name: "dir/file", Attr: pinXattr})
+	suite.assert.Equal(syscall.ENODATA, err)
+	err = suite.fileCache.SetXattr(internal.SetXattrOptions{Name: "dir", Attr: pinXattr, Value: []byte("1")})
+	suite.assert.Nil(err)
+	value, err = suite.fileCache.GetXattr(internal.GetXattrOptions{Name: "dir/file", Attr: pinXattr})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues("1", value)
+
+	err = suite.fileCache.RemoveXattr(internal.RemoveXattrOptions{Name: "dir", Attr: pinXattr})
+	suite.assert.Nil(err)
+	suite.assert.False(suite.fileCache.pins.pinned("dir/file"))
+	err = suite.fileCache.RemoveXattr(internal.RemoveXattrOptions{Name: "dir", Attr: pinXattr})
+	suite.assert.Equal(syscall.ENODATA, err)
+}
+
+func (suite *fileCacheTestSuite) TestPinSurvivesRenameAndRemount() {
+	defer suite.cleanupTest()
+
+	err := suite.fileCache.SetXattr(internal.SetXattrOptions{Name: "src/", Attr: pinXattr, Value: []byte("1")})
+	suite.assert.Nil(err)
+	err = suite.fileCache.SetXattr(internal.SetXattrOptions{Name: "file", Attr: pinXattr, Value: []byte("1")})
+	suite.assert.Nil(err)
+
+	// Pins move along with the renamed directory and file
+	os.MkdirAll(filepath.Join(suite.fake_storage_path, "src"), 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "src", "a"), []byte("data"), 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), []byte("data"), 0777)
+	err = suite.fileCache.RenameDir(internal.RenameDirOptions{Src: "src", Dst: "dst"})
+	suite.assert.Nil(err)
+	err = suite.fileCache.RenameFile(internal.RenameFileOptions{Src: "file", Dst: "renamed"})
+	suite.assert.Nil(err)
+	suite.assert.False(suite.fileCache.pins.pinned("src/a"))
+	suite.assert.True(suite.fileCache.pins.pinned("dst/a"))
+	suite.assert.False(suite.fileCache.pins.pinned("file"))
+	suite.assert.True(suite.fileCache.pins.pinned("renamed"))
+
+	// and are restored on remount
+	suite.remount(suite.loopback)
+	suite.assert.True(suite.fileCache.pins.pinned("dst/a"))
+	suite.assert.True(suite.fileCache.pins.pinned("renamed"))
+	suite.assert.False(suite.fileCache.pins.pinned("src/a"))
+
+	err = suite.fileCache.RemoveXattr(internal.RemoveXattrOptions{Name: "renamed", Attr: pinXattr})
+	suite.assert.Nil(err)
+	suite.remount(suite.loopback)
+	suite.assert.False(suite.fileCache.pins.pinned("renamed"))
+	suite.assert.True(suite.fileCache.pins.pinned("dst/a"))
+}
+
+func (suite *fileCacheTestSuite) TestPrefetch() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	files := []string{"data/a.bin", "data/sub/b.bin", "data/c.txt", "listed/d.txt", "other/e.txt", "other/f.txt"}
+	for _, file := range files {
+		path := filepath.Join(suite.fake_storage_path, file)
+		os.MkdirAll(filepath.Dir(path), 0777)
+		os.WriteFile(path, []byte("test data"), 0777)
+	}
+	list := filepath.Join(suite.fake_storage_path, "..", "prefetch_list")
+	os.WriteFile(list, []byte("# explicit list\nlisted/d.txt\n"), 0777)
+	defer os.Remove(list)
+
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  prefetch-paths:\n    - data/**/*.bin\n  prefetch-list: %s\n  prefetch-parallelism: 2\n  timeout-sec: 120\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, list, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+
+	cached := func(names ...string) func() bool {
+		return func() bool {
+			for _, name := range names {
+				if _, err := os.Stat(filepath.Join(suite.cache_path, name)); err != nil {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	suite.assert.Eventually(cached("data/a.bin", "data/sub/b.bin", "listed/d.txt"), 5*time.Second, 10*time.Millisecond)
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "data/c.txt"))
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "other/e.txt"))
+
+	// Runtime request for a directory
+	err := suite.fileCache.SetXattr(internal.SetXattrOptions{Name: "other", Attr: prefetchXattr, Value: []byte("1")})
+	suite.assert.Nil(err)
+	suite.assert.Eventually(cached("other/e.txt", "other/f.txt"), 5*time.Second, 10*time.Millisecond)
+
+	// No handle is left open and the file is served from cache
+	suite.assert.EqualValues(0, suite.fileCache.fileLocks.Get("other/e.txt").Count())
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "other/e.txt", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	data, _ := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.EqualValues("test data", data)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestUsageAccounting() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 120\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+
+	usage := func() (int64, int64) {
+		return suite.fileCache.usage.get()
+	}
+
+	path := "usage"
+	handle, err := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: path, Mode: 0777})
+	suite.assert.Nil(err)
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: make([]byte, 1024*1024)})
+	suite.assert.Nil(err)
+	bytes, files := usage()
+	suite.assert.EqualValues(1024*1024, bytes)
+	suite.assert.EqualValues(1, files)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	err = suite.fileCache.TruncateFile(internal.TruncateFileOptions{Name: path, Size: 4096})
+	suite.assert.Nil(err)
+	bytes, files = usage()
+	suite.assert.EqualValues(4096, bytes)
+	suite.assert.EqualValues(1, files)
+
+	err = suite.fileCache.RenameFile(internal.RenameFileOptions{Src: path, Dst: path + "_new"})
+	suite.assert.Nil(err)
+	bytes, files = usage()
+	suite.assert.EqualValues(4096, bytes)
+	suite.assert.EqualValues(1, files)
+
+	err = suite.fileCache.DeleteFile(internal.DeleteFileOptions{Name: path + "_new"})
+	suite.assert.Nil(err)
+	suite.assert.Eventually(func() bool {
+		bytes, files = usage()
+		return bytes == 0 && files == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Statfs reports the accounted usage against the configured size
+	suite.fileCache.maxCacheSize = 4
+	handle, _ = suite.fileCache.CreateFile(internal.CreateFileOptions{Name: path, Mode: 0777})
+	suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: make([]byte, 1024*1024)})
+	stat, ret, err := suite.fileCache.StatFs()
+	suite.assert.Nil(err)
+	suite.assert.True(ret)
+	suite.assert.EqualValues(3*1024*1024, stat.Bavail*uint64(stat.Frsize))
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestConfigAdaptivePolicies() {
+	defer suite.cleanupTest()
+	for _, policy := range []string{"arc", "gdsf"} {
+		suite.cleanupTest()
+		config := fmt.Sprintf("file_cache:\n  path: %s\n  policy: %s\n  max-size-mb: 10\n  policy-trace: true\n  timeout-sec: 120\n\nloopbackfs:\n  path: %s",
+			suite.cache_path, policy, suite.fake_storage_path)
+		suite.setupTestHelper(config)
+		suite.assert.Equal(policy, suite.fileCache.policy.Name())
+
+		// Files go through the policy like with lru
+		handle, err := suite.fileCache.CreateFile(internal.CreateFileOptions{Name: "file", Mode: 0777})
+		suite.assert.Nil(err)
+		suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		suite.assert.True(suite.fileCache.policy.IsCached(filepath.Join(suite.cache_path, "file")))
+	}
+}
+
+func (suite *fileCacheTestSuite) TestTiers() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	tier1 := suite.cache_path + "_tier1"
+	tier2 := suite.cache_path + "_tier2"
+	defer os.RemoveAll(tier1)
+	defer os.RemoveAll(tier2)
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "small"), []byte("small file"), 0777)
+	for i := 0; i < 6; i++ {
+		os.WriteFile(filepath.Join(suite.fake_storage_path, fmt.Sprintf("big%d", i)), make([]byte, 256*1024), 0777)
+	}
+
+	config := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 0\n  memory-tier-mb: 1\n  memory-tier-file-kb: 4\n  tiers:\n    - path: %s\n      max-size-mb: 1\n    - path: %s\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, tier1, tier2, suite.fake_storage_path)
+	suite.setupTestHelper(config)
+	suite.assert.Len(suite.fileCache.tiers, 3)
+
+	use := func(name string) []byte {
+		handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: name, Flags: os.O_RDONLY, Mode: 0777})
+		suite.assert.Nil(err)
+		data, _ := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+		suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		return data
+	}
+	evicted := func(name string) {
+		suite.assert.Eventually(func() bool {
+			_, err := os.Stat(filepath.Join(suite.cache_path, name))
+			return os.IsNotExist(err)
+		}, 5*time.Second, 10*time.Millisecond)
+	}
+
+	// Small file goes to memory, a larger one to the first tier on disk
+	use("small")
+	evicted("small")
+	suite.assert.NoFileExists(filepath.Join(tier1, "small"))
+	use("big0")
+	evicted("big0")
+	suite.assert.FileExists(filepath.Join(tier1, "big0"))
+
+	// Moved back on their next use
+	suite.assert.EqualValues("small file", use("small"))
+	suite.assert.EqualValues(make([]byte, 256*1024), use("big0"))
+	suite.assert.NoFileExists(filepath.Join(tier1, "big0"))
+	evicted("big0")
+
+	// First tier over its high threshold moves the files it took first to the next tier
+	for i := 1; i < 6; i++ {
+		use(fmt.Sprintf("big%d", i))
+		evicted(fmt.Sprintf("big%d", i))
+	}
+	suite.assert.FileExists(filepath.Join(tier2, "big0"))
+	suite.assert.FileExists(filepath.Join(tier1, "big5"))
+
+	// Copy older than the blob is not used
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "big5"), []byte("changed"), 0777)
+	suite.assert.EqualValues("changed", use("big5"))
+	suite.assert.NoFileExists(filepath.Join(tier1, "big5"))
+
+	// Deleted from the tiers along with the blob
+	err := suite.fileCache.DeleteFile(internal.DeleteFileOptions{Name: "big0"})
+	suite.assert.Nil(err)
+	suite.assert.NoFileExists(filepath.Join(tier2, "big0"))
+}
+
+func (suite *fileCacheTestSuite) TestMemoryTierOverflow() {
+	defer suite.cleanupTest()
+	tier := suite.cache_path + "_tier1"
+	defer os.RemoveAll(tier)
+
+	memory := newMemoryTier(8, 8)
+	memory.next = newDiskTier(TierOptions{Path: tier})
+	mtime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	take := func(name string) {
+		localPath := filepath.Join(suite.cache_path, name)
+		os.WriteFile(localPath, []byte("12345"), 0644)
+		os.Chtimes(localPath, mtime, mtime)
+		info, _ := os.Lstat(localPath)
+		suite.assert.True(memory.take(name, localPath, info))
+	}
+
+	// File pushed out of memory moves to the disk tier instead of being dropped
+	take("first")
+	take("second")
+	suite.assert.False(memory.list.has("first"))
+	suite.assert.True(memory.list.has("second"))
+	suite.assert.FileExists(filepath.Join(tier, "first"))
+
+	localPath := filepath.Join(suite.cache_path, "first")
+	suite.assert.True(memory.next.give("first", localPath, 5, mtime))
+	data, _ := os.ReadFile(localPath)
+	suite.assert.EqualValues("12345", data)
+}
+
+func (suite *fileCacheTestSuite) TestSharedCache() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), []byte("shared"), 0777)
+
+	conf := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 0\n  shared-cache: true\n\nloopbackfs:\n  path: %s\n\nazstorage:\n  account-name: account\n  container: container",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(conf)
+	localPath := filepath.Join(suite.cache_path, "account", "container", "file")
+	suite.assert.Equal(filepath.Dir(localPath), suite.fileCache.tmpPath)
+
+	// Second mount of the same container
+	other := newTestFileCache(suite.loopback)
+	err := other.Start(context.Background())
+	suite.assert.Nil(err)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	info, _ := os.Stat(localPath)
+
+	// Copy downloaded by the first mount is reused by the second one
+	otherHandle, err := other.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	otherInfo, _ := os.Stat(localPath)
+	suite.assert.True(os.SameFile(info, otherInfo))
+
+	// Not evicted by the first mount while the second one has it open
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Never(func() bool {
+		_, err := os.Stat(localPath)
+		return os.IsNotExist(err)
+	}, time.Second, 10*time.Millisecond)
+
+	other.CloseFile(internal.CloseFileOptions{Handle: otherHandle})
+	suite.assert.Eventually(func() bool {
+		_, err := os.Stat(localPath)
+		return os.IsNotExist(err)
+	}, 5*time.Second, 10*time.Millisecond)
+	_ = other.Stop()
+
+	// Cache state kept by one mount only is not allowed
+	conf = fmt.Sprintf("file_cache:\n  path: %s\n  shared-cache: true\n  write-back: true\n\nazstorage:\n  account-name: account\n  container: container", suite.cache_path)
+	config.ReadConfigFromReader(strings.NewReader(conf))
+	err = NewFileCacheComponent().Configure(true)
+	suite.assert.NotNil(err)
+	suite.assert.Contains(err.Error(), "write-back")
+
+	conf = fmt.Sprintf("file_cache:\n  path: %s\n  shared-cache: true", suite.cache_path)
+	config.ReadConfigFromReader(strings.NewReader(conf))
+	err = NewFileCacheComponent().Configure(true)
+	suite.assert.NotNil(err)
+}
+
+func (suite *fileCacheTestSuite) TestSharedCacheEviction() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	data := make([]byte, 600*1024)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), data, 0777)
+
+	conf := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 1000\n  max-size-mb: 1\n  shared-cache: true\n\nloopbackfs:\n  path: %s\n\nazstorage:\n  account-name: account\n  container: container",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(conf)
+
+	// File cached earlier by a mount of another container
+	otherPath := filepath.Join(suite.cache_path, "account", "other", "file")
+	os.MkdirAll(filepath.Dir(otherPath), 0777)
+	os.WriteFile(otherPath, data, 0777)
+	suite.fileCache.shared.touch(otherPath, time.Now().Add(-time.Hour))
+	suite.fileCache.usage.reconcile()
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	err = suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+
+	// Least recently used file goes first, whichever mount cached it
+	suite.fileCache.evictShared()
+	_, err = os.Stat(otherPath)
+	suite.assert.True(os.IsNotExist(err))
+	localPath := filepath.Join(suite.fileCache.tmpPath, "file")
+	_, err = os.Stat(localPath)
+	suite.assert.Nil(err)
+
+	index := make(map[string]int64)
+	raw, err := os.ReadFile(filepath.Join(suite.cache_path, sharedLockDir, sharedIndexFile))
+	suite.assert.Nil(err)
+	suite.assert.Nil(json.Unmarshal(raw, &index))
+	suite.assert.Contains(index, "account/container/file")
+	suite.assert.NotContains(index, "account/other/file")
+}
+
+func (suite *fileCacheTestSuite) TestEncryption() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	keyFile := suite.cache_path + "_key"
+	defer os.Remove(keyFile)
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	data := make([]byte, 200*1024)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), data, 0777)
+	key := make([]byte, encryptKeySize)
+	rand.Read(key)
+	os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(key)), 0600)
+
+	conf := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 1000\n  encryption: true\n  encryption-key-file: %s\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, keyFile, suite.fake_storage_path)
+	suite.setupTestHelper(conf)
+	suite.assert.NotNil(suite.fileCache.cipher)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.False(handle.Cached())
+	suite.assert.EqualValues(len(data), handle.Size)
+
+	// Cached copy is not the content
+	localPath := filepath.Join(suite.cache_path, "file")
+	cached, _ := os.ReadFile(localPath)
+	suite.assert.EqualValues(suite.fileCache.cipher.diskSize(int64(len(data))), len(cached))
+	suite.assert.False(strings.Contains(string(cached), string(data[:64])))
+
+	// Read across a chunk boundary
+	buf := make([]byte, 1000)
+	n, err := suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: encryptChunkSize - 500, Data: buf})
+	suite.assert.Nil(err)
+	suite.assert.Equal(1000, n)
+	suite.assert.EqualValues(data[encryptChunkSize-500:encryptChunkSize+500], buf)
+
+	// Write within the file and past its end, the gap reads as zeros
+	copy(data[100:], []byte("hello"))
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 100, Data: []byte("hello")})
+	suite.assert.Nil(err)
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: int64(len(data)) + 10, Data: []byte("world")})
+	suite.assert.Nil(err)
+	data = append(data, append(make([]byte, 10), []byte("world")...)...)
+
+	attr, err := suite.fileCache.GetAttr(internal.GetAttrOptions{Name: "file"})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(len(data), attr.Size)
+
+	// Storage gets the content
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	stored, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, "file"))
+	suite.assert.EqualValues(data, stored)
+
+	// Truncate in the middle of a chunk
+	err = suite.fileCache.TruncateFile(internal.TruncateFileOptions{Name: "file", Size: encryptChunkSize + 10})
+	suite.assert.Nil(err)
+	read, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues(data[:encryptChunkSize+10], read)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Tampered chunk fails to read
+	f, _ := os.OpenFile(localPath, os.O_RDWR, 0)
+	f.WriteAt([]byte{0xff}, 20)
+	f.Close()
+	handle, err = suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	_, err = suite.fileCache.ReadInBuffer(internal.ReadInBufferOptions{Handle: handle, Offset: 0, Data: buf})
+	suite.assert.Equal(syscall.EIO, err)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Plain copies are not staged on disk
+	staging := suite.cache_path + "_staging"
+	defer os.RemoveAll(staging)
+	conf = fmt.Sprintf("file_cache:\n  path: %s\n  allow-non-empty-temp: true\n  encryption: true\n  encryption-staging-path: %s", suite.cache_path, staging)
+	config.ReadConfigFromReader(strings.NewReader(conf))
+	err = NewFileCacheComponent().Configure(true)
+	suite.assert.NotNil(err)
+	suite.assert.Contains(err.Error(), "encryption-staging-path")
+
+	// Features reading cached files directly are not allowed
+	conf = fmt.Sprintf("file_cache:\n  path: %s\n  allow-non-empty-temp: true\n  encryption: true\n  sparse-cache: true", suite.cache_path)
+	config.ReadConfigFromReader(strings.NewReader(conf))
+	err = NewFileCacheComponent().Configure(true)
+	suite.assert.NotNil(err)
+	suite.assert.Contains(err.Error(), "sparse-cache")
+}
+
+func (suite *fileCacheTestSuite) TestEncryptionEarlierFiles() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), []byte("content"), 0777)
+
+	// Plain copy cached by an earlier mount without encryption
+	os.MkdirAll(suite.cache_path, 0777)
+	os.WriteFile(filepath.Join(suite.cache_path, "file"), []byte("content"), 0777)
+
+	conf := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 1000\n  allow-non-empty-temp: true\n  encryption: true\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(conf)
+	suite.assert.True(isLocalDirEmpty(suite.cache_path))
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDONLY, Mode: 0777})
+	suite.assert.Nil(err)
+	read, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.EqualValues("content", read)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestEncryptionLargeFile() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	// Spans several ranges downloaded in parallel, the last one partial
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	data := make([]byte, 2*encryptDownloadChunks*encryptChunkSize+3*encryptChunkSize+100)
+	rand.Read(data)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), data, 0777)
+
+	conf := fmt.Sprintf("file_cache:\n  path: %s\n  timeout-sec: 1000\n  encryption: true\n\nloopbackfs:\n  path: %s",
+		suite.cache_path, suite.fake_storage_path)
+	suite.setupTestHelper(conf)
+	suite.assert.Equal(defaultEncryptStagingPath, suite.fileCache.cipher.staging)
+
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "file", Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	read, err := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	suite.assert.True(bytes.Equal(data, read))
+
+	// Upload goes through a decrypted copy in staging which is gone afterwards
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("hello")})
+	suite.assert.Nil(err)
+	copy(data, []byte("hello"))
+	err = suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+	stored, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, "file"))
+	suite.assert.True(bytes.Equal(data, stored))
+	staged, _ := filepath.Glob(filepath.Join(suite.fileCache.cipher.staging, ".blobfuse2-upload-*"))
+	suite.assert.Empty(staged)
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+}
+
+func (suite *fileCacheTestSuite) TestChecksum() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	data := []byte("content of the blob")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "file"), data, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "other"), data, 0777)
+
+	conf := "file_cache:\n  path: %s\n  timeout-sec: 1000\n  verify-checksum: true\n  verify-on-open: true\n%s\nloopbackfs:\n  path: %s"
+	suite.setupTestHelper(fmt.Sprintf(conf, suite.cache_path, "", suite.fake_storage_path))
+
+	use := func(name string, flags int) []byte {
+		handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: name, Flags: flags, Mode: 0777})
+		suite.assert.Nil(err)
+		read, _ := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+		suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		return read
+	}
+	corrupt := func(name string) {
+		f, _ := os.OpenFile(filepath.Join(suite.cache_path, name), os.O_RDWR, 0)
+		f.WriteAt([]byte("X"), 0)
+		f.Close()
+	}
+
+	// Checksum is recorded on download and the copy is downloaded again on open once it fails
+	use("file", os.O_RDONLY)
+	localPath := filepath.Join(suite.cache_path, "file")
+	verified, err := verifyChecksum(localPath)
+	suite.assert.True(verified)
+	suite.assert.Nil(err)
+	corrupt("file")
+	suite.assert.EqualValues(data, use("file", os.O_RDONLY))
+
+	// Offline scan reports and deletes corrupt files
+	use("other", os.O_RDONLY)
+	corrupt("other")
+	result, err := VerifyCache(suite.cache_path, false)
+	suite.assert.Nil(err)
+	suite.assert.Equal(1, result.Verified)
+	suite.assert.Equal([]string{filepath.Join(suite.cache_path, "other")}, result.Corrupt)
+	_, err = VerifyCache(suite.cache_path, true)
+	suite.assert.Nil(err)
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "other"))
+
+	// File opened for writing is not the downloaded content anymore
+	use("file", os.O_RDWR)
+	result, err = VerifyCache(suite.cache_path, false)
+	suite.assert.Nil(err)
+	suite.assert.Equal(1, result.Unverified)
+	suite.assert.Empty(result.Corrupt)
+
+	// Download not matching the MD5 of the blob is rejected
+	err = suite.fileCache.checkDownload("file", localPath, &internal.ObjAttr{MD5: []byte("not the md5 of it")})
+	suite.assert.Equal(errChecksumMismatch, err)
+
+	// Background scan evicts a corrupt file
+	suite.cleanupTest()
+	os.MkdirAll(suite.fake_storage_path, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "other"), data, 0777)
+	suite.setupTestHelper(fmt.Sprintf(conf, suite.cache_path, "  verify-interval-sec: 1\n", suite.fake_storage_path))
+	use("other", os.O_RDONLY)
+	corrupt("other")
+	suite.assert.Eventually(func() bool {
+		_, err := os.Stat(filepath.Join(suite.cache_path, "other"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+// stagingFS : Writes the blocks of committed block lists to loopback, and counts writes sent to storage one by one
+type stagingFS struct {
+	internal.Component
+	path    string
+	commits int
+	writes  int
+}
+
+func (fs *stagingFS) FlushFile(options internal.FlushFileOptions) error {
+	if options.Handle.CacheObj == nil {
+		return fs.Component.FlushFile(options)
+	}
+
+	f, err := os.OpenFile(filepath.Join(fs.path, options.Handle.Path), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bol := options.Handle.CacheObj.BlockOffsetList
+	for _, blk := range bol.BlockList {
+		if blk.Dirty() {
+			f.WriteAt(blk.Data, blk.StartIndex)
+			blk.Flags.Clear(common.DirtyBlock)
+		}
+	}
+	fs.commits++
+	return f.Truncate(bol.BlockList[len(bol.BlockList)-1].EndIndex)
+}
+
+func (fs *stagingFS) WriteFile(options internal.WriteFileOptions) (int, error) {
+	fs.writes++
+	return fs.Component.WriteFile(options)
+}
+
+func (suite *fileCacheTestSuite) TestQuotasAndAdmission() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+
+	os.MkdirAll(filepath.Join(suite.fake_storage_path, "jobs"), 0777)
+	data := []byte("content of the blob")
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "jobs", "a"), data, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "jobs", "b"), data, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "scratch.tmp"), data, 0777)
+	os.WriteFile(filepath.Join(suite.fake_storage_path, "large"), make([]byte, 1024), 0777)
+
+	conf := "file_cache:\n  path: %s\n  timeout-sec: 1000\n  quotas:\n    - prefix: jobs\n      max-files: 1\n" +
+		"  admission-max-file-mb: 0.0001\n  admission-exclude:\n    - \"*.tmp\"\nloopbackfs:\n  path: %s"
+	suite.setupTestHelper(fmt.Sprintf(conf, suite.cache_path, suite.fake_storage_path))
+
+	use := func(name string) []byte {
+		handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: name, Flags: os.O_RDONLY, Mode: 0777})
+		suite.assert.Nil(err)
+		read, _ := suite.fileCache.ReadFile(internal.ReadFileOptions{Handle: handle})
+		suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+		return read
+	}
+
+	// File opened longest ago under the prefix is evicted once the quota is exceeded
+	use("jobs/a")
+	suite.assert.FileExists(filepath.Join(suite.cache_path, "jobs", "a"))
+	use("jobs/b")
+	suite.assert.Eventually(func() bool {
+		_, err := os.Stat(filepath.Join(suite.cache_path, "jobs", "a"))
+		return os.IsNotExist(err)
+	}, 5*time.Second, 50*time.Millisecond)
+	suite.assert.FileExists(filepath.Join(suite.cache_path, "jobs", "b"))
+
+	// Excluded and large files are served from storage without a local copy
+	suite.assert.EqualValues(data, use("scratch.tmp"))
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "scratch.tmp"))
+	suite.assert.EqualValues(make([]byte, 1024), use("large"))
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "large"))
+
+	// Excluded file opened to change it in place is cached
+	handle, err := suite.fileCache.OpenFile(internal.OpenFileOptions{Name: "scratch.tmp", Flags: os.O_RDWR, Mode: 0777})
+	suite.assert.Nil(err)
+	suite.assert.False(bypassed(handle))
+	suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle})
+
+	// Writes to an excluded file are uploaded in blocks as they fill up
+	fs := &stagingFS{Component: suite.loopback, path: suite.fake_storage_path}
+	suite.remount(fs)
+	handle, err = suite.fileCache.CreateFile(internal.CreateFileOptions{Name: "new.tmp", Mode: 0777})
+	suite.assert.Nil(err)
+	content := make([]byte, bypassBlockSize+MB)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	for offset := 0; offset < len(content); offset += 128 * 1024 {
+		_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: int64(offset), Data: content[offset : offset+128*1024]})
+		suite.assert.Nil(err)
+	}
+	suite.assert.Equal(1, fs.commits)
+	suite.assert.Nil(suite.fileCache.FlushFile(internal.FlushFileOptions{Handle: handle}))
+	suite.assert.Equal(2, fs.commits)
+	suite.assert.Equal(0, fs.writes)
+	written, _ := os.ReadFile(filepath.Join(suite.fake_storage_path, "new.tmp"))
+	suite.assert.EqualValues(content, written)
+
+	// Write to a block uploaded already goes to storage on its own
+	_, err = suite.fileCache.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: data})
+	suite.assert.Nil(err)
+	suite.assert.Equal(1, fs.writes)
+	suite.assert.Nil(suite.fileCache.CloseFile(internal.CloseFileOptions{Handle: handle}))
+	suite.assert.NoFileExists(filepath.Join(suite.cache_path, "new.tmp"))
+	written, _ = os.ReadFile(filepath.Join(suite.fake_storage_path, "new.tmp"))
+	suite.assert.EqualValues(data, written[:len(data)])
+	suite.assert.EqualValues(content[len(data):], written[len(data):])
+
+	// Bad quotas are rejected
+	fc := NewFileCacheComponent().(*FileCache)
+	config.ReadConfigFromReader(strings.NewReader("file_cache:\n  path: " + suite.cache_path +
+		"\n  allow-non-empty-temp: true\n  quotas:\n    - prefix: jobs\n"))
+	suite.assert.NotNil(fc.Configure(true))
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestFileCacheTestSuite(t *testing.T) {
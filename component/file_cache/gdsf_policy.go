@@ -0,0 +1,300 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"container/heap"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+)
+
+// Files smaller than this are weighed as if they were this large, a file just created is usually still empty
+const gdsfMinSize = 4096
+
+type gdsfEntry struct {
+	name      string
+	frequency uint64
+	size      int64
+	priority  float64
+	lastUsed  time.Time
+	index     int // Position in the heap, -1 once picked for eviction
+}
+
+// gdsfHeap : Cached files with the lowest priority first
+type gdsfHeap []*gdsfEntry
+
+func (h gdsfHeap) Len() int           { return len(h) }
+func (h gdsfHeap) Less(i, j int) bool { return h[i].priority < h[j].priority }
+
+func (h gdsfHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *gdsfHeap) Push(x interface{}) {
+	entry := x.(*gdsfEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *gdsfHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	entry.index = -1
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// gdsfPolicy : Greedy-Dual-Size-Frequency. Priority of a file is the number of times it was used divided by its size,
+// plus the priority of the last evicted file at its last use, and the file with the lowest priority is evicted first.
+// Small files which are used often stay, large files read once go first, and files that were popular long ago age out.
+type gdsfPolicy struct {
+	sync.Mutex
+	cachePolicyConfig
+
+	entries map[string]*gdsfEntry
+	heap    gdsfHeap
+	clock   float64 // Priority of the last evicted file
+
+	evictor *evictor
+}
+
+var _ cachePolicy = &gdsfPolicy{}
+
+func NewGDSFPolicy(cfg cachePolicyConfig) cachePolicy {
+	pol := &gdsfPolicy{
+		cachePolicyConfig: cfg,
+		entries:           make(map[string]*gdsfEntry),
+	}
+	pol.evictor = newEvictor("gdsfPolicy", &pol.cachePolicyConfig, pol)
+	return pol
+}
+
+func (p *gdsfPolicy) StartPolicy() error {
+	log.Trace("gdsfPolicy::StartPolicy")
+
+	p.evictor.start()
+	return nil
+}
+
+func (p *gdsfPolicy) ShutdownPolicy() error {
+	log.Trace("gdsfPolicy::ShutdownPolicy")
+
+	p.evictor.shutdown()
+	return nil
+}
+
+func (p *gdsfPolicy) UpdateConfig(c cachePolicyConfig) error {
+	log.Trace("gdsfPolicy::UpdateConfig")
+
+	p.Lock()
+	defer p.Unlock()
+
+	p.maxSizeMB = c.maxSizeMB
+	p.highThreshold = c.highThreshold
+	p.lowThreshold = c.lowThreshold
+	p.maxEviction = c.maxEviction
+	p.policyTrace = c.policyTrace
+	return nil
+}
+
+func (p *gdsfPolicy) CacheValid(name string) {
+	log.Trace("gdsfPolicy::CacheValid : %s", name)
+
+	size := int64(0)
+	if info, err := os.Stat(name); err == nil {
+		size = info.Size()
+	}
+
+	p.Lock()
+	entry, found := p.entries[name]
+	if !found {
+		entry = &gdsfEntry{name: name, index: -1}
+		p.entries[name] = entry
+	}
+	added := entry.index < 0
+	entry.frequency++
+	entry.size = size
+	entry.lastUsed = time.Now()
+	p.prioritize(entry)
+	p.Unlock()
+
+	if added {
+		p.evictor.checkUsage()
+	}
+}
+
+func (p *gdsfPolicy) CacheInvalidate(name string) {
+	log.Trace("gdsfPolicy::CacheInvalidate : %s", name)
+
+	if p.cacheTimeout == 0 {
+		p.CachePurge(name)
+	}
+}
+
+func (p *gdsfPolicy) CachePurge(name string) {
+	log.Trace("gdsfPolicy::CachePurge : %s", name)
+
+	p.Lock()
+	if entry, found := p.entries[name]; found {
+		if entry.index >= 0 {
+			heap.Remove(&p.heap, entry.index)
+		}
+		delete(p.entries, name)
+	}
+	p.Unlock()
+
+	p.evictor.purge(name)
+}
+
+func (p *gdsfPolicy) IsCached(name string) bool {
+	log.Trace("gdsfPolicy::IsCached : %s", name)
+
+	p.Lock()
+	defer p.Unlock()
+
+	entry, found := p.entries[name]
+	return found && entry.index >= 0
+}
+
+func (p *gdsfPolicy) Name() string {
+	return "gdsf"
+}
+
+// prioritize : Set the priority of the file as of now and place it in the heap, requires Lock()
+func (p *gdsfPolicy) prioritize(entry *gdsfEntry) {
+	size := entry.size
+	if size < gdsfMinSize {
+		size = gdsfMinSize
+	}
+	entry.priority = p.clock + float64(entry.frequency)*1024/float64(size)
+
+	if entry.index < 0 {
+		heap.Push(&p.heap, entry)
+	} else {
+		heap.Fix(&p.heap, entry.index)
+	}
+}
+
+// victim : File with the lowest priority, its priority becomes the base for the files used after it
+func (p *gdsfPolicy) victim() (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Pinned files are passed over and put back once the victim is found
+	skipped := make([]*gdsfEntry, 0)
+	defer func() {
+		for _, entry := range skipped {
+			heap.Push(&p.heap, entry)
+		}
+	}()
+
+	for p.heap.Len() > 0 {
+		entry := heap.Pop(&p.heap).(*gdsfEntry)
+		if p.pinned(entry.name) {
+			skipped = append(skipped, entry)
+			continue
+		}
+		p.clock = entry.priority
+		return entry.name, true
+	}
+	return "", false
+}
+
+func (p *gdsfPolicy) expired(timeout time.Duration, maxCount uint32) []string {
+	p.Lock()
+	defer p.Unlock()
+
+	names := make([]string, 0)
+	for i := 0; i < p.heap.Len() && uint32(len(names)) < maxCount; {
+		if time.Since(p.heap[i].lastUsed) < timeout || p.pinned(p.heap[i].name) {
+			i++
+			continue
+		}
+		// Element at i is replaced by another one, so look at i again
+		names = append(names, heap.Remove(&p.heap, i).(*gdsfEntry).name)
+	}
+	return names
+}
+
+func (p *gdsfPolicy) keep(name string) {
+	p.Lock()
+	defer p.Unlock()
+
+	entry, found := p.entries[name]
+	if !found {
+		entry = &gdsfEntry{name: name, frequency: 1, index: -1}
+		p.entries[name] = entry
+	}
+	entry.lastUsed = time.Now()
+	p.prioritize(entry)
+}
+
+func (p *gdsfPolicy) evicted(name string) {
+	p.Lock()
+	defer p.Unlock()
+
+	// Used again since it was picked, it is back in the heap then
+	if entry, found := p.entries[name]; found && entry.index < 0 {
+		delete(p.entries, name)
+	}
+}
+
+func (p *gdsfPolicy) printNodes() {
+	if !p.policyTrace {
+		return
+	}
+
+	p.Lock()
+	defer p.Unlock()
+
+	log.Debug("gdsfPolicy::printNodes : Starts, clock %f, %d files", p.clock, p.heap.Len())
+
+	// Heap is only partly ordered, listed from the next to be evicted
+	entries := make([]*gdsfEntry, len(p.heap))
+	copy(entries, p.heap)
+	sort.Slice(entries, func(i, j int) bool { return entries[i].priority < entries[j].priority })
+
+	for i, entry := range entries {
+		log.Debug(" ==> (%d) %s priority %f, frequency %d, size %d", i, entry.name, entry.priority, entry.frequency, entry.size)
+	}
+
+	log.Debug("gdsfPolicy::printNodes : Ends")
+}
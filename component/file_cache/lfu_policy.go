@@ -40,6 +40,7 @@ import (
 	"time"
 
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
 )
 
 type lfuPolicy struct {
@@ -136,6 +137,16 @@ func (l *lfuPolicy) clearItemFromCache(path string) {
 		azPath = azPath[1:]
 	}
 
+	if l.pins.pinned(azPath) {
+		// Gone from the cache already if purged by a delete, else it is put back in the list
+		if _, err := os.Stat(path); err == nil {
+			log.Debug("lfuPolicy::clearItemFromCache : %s is pinned, not evicting", path)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, pinnedSkips, (int64)(1))
+			l.CacheValid(path)
+		}
+		return
+	}
+
 	flock := l.fileLocks.Get(azPath)
 	if l.fileLocks.Locked(azPath) {
 		log.Warn("lfuPolicy::DeleteItem : File in under download %s", azPath)
@@ -154,9 +165,11 @@ func (l *lfuPolicy) clearItemFromCache(path string) {
 	}
 
 	// There are no open handles for this file so its safe to remove this
-	err := deleteFile(path)
+	err := l.removeFile(path)
 	if err != nil && !os.IsNotExist(err) {
 		log.Err("lfuPolicy::DeleteItem : failed to delete local file %s [%s]", path, err.Error())
+	} else {
+		l.usage.removed(path)
 	}
 
 	// File was deleted so try clearing its parent directory
@@ -187,6 +200,8 @@ func NewLFUPolicy(cfg cachePolicyConfig) cachePolicy {
 		closeChan:         make(chan int, 10),
 	}
 	pol.list = newLFUList(cfg.maxSizeMB, cfg.lowThreshold, cfg.highThreshold, pol.removeFiles, cfg.tmpPath, cfg.cacheTimeout)
+	pol.list.pins = cfg.pins
+	pol.list.usage = cfg.usage
 	return pol
 }
 
@@ -306,6 +321,25 @@ type lfuList struct {
 	cachePath    string
 	cacheAge     uint64
 	cacheTimeout uint32
+	pins         *pinSet
+	usage        *usageTracker
+}
+
+// pinned : Whether the cached file is pinned, going by its path in storage
+func (list *lfuList) pinned(key string) bool {
+	return list.pins.pinned(strings.TrimPrefix(strings.TrimPrefix(key, list.cachePath), "/"))
+}
+
+// evictable : Least frequently used file which is not pinned
+func (list *lfuList) evictable() *dataNode {
+	for freqNode := list.first; freqNode != nil; freqNode = freqNode.next {
+		for node := freqNode.list.first; node != nil; node = node.next {
+			if !list.pinned(node.key) {
+				return node
+			}
+		}
+	}
+	return nil
 }
 
 func (list *lfuList) deleteFrequency(freq uint64) {
@@ -412,15 +446,20 @@ func (list *lfuList) put(key string) {
 		list.promote(node)
 		list.setTimerIfValid(node)
 	} else {
-		if usage := getUsagePercentage(list.cachePath, list.maxSizeMB); usage > list.upperThresh {
-			for usage > list.lowerThresh && list.first != nil {
-				toDeletePath := list.first.list.first.key
-				list.first.pop()
+		if usage := getUsagePercentage(list.usage, list.maxSizeMB); usage > list.upperThresh {
+			for usage > list.lowerThresh {
+				victim := list.evictable()
+				if victim == nil {
+					break
+				}
+				toDeletePath := victim.key
+				freqNode := list.freqNodeMap[victim.frequency]
+				freqNode.remove(victim)
 				delete(list.dataNodeMap, toDeletePath)
-				if list.first.list.size == 0 {
-					list.deleteFrequency(list.first.frequency)
+				if freqNode.list.size == 0 {
+					list.deleteFrequency(freqNode.frequency)
 					list.size--
-					usage = getUsagePercentage(list.cachePath, list.maxSizeMB)
+					usage = getUsagePercentage(list.usage, list.maxSizeMB)
 				}
 				list.deleteFiles <- toDeletePath
 			}
@@ -461,7 +500,11 @@ func (list *lfuList) setTimerIfValid(node *dataNode) {
 	if list.cacheTimeout > 0 {
 		timer := time.AfterFunc(time.Duration(list.cacheTimeout)*time.Second, func() {
 			list.Lock()
-			list.delete(node.key)
+			if _, found := list.dataNodeMap[node.key]; found && list.pinned(node.key) {
+				list.setTimerIfValid(node)
+			} else {
+				list.delete(node.key)
+			}
 			list.Unlock()
 		})
 		node.timer = timer
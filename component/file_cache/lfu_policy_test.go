@@ -281,6 +281,43 @@ func (suite *lfuPolicyTestSuite) TestMaxEviction() {
 	}
 }
 
+func (suite *lfuPolicyTestSuite) TestPinned() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	os.Mkdir(cache_path, fs.FileMode(0777))
+
+	config := cachePolicyConfig{
+		tmpPath:       cache_path,
+		cacheTimeout:  1,
+		maxEviction:   defaultMaxEviction,
+		maxSizeMB:     0,
+		highThreshold: defaultMaxThreshold,
+		lowThreshold:  defaultMinThreshold,
+		fileLocks:     &common.LockMap{},
+		pins:          newPinSet([]string{"models/**"}),
+	}
+	config.pins.pin("reference")
+
+	suite.setupTestHelper(config)
+
+	names := []string{"models/weights", "reference", "scratch"}
+	os.Mkdir(cache_path+"/models", fs.FileMode(0777))
+	for _, name := range names {
+		f, _ := os.Create(cache_path + "/" + name)
+		f.Close()
+		suite.policy.CacheValid(cache_path + "/" + name)
+	}
+
+	time.Sleep(4 * time.Second) // Wait for time > cacheTimeout, only the file not pinned is evicted
+
+	suite.assert.True(suite.policy.IsCached(cache_path + "/models/weights"))
+	suite.assert.FileExists(cache_path + "/models/weights")
+	suite.assert.True(suite.policy.IsCached(cache_path + "/reference"))
+	suite.assert.FileExists(cache_path + "/reference")
+	suite.assert.False(suite.policy.IsCached(cache_path + "/scratch"))
+	suite.assert.NoFileExists(cache_path + "/scratch")
+}
+
 func TestLFUPolicyTestSuite(t *testing.T) {
 	suite.Run(t, new(lfuPolicyTestSuite))
 }
@@ -40,6 +40,7 @@ import (
 	"time"
 
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
 )
 
 type lruNode struct {
@@ -187,8 +188,9 @@ func (p *lruPolicy) IsCached(name string) bool {
 	val, found := p.nodeMap.Load(name)
 	if found {
 		node := val.(*lruNode)
-		log.Debug("lruPolicy::IsCached : %s, deleted:%t", name, node.deleted)
-		if !node.deleted {
+		deleted := p.isDeleted(node)
+		log.Debug("lruPolicy::IsCached : %s, deleted:%t", name, deleted)
+		if !deleted {
 			return true
 		}
 	}
@@ -196,6 +198,13 @@ func (p *lruPolicy) IsCached(name string) bool {
 	return false
 }
 
+// isDeleted : Nodes are marked deleted and revalidated by other goroutines so the flag is read under the lock
+func (p *lruPolicy) isDeleted(node *lruNode) bool {
+	p.Lock()
+	defer p.Unlock()
+	return node.deleted
+}
+
 func (p *lruPolicy) Name() string {
 	return "lru"
 }
@@ -277,7 +286,7 @@ func (p *lruPolicy) clearCache() {
 		case <-p.diskUsageMonitor:
 			// File cache timeout has not occurred so just monitor the cache usage
 			cleanupCount := 0
-			pUsage := getUsagePercentage(p.tmpPath, p.maxSizeMB)
+			pUsage := getUsagePercentage(p.usage, p.maxSizeMB)
 			if pUsage > p.highThreshold {
 				continueDeletion := true
 				for continueDeletion {
@@ -288,7 +297,7 @@ func (p *lruPolicy) clearCache() {
 					p.printNodes()
 					p.deleteExpiredNodes()
 
-					pUsage := getUsagePercentage(p.tmpPath, p.maxSizeMB)
+					pUsage := getUsagePercentage(p.usage, p.maxSizeMB)
 					if pUsage < p.lowThreshold || cleanupCount >= 3 {
 						log.Info("lruPolicy::ClearCache : Threshold stablized %f > %f", pUsage, p.lowThreshold)
 						continueDeletion = false
@@ -391,6 +400,10 @@ func (p *lruPolicy) deleteExpiredNodes() {
 
 	p.lastMarker.next = node
 	if node != nil {
+		// Detach the evicted run so revalidating one of its nodes does not relink the rest of the list
+		if node.prev != nil {
+			node.prev.next = nil
+		}
 		node.prev = p.lastMarker
 	}
 	p.Unlock()
@@ -398,7 +411,7 @@ func (p *lruPolicy) deleteExpiredNodes() {
 	log.Debug("lruPolicy::deleteExpiredNodes : List generated %d items", count)
 
 	for _, item := range delItems {
-		if item.deleted {
+		if p.isDeleted(item) {
 			p.removeNode(item.name)
 			p.deleteItem(item.name)
 		}
@@ -415,6 +428,11 @@ func (p *lruPolicy) deleteItem(name string) {
 		azPath = azPath[1:]
 	}
 
+	if p.pins.pinned(azPath) {
+		p.keepPinned(name)
+		return
+	}
+
 	flock := p.fileLocks.Get(azPath)
 	if p.fileLocks.Locked(azPath) {
 		log.Warn("lruPolicy::DeleteItem : File in under download %s", azPath)
@@ -433,9 +451,11 @@ func (p *lruPolicy) deleteItem(name string) {
 	}
 
 	// There are no open handles for this file so its safe to remove this
-	err := deleteFile(name)
+	err := p.removeFile(name)
 	if err != nil && !os.IsNotExist(err) {
 		log.Err("lruPolicy::DeleteItem : failed to delete local file %s [%s]", name, err.Error())
+	} else {
+		p.usage.removed(name)
 	}
 
 	// File was deleted so try clearing its parent directory
@@ -443,6 +463,18 @@ func (p *lruPolicy) deleteItem(name string) {
 	// This might require something like hierarchical locking.
 }
 
+// keepPinned : Put a pinned file back in the list instead of evicting it, unless it is gone from the cache already
+func (p *lruPolicy) keepPinned(name string) {
+	if _, err := os.Stat(name); err != nil {
+		return
+	}
+
+	log.Debug("lruPolicy::keepPinned : %s is pinned, not evicting", name)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, pinnedSkips, (int64)(1))
+	// Revalidate right away rather than through the channel so the file does not read as evicted meanwhile
+	p.cacheValidate(name)
+}
+
 func (p *lruPolicy) printNodes() {
 	if !p.policyTrace {
 		return
@@ -0,0 +1,264 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	defaultOfflineProbeInterval = 30
+
+	// How a file changed both locally and in storage is reconciled once storage is reachable again
+	conflictKeepBoth   = "keep-both"   // Upload the local copy next to the blob under a conflict name
+	conflictKeepLocal  = "keep-local"  // Overwrite the blob with the local copy
+	conflictKeepRemote = "keep-remote" // Keep the blob, move the local copy aside in the write-back directory
+
+	conflictDir = "conflicts"
+
+	stateConnected = "connected"
+	stateOffline   = "offline"
+)
+
+// errStorageOffline : Returned instead of calling storage while it is known to be unreachable
+var errStorageOffline = errors.New("storage is not reachable")
+
+// isOfflineError : Whether the error means storage could not be reached, as against storage failing the request
+func isOfflineError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Is(err, errStorageOffline) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// Errno satisfies net.Error as well, so only the network ones are taken
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case syscall.ECONNREFUSED, syscall.ECONNRESET, syscall.ECONNABORTED, syscall.EHOSTUNREACH,
+			syscall.ENETUNREACH, syscall.ENETDOWN, syscall.ETIMEDOUT, syscall.ENOTCONN:
+			// ENOTCONN is what storage fails calls with while its circuit breaker is open
+			return true
+		}
+		return false
+	}
+
+	var nerr net.Error
+	return errors.As(err, &nerr)
+}
+
+// connectivity : Tracks whether storage is reachable. Once a call fails to reach it, storage is probed periodically
+// till it answers again.
+type connectivity struct {
+	offline  int32
+	interval time.Duration
+	probe    func() error
+	onChange func(offline bool)
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newConnectivity(interval time.Duration, probe func() error, onChange func(bool)) *connectivity {
+	return &connectivity{
+		interval: interval,
+		probe:    probe,
+		onChange: onChange,
+	}
+}
+
+func (cn *connectivity) isOffline() bool {
+	return atomic.LoadInt32(&cn.offline) == 1
+}
+
+func (cn *connectivity) setOffline(err error) {
+	if !atomic.CompareAndSwapInt32(&cn.offline, 0, 1) {
+		return
+	}
+
+	log.Warn("connectivity::setOffline : Storage is not reachable, serving from local cache [%s]", err.Error())
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, connectionState, stateOffline)
+	cn.onChange(true)
+}
+
+func (cn *connectivity) setOnline() {
+	if !atomic.CompareAndSwapInt32(&cn.offline, 1, 0) {
+		return
+	}
+
+	log.Info("connectivity::setOnline : Storage is reachable again, reconciling pending uploads")
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, connectionState, stateConnected)
+	cn.onChange(false)
+}
+
+// start : Probe storage while it is offline
+func (cn *connectivity) start() {
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, connectionState, stateConnected)
+
+	cn.stop = make(chan struct{})
+	cn.wg.Add(1)
+	go func() {
+		defer cn.wg.Done()
+		ticker := time.NewTicker(cn.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-cn.stop:
+				return
+			case <-ticker.C:
+				if cn.isOffline() {
+					err := cn.probe()
+					if !isOfflineError(err) {
+						cn.setOnline()
+					}
+				}
+			}
+		}
+	}()
+}
+
+func (cn *connectivity) shutdown() {
+	if cn.stop != nil {
+		close(cn.stop)
+		cn.wg.Wait()
+	}
+}
+
+// offline : Whether storage is known to be unreachable
+func (fc *FileCache) offline() bool {
+	return fc.conn != nil && fc.conn.isOffline()
+}
+
+// checkOffline : Switch to offline mode if the error means storage could not be reached, returns true if so
+func (fc *FileCache) checkOffline(err error) bool {
+	if fc.conn == nil || !isOfflineError(err) {
+		return false
+	}
+
+	fc.conn.setOffline(err)
+	return true
+}
+
+// probeStorage : List a single item at the root, any answer from storage means it is reachable
+func (fc *FileCache) probeStorage() error {
+	_, _, err := fc.NextComponent().StreamDir(internal.StreamDirOptions{Name: "", Count: 1})
+	return err
+}
+
+// connectivityChanged : Hold background uploads while offline and resume them once storage is back
+func (fc *FileCache) connectivityChanged(offline bool) {
+	if offline {
+		fc.writeBack.pause()
+	} else {
+		fc.writeBack.resume()
+	}
+}
+
+// resolveConflict : Check the blob did not change in storage since the local copy was taken from it, else apply the
+// conflict policy. Returns true if the local copy is not to be uploaded over the blob. Caller holds the lock of the
+// file.
+func (fc *FileCache) resolveConflict(name string, localPath string) (bool, error) {
+	attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+	if err == syscall.ENOENT || os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	// Without a version of the blob to go by the file was created locally, so a blob by that name is someone else's
+	e := fc.index.get(name)
+	if e != nil && (e.ETag != "" || !e.LMT.IsZero()) && e.matches(attr) {
+		return false, nil
+	}
+
+	if fc.conflictPolicy == conflictKeepLocal {
+		log.Warn("FileCache::resolveConflict : %s changed in storage as well, overwriting it with local changes", name)
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, offlineConflicts, (int64)(1))
+		return false, nil
+	}
+
+	// Local copy goes away below, so it has to wait till nobody has it open
+	if fc.fileLocks.Get(name).Count() > 1 {
+		return false, fmt.Errorf("%s changed in storage and is open locally, conflict is resolved once it is closed", name)
+	}
+
+	if fc.conflictPolicy == conflictKeepRemote {
+		dst := filepath.Join(fc.writeBack.dir, conflictDir, name)
+		err = os.MkdirAll(filepath.Dir(dst), 0700)
+		if err == nil {
+			err = os.Rename(localPath, dst)
+		}
+		if err != nil {
+			return false, err
+		}
+		fc.usage.removed(localPath)
+		log.Warn("FileCache::resolveConflict : %s changed in storage as well, local changes moved to %s", name, dst)
+	} else {
+		f, err := os.Open(localPath)
+		if err != nil {
+			return false, err
+		}
+
+		dst := fmt.Sprintf("%s.conflict-%s", name, time.Now().Format("20060102T150405"))
+		err = fc.NextComponent().CopyFromFile(internal.CopyFromFileOptions{Name: dst, File: f})
+		f.Close()
+		if err != nil {
+			return false, err
+		}
+		log.Warn("FileCache::resolveConflict : %s changed in storage as well, local changes uploaded as %s", name, dst)
+		_ = deleteFile(localPath)
+	}
+
+	// Blob is downloaded afresh on next open
+	fc.index.remove(name)
+	fc.missedChmodList.Delete(name)
+	fc.missedTimesList.Delete(name)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, offlineConflicts, (int64)(1))
+	return true, nil
+}
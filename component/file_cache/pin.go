@@ -0,0 +1,284 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+)
+
+const (
+	// Runtime API on the mount: setting these xattrs on a path pins it or prefetches it, removing the pin xattr unpins it
+	pinXattr      = "user.blobfuse2.pin"
+	prefetchXattr = "user.blobfuse2.prefetch"
+
+	// Runtime pins are saved next to the cache directory, as the cache itself may be cleaned up on mount
+	pinFileSuffix = "_pins.json"
+)
+
+// matchPath : Whether the path or one of its parent directories matches the glob. Glob is matched a segment at a time
+// as in filepath.Match, with ** standing for any number of directories.
+func matchPath(pattern string, name string) bool {
+	p := strings.Split(strings.Trim(pattern, "/"), "/")
+	n := strings.Split(strings.Trim(name, "/"), "/")
+	for i := len(n); i > 0; i-- {
+		if matchSegments(p, n[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSegments(p []string, n []string) bool {
+	for len(p) > 0 {
+		if p[0] == "**" {
+			for i := 0; i <= len(n); i++ {
+				if matchSegments(p[1:], n[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(n) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(p[0], n[0]); !ok {
+			return false
+		}
+		p, n = p[1:], n[1:]
+	}
+	return len(n) == 0
+}
+
+// pinSet : Paths the eviction policies never remove from the cache, from config rules or pinned at runtime
+type pinSet struct {
+	sync.RWMutex
+	rules []string
+	paths map[string]bool
+	file  string // Runtime pins are saved here to be restored on remount, kept in memory only if empty
+}
+
+func newPinSet(rules []string) *pinSet {
+	return &pinSet{
+		rules: rules,
+		paths: make(map[string]bool),
+	}
+}
+
+func (ps *pinSet) setRules(rules []string) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.rules = rules
+}
+
+// pinned : Whether the file, given by its path in storage, is to be kept in the cache
+func (ps *pinSet) pinned(name string) bool {
+	if ps == nil {
+		return false
+	}
+
+	ps.RLock()
+	defer ps.RUnlock()
+
+	for _, rule := range ps.rules {
+		if matchPath(rule, name) {
+			return true
+		}
+	}
+	for dir := name; dir != "." && dir != "/" && dir != ""; dir = filepath.Dir(dir) {
+		if ps.paths[dir] {
+			return true
+		}
+	}
+	return false
+}
+
+// load : Restore the pins set at runtime by an earlier mount, later pins are saved to the same file
+func (ps *pinSet) load(file string) error {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.file = file
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	paths := make([]string, 0)
+	err = json.Unmarshal(data, &paths)
+	if err != nil {
+		return err
+	}
+	for _, path := range paths {
+		ps.paths[path] = true
+	}
+	return nil
+}
+
+// saveLocked : Write the runtime pins, replacing the earlier file atomically. Caller holds the lock.
+func (ps *pinSet) saveLocked() {
+	if ps.file == "" {
+		return
+	}
+
+	paths := make([]string, 0, len(ps.paths))
+	for path := range ps.paths {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	data, err := json.Marshal(paths)
+	if err == nil {
+		err = os.WriteFile(ps.file+".tmp", data, 0600)
+	}
+	if err == nil {
+		err = os.Rename(ps.file+".tmp", ps.file)
+	}
+	if err != nil {
+		log.Err("pinSet::save : failed to save pins to %s [%s]", ps.file, err.Error())
+	}
+}
+
+func (ps *pinSet) pin(name string) {
+	ps.Lock()
+	defer ps.Unlock()
+	ps.paths[internal.TruncateDirName(name)] = true
+	ps.saveLocked()
+}
+
+// unpin : Drop a pin set at runtime, returns false if there was none
+func (ps *pinSet) unpin(name string) bool {
+	ps.Lock()
+	defer ps.Unlock()
+
+	name = internal.TruncateDirName(name)
+	if !ps.paths[name] {
+		return false
+	}
+	delete(ps.paths, name)
+	ps.saveLocked()
+	return true
+}
+
+// rename : Move the runtime pins on the path, and on paths under it, to where it was renamed
+func (ps *pinSet) rename(src string, dst string) {
+	if ps == nil {
+		return
+	}
+
+	ps.Lock()
+	defer ps.Unlock()
+
+	src, dst = internal.TruncateDirName(src), internal.TruncateDirName(dst)
+	moved := make([]string, 0)
+	for path := range ps.paths {
+		if path == src || strings.HasPrefix(path, src+"/") {
+			moved = append(moved, path)
+		}
+	}
+	if len(moved) == 0 {
+		return
+	}
+
+	for _, path := range moved {
+		delete(ps.paths, path)
+	}
+	for _, path := range moved {
+		ps.paths[dst+strings.TrimPrefix(path, src)] = true
+	}
+	ps.saveLocked()
+}
+
+// GetXattr : Pin xattr reads as "1" on a pinned path, others come from storage
+func (fc *FileCache) GetXattr(options internal.GetXattrOptions) ([]byte, error) {
+	if options.Attr != pinXattr {
+		return fc.NextComponent().GetXattr(options)
+	}
+
+	if !fc.pins.pinned(options.Name) {
+		return nil, syscall.ENODATA
+	}
+	return []byte("1"), nil
+}
+
+// SetXattr : Pin or prefetch the path, file or directory, others go to storage
+func (fc *FileCache) SetXattr(options internal.SetXattrOptions) error {
+	switch options.Attr {
+	case pinXattr:
+		log.Info("FileCache::SetXattr : pinning %s", options.Name)
+		fc.pins.pin(options.Name)
+		return nil
+
+	case prefetchXattr:
+		log.Info("FileCache::SetXattr : prefetching %s", options.Name)
+		fc.prefetch.add(options.Name)
+		return nil
+	}
+
+	return fc.NextComponent().SetXattr(options)
+}
+
+// ListXattr : Pin xattr is listed on a pinned path along with the ones from storage
+func (fc *FileCache) ListXattr(options internal.ListXattrOptions) ([]string, error) {
+	names, err := fc.NextComponent().ListXattr(options)
+	if err == nil && fc.pins.pinned(options.Name) {
+		names = append(names, pinXattr)
+	}
+	return names, err
+}
+
+// RemoveXattr : Unpin the path, which has no effect on pins from config rules
+func (fc *FileCache) RemoveXattr(options internal.RemoveXattrOptions) error {
+	if options.Attr != pinXattr {
+		return fc.NextComponent().RemoveXattr(options)
+	}
+
+	if !fc.pins.unpin(options.Name) {
+		return syscall.ENODATA
+	}
+	log.Info("FileCache::RemoveXattr : unpinned %s", options.Name)
+	return nil
+}
@@ -0,0 +1,240 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	defaultPrefetchParallelism = 4
+	prefetchQueueSize          = 1024
+)
+
+// prefetcher : Downloads files into the cache in background ahead of their use. Rules are expanded against storage
+// listings and the files matching them are downloaded by a bounded number of workers.
+type prefetcher struct {
+	workers int
+	rules   []string // Prefetched on start
+	queue   chan string
+	queued  sync.Map // Files queued or being downloaded, so a file is fetched once for overlapping rules
+
+	list  func(dir string, fn func(attr *internal.ObjAttr) bool) error // Walk the files under a directory in storage
+	stat  func(name string) (*internal.ObjAttr, error)
+	fetch func(name string) error
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newPrefetcher(workers int, list func(string, func(*internal.ObjAttr) bool) error,
+	stat func(string) (*internal.ObjAttr, error), fetch func(string) error) *prefetcher {
+	return &prefetcher{
+		workers: workers,
+		queue:   make(chan string, prefetchQueueSize),
+		list:    list,
+		stat:    stat,
+		fetch:   fetch,
+		stop:    make(chan struct{}),
+	}
+}
+
+func (pf *prefetcher) start() {
+	for i := 0; i < pf.workers; i++ {
+		pf.wg.Add(1)
+		go func() {
+			defer pf.wg.Done()
+			for {
+				select {
+				case <-pf.stop:
+					return
+				case name := <-pf.queue:
+					err := pf.fetch(name)
+					pf.queued.Delete(name)
+					if err != nil {
+						log.Err("prefetcher::start : Failed to prefetch %s [%s]", name, err.Error())
+						fileCacheStatsCollector.UpdateStats(stats_manager.Increment, prefetchFailures, (int64)(1))
+					} else {
+						fileCacheStatsCollector.UpdateStats(stats_manager.Increment, prefetchFiles, (int64)(1))
+					}
+				}
+			}
+		}()
+	}
+}
+
+// shutdown : Stop the workers and the rules being expanded, files not yet downloaded are dropped
+func (pf *prefetcher) shutdown() {
+	close(pf.stop)
+	pf.wg.Wait()
+}
+
+// enqueue : Queue a file for download, returns false once stopped
+func (pf *prefetcher) enqueue(name string) bool {
+	if _, found := pf.queued.LoadOrStore(name, true); found {
+		return true
+	}
+
+	select {
+	case pf.queue <- name:
+		return true
+	case <-pf.stop:
+		return false
+	}
+}
+
+// add : Expand the rule, a path or a glob, in background and queue the files matching it
+func (pf *prefetcher) add(rule string) {
+	rule = strings.Trim(rule, "/")
+	pf.wg.Add(1)
+	go func() {
+		defer pf.wg.Done()
+
+		err := pf.expand(rule)
+		if err != nil {
+			log.Err("prefetcher::add : Failed to list files for %s [%s]", rule, err.Error())
+		}
+	}()
+}
+
+func (pf *prefetcher) expand(rule string) error {
+	// Only the directory the glob can not match beyond is listed
+	base := make([]string, 0)
+	for _, seg := range strings.Split(rule, "/") {
+		if strings.ContainsAny(seg, "*?[") {
+			break
+		}
+		base = append(base, seg)
+	}
+	dir := strings.Join(base, "/")
+
+	if dir != "" {
+		attr, err := pf.stat(dir)
+		if err != nil {
+			return err
+		}
+		if !attr.IsDir() {
+			if matchPath(rule, dir) {
+				pf.enqueue(dir)
+			}
+			return nil
+		}
+	}
+
+	return pf.list(dir, func(attr *internal.ObjAttr) bool {
+		return !matchPath(rule, attr.Path) || pf.enqueue(attr.Path)
+	})
+}
+
+// addList : Queue the paths listed in the file, one per line
+func (pf *prefetcher) addList(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			pf.add(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// walkStorage : Call fn for every file under the directory in storage till it returns false
+func (fc *FileCache) walkStorage(dir string, fn func(attr *internal.ObjAttr) bool) error {
+	_, err := fc.walkDir(dir, fn)
+	return err
+}
+
+func (fc *FileCache) walkDir(dir string, fn func(attr *internal.ObjAttr) bool) (bool, error) {
+	token := ""
+	for {
+		attrs, next, err := fc.NextComponent().StreamDir(internal.StreamDirOptions{Name: dir, Token: token})
+		if err != nil {
+			return false, err
+		}
+
+		for _, attr := range attrs {
+			more := true
+			if attr.IsDir() {
+				more, err = fc.walkDir(attr.Path, fn)
+				if err != nil {
+					return false, err
+				}
+			} else {
+				more = fn(attr)
+			}
+			if !more {
+				return false, nil
+			}
+		}
+
+		if next == "" {
+			return true, nil
+		}
+		token = next
+	}
+}
+
+func (fc *FileCache) statStorage(name string) (*internal.ObjAttr, error) {
+	return fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+}
+
+// prefetchFile : Bring the file in the cache as an open would, without keeping a handle open
+func (fc *FileCache) prefetchFile(name string) error {
+	handle, err := fc.OpenFile(internal.OpenFileOptions{Name: name, Flags: os.O_RDONLY, Mode: fc.defaultPermission})
+	if err != nil {
+		return err
+	}
+
+	// Ranges left to read on demand are fetched now, nobody is going to read them through this handle
+	err = fc.fillFile(name, filepath.Join(fc.tmpPath, name))
+	closeErr := fc.CloseFile(internal.CloseFileOptions{Handle: handle})
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
@@ -0,0 +1,466 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/handlemap"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	// Quotas are checked this often, and after files are closed
+	quotaCheckInterval = 10 * time.Second
+
+	// Set on handles of files kept out of the cache, which are read and written in storage directly
+	bypassKey = "fc_bypass"
+
+	// Writes to a file which is not cached are uploaded in blocks of this size
+	bypassBlockSize     = 8 * MB
+	bypassBlockIdLength = 16
+)
+
+// QuotaOptions : Limits on the files cached under a path prefix, 0 is no limit
+type QuotaOptions struct {
+	Prefix    string  `config:"prefix" yaml:"prefix,omitempty"`
+	MaxSizeMB float64 `config:"max-size-mb" yaml:"max-size-mb,omitempty"`
+	MaxFiles  uint32  `config:"max-files" yaml:"max-files,omitempty"`
+}
+
+// quotaSet : Quotas on path prefixes, enforced by evicting the files under the prefix opened longest ago
+type quotaSet struct {
+	sync.Mutex
+	rules   []QuotaOptions
+	lastUse map[string]time.Time // Last open of the files under a quota, by local path
+	policy  cachePolicyConfig    // Evictions go through the checks of the cache policy
+
+	check chan struct{}
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+func newQuotaSet(quotas []QuotaOptions) (*quotaSet, error) {
+	for _, q := range quotas {
+		if strings.Trim(q.Prefix, "/") == "" {
+			return nil, fmt.Errorf("quota without prefix")
+		}
+		if q.MaxSizeMB <= 0 && q.MaxFiles == 0 {
+			return nil, fmt.Errorf("quota on %s without max-size-mb or max-files", q.Prefix)
+		}
+	}
+
+	return &quotaSet{
+		rules:   quotas,
+		lastUse: make(map[string]time.Time),
+		check:   make(chan struct{}, 1),
+	}, nil
+}
+
+// used : File was opened, name is its path in storage
+func (q *quotaSet) used(name string, localPath string) {
+	if q == nil {
+		return
+	}
+
+	for _, rule := range q.rules {
+		if strings.HasPrefix(name, strings.TrimPrefix(rule.Prefix, "/")) {
+			q.Lock()
+			q.lastUse[localPath] = time.Now()
+			q.Unlock()
+			return
+		}
+	}
+}
+
+// nudge : Check the quotas soon, files may have grown
+func (q *quotaSet) nudge() {
+	if q == nil {
+		return
+	}
+
+	select {
+	case q.check <- struct{}{}:
+	default:
+	}
+}
+
+// victims : Files under a quota, opened longest ago first. Files gone from the cache are forgotten.
+func (q *quotaSet) victims(prefix string, files map[string]int64) []string {
+	q.Lock()
+	defer q.Unlock()
+
+	for path := range q.lastUse {
+		if _, found := files[path]; !found && strings.HasPrefix(path, prefix) {
+			delete(q.lastUse, path)
+		}
+	}
+
+	paths := make([]string, 0, len(files))
+	for path := range files {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return q.lastUse[paths[i]].Before(q.lastUse[paths[j]])
+	})
+	return paths
+}
+
+func (q *quotaSet) start(enforce func()) {
+	if q == nil {
+		return
+	}
+
+	q.stop = make(chan struct{})
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		ticker := time.NewTicker(quotaCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-q.stop:
+				return
+			case <-ticker.C:
+				enforce()
+			case <-q.check:
+				enforce()
+			}
+		}
+	}()
+}
+
+func (q *quotaSet) shutdown() {
+	if q != nil && q.stop != nil {
+		close(q.stop)
+		q.wg.Wait()
+	}
+}
+
+// enforceQuotas : Evict files under each quota which is exceeded till it is met, and report the usage of each
+func (fc *FileCache) enforceQuotas() {
+	for _, rule := range fc.quotas.rules {
+		prefix := fc.tmpPath + "/" + strings.TrimPrefix(rule.Prefix, "/")
+		files := fc.usage.under(prefix)
+		bytes := int64(0)
+		for _, size := range files {
+			bytes += size
+		}
+
+		over := func() bool {
+			return (rule.MaxSizeMB > 0 && float64(bytes) > rule.MaxSizeMB*MB) ||
+				(rule.MaxFiles > 0 && len(files) > int(rule.MaxFiles))
+		}
+		if over() {
+			log.Info("FileCache::enforceQuotas : %s over its quota with %d bytes in %d files", rule.Prefix, bytes, len(files))
+		}
+
+		for _, path := range fc.quotas.victims(prefix, files) {
+			if !over() {
+				break
+			}
+			if !evictFile(&fc.quotas.policy, "quota", path) {
+				continue
+			}
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				fc.policy.CachePurge(path)
+				bytes -= files[path]
+				delete(files, path)
+				fileCacheStatsCollector.UpdateStats(stats_manager.Increment, quotaEvictions, (int64)(1))
+			}
+		}
+
+		fileCacheStatsCollector.UpdateStats(stats_manager.Replace, fmt.Sprintf("Quota %s bytes", rule.Prefix), bytes)
+		fileCacheStatsCollector.UpdateStats(stats_manager.Replace, fmt.Sprintf("Quota %s files", rule.Prefix), int64(len(files)))
+	}
+}
+
+// excluded : Whether the file matches a pattern of files never cached. A pattern without a '/' is matched against
+// the file name, else against the path as in pin-paths.
+func (fc *FileCache) excluded(name string) bool {
+	for _, pattern := range fc.admitExclude {
+		if !strings.Contains(strings.Trim(pattern, "/"), "/") {
+			if ok, _ := filepath.Match(pattern, filepath.Base(name)); ok {
+				return true
+			}
+		} else if matchPath(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// admitted : Whether the file is to be cached on open. A file in the cache already is, so local changes are not
+// bypassed.
+func (fc *FileCache) admitted(name string, localPath string) bool {
+	if len(fc.admitExclude) == 0 && fc.admitMaxSize == 0 {
+		return true
+	}
+	if _, err := os.Stat(localPath); err == nil {
+		return true
+	}
+	if fc.excluded(name) {
+		return false
+	}
+	if fc.admitMaxSize > 0 {
+		attr, err := fc.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
+		if err == nil && attr.Size > fc.admitMaxSize {
+			return false
+		}
+	}
+	return true
+}
+
+// bypassWriter : Writes to a file which is not cached, gathered into blocks which are staged and committed as they
+// fill up. Blocks already committed are not held, writes to them go to storage one by one.
+type bypassWriter struct {
+	sync.Mutex
+	bol    *common.BlockOffsetList // Blocks committed so far, read again from storage if nil
+	buf    []byte                  // Block being filled, starting where the committed ones end
+	start  int64
+	direct bool // Blob has no blocks to add to, every write goes to storage
+}
+
+// streamable : Whether a file opened with these flags can be served from storage directly. A file opened for writing
+// has to be written afresh, as its blocks are uploaded in order.
+func streamable(flags int) bool {
+	return flags&(os.O_WRONLY|os.O_RDWR) == 0 || flags&os.O_TRUNC != 0
+}
+
+// bypass : Mark a handle from the next component as serving a file which is not cached, and if it is for an empty
+// blob to be written then gather the writes into blocks
+func bypass(handle *handlemap.Handle, writable bool) *handlemap.Handle {
+	var w *bypassWriter
+	if writable {
+		w = &bypassWriter{bol: &common.BlockOffsetList{}, buf: make([]byte, 0, bypassBlockSize)}
+	}
+	handle.SetValue(bypassKey, w)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, bypassOpens, (int64)(1))
+	return handle
+}
+
+// bypassed : Whether the handle serves a file which is not cached
+func bypassed(handle *handlemap.Handle) bool {
+	_, found := handle.GetValue(bypassKey)
+	return found
+}
+
+func getBypassWriter(handle *handlemap.Handle) *bypassWriter {
+	val, found := handle.GetValue(bypassKey)
+	if !found {
+		return nil
+	}
+	return val.(*bypassWriter)
+}
+
+// openBypass : Open the file in storage, for a file which is not to be cached
+func (fc *FileCache) openBypass(options internal.OpenFileOptions) (*handlemap.Handle, error) {
+	log.Debug("FileCache::openBypass : %s is not admitted to the cache, serving it from storage", options.Name)
+
+	if options.Flags&os.O_TRUNC != 0 {
+		err := fc.NextComponent().TruncateFile(internal.TruncateFileOptions{Name: options.Name, Size: 0})
+		if err != nil {
+			log.Err("FileCache::openBypass : Failed to truncate %s [%s]", options.Name, err.Error())
+			return nil, err
+		}
+	}
+
+	handle, err := fc.NextComponent().OpenFile(options)
+	if err != nil {
+		log.Err("FileCache::openBypass : Failed to open %s [%s]", options.Name, err.Error())
+		return nil, err
+	}
+	return bypass(handle, options.Flags&os.O_TRUNC != 0), nil
+}
+
+// writeBypass : Write to a file which is not cached. Writes from the start of the block being filled on are gathered
+// in it, anything before that is written to storage directly.
+func (fc *FileCache) writeBypass(options internal.WriteFileOptions) (int, error) {
+	w := getBypassWriter(options.Handle)
+	if w == nil {
+		log.Err("FileCache::writeBypass : %s was not opened for writing", options.Handle.Path)
+		return 0, syscall.EBADF
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	var n int
+	var err error
+	if w.direct || options.Offset < w.start {
+		n, err = fc.writeDirect(w, options)
+	} else {
+		n, err = fc.gather(w, options.Handle, options.Offset, options.Data)
+	}
+	if err != nil {
+		log.Err("FileCache::writeBypass : Failed to write %s [%s]", options.Handle.Path, err.Error())
+		return n, err
+	}
+
+	// Reads on the handle are limited to its size
+	end := options.Offset + int64(n)
+	if end > atomic.LoadInt64(&options.Handle.Size) {
+		atomic.StoreInt64(&options.Handle.Size, end)
+	}
+	return n, nil
+}
+
+// gather : Copy the data into the block being filled, staging it each time it is full. Requires Lock().
+func (fc *FileCache) gather(w *bypassWriter, handle *handlemap.Handle, offset int64, data []byte) (int, error) {
+	written := 0
+	for {
+		// Gap left by writing past the end of the block is zeros
+		pos := offset - w.start
+		if pos >= bypassBlockSize {
+			w.buf = w.buf[:bypassBlockSize]
+			if err := fc.stageBypassBlock(w, handle); err != nil {
+				return written, err
+			}
+			continue
+		}
+		if len(data) == 0 {
+			return written, nil
+		}
+
+		n := int64(len(data))
+		if pos+n > bypassBlockSize {
+			n = bypassBlockSize - pos
+		}
+		if pos+n > int64(len(w.buf)) {
+			w.buf = w.buf[:pos+n]
+		}
+		copy(w.buf[pos:], data[:n])
+		data, offset, written = data[n:], offset+n, written+int(n)
+
+		if len(w.buf) == bypassBlockSize {
+			if err := fc.stageBypassBlock(w, handle); err != nil {
+				return written, err
+			}
+		}
+	}
+}
+
+// writeDirect : Write to a part of the file which is committed already. Requires Lock().
+func (fc *FileCache) writeDirect(w *bypassWriter, options internal.WriteFileOptions) (int, error) {
+	err := fc.stageBypassBlock(w, options.Handle)
+	if err != nil {
+		return 0, err
+	}
+
+	// Blocks of the blob change underneath, they are read again before the next block is committed
+	w.bol = nil
+	return fc.NextComponent().WriteFile(options)
+}
+
+// stageBypassBlock : Stage the block being filled and commit it after the ones before it. Requires Lock().
+func (fc *FileCache) stageBypassBlock(w *bypassWriter, handle *handlemap.Handle) error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	name := handle.Path
+	if w.bol == nil {
+		bol, err := fc.NextComponent().GetFileBlockOffsets(internal.GetFileBlockOffsetsOptions{Name: name})
+		if err != nil {
+			return err
+		}
+		end := int64(0)
+		if len(bol.BlockList) > 0 {
+			end = bol.BlockList[len(bol.BlockList)-1].EndIndex
+		}
+		if end != w.start {
+			// Blob written without blocks, nothing to add the block to
+			w.direct = true
+			_, err = fc.NextComponent().WriteFile(internal.WriteFileOptions{Handle: handle, Offset: w.start, Data: w.buf})
+			w.buf = w.buf[:0]
+			return err
+		}
+		w.bol = bol
+	}
+
+	blk := &common.Block{
+		Id:         base64.StdEncoding.EncodeToString(common.NewUUIDWithLength(bypassBlockIdLength)),
+		StartIndex: w.start,
+		EndIndex:   w.start + int64(len(w.buf)),
+		Data:       w.buf,
+	}
+	if w.bol.BlockIdLength != 0 {
+		blk.Id = base64.StdEncoding.EncodeToString(common.NewUUIDWithLength(w.bol.BlockIdLength))
+	}
+	blk.Flags.Set(common.DirtyBlock)
+	w.bol.BlockList = append(w.bol.BlockList, blk)
+
+	uploadHandle := handlemap.NewHandle(name)
+	uploadHandle.CacheObj = &handlemap.Cache{BlockOffsetList: w.bol}
+	err := fc.NextComponent().FlushFile(internal.FlushFileOptions{Handle: uploadHandle})
+	if err != nil {
+		w.bol.BlockList = w.bol.BlockList[:len(w.bol.BlockList)-1]
+		return err
+	}
+
+	blk.Data = nil
+	w.start = blk.EndIndex
+	w.buf = make([]byte, 0, bypassBlockSize)
+	return nil
+}
+
+// flushBypass : Upload what is gathered of the writes to a file which is not cached
+func (fc *FileCache) flushBypass(handle *handlemap.Handle) error {
+	w := getBypassWriter(handle)
+	if w == nil {
+		return nil
+	}
+
+	w.Lock()
+	defer w.Unlock()
+
+	err := fc.stageBypassBlock(w, handle)
+	if err != nil {
+		log.Err("FileCache::flushBypass : Failed to upload %s [%s]", handle.Path, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,435 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/config"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	// Blobs are spread over this many lock files, so the lock directory does not grow with the cache
+	sharedLockStripes = 1024
+	sharedLockDir     = ".locks"
+
+	// Other mounts change the shared cache behind our back, so usage is walked more often
+	sharedUsageReconcileInterval = 30 * time.Second
+
+	// Index lives in the lock directory so it is not counted as usage of the cache
+	sharedIndexFile = "index.json"
+	sharedIndexLock = "index"
+
+	// Accesses are merged into the shared index and usage is checked against the thresholds this often
+	sharedIndexInterval = 30 * time.Second
+)
+
+// sharedCache : Cache directory used by several mounts on the host. Each blob is cached once, under
+// <path>/<account>/<container>/<blob>, and the mounts coordinate with file locks. A lock file is held exclusively while
+// its blobs are checked, downloaded or evicted, and every open handle holds a shared lock on the cached file so no
+// other mount evicts or replaces it meanwhile.
+//
+// Usage of the shared cache is that of all the mounts, so eviction to the thresholds goes by an index of the last
+// access of every cached file, keyed by account, container and blob, which all the mounts merge their accesses into.
+// Whichever mount finds usage over the high threshold evicts the least recently used files, cached by any mount.
+type sharedCache struct {
+	sync.Mutex
+	root  string
+	locks string
+
+	accessed map[string]int64 // Accesses of this mount not merged into the index yet, by key
+
+	maxSizeMB     float64
+	highThreshold float64
+	lowThreshold  float64
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+func newSharedCache(root string) (*sharedCache, error) {
+	s := &sharedCache{
+		root:     root,
+		locks:    filepath.Join(root, sharedLockDir),
+		accessed: make(map[string]int64),
+	}
+	err := os.MkdirAll(s.locks, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// sharedCachePath : Directory of this mount in the shared cache, its subdirectory of the container if it has one
+func sharedCachePath(root string) (string, error) {
+	var account, container, subdir string
+	_ = config.UnmarshalKey("azstorage.account-name", &account)
+	_ = config.UnmarshalKey("azstorage.container", &container)
+	_ = config.UnmarshalKey("azstorage.subdirectory", &subdir)
+	if account == "" || container == "" {
+		return "", fmt.Errorf("account-name and container of azstorage are needed to share the cache")
+	}
+	return filepath.Join(root, account, container, strings.Trim(subdir, "/")), nil
+}
+
+// configureShared : Cache under the account and container of this mount in the shared cache at tmpPath
+func (c *FileCache) configureShared(conf FileCacheOptions) error {
+	// These keep state of the cached files in this mount only, which other mounts would not respect
+	unsupported := []struct {
+		option string
+		set    bool
+	}{
+		{"write-back", conf.WriteBack},
+		{"offline-mode", conf.OfflineMode},
+		{"persistent-cache", conf.PersistentCache},
+		{"sparse-cache", conf.SparseCache},
+		{"async-open", conf.AsyncOpen},
+		{"tiers", len(conf.Tiers) > 0 || conf.MemoryTierMB > 0},
+	}
+	for _, u := range unsupported {
+		if u.set {
+			log.Err("FileCache: config error [shared-cache can not be used with %s]", u.option)
+			return fmt.Errorf("config error in %s [shared-cache can not be used with %s]", c.Name(), u.option)
+		}
+	}
+
+	path, err := sharedCachePath(c.tmpPath)
+	if err != nil {
+		log.Err("FileCache: config error [%s]", err.Error())
+		return fmt.Errorf("config error in %s [%s]", c.Name(), err.Error())
+	}
+
+	if c.shared == nil {
+		c.shared, err = newSharedCache(c.tmpPath)
+		if err == nil {
+			err = os.MkdirAll(path, 0777)
+		}
+		if err != nil {
+			log.Err("FileCache: config error [failed to create shared cache %s [%s]]", path, err.Error())
+			return fmt.Errorf("config error in %s [shared-cache %s: %s]", c.Name(), path, err.Error())
+		}
+	}
+	c.tmpPath = path
+
+	return nil
+}
+
+// lock : Take the lock file the cached file at localPath goes with, the returned function releases it
+func (s *sharedCache) lock(localPath string) (func(), error) {
+	if s == nil {
+		return func() {}, nil
+	}
+
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(strings.TrimPrefix(localPath, s.root)))
+
+	f, err := os.OpenFile(filepath.Join(s.locks, fmt.Sprint(h.Sum32()%sharedLockStripes)), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() { f.Close() }, nil
+}
+
+// inUse : Whether another mount has the cached file open, requires lock()
+func (s *sharedCache) inUse(localPath string) bool {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) == syscall.EWOULDBLOCK
+}
+
+// hold : Keep other mounts from evicting or replacing the file while the handle is open, released on close. The open
+// counts as an access of the file in the shared index.
+func (s *sharedCache) hold(f *os.File) error {
+	if s == nil {
+		return nil
+	}
+
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_SH)
+	if err == nil {
+		s.touch(f.Name(), time.Now())
+	}
+	return err
+}
+
+// evictable : Lock the file so it can be evicted, nil if another mount has it open
+func (s *sharedCache) evictable(localPath string) func() {
+	unlock, err := s.lock(localPath)
+	if err != nil {
+		log.Err("sharedCache::evictable : Failed to lock %s [%s]", localPath, err.Error())
+		return nil
+	}
+	if s.inUse(localPath) {
+		log.Debug("sharedCache::evictable : %s is open in another mount, not evicting", localPath)
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, sharedSkips, (int64)(1))
+		unlock()
+		return nil
+	}
+	return unlock
+}
+
+// current : Whether the cached file, downloaded by this or another mount, is the version in storage
+func (s *sharedCache) current(localPath string, attr *internal.ObjAttr) bool {
+	info, err := os.Stat(localPath)
+	if err != nil || info.Size() != attr.Size || !info.ModTime().Equal(attr.Mtime) {
+		return false
+	}
+	// Partially downloaded
+	if sp, err := loadSparseFile(localPath); err != nil || sp != nil {
+		return false
+	}
+	return true
+}
+
+// key : Account, container and blob of the cached file, its path under the root
+func (s *sharedCache) key(localPath string) string {
+	return strings.TrimPrefix(strings.TrimPrefix(localPath, s.root), "/")
+}
+
+// touch : Record an access of the cached file, merged into the index on next update
+func (s *sharedCache) touch(localPath string, at time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	if at.UnixNano() > s.accessed[s.key(localPath)] {
+		s.accessed[s.key(localPath)] = at.UnixNano()
+	}
+}
+
+// setThresholds : Usage of the shared cache to evict at, and to evict down to
+func (s *sharedCache) setThresholds(maxSizeMB float64, high float64, low float64) {
+	s.Lock()
+	defer s.Unlock()
+
+	s.maxSizeMB = maxSizeMB
+	s.highThreshold = high
+	s.lowThreshold = low
+}
+
+// update : Merge the accesses of this mount into the index and hand it to fn, with the index locked against the
+// other mounts till fn returns and the index is saved
+func (s *sharedCache) update(fn func(index map[string]int64)) error {
+	f, err := os.OpenFile(filepath.Join(s.locks, sharedIndexLock), os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(s.locks, sharedIndexFile)
+	index := make(map[string]int64)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &index)
+		if err != nil {
+			log.Warn("sharedCache::update : Discarding corrupt index %s [%s]", path, err.Error())
+			index = make(map[string]int64)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	s.Lock()
+	for key, at := range s.accessed {
+		if at > index[key] {
+			index[key] = at
+		}
+	}
+	s.accessed = make(map[string]int64)
+	s.Unlock()
+
+	if fn != nil {
+		fn(index)
+	}
+
+	data, err = json.Marshal(index)
+	if err != nil {
+		return err
+	}
+
+	// Readers only ever see a complete index
+	err = os.WriteFile(path+".tmp", data, 0666)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// start : Merge accesses into the index and evict to the thresholds periodically
+func (s *sharedCache) start(evict func()) {
+	s.stop = make(chan struct{})
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(sharedIndexInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-ticker.C:
+				evict()
+			}
+		}
+	}()
+}
+
+// shutdown : Stop evicting and leave the accesses of this mount in the index for the other mounts
+func (s *sharedCache) shutdown() {
+	if s.stop != nil {
+		close(s.stop)
+		s.wg.Wait()
+	}
+
+	err := s.update(nil)
+	if err != nil {
+		log.Err("sharedCache::shutdown : Failed to update index in %s [%s]", s.locks, err.Error())
+	}
+}
+
+// evictShared : Once usage of the shared cache is over the high threshold, evict the least recently used files in the
+// index till it is below the low threshold, whichever mount cached them. Files pinned in this mount are kept, and so
+// are files open in any mount, as evictable() does not hand those out.
+func (fc *FileCache) evictShared() {
+	s := fc.shared
+	s.Lock()
+	maxSizeMB, high, low := s.maxSizeMB, s.highThreshold, s.lowThreshold
+	s.Unlock()
+
+	err := s.update(func(index map[string]int64) {
+		usage := getUsagePercentage(fc.usage, maxSizeMB)
+		if usage <= high {
+			return
+		}
+		log.Info("FileCache::evictShared : High threshold reached %f > %f", usage, high)
+
+		keys := make([]string, 0, len(index))
+		for key := range index {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return index[keys[i]] < index[keys[j]]
+		})
+
+		for _, key := range keys {
+			if usage <= low {
+				break
+			}
+
+			localPath := filepath.Join(s.root, key)
+			if strings.HasPrefix(localPath, fc.tmpPath+"/") && fc.pins.pinned(strings.TrimPrefix(localPath, fc.tmpPath+"/")) {
+				continue
+			}
+
+			unlock := s.evictable(localPath)
+			if unlock == nil {
+				continue
+			}
+			err := deleteFile(localPath)
+			unlock()
+			if err != nil {
+				continue
+			}
+
+			delete(index, key)
+			fc.usage.removed(localPath)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, sharedEvictions, (int64)(1))
+			usage = getUsagePercentage(fc.usage, maxSizeMB)
+		}
+		log.Info("FileCache::evictShared : Usage at %f after eviction", usage)
+	})
+	if err != nil {
+		log.Err("FileCache::evictShared : Failed to update index in %s [%s]", s.locks, err.Error())
+	}
+}
+
+// restoreShared : Register the files of this mount already in the shared cache with the eviction policy, so they
+// expire in time. Files of any mount missing from the index, left by a mount which did not get to update it, are
+// added to it as last accessed when they were last modified.
+func (fc *FileCache) restoreShared() {
+	count := 0
+	_ = filepath.WalkDir(fc.shared.root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() && path == fc.shared.locks {
+			return filepath.SkipDir
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		if strings.HasPrefix(path, fc.tmpPath+"/") {
+			fc.policy.CacheValid(path)
+			count++
+		}
+		if info, err := d.Info(); err == nil {
+			fc.shared.touch(path, info.ModTime())
+		}
+		return nil
+	})
+	log.Info("FileCache::restoreShared : %d files of this mount found in shared cache %s", count, fc.shared.root)
+
+	// Merge keeps the later of the modification of a file and its access in the index
+	err := fc.shared.update(nil)
+	if err != nil {
+		log.Err("FileCache::restoreShared : Failed to update index in %s [%s]", fc.shared.locks, err.Error())
+	}
+}
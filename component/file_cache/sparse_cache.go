@@ -0,0 +1,501 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"sync"
+	"syscall"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/handlemap"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	// Bitmap of downloaded chunks is kept in this xattr of the cached file, so it is persisted with the file and
+	// goes away when the file is evicted. A cached file without it is complete.
+	sparseXattr = "user.blobfuse2.ranges"
+
+	defaultSparseBlockSizeMB = 4
+	defaultSparseReadAhead   = 4
+
+	// xattr values are limited to a block on ext4, so large files use bigger chunks to keep the bitmap small
+	maxSparseChunks = 16384
+
+	// Chunk size, blob size and length of the ETag of the blob
+	sparseHeaderLen = 18
+)
+
+var errSparseCorrupt = errors.New("corrupt sparse file bitmap")
+
+// sparseFile : Chunks of a cached file downloaded so far, shared by all handles of the file
+type sparseFile struct {
+	sync.Mutex
+	chunkSize int64
+	size      int64 // Size of the blob, anything beyond is only local
+	bitmap    []byte
+	missing   int64
+	inflight  map[int64]chan struct{}
+	etag      string // Version of the blob the chunks are downloaded from, empty if not known
+	stale     bool   // Blob changed since the file was created, it is discarded
+
+	downloading bool          // Background download of the file is running
+	next        int64         // Chunk the background download continues from
+	stop        bool          // Background download should stop after the chunks in flight
+	done        chan struct{} // Closed when the background download stops
+}
+
+// sparseChunkSize : Chunk size for a file of given size, doubled till the bitmap is small enough
+func sparseChunkSize(size int64, chunkSize int64) int64 {
+	for (size+chunkSize-1)/chunkSize > maxSparseChunks {
+		chunkSize *= 2
+	}
+	return chunkSize
+}
+
+func newSparseFile(size int64, chunkSize int64) *sparseFile {
+	chunks := (size + chunkSize - 1) / chunkSize
+	return &sparseFile{
+		chunkSize: chunkSize,
+		size:      size,
+		bitmap:    make([]byte, (chunks+7)/8),
+		missing:   chunks,
+		inflight:  make(map[int64]chan struct{}),
+	}
+}
+
+func (s *sparseFile) present(chunk int64) bool {
+	return s.bitmap[chunk/8]&(1<<(chunk%8)) != 0
+}
+
+func (s *sparseFile) set(chunk int64) {
+	if !s.present(chunk) {
+		s.bitmap[chunk/8] |= 1 << (chunk % 8)
+		s.missing--
+	}
+}
+
+// truncate : Blob and local file were truncated to given size. Growth is zeros on both sides so only shrinking matters.
+func (s *sparseFile) truncate(size int64) {
+	if size >= s.size {
+		return
+	}
+
+	s.size = size
+	chunks := (size + s.chunkSize - 1) / s.chunkSize
+	s.missing = 0
+	for c := int64(0); c < chunks; c++ {
+		if !s.present(c) {
+			s.missing++
+		}
+	}
+}
+
+// encode : Chunk size, blob size and ETag of the blob followed by the bitmap
+func (s *sparseFile) encode() []byte {
+	data := make([]byte, sparseHeaderLen+len(s.etag)+len(s.bitmap))
+	binary.LittleEndian.PutUint64(data[0:], uint64(s.chunkSize))
+	binary.LittleEndian.PutUint64(data[8:], uint64(s.size))
+	binary.LittleEndian.PutUint16(data[16:], uint16(len(s.etag)))
+	copy(data[sparseHeaderLen:], s.etag)
+	copy(data[sparseHeaderLen+len(s.etag):], s.bitmap)
+	return data
+}
+
+func decodeSparseFile(data []byte) (*sparseFile, error) {
+	if len(data) < sparseHeaderLen {
+		return nil, errSparseCorrupt
+	}
+
+	chunkSize := int64(binary.LittleEndian.Uint64(data[0:]))
+	size := int64(binary.LittleEndian.Uint64(data[8:]))
+	if chunkSize <= 0 || size < 0 {
+		return nil, errSparseCorrupt
+	}
+
+	etagLen := int(binary.LittleEndian.Uint16(data[16:]))
+	s := newSparseFile(size, chunkSize)
+	if len(data)-sparseHeaderLen-etagLen != len(s.bitmap) {
+		return nil, errSparseCorrupt
+	}
+	s.etag = string(data[sparseHeaderLen : sparseHeaderLen+etagLen])
+	copy(s.bitmap, data[sparseHeaderLen+etagLen:])
+
+	s.missing = 0
+	for c := int64(0); c < (size+chunkSize-1)/chunkSize; c++ {
+		if !s.present(c) {
+			s.missing++
+		}
+	}
+	return s, nil
+}
+
+// persist : Save the bitmap with the cached file, dropping it once every chunk is downloaded
+func (s *sparseFile) persist(localPath string) error {
+	if s.missing == 0 {
+		err := syscall.Removexattr(localPath, sparseXattr)
+		if err == syscall.ENODATA {
+			return nil
+		}
+		return err
+	}
+	return syscall.Setxattr(localPath, sparseXattr, s.encode(), 0)
+}
+
+// loadSparseFile : Read the bitmap of a cached file, nil if the file is complete
+func loadSparseFile(localPath string) (*sparseFile, error) {
+	size, err := syscall.Getxattr(localPath, sparseXattr, nil)
+	if err != nil {
+		if err == syscall.ENODATA {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	data := make([]byte, size)
+	size, err = syscall.Getxattr(localPath, sparseXattr, data)
+	if err != nil {
+		return nil, err
+	}
+	return decodeSparseFile(data[:size])
+}
+
+// createSparseFile : Size the freshly created cache file like the blob without downloading anything. Chunks are
+// downloaded only from the given version of the blob.
+func (fc *FileCache) createSparseFile(localPath string, f *os.File, size int64, etag string) error {
+	s := newSparseFile(size, sparseChunkSize(size, fc.sparseBlockSize))
+	s.etag = etag
+
+	// Bitmap goes first so the file never looks complete before it is
+	err := s.persist(localPath)
+	if err != nil {
+		return err
+	}
+
+	err = f.Truncate(size)
+	if err != nil {
+		_ = syscall.Removexattr(localPath, sparseXattr)
+	}
+	return err
+}
+
+// openSparseFile : Track the chunks of a partially downloaded file while it has open handles
+func (fc *FileCache) openSparseFile(name string, localPath string) *sparseFile {
+	if val, ok := fc.sparseFiles.Load(name); ok {
+		s := val.(*sparseFile)
+		s.Lock()
+		stale := s.stale
+		s.Unlock()
+		if !stale {
+			return s
+		}
+		// File was discarded and downloaded again since
+		fc.sparseFiles.Delete(name)
+	}
+
+	s, err := loadSparseFile(localPath)
+	if err != nil {
+		log.Err("FileCache::openSparseFile : failed to load bitmap of %s [%s]", name, err.Error())
+	}
+	if s == nil {
+		return nil
+	}
+
+	fc.sparseFiles.Store(name, s)
+	return s
+}
+
+// getSparseFile : Chunks of the given file if it is only partially downloaded and open
+func (fc *FileCache) getSparseFile(name string) *sparseFile {
+	if val, ok := fc.sparseFiles.Load(name); ok {
+		return val.(*sparseFile)
+	}
+	return nil
+}
+
+// releaseSparseFile : Drop the bitmap from memory once the file has no open handles and no background download, or is
+// deleted, in which case its download is stopped
+func (fc *FileCache) releaseSparseFile(name string) {
+	if val, found := fc.sparseFiles.LoadAndDelete(name); found {
+		fc.stopAsyncDownload(val.(*sparseFile))
+	}
+}
+
+// truncateSparseFile : Update the bitmap of a partially downloaded file which was truncated
+func (fc *FileCache) truncateSparseFile(name string, localPath string, size int64) {
+	s := fc.getSparseFile(name)
+	if s == nil {
+		// Bitmap is only held in memory while the file is open
+		loaded, err := loadSparseFile(localPath)
+		if err != nil || loaded == nil {
+			return
+		}
+		s = loaded
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.truncate(size)
+	err := s.persist(localPath)
+	if err != nil {
+		log.Err("FileCache::truncateSparseFile : failed to save bitmap of %s [%s]", name, err.Error())
+	}
+}
+
+// fillFile : Download whatever is missing of a partially downloaded file
+func (fc *FileCache) fillFile(name string, localPath string) error {
+	s := fc.getSparseFile(name)
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	size := s.size
+	s.Unlock()
+	return fc.fillRange(name, localPath, 0, size, false)
+}
+
+// fillRange : Download the chunks of a partially downloaded file overlapping the given range which are not yet in
+// the cache. Chunks being downloaded by another caller are waited upon. With read ahead, few of the chunks following
+// the range are downloaded in the same request.
+func (fc *FileCache) fillRange(name string, localPath string, offset int64, length int64, readAhead bool) error {
+	s := fc.getSparseFile(name)
+	if s == nil {
+		return nil
+	}
+
+	s.Lock()
+	if s.stale {
+		s.Unlock()
+		return syscall.EIO
+	}
+	if s.missing == 0 || offset >= s.size || length <= 0 {
+		s.Unlock()
+		return nil
+	}
+	first := offset / s.chunkSize
+	last := (offset + length - 1) / s.chunkSize
+	lastChunk := (s.size - 1) / s.chunkSize
+	if last > lastChunk {
+		last = lastChunk
+	}
+	end := last
+	if readAhead {
+		end += fc.sparseReadAhead
+		if end > lastChunk {
+			end = lastChunk
+		}
+	}
+	s.Unlock()
+
+	for {
+		s.Lock()
+		if s.stale {
+			s.Unlock()
+			return syscall.EIO
+		}
+		var wait chan struct{}
+		fetch := make([]int64, 0)
+		for c := first; c <= end; c++ {
+			if s.present(c) {
+				continue
+			}
+			if ch, ok := s.inflight[c]; ok {
+				if c <= last {
+					wait = ch
+					break
+				}
+				continue
+			}
+			s.inflight[c] = make(chan struct{})
+			fetch = append(fetch, c)
+		}
+		s.Unlock()
+
+		err := fc.downloadChunks(name, localPath, s, fetch)
+		if err != nil {
+			return err
+		}
+
+		if wait == nil {
+			return nil
+		}
+		// Another caller is downloading a chunk we need, check again once it is done
+		<-wait
+	}
+}
+
+// downloadChunks : Download the given chunks, contiguous ones in a single request, and mark them present
+func (fc *FileCache) downloadChunks(name string, localPath string, s *sparseFile, chunks []int64) error {
+	if len(chunks) == 0 {
+		return nil
+	}
+
+	done := make([]int64, 0, len(chunks))
+	var err error
+	var f *os.File
+
+	s.Lock()
+	etag := s.etag
+	s.Unlock()
+
+	// Ranged reads need a handle from the next component; loopback reads through its file object and
+	// azstorage clamps the read to the handle size
+	var remote *handlemap.Handle
+	remote, err = fc.NextComponent().OpenFile(internal.OpenFileOptions{Name: name, Flags: os.O_RDONLY, Mode: fc.defaultPermission})
+	if err == nil {
+		if remote.Size == 0 {
+			remote.Size = s.size
+		}
+		defer fc.NextComponent().CloseFile(internal.CloseFileOptions{Handle: remote}) //nolint
+		f, err = os.OpenFile(localPath, os.O_WRONLY, 0)
+	}
+	for i := 0; err == nil && i < len(chunks); {
+		j := i + 1
+		for j < len(chunks) && chunks[j] == chunks[j-1]+1 {
+			j++
+		}
+
+		start := chunks[i] * s.chunkSize
+		stop := (chunks[j-1] + 1) * s.chunkSize
+		if stop > s.size {
+			stop = s.size
+		}
+
+		data := make([]byte, stop-start)
+		var n int
+		n, err = fc.NextComponent().ReadInBuffer(internal.ReadInBufferOptions{
+			Handle: remote,
+			Offset: start,
+			Data:   data,
+			Etag:   etag,
+		})
+		if err == nil && int64(n) != stop-start {
+			err = syscall.EIO
+		}
+		if err == nil {
+			_, err = f.WriteAt(data, start)
+			fc.usage.changed(localPath)
+		}
+		if err == nil {
+			done = append(done, chunks[i:j]...)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, sparseFetches, (int64)(1))
+		}
+		i = j
+	}
+	if err == syscall.ESTALE && f != nil {
+		fc.discardSparseFile(name, localPath, s, f)
+		err = syscall.EIO
+	}
+	if f != nil {
+		f.Close()
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	for _, c := range done {
+		s.set(c)
+	}
+	for _, c := range chunks {
+		close(s.inflight[c])
+		delete(s.inflight, c)
+	}
+
+	if len(done) > 0 && !s.stale {
+		perr := s.persist(localPath)
+		if perr != nil {
+			log.Err("FileCache::downloadChunks : failed to save bitmap of %s [%s]", name, perr.Error())
+		}
+	}
+
+	if err != nil {
+		log.Err("FileCache::downloadChunks : failed to download %s [%s]", name, err.Error())
+		return err
+	}
+	return nil
+}
+
+// discardSparseFile : Blob changed since the file was created, so the chunks downloaded so far do not go with the rest
+// of it. The file is deleted for the next open to download it again, handles open on it fail to read what is missing.
+func (fc *FileCache) discardSparseFile(name string, localPath string, s *sparseFile, f *os.File) {
+	log.Warn("FileCache::discardSparseFile : %s changed in storage while partially downloaded, discarding it", name)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, sparseDiscards, (int64)(1))
+
+	s.Lock()
+	s.stale = true
+	s.stop = true
+	s.Unlock()
+
+	// File may have been replaced meanwhile, which is then left alone
+	opened, err := f.Stat()
+	if err != nil {
+		return
+	}
+	current, err := os.Stat(localPath)
+	if err != nil || !os.SameFile(opened, current) {
+		return
+	}
+
+	err = deleteFile(localPath)
+	if err != nil {
+		log.Err("FileCache::discardSparseFile : failed to delete %s [%s]", localPath, err.Error())
+		return
+	}
+	fc.usage.removed(localPath)
+	fc.cachedETags.Delete(name)
+	if fc.index != nil {
+		fc.index.remove(name)
+	}
+}
+
+// updateSparseETag : Blocks written to a partially downloaded file were committed to the blob, whose other blocks are
+// still those the missing chunks are to be downloaded from, now under a new ETag
+func (fc *FileCache) updateSparseETag(name string, localPath string, etag string) {
+	s := fc.getSparseFile(name)
+	if s == nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.etag = etag
+	err := s.persist(localPath)
+	if err != nil {
+		log.Err("FileCache::updateSparseETag : failed to save bitmap of %s [%s]", name, err.Error())
+	}
+}
@@ -0,0 +1,525 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"container/list"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+// Files up to this size are kept by the memory tier, unless configured
+const defaultMemoryTierFileKB = 64
+
+// TierOptions : Slower cache below the path of file_cache, files evicted from the tiers above it are moved here
+type TierOptions struct {
+	Path          string  `config:"path" yaml:"path,omitempty"`
+	MaxSizeMB     float64 `config:"max-size-mb" yaml:"max-size-mb,omitempty"`
+	HighThreshold uint32  `config:"high-threshold" yaml:"high-threshold,omitempty"`
+	LowThreshold  uint32  `config:"low-threshold" yaml:"low-threshold,omitempty"`
+}
+
+// cacheTier : Level below the cache directory holding evicted files till they are used again
+type cacheTier interface {
+	// take : Move the evicted file at localPath into the tier, false if the tier does not keep such a file
+	take(name string, localPath string, info os.FileInfo) bool
+	// give : Move the file back to localPath if the tier has this version of it, any other version is dropped
+	give(name string, localPath string, size int64, mtime time.Time) bool
+	drop(name string)
+	clear()
+	load()
+}
+
+type tierEntry struct {
+	name  string
+	value interface{}
+}
+
+// tierList : Files in a tier by name, least recently moved in at the back
+type tierList struct {
+	files   *list.List
+	entries map[string]*list.Element
+}
+
+func newTierList() tierList {
+	return tierList{files: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (l *tierList) add(name string, value interface{}) {
+	l.remove(name)
+	l.entries[name] = l.files.PushFront(&tierEntry{name: name, value: value})
+}
+
+func (l *tierList) has(name string) bool {
+	_, found := l.entries[name]
+	return found
+}
+
+func (l *tierList) remove(name string) interface{} {
+	if e, found := l.entries[name]; found {
+		l.files.Remove(e)
+		delete(l.entries, name)
+		return e.Value.(*tierEntry).value
+	}
+	return nil
+}
+
+// oldest : Name of the file moved in longest ago
+func (l *tierList) oldest() (string, bool) {
+	if e := l.files.Back(); e != nil {
+		return e.Value.(*tierEntry).name, true
+	}
+	return "", false
+}
+
+// diskTier : Files kept in a directory, demoted further to the next disk tier when over its high threshold
+type diskTier struct {
+	sync.Mutex
+	path          string
+	maxSizeMB     float64
+	highThreshold float64
+	lowThreshold  float64
+
+	usage *usageTracker
+	list  tierList
+	next  *diskTier
+}
+
+func newDiskTier(opt TierOptions) *diskTier {
+	t := &diskTier{
+		path:          common.ExpandPath(opt.Path),
+		maxSizeMB:     opt.MaxSizeMB,
+		highThreshold: float64(opt.HighThreshold),
+		lowThreshold:  float64(opt.LowThreshold),
+		list:          newTierList(),
+	}
+	if t.highThreshold == 0 {
+		t.highThreshold = defaultMaxThreshold
+	}
+	if t.lowThreshold == 0 {
+		t.lowThreshold = defaultMinThreshold
+	}
+	t.usage = newUsageTracker(t.path)
+	return t
+}
+
+// load : Reuse the files left in the tier by an earlier mount, they are checked against storage before their use
+func (t *diskTier) load() {
+	t.Lock()
+	defer t.Unlock()
+
+	_ = filepath.Walk(t.path, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			t.list.add(strings.TrimPrefix(path, t.path+"/"), nil)
+		}
+		return nil
+	})
+	t.usage.reconcile()
+}
+
+func (t *diskTier) take(name string, localPath string, info os.FileInfo) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	dst := filepath.Join(t.path, name)
+	err := moveFile(localPath, dst, info)
+	if err != nil {
+		log.Err("diskTier::take : Failed to move %s to %s [%s]", localPath, dst, err.Error())
+		return false
+	}
+	t.addLocked(name, dst)
+	return true
+}
+
+// takeData : Write a file dropped by the memory tier into the tier
+func (t *diskTier) takeData(name string, file *memoryFile) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	dst := filepath.Join(t.path, name)
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err == nil {
+		err = os.WriteFile(dst, file.data, file.mode)
+	}
+	if err == nil {
+		err = os.Chtimes(dst, file.mtime, file.mtime)
+	}
+	if err != nil {
+		log.Err("diskTier::takeData : Failed to write %s [%s]", dst, err.Error())
+		_ = os.Remove(dst)
+		return false
+	}
+	t.addLocked(name, dst)
+	return true
+}
+
+// addLocked : Account for a file moved into the tier. Requires Lock()
+func (t *diskTier) addLocked(name string, dst string) {
+	t.usage.changed(dst)
+	t.list.add(name, nil)
+
+	// Room is made by moving the files taken longest ago further down
+	usage := getUsagePercentage(t.usage, t.maxSizeMB)
+	if usage > t.highThreshold {
+		for usage > t.lowThreshold {
+			oldest, found := t.list.oldest()
+			if !found {
+				break
+			}
+			t.evict(oldest)
+			usage = getUsagePercentage(t.usage, t.maxSizeMB)
+		}
+	}
+}
+
+// evict : Move the file to the next tier, or delete it from the last one. Requires Lock()
+func (t *diskTier) evict(name string) {
+	t.list.remove(name)
+
+	path := filepath.Join(t.path, name)
+	info, err := os.Lstat(path)
+	if err == nil && t.next != nil && t.next.take(name, path, info) {
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, tierDemotions, (int64)(1))
+	} else {
+		_ = deleteFile(path)
+	}
+	t.usage.removed(path)
+}
+
+func (t *diskTier) give(name string, localPath string, size int64, mtime time.Time) bool {
+	t.Lock()
+	defer t.Unlock()
+
+	if !t.list.has(name) {
+		return false
+	}
+	t.list.remove(name)
+
+	src := filepath.Join(t.path, name)
+	defer t.usage.removed(src)
+
+	info, err := os.Lstat(src)
+	if err == nil && info.Size() == size && info.ModTime().Equal(mtime) {
+		err = os.MkdirAll(filepath.Dir(localPath), 0777)
+		if err == nil {
+			err = moveFile(src, localPath, info)
+		}
+		if err == nil {
+			return true
+		}
+		log.Err("diskTier::give : Failed to move %s to %s [%s]", src, localPath, err.Error())
+	}
+
+	_ = deleteFile(src)
+	return false
+}
+
+func (t *diskTier) drop(name string) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.list.has(name) {
+		t.list.remove(name)
+		path := filepath.Join(t.path, name)
+		_ = deleteFile(path)
+		t.usage.removed(path)
+	}
+}
+
+func (t *diskTier) clear() {
+	t.Lock()
+	defer t.Unlock()
+
+	dirents, err := os.ReadDir(t.path)
+	if err == nil {
+		for _, entry := range dirents {
+			os.RemoveAll(filepath.Join(t.path, entry.Name()))
+		}
+	}
+	t.list = newTierList()
+	t.usage.reconcile()
+}
+
+// memoryFile : Content of a small file kept in the memory tier
+type memoryFile struct {
+	data  []byte
+	mode  os.FileMode
+	mtime time.Time
+}
+
+// memoryTier : Small files kept in memory, the ones taken longest ago move to the first disk tier once it is full
+type memoryTier struct {
+	sync.Mutex
+	maxBytes    int64
+	maxFileSize int64
+	bytes       int64
+	list        tierList
+	next        *diskTier
+}
+
+func newMemoryTier(maxBytes int64, maxFileSize int64) *memoryTier {
+	return &memoryTier{
+		maxBytes:    maxBytes,
+		maxFileSize: maxFileSize,
+		list:        newTierList(),
+	}
+}
+
+func (t *memoryTier) take(name string, localPath string, info os.FileInfo) bool {
+	if info.Size() > t.maxFileSize || info.Size() > t.maxBytes {
+		return false
+	}
+
+	data, err := os.ReadFile(localPath)
+	if err != nil {
+		log.Err("memoryTier::take : Failed to read %s [%s]", localPath, err.Error())
+		return false
+	}
+	if deleteFile(localPath) != nil {
+		return false
+	}
+
+	t.Lock()
+	t.dropLocked(name)
+	t.list.add(name, &memoryFile{data: data, mode: info.Mode(), mtime: info.ModTime()})
+	t.bytes += int64(len(data))
+
+	overflow := make(map[string]*memoryFile)
+	for t.bytes > t.maxBytes {
+		oldest, _ := t.list.oldest()
+		if file, ok := t.list.remove(oldest).(*memoryFile); ok && file != nil {
+			t.bytes -= int64(len(file.data))
+			overflow[oldest] = file
+		}
+	}
+	t.Unlock()
+
+	// Files pushed out are written to disk outside the lock, they are lost only when there is no disk tier
+	for oldest, file := range overflow {
+		if t.next != nil && t.next.takeData(oldest, file) {
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, tierDemotions, (int64)(1))
+		}
+	}
+	return true
+}
+
+func (t *memoryTier) give(name string, localPath string, size int64, mtime time.Time) bool {
+	t.Lock()
+	file, _ := t.list.remove(name).(*memoryFile)
+	if file != nil {
+		t.bytes -= int64(len(file.data))
+	}
+	t.Unlock()
+
+	if file == nil || int64(len(file.data)) != size || !file.mtime.Equal(mtime) {
+		return false
+	}
+
+	err := os.MkdirAll(filepath.Dir(localPath), 0777)
+	if err == nil {
+		err = os.WriteFile(localPath, file.data, file.mode)
+	}
+	if err == nil {
+		err = os.Chtimes(localPath, mtime, mtime)
+	}
+	if err != nil {
+		log.Err("memoryTier::give : Failed to write %s [%s]", localPath, err.Error())
+		_ = os.Remove(localPath)
+		return false
+	}
+	return true
+}
+
+// dropLocked : Requires Lock()
+func (t *memoryTier) dropLocked(name string) {
+	if file, ok := t.list.remove(name).(*memoryFile); ok && file != nil {
+		t.bytes -= int64(len(file.data))
+	}
+}
+
+func (t *memoryTier) drop(name string) {
+	t.Lock()
+	defer t.Unlock()
+
+	t.dropLocked(name)
+}
+
+// load : Memory does not outlive the mount
+func (t *memoryTier) load() {}
+
+func (t *memoryTier) clear() {
+	t.Lock()
+	defer t.Unlock()
+
+	t.list = newTierList()
+	t.bytes = 0
+}
+
+// moveFile : Rename the file, or copy it over when the destination is on another file system
+func moveFile(src string, dst string, info os.FileInfo) error {
+	err := os.MkdirAll(filepath.Dir(dst), 0777)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if linkErr, ok := err.(*os.LinkError); !ok || linkErr.Err != syscall.EXDEV {
+		return err
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chtimes(dst, info.ModTime(), info.ModTime())
+	}
+	if err != nil {
+		_ = os.Remove(dst)
+		return err
+	}
+	return os.Remove(src)
+}
+
+// configureTiers : Memory tier goes first as it keeps small files only, disk tiers follow in the order configured
+// and each of them overflows into the one after it
+func (c *FileCache) configureTiers(conf FileCacheOptions) error {
+	c.tiers = nil
+	if conf.MemoryTierMB > 0 {
+		fileKB := int64(defaultMemoryTierFileKB)
+		if conf.MemoryTierFileKB > 0 {
+			fileKB = int64(conf.MemoryTierFileKB)
+		}
+		c.tiers = append(c.tiers, newMemoryTier(int64(conf.MemoryTierMB)*MB, fileKB*1024))
+	}
+
+	var memory *memoryTier
+	if len(c.tiers) > 0 {
+		memory = c.tiers[0].(*memoryTier)
+	}
+
+	var prev *diskTier
+	for i, opt := range conf.Tiers {
+		t := newDiskTier(opt)
+		if t.path == "" || t.path == c.tmpPath {
+			log.Err("FileCache: config error [invalid path for tier %d]", i+1)
+			return fmt.Errorf("config error in %s [invalid path for tier %d]", c.Name(), i+1)
+		}
+
+		err := os.MkdirAll(t.path, os.FileMode(0755))
+		if err != nil {
+			log.Err("FileCache: config error creating directory of tier %d [%s]", i+1, err.Error())
+			return fmt.Errorf("config error in %s [%s]", c.Name(), err.Error())
+		}
+
+		if prev != nil {
+			prev.next = t
+		} else if memory != nil {
+			memory.next = t
+		}
+		prev = t
+		c.tiers = append(c.tiers, t)
+	}
+	return nil
+}
+
+// demoteFile : Move a file evicted by the policy to the first tier which keeps it, instead of deleting it
+func (fc *FileCache) demoteFile(localPath string) bool {
+	info, err := os.Lstat(localPath)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+
+	// A partially downloaded file would be taken as complete once promoted
+	if s, err := loadSparseFile(localPath); err != nil || s != nil {
+		return false
+	}
+
+	name := strings.TrimPrefix(strings.TrimPrefix(localPath, fc.tmpPath), "/")
+	for _, t := range fc.tiers {
+		if t.take(name, localPath, info) {
+			log.Debug("FileCache::demoteFile : %s moved to a slower tier", name)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, tierDemotions, (int64)(1))
+			return true
+		}
+	}
+	return false
+}
+
+// promoteFile : Move the file back from a slower tier if one has the version in storage
+func (fc *FileCache) promoteFile(name string, localPath string, attr *internal.ObjAttr) bool {
+	for _, t := range fc.tiers {
+		if t.give(name, localPath, attr.Size, attr.Mtime) {
+			log.Debug("FileCache::promoteFile : %s moved back from a slower tier", name)
+			fileCacheStatsCollector.UpdateStats(stats_manager.Increment, tierPromotions, (int64)(1))
+			if fc.index != nil {
+				fc.index.set(name, attr)
+			}
+			fc.recordETag(name, attr)
+			return true
+		}
+	}
+	return false
+}
+
+// dropFromTiers : File changed or was deleted in storage through this mount
+func (fc *FileCache) dropFromTiers(name string) {
+	for _, t := range fc.tiers {
+		t.drop(name)
+	}
+}
@@ -0,0 +1,255 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common"
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+// Accounting drifts only if the cache directory is changed outside blobfuse2, it is corrected by a walk this often
+const usageReconcileInterval = 5 * time.Minute
+
+// usageTracker : Bytes on disk used by the cache, kept per file and updated as files are downloaded, written, truncated
+// and deleted. Changed files are only marked on the data path and looked at when usage is asked for. Open files are
+// looked at every time, as writes through cached handles and background downloads do not come through file cache.
+type usageTracker struct {
+	sync.Mutex
+	root  string
+	files map[string]int64 // Bytes on disk of each cached file by its local path
+	stale map[string]bool  // Files changed since they were last looked at
+	open  map[string]int   // Handles open on each file
+	total int64
+
+	interval time.Duration // Between reconciling walks
+	stop     chan struct{}
+	wg       sync.WaitGroup
+}
+
+func newUsageTracker(root string) *usageTracker {
+	return &usageTracker{
+		root:     root,
+		files:    make(map[string]int64),
+		stale:    make(map[string]bool),
+		open:     make(map[string]int),
+		interval: usageReconcileInterval,
+	}
+}
+
+// changed : File was created or its size may have changed
+func (u *usageTracker) changed(path string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	u.stale[path] = true
+	u.Unlock()
+}
+
+// opened : Handle was opened on the file, its size is looked at each time usage is asked for till it is closed
+func (u *usageTracker) opened(path string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	u.open[path]++
+	u.Unlock()
+}
+
+// closed : Handle on the file was closed
+func (u *usageTracker) closed(path string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.stale[path] = true
+	if u.open[path] > 1 {
+		u.open[path]--
+	} else {
+		delete(u.open, path)
+	}
+}
+
+// removed : File was deleted from the cache
+func (u *usageTracker) removed(path string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	delete(u.stale, path)
+	u.total -= u.files[path]
+	delete(u.files, path)
+}
+
+// renamed : File was moved within the cache, replacing whatever was at the destination
+func (u *usageTracker) renamed(src string, dst string) {
+	if u == nil {
+		return
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	if u.stale[src] {
+		delete(u.stale, src)
+		u.stale[dst] = true
+	}
+	u.total -= u.files[dst]
+	delete(u.files, dst)
+	if size, found := u.files[src]; found {
+		delete(u.files, src)
+		u.files[dst] = size
+	}
+}
+
+// refresh : Look at the files changed since last time and the ones open, requires Lock()
+func (u *usageTracker) refresh() {
+	for path := range u.open {
+		u.stale[path] = true
+	}
+
+	for path := range u.stale {
+		u.total -= u.files[path]
+		delete(u.files, path)
+
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode().IsRegular() {
+			u.files[path] = common.DiskBytes(info)
+			u.total += u.files[path]
+		}
+	}
+	u.stale = make(map[string]bool)
+}
+
+// get : Bytes used and number of files in the cache
+func (u *usageTracker) get() (int64, int64) {
+	if u == nil {
+		return 0, 0
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.refresh()
+	return u.total, int64(len(u.files))
+}
+
+// under : Bytes on disk of the files whose local path starts with prefix
+func (u *usageTracker) under(prefix string) map[string]int64 {
+	files := make(map[string]int64)
+	if u == nil {
+		return files
+	}
+
+	u.Lock()
+	defer u.Unlock()
+
+	u.refresh()
+	for path, size := range u.files {
+		if strings.HasPrefix(path, prefix) {
+			files[path] = size
+		}
+	}
+	return files
+}
+
+// reconcile : Walk the cache and replace the accounting with what is on disk
+func (u *usageTracker) reconcile() {
+	lockDir := filepath.Join(u.root, sharedLockDir)
+	files, total := common.DirUsage(u.root, func(path string, d fs.DirEntry) bool {
+		return d.IsDir() && path == lockDir
+	})
+
+	u.Lock()
+	u.refresh()
+	if u.total != total || len(u.files) != len(files) {
+		log.Info("usageTracker::reconcile : Usage corrected from %d bytes in %d files to %d bytes in %d files",
+			u.total, len(u.files), total, len(files))
+	}
+	u.files = files
+	u.total = total
+	u.Unlock()
+
+	updateUsageStats(total, int64(len(files)))
+}
+
+// start : Account for the files already in the cache and reconcile periodically
+func (u *usageTracker) start() {
+	u.reconcile()
+
+	u.stop = make(chan struct{})
+	u.wg.Add(1)
+	go func() {
+		defer u.wg.Done()
+		ticker := time.NewTicker(u.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-u.stop:
+				return
+			case <-ticker.C:
+				u.reconcile()
+			}
+		}
+	}()
+}
+
+func (u *usageTracker) shutdown() {
+	if u.stop != nil {
+		close(u.stop)
+		u.wg.Wait()
+	}
+}
+
+func updateUsageStats(bytes int64, files int64) {
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, cacheBytes, bytes)
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, cacheFiles, files)
+}
@@ -0,0 +1,568 @@
+/*
+    _____           _____   _____   ____          ______  _____  ------
+   |     |  |      |     | |     | |     |     | |       |            |
+   |     |  |      |     | |     | |     |     | |       |            |
+   | --- |  |      |     | |-----| |---- |     | |-----| |-----  ------
+   |     |  |      |     | |     | |     |     |       | |       |
+   | ____|  |_____ | ____| | ____| |     |_____|  _____| |_____  |_____
+
+
+   Licensed under the MIT License <http://opensource.org/licenses/MIT>.
+
+   Copyright © 2020-2022 Microsoft Corporation. All rights reserved.
+   Author : <blobfusedev@microsoft.com>
+
+   Permission is hereby granted, free of charge, to any person obtaining a copy
+   of this software and associated documentation files (the "Software"), to deal
+   in the Software without restriction, including without limitation the rights
+   to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+   copies of the Software, and to permit persons to whom the Software is
+   furnished to do so, subject to the following conditions:
+
+   The above copyright notice and this permission notice shall be included in all
+   copies or substantial portions of the Software.
+
+   THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+   IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+   FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+   AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+   LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+   OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+   SOFTWARE
+*/
+
+package file_cache
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-storage-fuse/v2/common/log"
+	"github.com/Azure/azure-storage-fuse/v2/internal"
+	"github.com/Azure/azure-storage-fuse/v2/internal/stats_manager"
+)
+
+const (
+	defaultWriteBackWorkers = 4
+	writeBackJournalExt     = ".wb"
+
+	// Failed uploads are retried after a delay doubling from the min to the max
+	writeBackMinRetry = time.Second
+	writeBackMaxRetry = 5 * time.Minute
+)
+
+// writeBackRecord : Journal entry of a file closed locally which is still to be uploaded
+type writeBackRecord struct {
+	Name   string    `json:"name"`
+	Queued time.Time `json:"queued"`
+}
+
+// writeBackItem : In memory state of a pending upload
+type writeBackItem struct {
+	uploading bool      // A worker or a sync flush is uploading the file right now
+	again     bool      // File was flushed again during the upload, so upload it once more
+	attempts  int       // Failed uploads so far
+	retryAt   time.Time // Earliest time of the next attempt
+}
+
+// writeBack : Queue of files closed locally but not yet uploaded. Each pending file has an entry in the journal
+// directory till its upload succeeds, so uploads pending at unmount or crash are done on next mount. A file is
+// uploaded by one worker at a time so uploads of a path are applied in order.
+type writeBack struct {
+	sync.Mutex
+	cond    *sync.Cond
+	dir     string
+	workers int
+	pending map[string]*writeBackItem
+	queue   []string // Pending files not being uploaded, oldest first
+
+	upload  func(name string) error // Upload the cached file to storage
+	release func(name string)       // File is no more pending, it may be evicted now
+
+	paused  bool // Storage is offline, uploads wait till it is back
+	stopped bool
+	wg      sync.WaitGroup
+	ticker  *time.Ticker
+	quit    chan struct{} // Stops the ticker waking up workers for retries
+}
+
+func newWriteBack(dir string, workers int, upload func(string) error, release func(string)) (*writeBack, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	wb := &writeBack{
+		dir:     dir,
+		workers: workers,
+		pending: make(map[string]*writeBackItem),
+		upload:  upload,
+		release: release,
+	}
+	wb.cond = sync.NewCond(&wb.Mutex)
+	return wb, nil
+}
+
+// journalPath : Journal entry of the given file
+func (wb *writeBack) journalPath(name string) string {
+	hash := md5.Sum([]byte(name))
+	return filepath.Join(wb.dir, hex.EncodeToString(hash[:])+writeBackJournalExt)
+}
+
+// persist : Record the file in the journal, synced to disk before close returns to the user
+func (wb *writeBack) persist(name string) error {
+	data, err := json.Marshal(writeBackRecord{Name: name, Queued: time.Now()})
+	if err != nil {
+		return err
+	}
+
+	path := wb.journalPath(name)
+	f, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (wb *writeBack) unpersist(name string) {
+	err := os.Remove(wb.journalPath(name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Warn("writeBack::unpersist : Failed to remove journal entry of %s [%s]", name, err.Error())
+	}
+}
+
+// journal : Files left pending when blobfuse2 last stopped
+func (wb *writeBack) journal() []writeBackRecord {
+	entries, err := os.ReadDir(wb.dir)
+	if err != nil {
+		log.Err("writeBack::journal : Failed to read %s [%s]", wb.dir, err.Error())
+		return nil
+	}
+
+	records := make([]writeBackRecord, 0)
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), writeBackJournalExt) {
+			continue
+		}
+
+		path := filepath.Join(wb.dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		rec := writeBackRecord{}
+		if json.Unmarshal(data, &rec) != nil || rec.Name == "" {
+			log.Warn("writeBack::journal : Discarding corrupt journal entry %s", entry.Name())
+			_ = os.Remove(path)
+			continue
+		}
+		records = append(records, rec)
+	}
+	return records
+}
+
+// add : Queue the file for upload, returns true if it was not pending already
+func (wb *writeBack) add(name string) (bool, error) {
+	wb.Lock()
+	defer wb.Unlock()
+
+	item, found := wb.pending[name]
+	if found {
+		if item.uploading {
+			item.again = true
+		}
+		return false, nil
+	}
+
+	err := wb.persist(name)
+	if err != nil {
+		return false, err
+	}
+
+	wb.pending[name] = &writeBackItem{}
+	wb.queue = append(wb.queue, name)
+	wb.updateStats()
+	wb.cond.Signal()
+	return true, nil
+}
+
+// restore : Queue files from the journal, which are already persisted
+func (wb *writeBack) restore(name string) {
+	wb.Lock()
+	defer wb.Unlock()
+
+	if _, found := wb.pending[name]; !found {
+		wb.pending[name] = &writeBackItem{}
+		wb.queue = append(wb.queue, name)
+		wb.updateStats()
+	}
+}
+
+// has : Whether the file is pending upload
+func (wb *writeBack) has(name string) bool {
+	wb.Lock()
+	defer wb.Unlock()
+	_, found := wb.pending[name]
+	return found
+}
+
+// count : Number of files pending upload
+func (wb *writeBack) count() int {
+	wb.Lock()
+	defer wb.Unlock()
+	return len(wb.pending)
+}
+
+func (wb *writeBack) updateStats() {
+	fileCacheStatsCollector.UpdateStats(stats_manager.Replace, writeBackPending, (int64)(len(wb.pending)))
+}
+
+// under : Pending files in the given directory and its subdirectories
+func (wb *writeBack) under(dir string) []string {
+	wb.Lock()
+	defer wb.Unlock()
+
+	prefix := internal.ExtendDirName(dir)
+	names := make([]string, 0)
+	for name := range wb.pending {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// dequeue : Remove the file from the queue of files waiting for a worker
+func (wb *writeBack) dequeue(name string) {
+	for i, n := range wb.queue {
+		if n == name {
+			wb.queue = append(wb.queue[:i], wb.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+// next : Wait for a file due for upload and mark it uploading, empty once stopped
+func (wb *writeBack) next() string {
+	wb.Lock()
+	defer wb.Unlock()
+
+	for !wb.stopped {
+		now := time.Now()
+		for _, name := range wb.queue {
+			item := wb.pending[name]
+			if !wb.paused && !item.retryAt.After(now) {
+				wb.dequeue(name)
+				item.uploading = true
+				return name
+			}
+		}
+		wb.cond.Wait()
+	}
+	return ""
+}
+
+// done : Record result of an upload, dropping the file from the journal on success
+func (wb *writeBack) done(name string, err error) {
+	wb.Lock()
+	item := wb.pending[name]
+	item.uploading = false
+	defer wb.cond.Broadcast()
+
+	if err != nil && wb.paused {
+		// Failed for want of storage, not counted as an attempt
+		wb.queue = append(wb.queue, name)
+		wb.Unlock()
+
+		log.Info("writeBack::done : Upload of %s deferred till storage is reachable [%s]", name, err.Error())
+		return
+	}
+
+	if err != nil {
+		item.attempts++
+		delay := writeBackMinRetry << (item.attempts - 1)
+		if delay > writeBackMaxRetry || delay <= 0 {
+			delay = writeBackMaxRetry
+		}
+		item.retryAt = time.Now().Add(delay)
+		wb.queue = append(wb.queue, name)
+		wb.Unlock()
+
+		log.Err("writeBack::done : Upload of %s failed, attempt %d, retrying in %s [%s]", name, item.attempts, delay, err.Error())
+		fileCacheStatsCollector.UpdateStats(stats_manager.Increment, writeBackFailures, (int64)(1))
+		return
+	}
+
+	fileCacheStatsCollector.UpdateStats(stats_manager.Increment, writeBackUploads, (int64)(1))
+	if item.again {
+		// Changed during the upload so the uploaded content may be stale
+		item.again = false
+		item.attempts = 0
+		item.retryAt = time.Time{}
+		wb.queue = append(wb.queue, name)
+		wb.Unlock()
+		return
+	}
+
+	delete(wb.pending, name)
+	wb.unpersist(name)
+	wb.updateStats()
+	wb.Unlock()
+
+	wb.release(name)
+}
+
+// take : Wait for the upload of the file in progress, if any, and claim the file. Returns false if it is not pending.
+func (wb *writeBack) take(name string) bool {
+	wb.Lock()
+	defer wb.Unlock()
+
+	for {
+		item, found := wb.pending[name]
+		if !found {
+			return false
+		}
+		if !item.uploading {
+			wb.dequeue(name)
+			item.uploading = true
+			item.again = false
+			return true
+		}
+		wb.cond.Wait()
+	}
+}
+
+// flush : Upload the file now if it is pending, used when the user asks for data to be in storage
+func (wb *writeBack) flush(name string) error {
+	if !wb.take(name) {
+		return nil
+	}
+
+	err := wb.upload(name)
+	wb.done(name, err)
+	return err
+}
+
+// cancel : Drop the file from the queue as it is being deleted, waiting for an upload in progress.
+// Returns true if the file was pending.
+func (wb *writeBack) cancel(name string) bool {
+	if !wb.take(name) {
+		return false
+	}
+
+	wb.Lock()
+	delete(wb.pending, name)
+	wb.unpersist(name)
+	wb.updateStats()
+	wb.cond.Broadcast()
+	wb.Unlock()
+	return true
+}
+
+// pause : Hold uploads while storage is offline
+func (wb *writeBack) pause() {
+	wb.Lock()
+	defer wb.Unlock()
+	wb.paused = true
+}
+
+// resume : Storage is back, upload what was queued meanwhile at once
+func (wb *writeBack) resume() {
+	wb.Lock()
+	defer wb.Unlock()
+
+	wb.paused = false
+	for _, item := range wb.pending {
+		item.attempts = 0
+		item.retryAt = time.Time{}
+	}
+	wb.cond.Broadcast()
+}
+
+// start : Start the workers, and a ticker waking them up for retries
+func (wb *writeBack) start() {
+	wb.ticker = time.NewTicker(writeBackMinRetry)
+	wb.quit = make(chan struct{})
+	wb.wg.Add(1)
+	go func() {
+		defer wb.wg.Done()
+		for {
+			select {
+			case <-wb.quit:
+				return
+			case <-wb.ticker.C:
+				wb.cond.Broadcast()
+			}
+		}
+	}()
+
+	for i := 0; i < wb.workers; i++ {
+		wb.wg.Add(1)
+		go func() {
+			defer wb.wg.Done()
+			for {
+				name := wb.next()
+				if name == "" {
+					return
+				}
+				wb.done(name, wb.upload(name))
+			}
+		}()
+	}
+}
+
+// stop : Stop the workers after the uploads in progress, then try once more the files still pending.
+// Files which fail stay in the journal for next mount.
+func (wb *writeBack) stop() {
+	wb.Lock()
+	wb.stopped = true
+	wb.cond.Broadcast()
+	wb.Unlock()
+
+	if wb.quit != nil {
+		close(wb.quit)
+	}
+	wb.wg.Wait()
+	if wb.ticker != nil {
+		wb.ticker.Stop()
+	}
+
+	wb.Lock()
+	names := append([]string{}, wb.queue...)
+	paused := wb.paused
+	wb.Unlock()
+
+	if paused {
+		log.Warn("writeBack::stop : Storage is offline, %d files will be uploaded on next mount", len(names))
+		return
+	}
+
+	for _, name := range names {
+		if wb.take(name) {
+			err := wb.upload(name)
+			if err == nil {
+				wb.done(name, nil)
+			} else {
+				log.Err("writeBack::stop : Upload of %s failed, will retry on next mount [%s]", name, err.Error())
+				wb.Lock()
+				wb.pending[name].uploading = false
+				wb.Unlock()
+			}
+		}
+	}
+}
+
+// writeBackUpload : Upload a pending file from the local cache the way a flush does, holding the lock of the file so
+// it is not written to or replaced meanwhile
+func (fc *FileCache) writeBackUpload(name string) error {
+	if fc.offline() {
+		return errStorageOffline
+	}
+	localPath := filepath.Join(fc.tmpPath, name)
+
+	flock := fc.fileLocks.Get(name)
+	flock.Lock()
+	defer flock.Unlock()
+
+	// Blob may have changed while the file waited, more so if storage was offline meanwhile
+	if fc.conn != nil {
+		resolved, err := fc.resolveConflict(name, localPath)
+		if err != nil || resolved {
+			fc.checkOffline(err)
+			return err
+		}
+	}
+
+	// Ranges are not known for files queued by an earlier mount, those are uploaded whole
+	var dirty *dirtyRanges
+	if val, found := fc.writeBackDirty.Load(name); found {
+		dirty = val.(*dirtyRanges)
+	}
+
+	err := fc.uploadCached(name, dirty)
+	if err != nil {
+		fc.checkOffline(err)
+		return err
+	}
+	return nil
+}
+
+// writeBackRelease : Pending file holds a reference like an open handle so it is not evicted, drop it once uploaded
+func (fc *FileCache) writeBackRelease(name string) {
+	flock := fc.fileLocks.Get(name)
+	flock.Lock()
+	flock.Dec()
+	fc.writeBackDirty.Delete(name)
+	if flock.Count() == 0 {
+		fc.releaseSparseFile(name)
+	}
+	flock.Unlock()
+
+	fc.policy.CacheInvalidate(filepath.Join(fc.tmpPath, name))
+}
+
+// writeBackQueue : Make the data of a closed file durable locally and queue it for upload instead of uploading it now
+func (fc *FileCache) writeBackQueue(name string, f *os.File, dirty *dirtyRanges) error {
+	err := f.Sync()
+	if err != nil {
+		return err
+	}
+
+	flock := fc.fileLocks.Get(name)
+	flock.Lock()
+	defer flock.Unlock()
+
+	added, err := fc.writeBack.add(name)
+	if err != nil {
+		return err
+	}
+
+	// Ranges written through this handle are uploaded along with those of earlier handles still pending
+	val, _ := fc.writeBackDirty.LoadOrStore(name, &dirtyRanges{})
+	if dirty == nil {
+		val.(*dirtyRanges).setFull()
+	} else {
+		val.(*dirtyRanges).restore(dirty.take())
+	}
+	if added {
+		flock.Inc()
+	}
+	return nil
+}
+
+// replayWriteBack : Queue the files left pending in the journal when blobfuse2 last stopped
+func (fc *FileCache) replayWriteBack() {
+	for _, rec := range fc.writeBack.journal() {
+		localPath := filepath.Join(fc.tmpPath, rec.Name)
+		if _, err := os.Stat(localPath); err != nil {
+			log.Err("FileCache::replayWriteBack : Dropping pending upload of %s queued at %s, cached file is missing [%s]",
+				rec.Name, rec.Queued, err.Error())
+			fc.writeBack.unpersist(rec.Name)
+			continue
+		}
+
+		log.Info("FileCache::replayWriteBack : Resuming upload of %s queued at %s", rec.Name, rec.Queued)
+		flock := fc.fileLocks.Get(rec.Name)
+		flock.Lock()
+		flock.Inc()
+		flock.Unlock()
+
+		fc.policy.CacheValid(localPath)
+		fc.writeBack.restore(rec.Name)
+	}
+}
@@ -35,7 +35,11 @@ package libfuse
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"os"
+	"strings"
+	"syscall"
 
 	"github.com/Azure/azure-storage-fuse/v2/common"
 	"github.com/Azure/azure-storage-fuse/v2/common/config"
@@ -68,6 +72,7 @@ type Libfuse struct {
 	extensionPath         string
 	disableWritebackCache bool
 	ignoreOpenFlags       bool
+	posixACL              bool
 	lsFlags               common.BitMap16
 }
 
@@ -93,6 +98,7 @@ type LibfuseOptions struct {
 	ExtensionPath           string `config:"extension" yaml:"extension,omitempty"`
 	DisableWritebackCache   bool   `config:"disable-writeback-cache" yaml:"-"`
 	IgnoreOpenFlags         bool   `config:"ignore-open-flags" yaml:"ignore-open-flags,omitempty"`
+	PosixACL                bool   `config:"posix-acl" yaml:"posix-acl,omitempty"`
 }
 
 const compName = "libfuse"
@@ -169,6 +175,7 @@ func (lf *Libfuse) Validate(opt *LibfuseOptions) error {
 	lf.extensionPath = opt.ExtensionPath
 	lf.disableWritebackCache = opt.DisableWritebackCache
 	lf.ignoreOpenFlags = opt.IgnoreOpenFlags
+	lf.posixACL = opt.PosixACL
 
 	if opt.allowOther {
 		lf.dirPermission = uint(common.DefaultAllowOtherPermissionBits)
@@ -294,3 +301,19 @@ func init() {
 	ignoreOpenFlags := config.AddBoolFlag("ignore-open-flags", false, "Ignore unsupported open flags (APPEND, WRONLY) by blobfuse when writeback caching is enabled.")
 	config.BindPFlag(compName+".ignore-open-flags", ignoreOpenFlags)
 }
+
+// isSupportedXattr : Only POSIX ACLs and user namespace xattrs are passed down the pipeline
+func isSupportedXattr(name string) bool {
+	return strings.HasPrefix(name, "user.") || strings.HasPrefix(name, "system.posix_acl_")
+}
+
+// xattrErrno : Convert error received from the pipeline for an xattr operation to errno for the kernel
+func xattrErrno(err error) syscall.Errno {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		return errno
+	} else if os.IsNotExist(err) {
+		return syscall.ENOENT
+	}
+	return syscall.EIO
+}
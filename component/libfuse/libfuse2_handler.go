@@ -48,8 +48,10 @@ import (
 	"fmt"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/Azure/azure-storage-fuse/v2/common"
@@ -271,8 +273,14 @@ func libfuse_destroy(data unsafe.Pointer) {
 }
 
 func (lf *Libfuse) fillStat(attr *internal.ObjAttr, stbuf *C.stat_t) {
-	(*stbuf).st_uid = C.uint(lf.ownerUID)
-	(*stbuf).st_gid = C.uint(lf.ownerGID)
+	// Backing storage has the owner of this path so report that instead of the mounting user
+	if attr.IsOwnerSet() {
+		(*stbuf).st_uid = C.uint(attr.Uid)
+		(*stbuf).st_gid = C.uint(attr.Gid)
+	} else {
+		(*stbuf).st_uid = C.uint(lf.ownerUID)
+		(*stbuf).st_gid = C.uint(lf.ownerGID)
+	}
 	(*stbuf).st_nlink = 1
 	(*stbuf).st_size = C.long(attr.Size)
 
@@ -336,6 +344,10 @@ func libfuse2_getattr(path *C.char, stbuf *C.stat_t) C.int {
 	attr, err := fuseFS.NextComponent().GetAttr(internal.GetAttrOptions{Name: name})
 	if err != nil {
 		//log.Err("Libfuse::libfuse2_getattr : Failed to get attributes of %s [%s]", name, err.Error())
+		if err == syscall.ENOTCONN {
+			// Storage is unreachable, do not let kernel cache a negative entry
+			return -C.ENOTCONN
+		}
 		return -C.ENOENT
 	}
 
@@ -971,7 +983,33 @@ func libfuse2_chown(path *C.char, uid C.uid_t, gid C.gid_t) C.int {
 	name := trimFusePath(path)
 	name = common.NormalizeObjectName(name)
 	log.Trace("Libfuse::libfuse2_chown : %s", name)
-	// TODO: Implement
+
+	// (uid_t)-1 or (gid_t)-1 means that id is not to be changed
+	owner, group := int(uid), int(gid)
+	if uint32(uid) == math.MaxUint32 {
+		owner = -1
+	}
+	if uint32(gid) == math.MaxUint32 {
+		group = -1
+	}
+
+	err := fuseFS.NextComponent().Chown(
+		internal.ChownOptions{
+			Name:  name,
+			Owner: owner,
+			Group: group,
+		})
+	if err != nil {
+		log.Err("Libfuse::libfuse2_chown : error in chown of %s [%s]", name, err.Error())
+		if os.IsNotExist(err) {
+			return -C.ENOENT
+		}
+		return -C.EIO
+	}
+
+	libfuseStatsCollector.PushEvents(chown, name, map[string]interface{}{ownr: owner, grp: group})
+	libfuseStatsCollector.UpdateStats(stats_manager.Increment, chown, (int64)(1))
+
 	return 0
 }
 
@@ -981,9 +1019,166 @@ func libfuse2_utimens(path *C.char, tv *C.timespec_t) C.int {
 	name := trimFusePath(path)
 	name = common.NormalizeObjectName(name)
 	log.Trace("Libfuse::libfuse2_utimens : %s", name)
-	// TODO: is the conversion from [2]timespec to *timespec ok?
-	// TODO: Implement
-	// For now this returns 0 to allow touch to work correctly
+
+	attr := &internal.ObjAttr{}
+	if tv == nil {
+		// No times given means set both to current time
+		attr.Atime = time.Now()
+		attr.Mtime = attr.Atime
+	} else {
+		times := (*[2]C.timespec_t)(unsafe.Pointer(tv))
+		attr.Atime = timespecToTime(times[0])
+		attr.Mtime = timespecToTime(times[1])
+	}
+
+	if attr.Atime.IsZero() && attr.Mtime.IsZero() {
+		return 0
+	}
+
+	err := fuseFS.NextComponent().SetAttr(internal.SetAttrOptions{Name: name, Attr: attr})
+	if err != nil {
+		log.Err("Libfuse::libfuse2_utimens : error in setting times of %s [%s]", name, err.Error())
+		if os.IsNotExist(err) {
+			return -C.ENOENT
+		}
+		return -C.EIO
+	}
+
+	libfuseStatsCollector.PushEvents(utimens, name, map[string]interface{}{atm: attr.Atime, mtm: attr.Mtime})
+	libfuseStatsCollector.UpdateStats(stats_manager.Increment, utimens, (int64)(1))
+
+	return 0
+}
+
+// timespecToTime : Convert the time given by kernel, UTIME_OMIT is returned as zero time which means leave it unchanged
+func timespecToTime(ts C.timespec_t) time.Time {
+	switch ts.tv_nsec {
+	case C.UTIME_NOW:
+		return time.Now()
+	case C.UTIME_OMIT:
+		return time.Time{}
+	}
+	return time.Unix(int64(ts.tv_sec), int64(ts.tv_nsec))
+}
+
+// Extended Attribute Operations
+
+// libfuse_setxattr sets an extended attribute of a path
+//export libfuse_setxattr
+func libfuse_setxattr(path *C.char, name *C.char, value *C.char, size C.size_t, flags C.int) C.int {
+	fileName := trimFusePath(path)
+	fileName = common.NormalizeObjectName(fileName)
+	attrName := C.GoString(name)
+	log.Trace("Libfuse::libfuse_setxattr : %s, %s", fileName, attrName)
+
+	err := fuseFS.NextComponent().SetXattr(
+		internal.SetXattrOptions{
+			Name:  fileName,
+			Attr:  attrName,
+			Value: C.GoBytes(unsafe.Pointer(value), C.int(size)),
+			Flags: int(flags),
+		})
+	if err != nil {
+		log.Err("Libfuse::libfuse_setxattr : error setting %s of %s [%s]", attrName, fileName, err.Error())
+		return -C.int(xattrErrno(err))
+	}
+
+	libfuseStatsCollector.PushEvents(setXattr, fileName, map[string]interface{}{xattr: attrName})
+	libfuseStatsCollector.UpdateStats(stats_manager.Increment, setXattr, (int64)(1))
+
+	return 0
+}
+
+// libfuse_getxattr reads an extended attribute of a path
+//export libfuse_getxattr
+func libfuse_getxattr(path *C.char, name *C.char, value *C.char, size C.size_t) C.int {
+	fileName := trimFusePath(path)
+	fileName = common.NormalizeObjectName(fileName)
+	attrName := C.GoString(name)
+
+	if !isSupportedXattr(attrName) {
+		// Kernel queries security.capability on every write, do not send such calls down the pipeline
+		return -C.ENODATA
+	}
+	log.Trace("Libfuse::libfuse_getxattr : %s, %s", fileName, attrName)
+
+	data, err := fuseFS.NextComponent().GetXattr(internal.GetXattrOptions{Name: fileName, Attr: attrName})
+	if err != nil {
+		errno := xattrErrno(err)
+		if errno != syscall.ENODATA && errno != syscall.ENOTSUP {
+			log.Err("Libfuse::libfuse_getxattr : error getting %s of %s [%s]", attrName, fileName, err.Error())
+		}
+		return -C.int(errno)
+	}
+
+	// Size zero means caller is asking for the size of the value
+	if size == 0 {
+		return C.int(len(data))
+	} else if len(data) > int(size) {
+		return -C.ERANGE
+	}
+
+	if len(data) > 0 {
+		buf := (*[1 << 30]byte)(unsafe.Pointer(value))
+		copy(buf[:size], data)
+	}
+
+	return C.int(len(data))
+}
+
+// libfuse_listxattr lists names of extended attributes of a path
+//export libfuse_listxattr
+func libfuse_listxattr(path *C.char, list *C.char, size C.size_t) C.int {
+	fileName := trimFusePath(path)
+	fileName = common.NormalizeObjectName(fileName)
+	log.Trace("Libfuse::libfuse_listxattr : %s", fileName)
+
+	names, err := fuseFS.NextComponent().ListXattr(internal.ListXattrOptions{Name: fileName})
+	if err != nil {
+		log.Err("Libfuse::libfuse_listxattr : error listing xattrs of %s [%s]", fileName, err.Error())
+		return -C.int(xattrErrno(err))
+	}
+
+	// Names are returned as a list of null terminated strings
+	length := 0
+	for _, attrName := range names {
+		length += len(attrName) + 1
+	}
+
+	if size == 0 {
+		return C.int(length)
+	} else if length > int(size) {
+		return -C.ERANGE
+	}
+
+	buf := (*[1 << 30]byte)(unsafe.Pointer(list))
+	offset := 0
+	for _, attrName := range names {
+		offset += copy(buf[offset:size], attrName)
+		buf[offset] = 0
+		offset++
+	}
+
+	return C.int(length)
+}
+
+// libfuse_removexattr removes an extended attribute of a path
+//export libfuse_removexattr
+func libfuse_removexattr(path *C.char, name *C.char) C.int {
+	fileName := trimFusePath(path)
+	fileName = common.NormalizeObjectName(fileName)
+	attrName := C.GoString(name)
+	log.Trace("Libfuse::libfuse_removexattr : %s, %s", fileName, attrName)
+
+	err := fuseFS.NextComponent().RemoveXattr(internal.RemoveXattrOptions{Name: fileName, Attr: attrName})
+	if err != nil {
+		log.Err("Libfuse::libfuse_removexattr : error removing %s of %s [%s]", attrName, fileName, err.Error())
+		return -C.int(xattrErrno(err))
+	}
+
+	libfuseStatsCollector.PushEvents(removeXattr, fileName, map[string]interface{}{xattr: attrName})
+	libfuseStatsCollector.UpdateStats(stats_manager.Increment, removeXattr, (int64)(1))
+
 	return 0
 }
 
@@ -46,6 +46,10 @@ const (
 	syncFile     = "SyncFile"
 	syncDir      = "SyncDir"
 	chmod        = "Chmod"
+	chown        = "Chown"
+	utimens      = "Utimens"
+	setXattr     = "SetXattr"
+	removeXattr  = "RemoveXattr"
 
 	openHandles = "OpenFileHandles"
 	md          = "Mode"
@@ -53,4 +57,9 @@ const (
 	source      = "Src"
 	dest        = "Dest"
 	trgt        = "Target"
+	ownr        = "Owner"
+	grp         = "Group"
+	atm         = "Atime"
+	mtm         = "Mtime"
+	xattr       = "Xattr"
 )
@@ -145,6 +145,16 @@ func (suite *libfuseTestSuite) TestIgnoreAppendFlag() {
 	suite.assert.False(suite.libfuse.ignoreOpenFlags)
 }
 
+func (suite *libfuseTestSuite) TestPosixACL() {
+	defer suite.cleanupTest()
+	suite.assert.False(suite.libfuse.posixACL)
+
+	suite.cleanupTest() // clean up the default libfuse generated
+	config := "libfuse:\n  posix-acl: true\n"
+	suite.setupTestHelper(config) // setup a new libfuse with a custom config (clean up will occur after the test as usual)
+	suite.assert.True(suite.libfuse.posixACL)
+}
+
 // getattr
 
 func (suite *libfuseTestSuite) TestMkDir() {
@@ -295,10 +305,54 @@ func (suite *libfuseTestSuite) TestChown() {
 	testChown(suite)
 }
 
+func (suite *libfuseTestSuite) TestChownUnchangedGroup() {
+	testChownUnchangedGroup(suite)
+}
+
+func (suite *libfuseTestSuite) TestChownNotExists() {
+	testChownNotExists(suite)
+}
+
 func (suite *libfuseTestSuite) TestUtimens() {
 	testUtimens(suite)
 }
 
+func (suite *libfuseTestSuite) TestUtimensOmit() {
+	testUtimensOmit(suite)
+}
+
+func (suite *libfuseTestSuite) TestUtimensError() {
+	testUtimensError(suite)
+}
+
+func (suite *libfuseTestSuite) TestSetXattr() {
+	testSetXattr(suite)
+}
+
+func (suite *libfuseTestSuite) TestSetXattrNotSupported() {
+	testSetXattrNotSupported(suite)
+}
+
+func (suite *libfuseTestSuite) TestGetXattr() {
+	testGetXattr(suite)
+}
+
+func (suite *libfuseTestSuite) TestGetXattrNoData() {
+	testGetXattrNoData(suite)
+}
+
+func (suite *libfuseTestSuite) TestListXattr() {
+	testListXattr(suite)
+}
+
+func (suite *libfuseTestSuite) TestRemoveXattr() {
+	testRemoveXattr(suite)
+}
+
+func (suite *libfuseTestSuite) TestRemoveXattrError() {
+	testRemoveXattrError(suite)
+}
+
 // In order for 'go test' to run this suite, we need to create
 // a normal test function and pass our suite to suite.Run
 func TestLibfuseTestSuite(t *testing.T) {
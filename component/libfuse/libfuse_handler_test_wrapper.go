@@ -42,8 +42,10 @@ import "C"
 import (
 	"errors"
 	"io/fs"
+	"math"
 	"strings"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/Azure/azure-storage-fuse/v2/common"
@@ -645,17 +647,204 @@ func testChown(suite *libfuseTestSuite) {
 	defer C.free(unsafe.Pointer(path))
 	group := C.uint(5)
 	owner := C.uint(4)
+	options := internal.ChownOptions{Name: name, Owner: 4, Group: 5}
+	suite.mock.EXPECT().Chown(options).Return(nil)
 
 	err := libfuse_chown(path, owner, group, nil)
 	suite.assert.Equal(C.int(0), err)
 }
 
+func testChownUnchangedGroup(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	group := C.uint(math.MaxUint32)
+	owner := C.uint(4)
+	options := internal.ChownOptions{Name: name, Owner: 4, Group: -1}
+	suite.mock.EXPECT().Chown(options).Return(nil)
+
+	err := libfuse_chown(path, owner, group, nil)
+	suite.assert.Equal(C.int(0), err)
+}
+
+func testChownNotExists(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	group := C.uint(5)
+	owner := C.uint(4)
+	options := internal.ChownOptions{Name: name, Owner: 4, Group: 5}
+	suite.mock.EXPECT().Chown(options).Return(syscall.ENOENT)
+
+	err := libfuse_chown(path, owner, group, nil)
+	suite.assert.Equal(C.int(-C.ENOENT), err)
+}
+
 func testUtimens(suite *libfuseTestSuite) {
 	defer suite.cleanupTest()
 	name := "path"
 	path := C.CString("/" + name)
 	defer C.free(unsafe.Pointer(path))
+	suite.mock.EXPECT().SetAttr(gomock.Any()).Return(nil)
 
 	err := libfuse_utimens(path, nil, nil)
 	suite.assert.Equal(C.int(0), err)
 }
+
+func testUtimensOmit(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	tv := [2]C.timespec_t{}
+	tv[0].tv_nsec = C.UTIME_OMIT
+	tv[1].tv_sec = 1000
+	tv[1].tv_nsec = 5
+	options := internal.SetAttrOptions{Name: name, Attr: &internal.ObjAttr{Mtime: time.Unix(1000, 5)}}
+	suite.mock.EXPECT().SetAttr(options).Return(nil)
+
+	err := libfuse_utimens(path, &tv[0], nil)
+	suite.assert.Equal(C.int(0), err)
+
+	// Nothing to update
+	tv[1].tv_nsec = C.UTIME_OMIT
+	err = libfuse_utimens(path, &tv[0], nil)
+	suite.assert.Equal(C.int(0), err)
+}
+
+func testUtimensError(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	suite.mock.EXPECT().SetAttr(gomock.Any()).Return(errors.New("failed to set times"))
+
+	err := libfuse_utimens(path, nil, nil)
+	suite.assert.Equal(C.int(-C.EIO), err)
+}
+
+func testSetXattr(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("system.posix_acl_access")
+	defer C.free(unsafe.Pointer(attr))
+	value := C.CString("value")
+	defer C.free(unsafe.Pointer(value))
+	options := internal.SetXattrOptions{Name: name, Attr: "system.posix_acl_access", Value: []byte("value"), Flags: 0}
+	suite.mock.EXPECT().SetXattr(options).Return(nil)
+
+	err := libfuse_setxattr(path, attr, value, 5, 0)
+	suite.assert.Equal(C.int(0), err)
+}
+
+func testSetXattrNotSupported(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("system.posix_acl_access")
+	defer C.free(unsafe.Pointer(attr))
+	value := C.CString("value")
+	defer C.free(unsafe.Pointer(value))
+	suite.mock.EXPECT().SetXattr(gomock.Any()).Return(syscall.ENOTSUP)
+
+	err := libfuse_setxattr(path, attr, value, 5, 0)
+	suite.assert.Equal(C.int(-C.ENOTSUP), err)
+}
+
+func testGetXattr(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("user.key")
+	defer C.free(unsafe.Pointer(attr))
+	options := internal.GetXattrOptions{Name: name, Attr: "user.key"}
+	suite.mock.EXPECT().GetXattr(options).Return([]byte("value"), nil).Times(3)
+
+	// Size query
+	err := libfuse_getxattr(path, attr, nil, 0)
+	suite.assert.Equal(C.int(5), err)
+
+	buf := (*C.char)(C.calloc(8, 1))
+	defer C.free(unsafe.Pointer(buf))
+	err = libfuse_getxattr(path, attr, buf, 8)
+	suite.assert.Equal(C.int(5), err)
+	suite.assert.Equal("value", C.GoString(buf))
+
+	// Buffer too small
+	err = libfuse_getxattr(path, attr, buf, 2)
+	suite.assert.Equal(C.int(-C.ERANGE), err)
+}
+
+func testGetXattrNoData(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("system.posix_acl_default")
+	defer C.free(unsafe.Pointer(attr))
+	options := internal.GetXattrOptions{Name: name, Attr: "system.posix_acl_default"}
+	suite.mock.EXPECT().GetXattr(options).Return(nil, syscall.ENODATA)
+
+	err := libfuse_getxattr(path, attr, nil, 0)
+	suite.assert.Equal(C.int(-C.ENODATA), err)
+
+	// Unsupported namespaces are not sent to the pipeline
+	security := C.CString("security.capability")
+	defer C.free(unsafe.Pointer(security))
+	err = libfuse_getxattr(path, security, nil, 0)
+	suite.assert.Equal(C.int(-C.ENODATA), err)
+}
+
+func testListXattr(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	options := internal.ListXattrOptions{Name: name}
+	suite.mock.EXPECT().ListXattr(options).Return([]string{"user.a", "user.bc"}, nil).Times(3)
+
+	err := libfuse_listxattr(path, nil, 0)
+	suite.assert.Equal(C.int(15), err)
+
+	buf := (*C.char)(C.calloc(16, 1))
+	defer C.free(unsafe.Pointer(buf))
+	err = libfuse_listxattr(path, buf, 16)
+	suite.assert.Equal(C.int(15), err)
+	suite.assert.Equal([]byte("user.a\x00user.bc\x00"), C.GoBytes(unsafe.Pointer(buf), 15))
+
+	err = libfuse_listxattr(path, buf, 10)
+	suite.assert.Equal(C.int(-C.ERANGE), err)
+}
+
+func testRemoveXattr(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("system.posix_acl_default")
+	defer C.free(unsafe.Pointer(attr))
+	options := internal.RemoveXattrOptions{Name: name, Attr: "system.posix_acl_default"}
+	suite.mock.EXPECT().RemoveXattr(options).Return(nil)
+
+	err := libfuse_removexattr(path, attr)
+	suite.assert.Equal(C.int(0), err)
+}
+
+func testRemoveXattrError(suite *libfuseTestSuite) {
+	defer suite.cleanupTest()
+	name := "path"
+	path := C.CString("/" + name)
+	defer C.free(unsafe.Pointer(path))
+	attr := C.CString("system.posix_acl_default")
+	defer C.free(unsafe.Pointer(attr))
+	suite.mock.EXPECT().RemoveXattr(gomock.Any()).Return(errors.New("failed to remove"))
+
+	err := libfuse_removexattr(path, attr)
+	suite.assert.Equal(C.int(-C.EIO), err)
+}
@@ -93,6 +93,11 @@ static int populate_callbacks(fuse_operations_t *opt)
     opt->fsync      = (int (*)(const char *path, int, fuse_file_info_t *fi))libfuse_fsync;
     opt->fsyncdir   = (int (*)(const char *path, int, fuse_file_info_t *))libfuse_fsyncdir;
 
+    opt->setxattr   = (int (*)(const char *path, const char *name, const char *value, size_t size, int flags))libfuse_setxattr;
+    opt->getxattr   = (int (*)(const char *path, const char *name, char *value, size_t size))libfuse_getxattr;
+    opt->listxattr  = (int (*)(const char *path, char *list, size_t size))libfuse_listxattr;
+    opt->removexattr = (int (*)(const char *path, const char *name))libfuse_removexattr;
+
 
     #ifdef __FUSE2__
     opt->init       = (void *(*)(fuse_conn_info_t *))libfuse2_init;
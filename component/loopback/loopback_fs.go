@@ -42,6 +42,7 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/Azure/azure-storage-fuse/v2/common/config"
 	"github.com/Azure/azure-storage-fuse/v2/common/log"
@@ -446,6 +447,29 @@ func (lfs *LoopbackFS) Chown(options internal.ChownOptions) error {
 	return os.Chown(path, options.Owner, options.Group)
 }
 
+func (lfs *LoopbackFS) SetAttr(options internal.SetAttrOptions) error {
+	log.Trace("LoopbackFS::SetAttr : name=%s", options.Name)
+	if options.Attr == nil {
+		return nil
+	}
+
+	path := filepath.Join(lfs.path, options.Name)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	stat := info.Sys().(*syscall.Stat_t)
+	atime, mtime := options.Attr.Atime, options.Attr.Mtime
+	if atime.IsZero() {
+		atime = time.Unix(stat.Atim.Sec, stat.Atim.Nsec)
+	}
+	if mtime.IsZero() {
+		mtime = info.ModTime()
+	}
+	return os.Chtimes(path, atime, mtime)
+}
+
 func (lfs *LoopbackFS) InvalidateObject(_ string) {
 }
 
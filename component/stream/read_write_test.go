@@ -42,6 +42,7 @@ import (
 	"github.com/Azure/azure-storage-fuse/v2/internal"
 	"github.com/Azure/azure-storage-fuse/v2/internal/handlemap"
 
+	"github.com/golang/mock/gomock"
 	"github.com/stretchr/testify/suite"
 )
 
@@ -660,6 +661,44 @@ func (suite *streamTestSuite) TestTruncateFile() {
 	suite.assert.NotEqual(nil, err)
 }
 
+// metadata changes on an open file do not fail the commit of its blocks on close
+func (suite *streamTestSuite) TestChmodBeforeClose() {
+	defer suite.cleanupTest()
+	suite.cleanupTest()
+	config := "stream:\n  block-size-mb: 16\n  buffer-size-mb: 32\n  max-buffers: 4\n"
+	suite.setupTestHelper(config, false)
+
+	handle := &handlemap.Handle{Size: int64(1), Path: fileNames[0]}
+	openFileOptions := internal.OpenFileOptions{Name: fileNames[0], Flags: os.O_RDWR, Mode: os.FileMode(0777)}
+	getFileBlockOffsetsOptions := internal.GetFileBlockOffsetsOptions{Name: fileNames[0]}
+	readInBufferOptions := internal.ReadInBufferOptions{Handle: handle, Offset: 0, Data: make([]byte, 1)}
+	bol := &common.BlockOffsetList{BlockList: []*common.Block{}, Etag: "etag-at-open"}
+	bol.Flags.Set(common.SmallFile)
+
+	suite.mock.EXPECT().OpenFile(openFileOptions).Return(handle, nil)
+	suite.mock.EXPECT().GetFileBlockOffsets(getFileBlockOffsetsOptions).Return(bol, nil)
+	suite.mock.EXPECT().ReadInBuffer(readInBufferOptions).Return(len(readInBufferOptions.Data), nil)
+	_, err := suite.stream.OpenFile(openFileOptions)
+	suite.assert.Nil(err)
+
+	_, err = suite.stream.WriteFile(internal.WriteFileOptions{Handle: handle, Offset: 0, Data: []byte("a")})
+	suite.assert.Nil(err)
+
+	// Changes the ETag of the blob, like cp -p does before closing the file
+	chmodOptions := internal.ChmodOptions{Name: fileNames[0], Mode: os.FileMode(0644)}
+	suite.mock.EXPECT().Chmod(chmodOptions).Return(nil)
+	err = suite.stream.Chmod(chmodOptions)
+	suite.assert.Nil(err)
+
+	suite.mock.EXPECT().FlushFile(gomock.Any()).DoAndReturn(func(options internal.FlushFileOptions) error {
+		suite.assert.False(options.Handle.CacheObj.BlockOffsetList.MatchEtag())
+		return nil
+	})
+	suite.mock.EXPECT().CloseFile(internal.CloseFileOptions{Handle: handle}).Return(nil)
+	err = suite.stream.CloseFile(internal.CloseFileOptions{Handle: handle})
+	suite.assert.Nil(err)
+}
+
 func (suite *streamTestSuite) TestRenameFile() {
 	defer suite.cleanupTest()
 	suite.cleanupTest()
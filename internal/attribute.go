@@ -66,6 +66,7 @@ const (
 	PropFlagSymlink
 	PropFlagMetadataRetrieved
 	PropFlagModeDefault // TODO: Does this sound better as ModeDefault or DefaultMode? The getter would be IsModeDefault or IsDefaultMode
+	PropFlagOwnerSet
 )
 
 // ObjAttr : Attributes of any file/directory
@@ -76,10 +77,13 @@ type ObjAttr struct {
 	Crtime   time.Time       // creation time
 	Size     int64           // size of the file/directory
 	Mode     os.FileMode     // permissions in 0xxx format
+	Uid      uint32          // owner of the file/directory, valid only if PropFlagOwnerSet is set
+	Gid      uint32          // group of the file/directory, valid only if PropFlagOwnerSet is set
 	Flags    common.BitMap16 // flags
 	Path     string          // full path
 	Name     string          // base name of the path
 	MD5      []byte
+	ETag     string            // entity tag of the object in storage, changes whenever the object does
 	Metadata map[string]string // extra information to preserve
 }
 
@@ -104,3 +108,9 @@ func (attr *ObjAttr) IsMetadataRetrieved() bool {
 func (attr *ObjAttr) IsModeDefault() bool {
 	return attr.Flags.IsSet(PropFlagModeDefault)
 }
+
+// IsOwnerSet : Whether or not the owner and group of the path are known.
+// If not set the fuse layer shall report the mounting user as owner.
+func (attr *ObjAttr) IsOwnerSet() bool {
+	return attr.Flags.IsSet(PropFlagOwnerSet)
+}
@@ -310,6 +310,34 @@ func (base *BaseComponent) Chown(options ChownOptions) error {
 	return nil
 }
 
+func (base *BaseComponent) GetXattr(options GetXattrOptions) ([]byte, error) {
+	if base.next != nil {
+		return base.next.GetXattr(options)
+	}
+	return nil, syscall.ENOTSUP
+}
+
+func (base *BaseComponent) SetXattr(options SetXattrOptions) error {
+	if base.next != nil {
+		return base.next.SetXattr(options)
+	}
+	return syscall.ENOTSUP
+}
+
+func (base *BaseComponent) ListXattr(options ListXattrOptions) ([]string, error) {
+	if base.next != nil {
+		return base.next.ListXattr(options)
+	}
+	return []string{}, nil
+}
+
+func (base *BaseComponent) RemoveXattr(options RemoveXattrOptions) error {
+	if base.next != nil {
+		return base.next.RemoveXattr(options)
+	}
+	return syscall.ENOTSUP
+}
+
 func (base *BaseComponent) InvalidateObject(name string) {
 	if base.next != nil {
 		base.next.InvalidateObject(name)
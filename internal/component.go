@@ -133,6 +133,16 @@ type Component interface {
 
 	Chmod(ChmodOptions) error
 	Chown(ChownOptions) error
+
+	// Extended attribute operations
+	//GetXattr: Implementation expectations:
+	//1. must return syscall.ENODATA if the attribute does not exist
+	//2. must return syscall.ENOTSUP if the attribute is not supported by the storage
+	GetXattr(GetXattrOptions) ([]byte, error)
+	SetXattr(SetXattrOptions) error
+	ListXattr(ListXattrOptions) ([]string, error)
+	RemoveXattr(RemoveXattrOptions) error
+
 	//InvalidateObject: function used to clear any inode information relating to a particular fs object
 	InvalidateObject(string) // TODO: What does this do? Why do we need it if its a noop?
 	GetFileBlockOffsets(options GetFileBlockOffsetsOptions) (*common.BlockOffsetList, error)
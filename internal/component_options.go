@@ -108,6 +108,7 @@ type ReadInBufferOptions struct {
 	Handle *handlemap.Handle
 	Offset int64
 	Data   []byte
+	Etag   string // Read only from this version of the object if set, ESTALE if it changed
 }
 
 type WriteFileOptions struct {
@@ -189,6 +190,27 @@ type ChownOptions struct {
 	Group int
 }
 
+type GetXattrOptions struct {
+	Name string
+	Attr string
+}
+
+type SetXattrOptions struct {
+	Name  string
+	Attr  string
+	Value []byte
+	Flags int
+}
+
+type ListXattrOptions struct {
+	Name string
+}
+
+type RemoveXattrOptions struct {
+	Name string
+	Attr string
+}
+
 func TruncateDirName(name string) string {
 	if len(name) == 0 {
 		return ""
@@ -659,3 +659,61 @@ func (mr *MockComponentMockRecorder) FileUsed(arg0 interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "FileUsed", reflect.TypeOf((*MockComponent)(nil).FileUsed), arg0)
 }
+
+// GetXattr mocks base method.
+func (m *MockComponent) GetXattr(arg0 GetXattrOptions) ([]byte, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GetXattr", arg0)
+	ret0, _ := ret[0].([]byte)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// GetXattr indicates an expected call of GetXattr.
+func (mr *MockComponentMockRecorder) GetXattr(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GetXattr", reflect.TypeOf((*MockComponent)(nil).GetXattr), arg0)
+}
+
+// SetXattr mocks base method.
+func (m *MockComponent) SetXattr(arg0 SetXattrOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "SetXattr", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// SetXattr indicates an expected call of SetXattr.
+func (mr *MockComponentMockRecorder) SetXattr(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetXattr", reflect.TypeOf((*MockComponent)(nil).SetXattr), arg0)
+}
+
+// ListXattr mocks base method.
+func (m *MockComponent) ListXattr(arg0 ListXattrOptions) ([]string, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "ListXattr", arg0)
+	ret0, _ := ret[0].([]string)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// ListXattr indicates an expected call of ListXattr.
+func (mr *MockComponentMockRecorder) ListXattr(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "ListXattr", reflect.TypeOf((*MockComponent)(nil).ListXattr), arg0)
+}
+
+// RemoveXattr mocks base method.
+func (m *MockComponent) RemoveXattr(arg0 RemoveXattrOptions) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "RemoveXattr", arg0)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// RemoveXattr indicates an expected call of RemoveXattr.
+func (mr *MockComponentMockRecorder) RemoveXattr(arg0 interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "RemoveXattr", reflect.TypeOf((*MockComponent)(nil).RemoveXattr), arg0)
+}
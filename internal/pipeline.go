@@ -104,17 +104,33 @@ func (p *Pipeline) Create() {
 	}
 }
 
-// Start : Start the pipeline by calling 'Start' method of each component in reverse order of chaining
+// StartListener : Implemented by components with background work which has to wait till the components chained
+// above them have started, for example work on local files those components clean up when they start
+type StartListener interface {
+	OnPipelineStart()
+}
+
+// Start : Start the pipeline by calling 'Start' method of each component in reverse order of chaining.
+// The first component may serve requests from its Start till unmount, so listeners are told before it is started.
 func (p *Pipeline) Start(ctx context.Context) (err error) {
 	p.Create()
+	if len(p.components) == 0 {
+		return nil
+	}
 
-	for i := len(p.components) - 1; i >= 0; i-- {
+	for i := len(p.components) - 1; i > 0; i-- {
 		if err = p.components[i].Start(ctx); err != nil {
 			return err
 		}
 	}
 
-	return nil
+	for _, comp := range p.components {
+		if listener, ok := comp.(StartListener); ok {
+			listener.OnPipelineStart()
+		}
+	}
+
+	return p.components[0].Start(ctx)
 }
 
 // Stop : Stop the pipeline by calling 'Stop' method of each component
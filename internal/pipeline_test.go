@@ -34,12 +34,16 @@
 package internal
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 )
 
+// Components started so far, in order
+var started []string
+
 //   Test compoennts
 type ComponentA struct {
 	BaseComponent
@@ -57,6 +61,11 @@ type ComponentB struct {
 	BaseComponent
 }
 
+func (ac *ComponentB) Start(ctx context.Context) error {
+	started = append(started, "ComponentB")
+	return nil
+}
+
 func (ac *ComponentB) Priority() ComponentPriority {
 	return EComponentPriority.LevelMid()
 }
@@ -67,6 +76,17 @@ func NewComponentB() Component {
 
 type ComponentC struct {
 	BaseComponent
+	startedBefore []string
+}
+
+func (ac *ComponentC) Start(ctx context.Context) error {
+	started = append(started, "ComponentC")
+	return nil
+}
+
+// OnPipelineStart : Records the components started by the time it is called
+func (ac *ComponentC) OnPipelineStart() {
+	ac.startedBefore = append([]string{}, started...)
 }
 
 func (ac *ComponentC) Priority() ComponentPriority {
@@ -119,6 +139,17 @@ func (s *pipelineTestSuite) TestStartStopCreateNewPipeline() {
 	s.assert.Nil(err)
 }
 
+func (s *pipelineTestSuite) TestStartListener() {
+	p, err := NewPipeline([]string{"ComponentA", "ComponentB", "ComponentC"}, false)
+	s.assert.Nil(err)
+
+	// Listener is told once every component but the first one has started
+	started = nil
+	err = p.Start(nil)
+	s.assert.Nil(err)
+	s.assert.Equal([]string{"ComponentC", "ComponentB"}, p.components[2].(*ComponentC).startedBefore)
+}
+
 func TestPipelineTestSuite(t *testing.T) {
 	suite.Run(t, new(pipelineTestSuite))
 }
@@ -35,6 +35,7 @@ package file_cache
 
 import (
 	"fmt"
+	"io/fs"
 	"math"
 	"strconv"
 	"strings"
@@ -108,12 +109,17 @@ func (fc *FileCache) cacheWatcher() error {
 	fc.cacheObj.fileCreatedMap = make(map[string]int64)
 	fc.cacheObj.fileRemovedMap = make(map[string]int64)
 
+	// Files cached before the monitor started are not reported by the watcher
+	fc.reconcile()
+	ticker := time.NewTicker(reconcileInterval)
+
 	w := watcher.New()
 
 	// ignore hidden files
 	w.IgnoreHiddenFiles(true)
 
 	go func() {
+		defer ticker.Stop()
 		for {
 			select {
 
@@ -144,6 +150,9 @@ func (fc *FileCache) cacheWatcher() error {
 
 				}
 
+			case <-ticker.C:
+				fc.reconcile()
+
 			case err := <-w.Error:
 				log.Err("cache_monitor::cache_watcher : [%v]", err)
 				return
@@ -183,8 +192,8 @@ func (fc *FileCache) cacheWatcher() error {
 func (fc *FileCache) createEvent(event *watcher.Event) {
 	if !event.IsDir() {
 		delete(fc.cacheObj.fileRemovedMap, event.Path)
-		fc.cacheObj.fileCreatedMap[event.Path] = event.Size()
-		fc.cacheObj.cacheSize += event.Size()
+		fc.cacheObj.fileCreatedMap[event.Path] = common.DiskBytes(event.FileInfo)
+		fc.cacheObj.cacheSize += common.DiskBytes(event.FileInfo)
 		fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
 	}
 
@@ -198,9 +207,9 @@ func (fc *FileCache) createEvent(event *watcher.Event) {
 
 func (fc *FileCache) removeEvent(event *watcher.Event) {
 	if !event.IsDir() {
+		fc.cacheObj.fileRemovedMap[event.Path] = fc.cacheObj.fileCreatedMap[event.Path]
+		fc.cacheObj.cacheSize = int64(math.Max(0, float64(fc.cacheObj.cacheSize-fc.cacheObj.fileCreatedMap[event.Path])))
 		delete(fc.cacheObj.fileCreatedMap, event.Path)
-		fc.cacheObj.fileRemovedMap[event.Path] = event.Size()
-		fc.cacheObj.cacheSize = int64(math.Max(0, float64(fc.cacheObj.cacheSize-event.Size())))
 		fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
 	}
 
@@ -217,9 +226,9 @@ func (fc *FileCache) chmodEvent(event *watcher.Event) {
 		delete(fc.cacheObj.fileRemovedMap, event.Path)
 		fileSize := fc.cacheObj.fileCreatedMap[event.Path]
 
-		if fileSize != event.Size() {
-			fc.cacheObj.cacheSize += event.Size() - fileSize
-			fc.cacheObj.fileCreatedMap[event.Path] = event.Size()
+		if size := common.DiskBytes(event.FileInfo); fileSize != size {
+			fc.cacheObj.cacheSize += size - fileSize
+			fc.cacheObj.fileCreatedMap[event.Path] = size
 			fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
 		}
 	}
@@ -234,13 +243,14 @@ func (fc *FileCache) writeEvent(event *watcher.Event) {
 	if !event.IsDir() {
 		delete(fc.cacheObj.fileRemovedMap, event.Path)
 		fileSize := fc.cacheObj.fileCreatedMap[event.Path]
+		size := common.DiskBytes(event.FileInfo)
 
-		if fileSize == event.Size() {
+		if fileSize == size {
 			return
 		}
 
-		fc.cacheObj.cacheSize += event.Size() - fileSize
-		fc.cacheObj.fileCreatedMap[event.Path] = event.Size()
+		fc.cacheObj.cacheSize += size - fileSize
+		fc.cacheObj.fileCreatedMap[event.Path] = size
 		fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
 	} else {
 		return
@@ -256,6 +266,8 @@ func (fc *FileCache) writeEvent(event *watcher.Event) {
 }
 
 func (fc *FileCache) renameEvent(event *watcher.Event) {
+	fc.movedFile(event)
+
 	e := fc.getCacheEventObj(event)
 	e.Value[oldPath] = event.OldPath
 
@@ -263,12 +275,57 @@ func (fc *FileCache) renameEvent(event *watcher.Event) {
 }
 
 func (fc *FileCache) moveEvent(event *watcher.Event) {
+	fc.movedFile(event)
+
 	e := fc.getCacheEventObj(event)
 	e.Value[oldPath] = event.OldPath
 
 	fc.ExportStats(time.Now().Format(time.RFC3339), e)
 }
 
+// movedFile : Account the file under its new path, dropping any file it replaced
+func (fc *FileCache) movedFile(event *watcher.Event) {
+	if event.IsDir() {
+		return
+	}
+
+	size, found := fc.cacheObj.fileCreatedMap[event.OldPath]
+	if !found {
+		size = common.DiskBytes(event.FileInfo)
+		fc.cacheObj.cacheSize += size
+	}
+	delete(fc.cacheObj.fileCreatedMap, event.OldPath)
+
+	fc.cacheObj.cacheSize -= fc.cacheObj.fileCreatedMap[event.Path]
+	fc.cacheObj.fileCreatedMap[event.Path] = size
+	fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
+}
+
+// reconcile : Replace the usage built from events with what is in the cache directory and report it, events can be
+// missed between polls of the watcher
+func (fc *FileCache) reconcile() {
+	// Watcher ignores hidden files as well
+	files, size := common.DirUsage(fc.tmpPath, func(path string, d fs.DirEntry) bool {
+		return strings.HasPrefix(d.Name(), ".")
+	})
+
+	fc.cacheObj.fileCreatedMap = files
+	fc.cacheObj.cacheSize = size
+	fc.cacheObj.cacheConsumed = (float64)(fc.cacheObj.cacheSize*100) / (fc.maxSizeMB * common.MbToBytes)
+
+	e := &hmcommon.CacheEvent{
+		CacheEvent:      usage,
+		Path:            fc.tmpPath,
+		IsDir:           true,
+		CacheSize:       fc.cacheObj.cacheSize,
+		CacheConsumed:   fmt.Sprintf("%.2f%%", fc.cacheObj.cacheConsumed),
+		CacheFilesCnt:   (int64)(len(fc.cacheObj.fileCreatedMap)),
+		EvictedFilesCnt: (int64)(len(fc.cacheObj.fileRemovedMap)),
+		Value:           make(map[string]string),
+	}
+	fc.ExportStats(time.Now().Format(time.RFC3339), e)
+}
+
 func (fc *FileCache) getCacheEventObj(event *watcher.Event) *hmcommon.CacheEvent {
 	e := &hmcommon.CacheEvent{
 		CacheEvent:      event.Op.String(),
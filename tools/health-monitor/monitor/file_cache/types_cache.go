@@ -33,6 +33,8 @@
 
 package file_cache
 
+import "time"
+
 const (
 	create = "CREATE"
 	remove = "REMOVE"
@@ -40,8 +42,12 @@ const (
 	write  = "WRITE"
 	rename = "RENAME"
 	move   = "MOVE"
+	usage  = "USAGE"
 
 	oldPath  = "OldPath"
 	mode     = "Mode"
 	fileSize = "FileSize"
+
+	// Usage is rebuilt from the cache directory this often
+	reconcileInterval = 5 * time.Minute
 )